@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/yuya-takeyama/guruguru-cache/template"
+)
+
+var alsoKeys []string
+
+// storeAliases copies the cache to the keys rendered from --also-key with server-side copies, replacing existing ones.
+// Aliases like latest-main are updated even when the cache already exists, so that they point to the latest one,
+// and the objects of the replaced generation are deleted after the alias is replaced.
+func storeAliases(cacheKey string) error {
+	if len(alsoKeys) == 0 {
+		return nil
+	}
+
+	// the cache may not be stored with --max-size-policy warn, which skips it when it still exceeds --max-size
+	exists, err := cacheExists(cacheKey)
+	if err != nil || !exists {
+		return err
+	}
+
+	srcKey := strings.TrimPrefix(cacheKey, prefixedKey(""))
+	generation, err := cacheGeneration(cacheKey)
+	if err != nil {
+		return err
+	}
+	for _, keyTemplate := range alsoKeys {
+		alias, err := template.ExecuteTemplate(keyTemplate)
+		if err != nil {
+			return err
+		}
+		if alias == srcKey {
+			continue
+		}
+
+		var replaced *cacheEntry
+		aliasExists, err := cacheExists(prefixedKey(alias))
+		if err != nil {
+			return err
+		}
+		if aliasExists {
+			// copying the same generation again would overwrite the objects readers of the alias are reading
+			aliasGeneration, err := cacheGeneration(prefixedKey(alias))
+			if err != nil {
+				return err
+			}
+			if generation != "" && aliasGeneration == generation {
+				log.Printf("cache is already stored as %s\n", alias)
+				continue
+			}
+
+			if replaced, err = findCacheEntry(prefixedKey(alias)); err != nil {
+				return err
+			}
+		}
+
+		// the objects of the generation are copied beside the replaced ones until the object of the alias is copied at last
+		if _, err := copyCache(srcKey, s3Bucket, alias); err != nil {
+			return err
+		}
+		if replaced != nil {
+			if err := deleteStaleObjects(replaced); err != nil {
+				return err
+			}
+		}
+
+		log.Printf("cache is also stored as %s\n", alias)
+	}
+
+	return nil
+}
+
+// cacheGeneration returns the generation of the cache, which is empty for caches stored by older versions
+func cacheGeneration(cacheKey string) (string, error) {
+	head, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &s3Bucket,
+		Key:    aws.String(objectKey(cacheKey)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get metadata of %s: %s", cacheKey, err)
+	}
+
+	return objectGeneration(head.Metadata), nil
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreAliases(t *testing.T) {
+	setupFixturesToCache(t)
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original []string) { alsoKeys = original }(alsoKeys)
+	alsoKeys = []string{"alias"}
+	// objects are modified a second apart, so that overwritten objects are told apart from the others
+	var tick time.Duration
+	fake.now = func() time.Time {
+		tick += time.Second
+		return time.Now().Add(tick)
+	}
+
+	cacheKey := prefixedKey("key")
+	aliasKey := prefixedKey("alias")
+	store := func() string {
+		err := storeTarStream(cacheKey, 512, nil, func(w io.Writer) error {
+			return writeTar(w, []string{"tmp/foo"})
+		})
+		if err != nil {
+			t.Fatalf("failed to store: %s", err)
+		}
+		if err := storeAliases(cacheKey); err != nil {
+			t.Fatalf("failed to store aliases: %s", err)
+		}
+
+		generation, err := cacheGeneration(cacheKey)
+		if err != nil {
+			t.Fatalf("failed to get the generation: %s", err)
+		}
+		if aliasGeneration, err := cacheGeneration(aliasKey); err != nil || aliasGeneration != generation {
+			t.Fatalf("the alias doesn't have the generation of the cache: %s: %v", aliasGeneration, err)
+		}
+
+		item, err := getExactlyMatchedItem(aliasKey)
+		if err != nil {
+			t.Fatalf("failed to get the alias: %s", err)
+		}
+		body, err := newArchiveReader(item, objectKey(aliasKey))
+		if err != nil {
+			t.Fatalf("failed to read the alias: %s", err)
+		}
+		defer body.Close()
+		if _, err := readArchiveEntries(body); err != nil {
+			t.Fatalf("the parts of the alias aren't read: %s", err)
+		}
+
+		return generation
+	}
+
+	first := store()
+	second := store()
+
+	// the alias is replaced by the objects of the new generation
+	for _, key := range fake.keys() {
+		if strings.HasPrefix(key, aliasKey) && strings.Contains(key, first) {
+			t.Fatalf("the object of the replaced generation of the alias is left: %s", key)
+		}
+	}
+
+	// the alias already pointing to the cache isn't copied again
+	fake.requests = nil
+	if err := storeAliases(cacheKey); err != nil {
+		t.Fatalf("failed to store aliases: %s", err)
+	}
+	for _, r := range fake.requests {
+		if r.Method != http.MethodHead && strings.HasPrefix(r.Key, s3Bucket+"/"+aliasKey) {
+			t.Fatalf("the alias is requested again: %s %s", r.Method, r.Key)
+		}
+	}
+	if generation, err := cacheGeneration(aliasKey); err != nil || generation != second {
+		t.Fatalf("the alias is changed: %s: %v", generation, err)
+	}
+}
@@ -0,0 +1,343 @@
+package cmd
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/spf13/cobra"
+	"github.com/yuya-takeyama/guruguru-cache/template"
+)
+
+var appendTo string
+
+func init() {
+	appendCmd := &cobra.Command{
+		Use:   "append [flags] [cache key] [paths...]",
+		Short: "Add paths to a cache and store it again with the same key or another",
+		Args:  cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupTemplate(); err != nil {
+				log.Fatal(err)
+			}
+
+			cacheKey, err := template.ExecuteTemplate(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			found, err := appendPaths(prefixedKey(cacheKey), expandHomes(args[1:]))
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !found {
+				log.Println("no cache is found")
+				os.Exit(cacheMissExitCode)
+			}
+		},
+	}
+
+	appendCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches")
+	appendCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(appendCmd)
+	addTemplateFlags(appendCmd)
+	appendCmd.Flags().StringVarP(&appendTo, "to", "", "", "Cache key to store the cache with the paths as (default the key of the matched cache, replacing it)")
+	addArchiveFlags(appendCmd)
+	addUploadFlags(appendCmd)
+	appendCmd.Flags().StringVarP(&downloadPartSize, "download-part-size", "", "5MB", "Size of each range of concurrent downloads")
+	appendCmd.Flags().IntVarP(&downloadConcurrency, "download-concurrency", "", s3manager.DefaultDownloadConcurrency, "Number of ranges downloaded concurrently")
+	addTmpSpaceFlags(appendCmd)
+	appendCmd.Flags().StringVarP(&ageIdentityFile, "age-identity-file", "", "", "age identity file to decrypt the encrypted cache")
+	appendCmd.Flags().StringVarP(&passphraseFile, "passphrase-file", "", "", "Decrypt and encrypt the cache with the passphrase in the file")
+
+	rootCmd.AddCommand(appendCmd)
+}
+
+// appendPaths stores the cache matching the key with the paths added as --to or the key of the matched cache,
+// reporting whether the cache is found
+func appendPaths(cacheKey string, paths []string) (bool, error) {
+	if err := validateDownloadOptions(); err != nil {
+		return false, err
+	}
+	if err := validateUploadOptions(); err != nil {
+		return false, err
+	}
+	if err := validateExcludes(); err != nil {
+		return false, err
+	}
+	if err := validateMaxSize(); err != nil {
+		return false, err
+	}
+
+	partSize, err := parseSize(maxPartSize)
+	if err != nil {
+		return false, err
+	}
+
+	item, itemKey := findCache([]string{cacheKey})
+	if item == nil {
+		return false, nil
+	}
+	if isPathArchivesManifest(item) {
+		item.Body.Close()
+		return true, fmt.Errorf("paths can't be appended to cache of per-path archives: %s", itemKey)
+	}
+
+	srcKey := cacheKeyFromObjectKey(itemKey)
+	dstKey := srcKey
+	if appendTo != "" {
+		to, err := template.ExecuteTemplate(appendTo)
+		if err != nil {
+			return true, err
+		}
+		dstKey = prefixedKey(to)
+	}
+
+	var replaced *cacheEntry
+	if dstKey == srcKey {
+		if replaced, err = findCacheEntry(dstKey); err != nil {
+			return true, err
+		}
+	} else {
+		exists, err := cacheExists(dstKey)
+		if err != nil {
+			return true, err
+		}
+		if exists {
+			log.Printf("cache already exists: %s\n", dstKey)
+			return true, nil
+		}
+	}
+
+	// the cache is downloaded first, as its objects may be overwritten while reading them
+	dir, err := ioutil.TempDir(tmpDir, "guruguru-cache-")
+	if err != nil {
+		return true, fmt.Errorf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// only the archive is written to the temp directory
+	err = checkTmpSpace(dir, func() int64 {
+		size, err := archiveSize(srcKey, item)
+		if err != nil {
+			log.Printf("failed to get the size of the archive: %s\n", err)
+		}
+		return size
+	})
+	if err != nil {
+		return true, err
+	}
+
+	file := downloadCache(dir, item, itemKey)
+	defer file.Close()
+
+	// the appended cache has the changes since the same base cache as the source
+	var checksumMetadata map[string]*string
+	base, err := storedDeltaBase(srcKey)
+	if err != nil {
+		return true, err
+	}
+	if base != "" {
+		checksumMetadata = map[string]*string{baseMetadataKey: aws.String(base)}
+	}
+
+	// the cache being replaced is read until the new generation replaces the object of the key at last
+	log.Printf("Appending %s to %s as %s\n", strings.Join(paths, ", "), srcKey, dstKey)
+	err = storeTarStream(dstKey, partSize, checksumMetadata, func(w io.Writer) error {
+		return appendTar(w, file, paths)
+	})
+	if _, tooLarge := err.(*cacheTooLargeError); tooLarge {
+		reportTooLarge(paths)
+		if maxSizePolicy == maxSizePolicyWarn {
+			log.Printf("cache is not stored: %s\n", err)
+			return true, nil
+		}
+	}
+	if err != nil {
+		return true, err
+	}
+	if skipped := archiveBudget.skippedEntries(); skipped > 0 {
+		log.Printf("cache is truncated to --max-size %s, leaving out %d entries: %s\n", formatSize(archiveBudget.limit), skipped, dstKey)
+	}
+
+	if replaced != nil {
+		if err := deleteStaleObjects(replaced); err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// appendTar copies the entries of the archive and writes the entries of the paths after them.
+// metadata.json of the archive is at its end, so the paths are numbered after all the entries are copied.
+func appendTar(w io.Writer, r io.Reader, paths []string) error {
+	tr, err := openTarReader(r)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+
+	var base *metadata
+	var baseManifest *fileManifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar entry: %s", err)
+		}
+
+		if strings.TrimPrefix(hdr.Name, "./") == "metadata.json" {
+			base = new(metadata)
+			if err := json.NewDecoder(tr).Decode(base); err != nil {
+				return fmt.Errorf("invalid metadata.json: %s", err)
+			}
+			continue
+		}
+		// the files of the paths are added to the manifest of the archive
+		if isManifestEntry(hdr) {
+			if baseManifest, err = readManifest(tr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		hdr.Format = tar.FormatPAX
+		// sparse files are written again only with their data segments, skipping the zeros of the holes
+		if isSparseHeader(hdr) {
+			segments, err := parseSparseHeader(hdr)
+			if err != nil {
+				return err
+			}
+			if err := writeSparseFile(tw, w, hdr, segments, sparseData(tr, segments), nil); err != nil {
+				return fmt.Errorf("failed to copy %s: %s", hdr.Name, err)
+			}
+			continue
+		}
+		if err := writeHeader(tw, w, hdr); err != nil {
+			return fmt.Errorf("failed to write tar header: %s", err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return fmt.Errorf("failed to copy %s: %s", hdr.Name, err)
+		}
+	}
+
+	if base == nil {
+		return fmt.Errorf("metadata.json is missing")
+	}
+	for _, path := range paths {
+		for _, p := range base.Paths {
+			if filepath.Clean(path) == filepath.Clean(p) {
+				return fmt.Errorf("path is already in the cache: %s", path)
+			}
+		}
+	}
+
+	meta := newMetadata(base.Paths)
+	meta.PathStats = base.PathStats
+	meta.Base, meta.BaseSHA256, meta.BaseETag, meta.Removed = base.Base, base.BaseSHA256, base.BaseETag, base.Removed
+	if base.HomeDir != "" {
+		meta.HomeDir = base.HomeDir
+	}
+	if baseManifest != nil {
+		meta.manifest = baseManifest
+	}
+	if err := writePathEntries(tw, w, meta, paths); err != nil {
+		return err
+	}
+
+	return closeTar(tw, w, meta)
+}
+
+// findCacheEntry returns the cache with all its objects
+func findCacheEntry(cacheKey string) (*cacheEntry, error) {
+	key := strings.TrimPrefix(cacheKey, prefixedKey(""))
+	caches, err := listCaches(key)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range caches {
+		if c.Key == key {
+			return c, nil
+		}
+	}
+
+	return nil, fmt.Errorf("cache is not found: %s", cacheKey)
+}
+
+// deleteStaleObjects deletes the objects of the replaced cache which aren't overwritten, like parts of its generation.
+// Objects are compared by ETags and modification times instead of local clocks, except the object of the cache key and the checksum,
+// which are always uploaded again but may be identical within a second, and the index, which is compared by its generation.
+func deleteStaleObjects(replaced *cacheEntry) error {
+	cacheKey := prefixedKey(replaced.Key)
+	current, err := findCacheEntry(cacheKey)
+	if err != nil {
+		return err
+	}
+
+	type version struct {
+		key, etag    string
+		lastModified time.Time
+	}
+	versionOf := func(object *s3.Object) version {
+		return version{aws.StringValue(object.Key), aws.StringValue(object.ETag), aws.TimeValue(object.LastModified)}
+	}
+
+	unchanged := make(map[version]bool)
+	for _, object := range current.objects {
+		unchanged[versionOf(object)] = true
+	}
+
+	var stale []string
+	for _, object := range replaced.objects {
+		key := aws.StringValue(object.Key)
+		if !unchanged[versionOf(object)] || key == objectKey(cacheKey) || key == checksumKey(cacheKey) {
+			continue
+		}
+		if key == indexKey(cacheKey) {
+			if current, err := isCurrentGeneration(cacheKey, key); err != nil || current {
+				continue
+			}
+		}
+		stale = append(stale, key)
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	log.Printf("deleting %d stale objects of the replaced cache\n", len(stale))
+	return deleteObjects(stale)
+}
+
+// isCurrentGeneration reports whether the object of the cache like its index has the generation of the cache
+func isCurrentGeneration(cacheKey string, key string) (bool, error) {
+	var generations []string
+	for _, k := range []string{objectKey(cacheKey), key} {
+		head, err := s3Client.HeadObject(&s3.HeadObjectInput{
+			Bucket: &s3Bucket,
+			Key:    aws.String(k),
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to get metadata of %s: %s", k, err)
+		}
+		generations = append(generations, objectGeneration(head.Metadata))
+	}
+
+	return generations[0] == generations[1], nil
+}
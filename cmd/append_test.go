@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestAppendTar(t *testing.T) {
+	setupFixturesToCache(t)
+
+	base := new(bytes.Buffer)
+	if _, err := writeArchive(base, []string{"tmp/foo"}); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	appended := new(bytes.Buffer)
+	if err := appendTar(appended, bytes.NewReader(base.Bytes()), []string{"tmp/abc/def"}); err != nil {
+		t.Fatalf("failed to append paths: %s", err)
+	}
+
+	digests, paths, err := readArchiveDigests(bytes.NewReader(appended.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read the archive: %s", err)
+	}
+	if !reflect.DeepEqual(paths, []string{"tmp/foo", "tmp/abc/def"}) {
+		t.Fatalf("paths are wrong: %v", paths)
+	}
+	for _, path := range []string{"tmp/foo/hoge.txt", "tmp/abc/def/ghe"} {
+		if _, ok := digests[path]; !ok {
+			t.Errorf("%s is missing in %v", path, digests)
+		}
+	}
+
+	if err := appendTar(new(bytes.Buffer), bytes.NewReader(base.Bytes()), []string{"tmp/foo/"}); err == nil {
+		t.Fatal("path already in the cache is appended")
+	}
+}
+
+func TestAppendTarWithSparseFiles(t *testing.T) {
+	setupFixturesToCache(t)
+	createSparseFixture(t, "tmp/foo/sparse.img")
+
+	base := new(bytes.Buffer)
+	if err := writeTar(base, []string{"tmp/foo"}); err != nil {
+		t.Fatalf("failed to write a tar: %s", err)
+	}
+
+	// the sparse file is copied only with its data segments
+	appended := new(bytes.Buffer)
+	if err := appendTar(appended, bytes.NewReader(base.Bytes()), []string{"tmp/abc/def"}); err != nil {
+		t.Fatalf("failed to append paths: %s", err)
+	}
+	if appended.Len() >= 1<<20 {
+		t.Fatalf("the holes of the sparse file are copied: %d bytes", appended.Len())
+	}
+
+	expected, err := ioutil.ReadFile("tmp/foo/sparse.img")
+	if err != nil {
+		t.Fatalf("failed to read a fixture file: %s", err)
+	}
+	tr := tar.NewReader(appended)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("the sparse file isn't found: %v", err)
+		}
+		if hdr.Name != "0000/foo/sparse.img" {
+			continue
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil || !isSparseHeader(hdr) || !bytes.Equal(content, expected) {
+			t.Fatalf("the copied sparse file is wrong: %d bytes: %v", len(content), err)
+		}
+		break
+	}
+}
+
+func TestAppendPathsToSameKey(t *testing.T) {
+	setupFixturesToCache(t)
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original string) { maxPartSize = original }(maxPartSize)
+	maxPartSize = "512"
+
+	cacheKey := prefixedKey("key")
+	err := storeTarStream(cacheKey, 512, nil, func(w io.Writer) error {
+		return writeTar(w, []string{"tmp/foo"})
+	})
+	if err != nil {
+		t.Fatalf("failed to store: %s", err)
+	}
+	generation := func() string {
+		head, err := s3Client.HeadObject(&s3.HeadObjectInput{Bucket: &s3Bucket, Key: aws.String(objectKey(cacheKey))})
+		if err != nil {
+			t.Fatalf("failed to get the cache: %s", err)
+		}
+		return objectGeneration(head.Metadata)
+	}
+	first := generation()
+	if first == "" {
+		t.Fatal("the cache has no generation")
+	}
+
+	found, err := appendPaths(cacheKey, []string{"tmp/abc/def"})
+	if err != nil || !found {
+		t.Fatalf("failed to append paths: %v: %v", found, err)
+	}
+
+	// the appended cache is a new generation, and the objects of the replaced one are deleted
+	if second := generation(); second == "" || second == first {
+		t.Fatalf("the appended cache isn't a new generation: %s", second)
+	}
+	for _, key := range fake.keys() {
+		if strings.Contains(key, first) {
+			t.Fatalf("the object of the replaced generation is left: %s", key)
+		}
+	}
+
+	item, err := getExactlyMatchedItem(cacheKey)
+	if err != nil {
+		t.Fatalf("failed to get the cache: %s", err)
+	}
+	body, err := newArchiveReader(item, objectKey(cacheKey))
+	if err != nil {
+		t.Fatalf("failed to read the cache: %s", err)
+	}
+	defer body.Close()
+	_, paths, err := readArchiveDigests(body)
+	if err != nil {
+		t.Fatalf("failed to read the archive: %s", err)
+	}
+	if !reflect.DeepEqual(paths, []string{"tmp/foo", "tmp/abc/def"}) {
+		t.Fatalf("paths are wrong: %v", paths)
+	}
+}
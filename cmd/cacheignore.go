@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cacheIgnoreFile is the name of files of gitignore-style patterns of files not to be stored
+const cacheIgnoreFile = ".cacheignore"
+
+// ignoreRule is a line of .cacheignore matched against paths relative to the directory of the file
+type ignoreRule struct {
+	base     string
+	segments []string
+	negated  bool
+	dirOnly  bool
+}
+
+// cacheIgnore is the rules of .cacheignore in the current directory followed by the one in the path to store
+type cacheIgnore struct {
+	rules []ignoreRule
+}
+
+// loadCacheIgnore reads .cacheignore files applied to the path, which may not exist
+func loadCacheIgnore(path string) (*cacheIgnore, error) {
+	c := &cacheIgnore{}
+	bases := []string{"."}
+	if info, err := os.Stat(path); err == nil && info.IsDir() && filepath.Clean(path) != "." {
+		bases = append(bases, path)
+	}
+
+	for _, base := range bases {
+		rules, err := readIgnoreRules(base)
+		if err != nil {
+			return nil, err
+		}
+		c.rules = append(c.rules, rules...)
+	}
+
+	return c, nil
+}
+
+func readIgnoreRules(base string) ([]ignoreRule, error) {
+	file, err := os.Open(filepath.Join(base, cacheIgnoreFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %s", cacheIgnoreFile, err)
+	}
+	defer file.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if rule, ok := parseIgnoreRule(base, line); ok {
+			rules = append(rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", file.Name(), err)
+	}
+
+	return rules, nil
+}
+
+// parseIgnoreRule parses a line like gitignore, where patterns without slashes except the trailing one match names at any depth
+func parseIgnoreRule(base string, line string) (ignoreRule, bool) {
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negated = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule, false
+	}
+
+	if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+	rule.segments = strings.Split(strings.TrimPrefix(line, "/"), "/")
+	for _, segment := range rule.segments {
+		if _, err := filepath.Match(segment, ""); err != nil {
+			return rule, false
+		}
+	}
+
+	return rule, true
+}
+
+// ignored reports whether the path is ignored by the last rule matching it
+func (c *cacheIgnore) ignored(path string, isDir bool) bool {
+	ignored := false
+	for _, rule := range c.rules {
+		rel, err := filepath.Rel(rule.base, path)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if matchSegments(rule.segments, strings.Split(filepath.ToSlash(rel), "/")) {
+			ignored = !rule.negated
+		}
+	}
+
+	return ignored
+}
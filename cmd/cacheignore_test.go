@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCacheIgnore(t *testing.T) {
+	var rules []ignoreRule
+	for _, line := range []string{"*.log", "!keep.log", "tmp/", "/build/*.o", `\#hash`} {
+		rule, ok := parseIgnoreRule("node_modules", line)
+		if !ok {
+			t.Fatalf("failed to parse %s", line)
+		}
+		rules = append(rules, rule)
+	}
+	c := &cacheIgnore{rules: rules}
+
+	testCases := []struct {
+		path     string
+		isDir    bool
+		expected bool
+	}{
+		{"node_modules", true, false},
+		{"node_modules/debug.log", false, true},
+		{"node_modules/foo/debug.log", false, true},
+		{"node_modules/foo/keep.log", false, false},
+		{"node_modules/foo/tmp", true, true},
+		{"node_modules/foo/tmp", false, false},
+		{"node_modules/build/a.o", false, true},
+		{"node_modules/foo/build/a.o", false, false},
+		{"node_modules/#hash", false, true},
+		{"other/debug.log", false, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			if actual := c.ignored(tc.path, tc.isDir); actual != tc.expected {
+				t.Errorf("expected %v but got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestWriteArchiveWithCacheIgnore(t *testing.T) {
+	setupFixturesToCache(t)
+
+	if err := ioutil.WriteFile("tmp/abc/.cacheignore", []byte("# generated files\ndef/\n"), 0644); err != nil {
+		t.Fatalf("failed to write .cacheignore: %s", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := writeArchive(buf, []string{"tmp/foo", "tmp/abc"}); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	digests, _, err := readArchiveDigests(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read the archive: %s", err)
+	}
+	for _, path := range []string{"tmp/abc/def", "tmp/abc/def/ghe"} {
+		if _, ok := digests[path]; ok {
+			t.Errorf("ignored %s is archived", path)
+		}
+	}
+	for _, path := range []string{"tmp/foo/hoge.txt", "tmp/abc/.cacheignore"} {
+		if _, ok := digests[path]; !ok {
+			t.Errorf("%s is missing in %v", path, digests)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package cmd
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/yuya-takeyama/guruguru-cache/template"
+)
+
+func init() {
+	catCmd := &cobra.Command{
+		Use:   "cat [flags] [cache key] [path]",
+		Short: "Print a file in a cache to stdout",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupTemplate(); err != nil {
+				log.Fatal(err)
+			}
+
+			cacheKey, err := template.ExecuteTemplate(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			found, err := findCacheKey([]string{prefixedKey(cacheKey)})
+			if err != nil {
+				log.Fatal(err)
+			}
+			if found == "" {
+				log.Println("no cache is found")
+				os.Exit(cacheMissExitCode)
+			}
+
+			if err := catCache(os.Stdout, found, args[1]); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	catCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches")
+	catCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(catCmd)
+	addTemplateFlags(catCmd)
+	catCmd.Flags().BoolVarP(&s3Anonymous, "anonymous", "", false, "Access the public S3 bucket without credentials")
+	catCmd.Flags().StringVarP(&ageIdentityFile, "age-identity-file", "", "", "age identity file to decrypt encrypted caches")
+	catCmd.Flags().StringVarP(&passphraseFile, "passphrase-file", "", "", "Decrypt encrypted caches with the passphrase in the file")
+	addTmpDirFlag(catCmd)
+
+	rootCmd.AddCommand(catCmd)
+}
+
+// catCache writes the file of the cache at the path it's restored to, or its name in the archive like 0000/foo/bar.
+// Only the gzip member of the file is downloaded when the cache has an index.
+func catCache(w io.Writer, cacheKey string, path string) error {
+	item, err := getExactlyMatchedItem(cacheKey)
+	if err != nil {
+		return fmt.Errorf("failed to get cache: %s", err)
+	}
+
+	if isPathArchivesManifest(item) {
+		defer item.Body.Close()
+
+		meta, err := readPathArchivesManifest(item.Body)
+		if err != nil {
+			return err
+		}
+		for i := range meta.Paths {
+			if _, ok := archiveEntryName(path, meta.Paths[i:i+1]); ok {
+				return catCache(w, pathArchiveKey(cacheKey, objectGeneration(item.Metadata), i), path)
+			}
+		}
+
+		return fmt.Errorf("file is not in the cache: %s", path)
+	}
+
+	if !isSplitArchive(item) {
+		ok, err := catIndexedEntry(w, cacheKey, objectGeneration(item.Metadata), path)
+		if err != nil || ok {
+			item.Body.Close()
+			return err
+		}
+	}
+
+	body, err := newArchiveReader(item, objectKey(cacheKey))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return catArchiveEntry(w, body, path)
+}
+
+// catIndexedEntry writes the regular file located by the index, reporting false when the cache has no index or the file isn't regular
+func catIndexedEntry(w io.Writer, cacheKey string, generation string, path string) (bool, error) {
+	index, err := getArchiveIndex(cacheKey, generation)
+	if err != nil || index == nil {
+		return false, err
+	}
+
+	entries := make(map[string]indexEntry)
+	for _, entry := range index.Entries {
+		entries[filepath.ToSlash(entry.Name)] = entry
+	}
+
+	name := filepath.ToSlash(path)
+	if _, ok := entries[name]; !ok {
+		metadataEntry, ok := entries["metadata.json"]
+		if !ok {
+			return false, nil
+		}
+		content, err := readIndexedEntry(objectKey(cacheKey), metadataEntry)
+		if err != nil {
+			return false, err
+		}
+		var meta metadata
+		if err := json.Unmarshal(content, &meta); err != nil {
+			return false, fmt.Errorf("failed to decode metadata file: %s", err)
+		}
+
+		if name, ok = archiveEntryName(path, meta.Paths); !ok {
+			return false, fmt.Errorf("file is not in the cache: %s", path)
+		}
+	}
+
+	entry, ok := entries[name]
+	if !ok {
+		return false, fmt.Errorf("file is not in the cache: %s", path)
+	}
+	if entry.Typeflag != string(tar.TypeReg) && entry.Typeflag != string(tar.TypeRegA) {
+		return false, nil
+	}
+
+	body, err := getObjectRange(objectKey(cacheKey), entry.Offset, -1)
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+
+	r, err := openEntry(body, entry)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return false, fmt.Errorf("failed to read %s: %s", entry.Name, err)
+	}
+
+	return true, nil
+}
+
+// catArchiveEntry streams the archive and writes the file.
+// metadata.json mapping names to paths is at the end of the archive, so files which may be the one are spooled to temporal files.
+func catArchiveEntry(w io.Writer, r io.Reader, path string) error {
+	tr, err := openTarReader(r)
+	if err != nil {
+		return err
+	}
+
+	wanted := filepath.ToSlash(path)
+	candidates := make(map[string]string)
+	links := make(map[string]string)
+	defer func() {
+		for _, file := range candidates {
+			os.Remove(file)
+		}
+	}()
+
+	var meta *metadata
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar entry: %s", err)
+		}
+
+		name := strings.TrimPrefix(filepath.ToSlash(hdr.Name), "./")
+		if name == "metadata.json" {
+			meta = new(metadata)
+			if err := json.NewDecoder(tr).Decode(meta); err != nil {
+				return fmt.Errorf("invalid metadata.json: %s", err)
+			}
+			if n, ok := archiveEntryName(path, meta.Paths); ok {
+				wanted = n
+			}
+			continue
+		}
+
+		isFile := hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA
+		if name == wanted {
+			switch {
+			case isFile:
+				if _, err := io.Copy(w, tr); err != nil {
+					return fmt.Errorf("failed to read %s: %s", hdr.Name, err)
+				}
+				return nil
+			case hdr.Typeflag == tar.TypeDir:
+				return fmt.Errorf("path is a directory: %s", path)
+			case hdr.Typeflag == tar.TypeSymlink:
+				return fmt.Errorf("path is a symlink to %s: %s", hdr.Linkname, path)
+			}
+		}
+
+		if hdr.Typeflag == tar.TypeLink {
+			links[name] = strings.TrimPrefix(filepath.ToSlash(hdr.Linkname), "./")
+			continue
+		}
+		if !isFile || meta != nil || !mayBeEntryOf(name, path) {
+			continue
+		}
+
+		file, err := ioutil.TempFile(tmpDir, "guruguru-cache-cat-")
+		if err != nil {
+			return fmt.Errorf("failed to create temporal file: %s", err)
+		}
+		candidates[name] = file.Name()
+		_, err = io.Copy(file, tr)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %s", hdr.Name, err)
+		}
+	}
+
+	spooled, ok := candidates[wanted]
+	if target, isLink := links[wanted]; isLink {
+		if spooled, ok = candidates[target]; !ok {
+			return fmt.Errorf("path is a hard link to %s, which can be printed instead: %s", target, path)
+		}
+	}
+	if !ok {
+		return fmt.Errorf("file is not in the cache: %s", path)
+	}
+
+	file, err := os.Open(spooled)
+	if err != nil {
+		return fmt.Errorf("failed to open temporal file: %s", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(w, file); err != nil {
+		return fmt.Errorf("failed to write %s: %s", path, err)
+	}
+
+	return nil
+}
+
+// archiveEntryName returns the name in the archive like 0000/foo/bar of the path restored to foo/bar
+func archiveEntryName(path string, paths []string) (string, bool) {
+	path = filepath.Clean(path)
+	for i, p := range paths {
+		p = filepath.Clean(p)
+		if path != p && !strings.HasPrefix(path, p+string(filepath.Separator)) {
+			continue
+		}
+
+		rel, err := filepath.Rel(filepath.Dir(p), path)
+		if err != nil {
+			continue
+		}
+
+		return fmt.Sprintf("%04d/%s", i, filepath.ToSlash(rel)), true
+	}
+
+	return "", false
+}
+
+// mayBeEntryOf reports whether the entry can be restored to the path, before the paths of the cache are known
+func mayBeEntryOf(name string, path string) bool {
+	kv := strings.SplitN(name, "/", 2)
+	if len(kv) < 2 {
+		return false
+	}
+
+	path = filepath.ToSlash(filepath.Clean(path))
+	return path == kv[1] || strings.HasSuffix(path, "/"+kv[1])
+}
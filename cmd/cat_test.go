@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCatArchiveEntry(t *testing.T) {
+	setupFixturesToCache(t)
+
+	archive := new(bytes.Buffer)
+	if _, err := writeArchive(archive, []string{"tmp/foo", "tmp/abc/def"}); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	for _, path := range []string{"tmp/foo/hoge.txt", "0000/foo/hoge.txt"} {
+		buf := new(bytes.Buffer)
+		if err := catArchiveEntry(buf, bytes.NewReader(archive.Bytes()), path); err != nil {
+			t.Fatalf("failed to print %s: %s", path, err)
+		}
+		if buf.String() != "This is foo!" {
+			t.Fatalf("the content of %s is wrong: %s", path, buf.String())
+		}
+	}
+
+	for _, path := range []string{"tmp/foo/missing.txt", "tmp/abc/def/ghe", "foo/hoge.txt"} {
+		if err := catArchiveEntry(new(bytes.Buffer), bytes.NewReader(archive.Bytes()), path); err == nil {
+			t.Fatalf("%s is printed without errors", path)
+		}
+	}
+}
+
+func TestArchiveEntryName(t *testing.T) {
+	paths := []string{"tmp/foo", "tmp/abc/def"}
+
+	for path, expected := range map[string]string{
+		"tmp/foo":            "0000/foo",
+		"tmp/foo/hoge.txt":   "0000/foo/hoge.txt",
+		"./tmp/abc/def/ghe/": "0001/def/ghe",
+	} {
+		name, ok := archiveEntryName(path, paths)
+		if !ok || name != expected {
+			t.Fatalf("name of %s is wrong: %s", path, name)
+		}
+	}
+
+	for _, path := range []string{"tmp/foobar", "tmp/abc", "other"} {
+		if name, ok := archiveEntryName(path, paths); ok {
+			t.Fatalf("name of %s is returned: %s", path, name)
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// chunksMetadataKey is the S3 metadata key of the number of chunks a cache consists of
+const chunksMetadataKey = "Chunks"
+
+const chunkStorePrefix = "chunks/"
+
+// chunkRefreshAge is the age of existing chunks which stores copy onto themselves before referring to them,
+// so that chunks a cache being stored refers to are newer than the grace period of prune
+const chunkRefreshAge = 24 * time.Hour
+
+// chunkManifestConcurrency is the number of manifests of caches read at once to find the chunks they refer to
+const chunkManifestConcurrency = 16
+
+// Chunk boundaries are found by a gear hash so that unchanged content produces the same chunks
+const (
+	chunkMinSize = 512 << 10
+	chunkMaxSize = 8 << 20
+	chunkMask    = 1<<20 - 1
+)
+
+var gearTable = newGearTable()
+
+// newGearTable generates the table deterministically since changing it invalidates all chunks
+func newGearTable() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x67757275677572)
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+
+	return table
+}
+
+type chunker struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: bufio.NewReaderSize(r, 1<<20)}
+}
+
+// Next returns the next content-defined chunk, which is valid until the next call.
+// The buffered bytes are scanned in place and copied to the chunk at once, instead of reading them one by one.
+func (c *chunker) Next() ([]byte, error) {
+	c.buf = c.buf[:0]
+
+	var hash uint64
+	for {
+		if c.r.Buffered() == 0 {
+			if _, err := c.r.Peek(1); err == io.EOF {
+				if len(c.buf) == 0 {
+					return nil, io.EOF
+				}
+				return c.buf, nil
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		data, _ := c.r.Peek(c.r.Buffered())
+		for i, b := range data {
+			hash = hash<<1 + gearTable[b]
+
+			n := len(c.buf) + i + 1
+			if (n >= chunkMinSize && hash&chunkMask == 0) || n >= chunkMaxSize {
+				c.buf = append(c.buf, data[:i+1]...)
+				c.r.Discard(i + 1)
+				return c.buf, nil
+			}
+		}
+		c.buf = append(c.buf, data...)
+		c.r.Discard(len(data))
+	}
+}
+
+func chunkKey(hash string) string {
+	return prefixedKey(chunkStorePrefix + hash + ".gz")
+}
+
+// uploadChunksToS3 splits the tar stream into chunks and uploads only ones missing in the chunk store.
+// Each chunk is compressed separately, so the concatenated chunks form a multistream gzip archive.
+// The manifest of the chunks is uploaded last after beforeHead uploads the other objects.
+func uploadChunksToS3(cacheKey string, generation string, r io.Reader, beforeHead func() error) error {
+	c := newChunker(r)
+
+	// chunks are checked and uploaded by up to --upload-concurrency workers, each with a copy of its chunk in memory
+	concurrency := uploadConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var uploadErr error
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return uploadErr != nil
+	}
+
+	var hashes []string
+	scheduled := make(map[string]bool)
+	uploaded := 0
+	var err error
+	for {
+		var chunk []byte
+		if chunk, err = c.Next(); err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			err = fmt.Errorf("failed to read archive: %s", err)
+			break
+		}
+
+		hash := fmt.Sprintf("%x", sha256.Sum256(chunk))
+		hashes = append(hashes, hash)
+		if scheduled[hash] {
+			continue
+		}
+		scheduled[hash] = true
+
+		sem <- struct{}{}
+		if failed() {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(chunk []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			ok, err := uploadChunk(hash, chunk)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if uploadErr == nil {
+					uploadErr = err
+				}
+				return
+			}
+			if ok {
+				uploaded++
+			}
+		}(append([]byte(nil), chunk...))
+	}
+	// chunks in progress are finished before returning, as the manifest must not refer to chunks which may be missing
+	wg.Wait()
+	if err == nil {
+		err = uploadErr
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Uploaded %d of %d chunks\n", uploaded, len(hashes))
+
+	if err := beforeHead(); err != nil {
+		return err
+	}
+
+	metadata := map[string]*string{
+		chunksMetadataKey: aws.String(strconv.Itoa(len(hashes))),
+	}
+
+	return uploadToS3(objectKey(cacheKey), strings.NewReader(strings.Join(hashes, "\n")), withGeneration(metadata, generation))
+}
+
+// uploadChunk compresses and uploads the chunk unless the chunk store has it, reporting whether it's uploaded
+func uploadChunk(hash string, chunk []byte) (bool, error) {
+	exists, err := chunkExists(s3Bucket, chunkKey(hash))
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	if _, err := gw.Write(chunk); err != nil {
+		return false, fmt.Errorf("failed to compress chunk: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		return false, fmt.Errorf("failed to compress chunk: %s", err)
+	}
+
+	if err := uploadToS3(chunkKey(hash), buf, nil); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func chunkKeysFromManifest(manifest io.Reader) ([]string, error) {
+	var keys []string
+
+	scanner := bufio.NewScanner(manifest)
+	for scanner.Scan() {
+		if hash := strings.TrimSpace(scanner.Text()); hash != "" {
+			keys = append(keys, chunkKey(hash))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read manifest of chunks: %s", err)
+	}
+
+	return keys, nil
+}
+
+// chunkExists reports whether the bucket has the chunk, refreshing its modification time by copying it onto itself
+// when it's older than chunkRefreshAge, so that prune doesn't sweep it before the manifest referring to it is uploaded
+func chunkExists(bucket string, key string) (bool, error) {
+	head, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			return false, nil
+		}
+
+		return false, markTransient(err, fmt.Errorf("failed to get metadata of chunk: %s", err))
+	}
+
+	if time.Since(aws.TimeValue(head.LastModified)) < chunkRefreshAge {
+		return true, nil
+	}
+
+	// the metadata is replaced with the same one, as S3 doesn't copy an object onto itself without changes
+	input := &s3.CopyObjectInput{
+		Bucket:               &bucket,
+		Key:                  &key,
+		CopySource:           aws.String(copySource(bucket, key)),
+		MetadataDirective:    aws.String(s3.MetadataDirectiveReplace),
+		Metadata:             head.Metadata,
+		ContentType:          head.ContentType,
+		StorageClass:         head.StorageClass,
+		ServerSideEncryption: head.ServerSideEncryption,
+		SSEKMSKeyId:          head.SSEKMSKeyId,
+	}
+	if _, err := s3Client.CopyObject(input); err != nil {
+		return false, markTransient(err, fmt.Errorf("failed to refresh chunk: %s", err))
+	}
+
+	return true, nil
+}
+
+// cacheRefs is the chunks of chunked caches by their keys, with the keys of the chunks each cache refers to
+// and the base caches delta caches have the changes since
+type cacheRefs struct {
+	chunks map[string]*s3.Object
+	refs   map[string][]string
+	bases  map[string]string
+}
+
+// listCacheRefs lists the chunks of chunked caches, which no cache refers to until readRefs is called
+func listCacheRefs() (*cacheRefs, error) {
+	objects, err := listObjects(chunkStorePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &cacheRefs{chunks: make(map[string]*s3.Object), refs: make(map[string][]string), bases: make(map[string]string)}
+	for _, object := range objects {
+		s.chunks[aws.StringValue(object.Key)] = object
+	}
+
+	return s, nil
+}
+
+// readRefs reads the manifests of the caches to find the chunks they refer to, which is skipped when no chunk exists,
+// and the checksum objects of the caches to find the base caches with bases
+func (s *cacheRefs) readRefs(caches []*cacheEntry, bases bool) error {
+	withChunks := len(s.chunks) > 0
+	if !withChunks && !bases {
+		return nil
+	}
+
+	type result struct {
+		cacheKey string
+		keys     []string
+		base     string
+		err      error
+	}
+	jobs := make(chan *cacheEntry)
+	results := make(chan result)
+
+	var wg sync.WaitGroup
+	for w := 0; w < chunkManifestConcurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				r := result{cacheKey: c.Key}
+				if withChunks {
+					r.keys, r.err = cacheChunkKeys(c)
+				}
+				if bases && r.err == nil {
+					r.base, r.err = storedDeltaBase(prefixedKey(c.Key))
+				}
+				results <- r
+			}
+		}()
+	}
+	go func() {
+		for _, c := range caches {
+			jobs <- c
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	var err error
+	for r := range results {
+		if r.err != nil {
+			if err == nil {
+				err = r.err
+			}
+			continue
+		}
+		if len(r.keys) > 0 {
+			s.refs[r.cacheKey] = r.keys
+		}
+		if r.base != "" {
+			s.bases[r.cacheKey] = r.base
+		}
+	}
+
+	return err
+}
+
+// cacheChunkKeys returns the keys of the chunks the manifests of the cache and its per-path archives list
+func cacheChunkKeys(c *cacheEntry) ([]string, error) {
+	var keys []string
+	for _, object := range c.objects {
+		key := aws.StringValue(object.Key)
+		if !strings.HasSuffix(key, ".tar.gz") || partKeyPattern.MatchString(key) {
+			continue
+		}
+
+		head, err := s3Client.HeadObject(&s3.HeadObjectInput{
+			Bucket: &s3Bucket,
+			Key:    &key,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get metadata of %s: %s", key, err)
+		}
+		if _, ok := head.Metadata[chunksMetadataKey]; !ok {
+			continue
+		}
+
+		item, err := s3Client.GetObject(&s3.GetObjectInput{
+			Bucket: &s3Bucket,
+			Key:    &key,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get manifest of chunks %s: %s", key, err)
+		}
+		chunkKeys, err := chunkKeysFromManifest(item.Body)
+		item.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, chunkKeys...)
+	}
+
+	return keys, nil
+}
+
+// size returns the total size of the chunks the caches refer to, counting each chunk once
+func (s *cacheRefs) size(caches []*cacheEntry) int64 {
+	counted := make(map[string]bool)
+	var size int64
+	for _, c := range caches {
+		size += s.newSize(c, counted)
+		s.count(c, counted)
+	}
+
+	return size
+}
+
+// newSize returns the size of the chunks the cache refers to which aren't counted yet, counting duplicates once
+func (s *cacheRefs) newSize(c *cacheEntry, counted map[string]bool) int64 {
+	if s == nil {
+		return 0
+	}
+
+	seen := make(map[string]bool)
+	var size int64
+	for _, key := range s.refs[c.Key] {
+		object, ok := s.chunks[key]
+		if !ok || counted[key] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		size += aws.Int64Value(object.Size)
+	}
+
+	return size
+}
+
+// count marks the chunks the cache refers to counted
+func (s *cacheRefs) count(c *cacheEntry, counted map[string]bool) {
+	if s == nil {
+		return
+	}
+
+	for _, key := range s.refs[c.Key] {
+		counted[key] = true
+	}
+}
+
+// totalSize returns the size of all the chunks whether caches refer to them or not
+func (s *cacheRefs) totalSize() int64 {
+	var size int64
+	for _, object := range s.chunks {
+		size += aws.Int64Value(object.Size)
+	}
+
+	return size
+}
+
+// withoutBases returns the pruned caches except the base caches of the delta caches which are kept
+func (s *cacheRefs) withoutBases(caches []*cacheEntry, pruned []*cacheEntry) []*cacheEntry {
+	kept := make(map[string]bool)
+	for _, c := range keptCaches(caches, pruned) {
+		if base, ok := s.bases[c.Key]; ok {
+			kept[base] = true
+		}
+	}
+
+	var withoutBases []*cacheEntry
+	for _, c := range pruned {
+		if kept[c.Key] {
+			log.Printf("keeping the base cache of delta caches: %s\n", c.Key)
+			continue
+		}
+		withoutBases = append(withoutBases, c)
+	}
+
+	return withoutBases
+}
+
+// unreferenced returns the chunks none of the caches refers to, modified before the time
+func (s *cacheRefs) unreferenced(caches []*cacheEntry, before time.Time) []*s3.Object {
+	referenced := make(map[string]bool)
+	for _, c := range caches {
+		for _, key := range s.refs[c.Key] {
+			referenced[key] = true
+		}
+	}
+
+	var objects []*s3.Object
+	for key, object := range s.chunks {
+		if !referenced[key] && aws.TimeValue(object.LastModified).Before(before) {
+			objects = append(objects, object)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return aws.StringValue(objects[i].Key) < aws.StringValue(objects[j].Key)
+	})
+
+	return objects
+}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func chunkHashes(t *testing.T, data []byte) map[[32]byte]bool {
+	c := newChunker(bytes.NewReader(data))
+	hashes := make(map[[32]byte]bool)
+	joined := new(bytes.Buffer)
+
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read a chunk: %s", err)
+		}
+		if len(chunk) > chunkMaxSize {
+			t.Fatalf("the chunk is too large: %d", len(chunk))
+		}
+
+		hashes[sha256.Sum256(chunk)] = true
+		joined.Write(chunk)
+	}
+
+	if !bytes.Equal(joined.Bytes(), data) {
+		t.Fatalf("the joined chunks differ from the original data")
+	}
+
+	return hashes
+}
+
+func TestChunkerIsContentDefined(t *testing.T) {
+	data := make([]byte, 16<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	original := chunkHashes(t, data)
+
+	// Insert some bytes in the middle so that the following offsets shift
+	modified := append(append(append([]byte{}, data[:8<<20]...), []byte("inserted")...), data[8<<20:]...)
+	shifted := chunkHashes(t, modified)
+
+	shared := 0
+	for hash := range shifted {
+		if original[hash] {
+			shared++
+		}
+	}
+
+	if shared < len(original)-2 {
+		t.Fatalf("too few chunks are shared: %d of %d", shared, len(original))
+	}
+}
+
+func TestChunkerBoundariesAreUnchanged(t *testing.T) {
+	data := make([]byte, 20<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	// long runs of the same byte are split at chunkMaxSize
+	data = append(data, make([]byte, 9<<20)...)
+
+	// the boundaries of the byte-by-byte scan, which chunks in existing chunk stores are split at
+	var expected []int
+	var hash uint64
+	n := 0
+	br := bufio.NewReader(bytes.NewReader(data))
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		n++
+		hash = hash<<1 + gearTable[b]
+		if (n >= chunkMinSize && hash&chunkMask == 0) || n >= chunkMaxSize {
+			expected = append(expected, n)
+			hash = 0
+			n = 0
+		}
+	}
+	if n > 0 {
+		expected = append(expected, n)
+	}
+
+	var actual []int
+	c := newChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read a chunk: %s", err)
+		}
+		actual = append(actual, len(chunk))
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("the chunks are split at different boundaries: %v, expected %v", actual, expected)
+	}
+}
+
+func TestUploadChunksToS3(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original int) { uploadConcurrency = original }(uploadConcurrency)
+	uploadConcurrency = 4
+
+	data := make([]byte, 8<<20)
+	rand.New(rand.NewSource(3)).Read(data)
+	// the same content produces the same chunks, which are uploaded once
+	data = append(data, data...)
+
+	var hashes []string
+	for hash := range chunkHashes(t, data) {
+		hashes = append(hashes, fmt.Sprintf("%x", hash))
+	}
+	fake.put(chunkKey(hashes[0]), []byte("existing"), nil)
+
+	if err := uploadChunksToS3(prefixedKey("gem"), "", bytes.NewReader(data), func() error { return nil }); err != nil {
+		t.Fatalf("failed to upload chunks: %s", err)
+	}
+
+	puts := 0
+	for _, r := range fake.requests {
+		if r.Method == http.MethodPut && strings.Contains(r.Key, chunkStorePrefix) {
+			puts++
+		}
+	}
+	if puts != len(hashes)-1 {
+		t.Fatalf("%d chunks are uploaded, expected %d", puts, len(hashes)-1)
+	}
+
+	manifest, ok := fake.content(objectKey(prefixedKey("gem")))
+	if !ok {
+		t.Fatal("the manifest isn't uploaded")
+	}
+	c := newChunker(bytes.NewReader(data))
+	var expected []string
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		expected = append(expected, fmt.Sprintf("%x", sha256.Sum256(chunk)))
+	}
+	if len(expected) <= len(hashes) {
+		t.Fatalf("no chunks are duplicated: %d", len(expected))
+	}
+	if string(manifest) != strings.Join(expected, "\n") {
+		t.Fatalf("the manifest is wrong: %s", manifest)
+	}
+}
+
+func TestUploadChunksInStorageClass(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original string) { storageClass = original }(storageClass)
+	storageClass = s3.StorageClassStandardIa
+
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(3)).Read(data)
+	if err := uploadChunksToS3(prefixedKey("gem"), "0123456789abcdef", bytes.NewReader(data), func() error { return nil }); err != nil {
+		t.Fatalf("failed to upload chunks: %s", err)
+	}
+
+	chunks := 0
+	for _, r := range fake.requests {
+		if r.Method != http.MethodPut || !strings.Contains(r.Key, chunkStorePrefix) {
+			continue
+		}
+		chunks++
+		if class := r.Header.Get("X-Amz-Storage-Class"); class != storageClass {
+			t.Fatalf("the chunk %s is uploaded in %q", r.Key, class)
+		}
+	}
+	if chunks == 0 {
+		t.Fatal("no chunks are uploaded")
+	}
+}
@@ -7,6 +7,15 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// Version is the version of guruguru-cache, set with -ldflags "-X github.com/yuya-takeyama/guruguru-cache/cmd.Version=..." on release
+var Version = "dev"
+
+// Commit is the git commit guruguru-cache is built from, set with -ldflags like Version
+var Commit = ""
+
+// BuildDate is the date guruguru-cache is built at, set with -ldflags like Version
+var BuildDate = ""
+
 var rootCmd = &cobra.Command{
 	Use:   "guruguru-cache",
 	Short: "Rule-based cache utility",
@@ -0,0 +1,252 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// cacheNamesCompletion is the shell function completing the names of caches in the config files
+const cacheNamesCompletion = "__guruguru-cache_cache_names"
+
+const bashCompletionFunction = `__guruguru-cache_cache_names()
+{
+    local names
+    if names=$(guruguru-cache config caches 2>/dev/null); then
+        COMPREPLY=( $(compgen -W "${names}" -- "$cur") )
+    fi
+}
+`
+
+func init() {
+	rootCmd.BashCompletionFunction = bashCompletionFunction
+
+	completionCmd := &cobra.Command{
+		Use:   "completion SHELL",
+		Short: "Print the completion script of bash, zsh or fish",
+		Long: `Print the completion script of bash, zsh or fish.
+
+  bash: source <(guruguru-cache completion bash)
+  zsh:  guruguru-cache completion zsh > "${fpath[1]}/_guruguru-cache"
+  fish: guruguru-cache completion fish > ~/.config/fish/completions/guruguru-cache.fish`,
+		Args:      cobra.ExactArgs(1),
+		ValidArgs: []string{"bash", "zsh", "fish"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			switch args[0] {
+			case "bash":
+				return rootCmd.GenBashCompletion(os.Stdout)
+			case "zsh":
+				return genZshCompletion(os.Stdout, rootCmd)
+			case "fish":
+				return genFishCompletion(os.Stdout, rootCmd)
+			default:
+				return fmt.Errorf("unsupported shell: %s", args[0])
+			}
+		},
+	}
+
+	rootCmd.AddCommand(completionCmd)
+}
+
+// completedCommands returns the available subcommands of the command
+func completedCommands(cmd *cobra.Command) []*cobra.Command {
+	var cmds []*cobra.Command
+	for _, sub := range cmd.Commands() {
+		if sub.IsAvailableCommand() {
+			cmds = append(cmds, sub)
+		}
+	}
+
+	return cmds
+}
+
+// completedFlags returns the visible flags of the command including the inherited ones
+func completedFlags(cmd *cobra.Command) []*pflag.Flag {
+	var flags []*pflag.Flag
+	visit := func(f *pflag.Flag) {
+		if !f.Hidden && f.Name != "help" {
+			flags = append(flags, f)
+		}
+	}
+	cmd.NonInheritedFlags().VisitAll(visit)
+	cmd.InheritedFlags().VisitAll(visit)
+
+	return flags
+}
+
+// completesCacheNames reports whether values of the flag are names of caches in the config files
+func completesCacheNames(f *pflag.Flag) bool {
+	for _, handler := range f.Annotations[cobra.BashCompCustom] {
+		if handler == cacheNamesCompletion {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isRepeatedFlag reports whether the flag can be given multiple times
+func isRepeatedFlag(f *pflag.Flag) bool {
+	return strings.HasSuffix(f.Value.Type(), "Array") || strings.HasSuffix(f.Value.Type(), "Slice")
+}
+
+// genZshCompletion writes the zsh completion script of the command and its subcommands
+func genZshCompletion(w io.Writer, root *cobra.Command) error {
+	name := root.Name()
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "#compdef %s\n\n", name)
+	fmt.Fprintf(&buf, `%s() {
+  local -a names
+  names=(${(f)"$(%s config caches 2>/dev/null)"})
+  _describe 'cache' names
+}
+`, cacheNamesCompletion, name)
+
+	var gen func(cmd *cobra.Command, function string)
+	gen = func(cmd *cobra.Command, function string) {
+		subs := completedCommands(cmd)
+		fmt.Fprintf(&buf, "\n%s() {\n", function)
+		fmt.Fprint(&buf, "  _arguments -C")
+		for _, f := range completedFlags(cmd) {
+			fmt.Fprintf(&buf, " \\\n    %s", zshFlagSpec(f))
+		}
+		if len(subs) > 0 {
+			fmt.Fprint(&buf, " \\\n    '1: :->commands' \\\n    '*::arg:->args'\n")
+			fmt.Fprint(&buf, "\n  case $state in\n  commands)\n    local -a commands\n    commands=(\n")
+			for _, sub := range subs {
+				fmt.Fprintf(&buf, "      '%s:%s'\n", sub.Name(), zshQuote(sub.Short))
+			}
+			fmt.Fprint(&buf, "    )\n    _describe 'command' commands\n    ;;\n  args)\n    case $words[1] in\n")
+			for _, sub := range subs {
+				fmt.Fprintf(&buf, "    %s) %s_%s ;;\n", sub.Name(), function, sub.Name())
+			}
+			fmt.Fprint(&buf, "    esac\n    ;;\n  esac\n")
+		} else {
+			fmt.Fprint(&buf, " \\\n    '*:file:_files'\n")
+		}
+		fmt.Fprint(&buf, "}\n")
+
+		for _, sub := range subs {
+			gen(sub, function+"_"+sub.Name())
+		}
+	}
+	gen(root, "_"+name)
+
+	fmt.Fprintf(&buf, "\n_%s \"$@\"\n", name)
+
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// zshFlagSpec returns the _arguments spec of the flag
+func zshFlagSpec(f *pflag.Flag) string {
+	spec := "[" + zshQuote(f.Usage) + "]"
+	if f.NoOptDefVal == "" {
+		if completesCacheNames(f) {
+			spec += ":cache:" + cacheNamesCompletion
+		} else {
+			spec += ":" + f.Name + ":_files"
+		}
+	}
+
+	repeated := ""
+	if isRepeatedFlag(f) {
+		repeated = "*"
+	}
+	if f.Shorthand != "" {
+		return fmt.Sprintf("'(-%s --%s)%s'{-%s,--%s}'%s'", f.Shorthand, f.Name, repeated, f.Shorthand, f.Name, spec)
+	}
+
+	return fmt.Sprintf("'%s--%s%s'", repeated, f.Name, spec)
+}
+
+// zshQuote escapes the text put in single quoted specs of _arguments
+func zshQuote(s string) string {
+	return strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+// genFishCompletion writes the fish completion script of the command and its subcommands
+func genFishCompletion(w io.Writer, root *cobra.Command) error {
+	name := root.Name()
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "complete -c %s -f\n", name)
+
+	var gen func(cmd *cobra.Command, path []string)
+	gen = func(cmd *cobra.Command, path []string) {
+		subs := completedCommands(cmd)
+		var subNames []string
+		for _, sub := range subs {
+			subNames = append(subNames, sub.Name())
+		}
+
+		var conditions []string
+		for _, p := range path {
+			conditions = append(conditions, "__fish_seen_subcommand_from "+p)
+		}
+		if len(path) == 0 {
+			conditions = append(conditions, "__fish_use_subcommand")
+		} else if len(subs) > 0 {
+			conditions = append(conditions, "not __fish_seen_subcommand_from "+strings.Join(subNames, " "))
+		}
+		commandCondition := strings.Join(conditions, "; and ")
+
+		for _, sub := range subs {
+			fmt.Fprintf(&buf, "complete -c %s -n '%s' -a %s -d %s\n", name, commandCondition, sub.Name(), fishQuote(sub.Short))
+		}
+
+		if len(path) > 0 {
+			flagCondition := strings.Join(conditions[:len(path)], "; and ")
+			cmd.NonInheritedFlags().VisitAll(func(f *pflag.Flag) {
+				if f.Hidden || f.Name == "help" {
+					return
+				}
+				fmt.Fprintf(&buf, "complete -c %s -n '%s' %s\n", name, flagCondition, fishFlagSpec(f))
+			})
+		} else {
+			root.PersistentFlags().VisitAll(func(f *pflag.Flag) {
+				if f.Hidden {
+					return
+				}
+				fmt.Fprintf(&buf, "complete -c %s %s\n", name, fishFlagSpec(f))
+			})
+		}
+
+		if len(path) > 0 && len(subs) == 0 {
+			fmt.Fprintf(&buf, "complete -c %s -n '%s' -F\n", name, commandCondition)
+		}
+
+		for _, sub := range subs {
+			gen(sub, append(path[:len(path):len(path)], sub.Name()))
+		}
+	}
+	gen(root, nil)
+
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// fishFlagSpec returns the options of complete for the flag
+func fishFlagSpec(f *pflag.Flag) string {
+	spec := "-l " + f.Name
+	if f.Shorthand != "" {
+		spec += " -s " + f.Shorthand
+	}
+	if f.NoOptDefVal == "" {
+		if completesCacheNames(f) {
+			spec += " -x -a '(guruguru-cache config caches 2>/dev/null)'"
+		} else {
+			spec += " -r -F"
+		}
+	}
+
+	return spec + " -d " + fishQuote(f.Usage)
+}
+
+// fishQuote quotes the text as a single quoted fish string
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func newCompletionTestCommand() *cobra.Command {
+	root := &cobra.Command{Use: "guruguru-cache"}
+	root.PersistentFlags().StringP("config", "", "", "Config file")
+
+	restore := &cobra.Command{Use: "restore", Short: "Restore cache files", Run: func(cmd *cobra.Command, args []string) {}}
+	restore.Flags().StringP("cache", "", "", "Name of the cache")
+	restore.MarkFlagCustom("cache", cacheNamesCompletion)
+	restore.Flags().BoolP("dry-run", "", false, "Don't restore [really]")
+	restore.Flags().StringArrayP("tag", "t", nil, "Tag")
+
+	root.AddCommand(restore)
+
+	return root
+}
+
+func TestGenZshCompletion(t *testing.T) {
+	var buf bytes.Buffer
+	if err := genZshCompletion(&buf, newCompletionTestCommand()); err != nil {
+		t.Fatalf("failed to generate zsh completion: %s", err)
+	}
+
+	for _, expected := range []string{
+		"#compdef guruguru-cache\n",
+		"      'restore:Restore cache files'\n",
+		"    restore) _guruguru-cache_restore ;;\n",
+		"'--cache[Name of the cache]:cache:__guruguru-cache_cache_names'",
+		`'--dry-run[Don'\''t restore \[really\]]'`,
+		"'(-t --tag)*'{-t,--tag}'[Tag]:tag:_files'",
+		"'--config[Config file]:config:_files'",
+		"\n_guruguru-cache \"$@\"\n",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Fatalf("zsh completion doesn't contain %q:\n%s", expected, buf.String())
+		}
+	}
+}
+
+func TestGenFishCompletion(t *testing.T) {
+	var buf bytes.Buffer
+	if err := genFishCompletion(&buf, newCompletionTestCommand()); err != nil {
+		t.Fatalf("failed to generate fish completion: %s", err)
+	}
+
+	for _, expected := range []string{
+		"complete -c guruguru-cache -n '__fish_use_subcommand' -a restore -d 'Restore cache files'\n",
+		"complete -c guruguru-cache -n '__fish_seen_subcommand_from restore' -l cache -x -a '(guruguru-cache config caches 2>/dev/null)' -d 'Name of the cache'\n",
+		`complete -c guruguru-cache -n '__fish_seen_subcommand_from restore' -l dry-run -d 'Don\'t restore [really]'` + "\n",
+		"complete -c guruguru-cache -n '__fish_seen_subcommand_from restore' -l tag -s t -r -F -d 'Tag'\n",
+		"complete -c guruguru-cache -l config -r -F -d 'Config file'\n",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Fatalf("fish completion doesn't contain %q:\n%s", expected, buf.String())
+		}
+	}
+}
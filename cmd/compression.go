@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4Magic  = []byte{0x04, 0x22, 0x4d, 0x18}
+	tarMagic  = []byte("ustar")
+)
+
+// tarMagicOffset is the offset of the magic field in a tar header
+const tarMagicOffset = 257
+
+// openTarReader returns the tar stream of the archive, decrypting and decompressing it
+func openTarReader(r io.Reader) (*tar.Reader, error) {
+	dr, err := decrypt(r)
+	if err != nil {
+		return nil, err
+	}
+
+	cr, err := decompress(dr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %s", err)
+	}
+
+	return tar.NewReader(cr), nil
+}
+
+// decompress detects the compression format of the archive by its magic bytes
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	head, err := br.Peek(tarMagicOffset + len(tarMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read archive: %s", err)
+	}
+
+	switch compressionFormat(head) {
+	case "gzip":
+		return gzip.NewReader(br)
+	case "zstd":
+		return zstd.NewReader(br)
+	case "lz4":
+		return lz4.NewReader(br), nil
+	case "tar":
+		return br, nil
+	}
+
+	return nil, fmt.Errorf("unknown compression format")
+}
+
+// compressionFormat names the format of the archive by its head, or returns empty for unknown ones
+func compressionFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, ageMagic):
+		return "age"
+	case bytes.HasPrefix(head, gzipMagic):
+		return "gzip"
+	case bytes.HasPrefix(head, zstdMagic):
+		return "zstd"
+	case bytes.HasPrefix(head, lz4Magic):
+		return "lz4"
+	case len(head) >= tarMagicOffset+len(tarMagic) && bytes.Equal(head[tarMagicOffset:tarMagicOffset+len(tarMagic)], tarMagic):
+		return "tar"
+	}
+
+	return ""
+}
@@ -0,0 +1,299 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/yuya-takeyama/guruguru-cache/template"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// configFileName is the name of config files in the home and the current directories
+const configFileName = ".guruguru-cache.yml"
+
+var configFile string
+
+// loadedConfig is the config merged from the files, which is empty without them
+var loadedConfig = new(config)
+
+type config struct {
+	S3Bucket          string                 `yaml:"s3_bucket,omitempty"`
+	FallbackS3Buckets []string               `yaml:"fallback_s3_buckets,omitempty"`
+	Prefix            string                 `yaml:"prefix,omitempty"`
+	AWSProfile        string                 `yaml:"aws_profile,omitempty"`
+	AWSRegion         string                 `yaml:"aws_region,omitempty"`
+	Flags             map[string]interface{} `yaml:"flags,omitempty"`
+	Caches            map[string]namedCache  `yaml:"caches,omitempty"`
+	files             []string
+}
+
+// namedCache is a cache given by --cache instead of the cache key and paths of arguments
+type namedCache struct {
+	Key         string   `yaml:"key"`
+	RestoreKeys []string `yaml:"restore_keys,omitempty"`
+	Paths       []string `yaml:"paths,omitempty"`
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "", "", "Config file used instead of "+configFileName+" in the current directory")
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		c, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		loadedConfig = c
+
+		return applyConfig(cmd.Flags(), c)
+	}
+
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Manage config files",
+	}
+
+	viewCmd := &cobra.Command{
+		Use:   "view",
+		Short: "Print the config merged from the config files",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, file := range loadedConfig.files {
+				fmt.Printf("# %s\n", file)
+			}
+
+			out, err := yaml.Marshal(loadedConfig)
+			if err != nil {
+				return fmt.Errorf("failed to encode config: %s", err)
+			}
+			fmt.Print(string(out))
+
+			return nil
+		},
+	}
+
+	validateCmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Validate the config files",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateConfig(loadedConfig); err != nil {
+				return err
+			}
+
+			fmt.Printf("config is valid: %d files\n", len(loadedConfig.files))
+
+			return nil
+		},
+	}
+
+	cachesCmd := &cobra.Command{
+		Use:   "caches",
+		Short: "Print the names of caches in the config files",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			for _, name := range cacheNames(loadedConfig) {
+				fmt.Println(name)
+			}
+		},
+	}
+
+	configCmd.AddCommand(viewCmd)
+	configCmd.AddCommand(validateCmd)
+	configCmd.AddCommand(cachesCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
+// configFiles returns the config files in the home directory and the current directory, or the one given by --config
+func configFiles() []string {
+	if configFile != "" {
+		return []string{configFile}
+	}
+
+	var files []string
+	if home := homeDir(); home != "" {
+		files = append(files, filepath.Join(home, configFileName))
+	}
+	if abs, err := filepath.Abs(configFileName); err == nil && (len(files) == 0 || abs != files[0]) {
+		files = append(files, configFileName)
+	}
+
+	return files
+}
+
+func homeDir() string {
+	if runtime.GOOS == "windows" {
+		return os.Getenv("USERPROFILE")
+	}
+
+	return os.Getenv("HOME")
+}
+
+// loadConfig merges the config files, where ones in the current directory take precedence.
+// Only the file given by --config must exist.
+func loadConfig() (*config, error) {
+	merged := new(config)
+	for _, file := range configFiles() {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) && configFile == "" {
+				continue
+			}
+
+			return nil, fmt.Errorf("failed to read config file: %s", err)
+		}
+
+		c := new(config)
+		if err := yaml.UnmarshalStrict(content, c); err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %s: %s", file, err)
+		}
+
+		mergeConfig(merged, c)
+		merged.files = append(merged.files, file)
+	}
+
+	return merged, nil
+}
+
+func mergeConfig(dst *config, src *config) {
+	if src.S3Bucket != "" {
+		dst.S3Bucket = src.S3Bucket
+	}
+	if src.FallbackS3Buckets != nil {
+		dst.FallbackS3Buckets = src.FallbackS3Buckets
+	}
+	if src.Prefix != "" {
+		dst.Prefix = src.Prefix
+	}
+	if src.AWSProfile != "" {
+		dst.AWSProfile = src.AWSProfile
+	}
+	if src.AWSRegion != "" {
+		dst.AWSRegion = src.AWSRegion
+	}
+
+	for name, value := range src.Flags {
+		if dst.Flags == nil {
+			dst.Flags = make(map[string]interface{})
+		}
+		dst.Flags[name] = value
+	}
+	for name, c := range src.Caches {
+		if dst.Caches == nil {
+			dst.Caches = make(map[string]namedCache)
+		}
+		dst.Caches[name] = c
+	}
+}
+
+// configFlags returns the defaults of flags given by the config
+func configFlags(c *config) map[string]interface{} {
+	flags := map[string]interface{}{}
+	for name, value := range c.Flags {
+		flags[name] = value
+	}
+
+	named := map[string]interface{}{
+		"s3-bucket":          c.S3Bucket,
+		"prefix":             c.Prefix,
+		"aws-profile":        c.AWSProfile,
+		"aws-region":         c.AWSRegion,
+		"fallback-s3-bucket": c.FallbackS3Buckets,
+	}
+	for name, value := range named {
+		if s, ok := value.(string); ok && s == "" {
+			continue
+		}
+		if l, ok := value.([]string); ok && l == nil {
+			continue
+		}
+		flags[name] = value
+	}
+
+	return flags
+}
+
+// applyConfig sets the defaults given by the config to the flags the command has and which aren't given
+func applyConfig(flags *pflag.FlagSet, c *config) error {
+	for name, value := range configFlags(c) {
+		f := flags.Lookup(name)
+		if f == nil || f.Changed {
+			continue
+		}
+
+		var values []string
+		switch v := value.(type) {
+		case []string:
+			values = v
+		case []interface{}:
+			for _, item := range v {
+				values = append(values, fmt.Sprint(item))
+			}
+		default:
+			values = []string{fmt.Sprint(v)}
+		}
+
+		for _, v := range values {
+			if err := flags.Set(name, v); err != nil {
+				return fmt.Errorf("invalid value of %s in config: %s", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateConfig checks that flags exist in some commands and named caches are valid
+func validateConfig(c *config) error {
+	known := make(map[string]bool)
+	var visit func(cmd *cobra.Command)
+	visit = func(cmd *cobra.Command) {
+		cmd.Flags().VisitAll(func(f *pflag.Flag) {
+			known[f.Name] = true
+		})
+		for _, sub := range cmd.Commands() {
+			visit(sub)
+		}
+	}
+	visit(rootCmd)
+
+	var names []string
+	for name := range c.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !known[name] {
+			return fmt.Errorf("unknown flag in config: %s", name)
+		}
+	}
+
+	for _, name := range cacheNames(c) {
+		cache := c.Caches[name]
+		if cache.Key == "" {
+			return fmt.Errorf("key of cache %s is required", name)
+		}
+		for _, key := range append([]string{cache.Key}, cache.RestoreKeys...) {
+			if err := template.ValidateTemplate(key); err != nil {
+				return fmt.Errorf("cache %s has %s", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// cacheNames returns the sorted names of caches in the config
+func cacheNames(c *config) []string {
+	var names []string
+	for name := range c.Caches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
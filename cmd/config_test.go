@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guruguru-cache-test-")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { configFile = "" }()
+
+	configFile = filepath.Join(dir, configFileName)
+	content := `s3_bucket: example-cache
+prefix: org/repo/
+flags:
+  upload-concurrency: 8
+  tag: [team=web, repo=guruguru-cache]
+caches:
+  gem:
+    key: 'gem-v1-{{ checksum "Gemfile.lock" }}'
+    restore_keys: [gem-v1-]
+    paths: [vendor/bundle]
+`
+	if err := ioutil.WriteFile(configFile, []byte(content), 0644); err != nil {
+		log.Fatalf("failed to write config file: %s", err)
+	}
+
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	if c.S3Bucket != "example-cache" || c.Caches["gem"].Paths[0] != "vendor/bundle" {
+		t.Fatalf("loaded config is wrong: %+v", c)
+	}
+	if err := validateConfig(c); err != nil {
+		t.Fatalf("valid config is rejected: %s", err)
+	}
+
+	flags := pflag.NewFlagSet("store", pflag.ContinueOnError)
+	bucket := flags.String("s3-bucket", "", "")
+	prefix := flags.String("prefix", "", "")
+	concurrency := flags.Int("upload-concurrency", 5, "")
+	tags := flags.StringArray("tag", nil, "")
+	if err := flags.Parse([]string{"--prefix=other/"}); err != nil {
+		t.Fatalf("failed to parse flags: %s", err)
+	}
+
+	if err := applyConfig(flags, c); err != nil {
+		t.Fatalf("failed to apply config: %s", err)
+	}
+	if *bucket != "example-cache" || *concurrency != 8 || !reflect.DeepEqual(*tags, []string{"team=web", "repo=guruguru-cache"}) {
+		t.Fatalf("config isn't applied: %s %d %v", *bucket, *concurrency, *tags)
+	}
+	if *prefix != "other/" {
+		t.Fatalf("flag given explicitly is overwritten by config: %s", *prefix)
+	}
+
+	c.Flags["no-such-flag"] = true
+	if err := validateConfig(c); err == nil {
+		t.Fatal("config with an unknown flag is accepted")
+	}
+
+	if err := ioutil.WriteFile(configFile, []byte("bucket: typo\n"), 0644); err != nil {
+		log.Fatalf("failed to write config file: %s", err)
+	}
+	if _, err := loadConfig(); err == nil {
+		t.Fatal("config with an unknown field is loaded")
+	}
+}
+
+func TestMergeConfig(t *testing.T) {
+	merged := new(config)
+	mergeConfig(merged, &config{S3Bucket: "home-cache", AWSRegion: "us-west-2", Caches: map[string]namedCache{"gem": {Key: "gem-v1"}}})
+	mergeConfig(merged, &config{S3Bucket: "project-cache", Caches: map[string]namedCache{"node": {Key: "node-v1"}}})
+
+	if merged.S3Bucket != "project-cache" || merged.AWSRegion != "us-west-2" || len(merged.Caches) != 2 {
+		t.Fatalf("merged config is wrong: %+v", merged)
+	}
+}
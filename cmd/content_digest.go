@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// contentDigestMetadataKey is the S3 metadata key of the checksum object of the digest of the files in the cache
+const contentDigestMetadataKey = "Content-Digest"
+
+var skipIfIdentical bool
+
+// contentDigest archives the paths like store does and returns the digest of the files in the archive
+func contentDigest(paths []string) (string, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTar(pw, paths))
+	}()
+	defer pr.Close()
+
+	return tarContentDigest(pr)
+}
+
+// tarContentDigest returns the SHA-256 digest of names, types, modes, links and contents of the entries of the tar stream.
+// Timestamps and owners aren't digested, so that files installed again with the same content have the same digest.
+func tarContentDigest(r io.Reader) (string, error) {
+	tr := tar.NewReader(r)
+	h := sha256.New()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read tar entry: %s", err)
+		}
+
+		// metadata.json has the version of guruguru-cache and when and where the cache is stored, which don't change files
+		if strings.TrimPrefix(hdr.Name, "./") == "metadata.json" {
+			var meta metadata
+			if err := json.NewDecoder(tr).Decode(&meta); err != nil {
+				return "", fmt.Errorf("invalid metadata.json: %s", err)
+			}
+			fmt.Fprintf(h, "metadata.json\x00%q\n", meta.Paths)
+			continue
+		}
+		// manifest.json has only the checksums of the files digested, and caches stored by older versions have no manifest
+		if isManifestEntry(hdr) {
+			continue
+		}
+
+		fmt.Fprintf(h, "%s\x00%c\x00%o\x00%s\x00%d\n", hdr.Name, hdr.Typeflag, hdr.Mode, hdr.Linkname, hdr.Size)
+		if _, err := io.Copy(h, tr); err != nil {
+			return "", fmt.Errorf("failed to read %s: %s", hdr.Name, err)
+		}
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// storedContentDigest returns the digest recorded with the checksum of the cache, which is empty for caches stored without --skip-if-identical
+func storedContentDigest(cacheKey string) (string, error) {
+	head, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &s3Bucket,
+		Key:    aws.String(checksumKey(cacheKey)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("failed to get checksum of cache: %s", err)
+	}
+
+	return aws.StringValue(head.Metadata[contentDigestMetadataKey]), nil
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestContentDigest(t *testing.T) {
+	setupFixturesToCache(t)
+	paths := []string{"tmp/foo", "tmp/abc/def"}
+
+	digest, err := contentDigest(paths)
+	if err != nil {
+		t.Fatalf("failed to compute the digest: %s", err)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes("tmp/foo/hoge.txt", past, past); err != nil {
+		t.Fatalf("failed to change times of a file: %s", err)
+	}
+	if touched, err := contentDigest(paths); err != nil || touched != digest {
+		t.Errorf("the digest is changed by timestamps: %s, %s", touched, err)
+	}
+
+	if err := ioutil.WriteFile("tmp/foo/hoge.txt", []byte("This is bar!"), 0644); err != nil {
+		t.Fatalf("failed to write a file: %s", err)
+	}
+	if changed, err := contentDigest(paths); err != nil || changed == digest {
+		t.Errorf("the digest isn't changed by the content: %s, %s", changed, err)
+	}
+
+	if reordered, err := contentDigest([]string{"tmp/abc/def", "tmp/foo"}); err != nil || reordered == digest {
+		t.Errorf("the digest isn't changed by the order of paths: %s, %s", reordered, err)
+	}
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var contentsJSON bool
+
+// archiveEntry is an entry of an archive with the path it's restored to
+type archiveEntry struct {
+	Path string      `json:"path"`
+	Size int64       `json:"size"`
+	Mode os.FileMode `json:"mode"`
+	Link string      `json:"link,omitempty"`
+}
+
+func init() {
+	contentsCmd := &cobra.Command{
+		Use:   "contents [flags] [cache keys...]",
+		Short: "List files in a cache without writing them to disk",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupTemplate(); err != nil {
+				log.Fatal(err)
+			}
+
+			cacheKeys, err := renderCacheKeys(args)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			item, itemKey := findCache(cacheKeys)
+			if item == nil {
+				log.Println("no cache is found")
+				os.Exit(cacheMissExitCode)
+			}
+			if isPathArchivesManifest(item) {
+				item.Body.Close()
+				log.Fatalf("cache of per-path archives can't be listed: %s", itemKey)
+			}
+
+			body, err := newArchiveReader(item, itemKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer body.Close()
+
+			entries, err := readArchiveContents(body)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if contentsJSON {
+				err = printContentsJSON(os.Stdout, entries)
+			} else {
+				err = printContents(os.Stdout, entries)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	contentsCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches")
+	contentsCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(contentsCmd)
+	addTemplateFlags(contentsCmd)
+	addKeyFlags(contentsCmd)
+	contentsCmd.Flags().BoolVarP(&s3Anonymous, "anonymous", "", false, "Access the public S3 bucket without credentials")
+	contentsCmd.Flags().StringVarP(&ageIdentityFile, "age-identity-file", "", "", "age identity file to decrypt encrypted caches")
+	contentsCmd.Flags().StringVarP(&passphraseFile, "passphrase-file", "", "", "Decrypt encrypted caches with the passphrase in the file")
+	contentsCmd.Flags().BoolVarP(&contentsJSON, "json", "", false, "Print files as JSON")
+
+	rootCmd.AddCommand(contentsCmd)
+}
+
+// readArchiveContents streams the archive and returns its entries in order.
+// Their names are replaced with the paths they're restored to after metadata.json at the end is read.
+func readArchiveContents(r io.Reader) ([]archiveEntry, error) {
+	tr, err := openTarReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []archiveEntry
+	var meta *metadata
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar entry: %s", err)
+		}
+
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.ToSlash(hdr.Name), "./"), "/")
+		if name == "metadata.json" {
+			meta = new(metadata)
+			if err := json.NewDecoder(tr).Decode(meta); err != nil {
+				return nil, fmt.Errorf("invalid metadata.json: %s", err)
+			}
+			continue
+		}
+		// the directories of paths like 0000/ aren't restored as they are
+		if !strings.Contains(name, "/") {
+			continue
+		}
+
+		entry := archiveEntry{Path: name, Size: hdr.Size, Mode: hdr.FileInfo().Mode()}
+		if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink {
+			entry.Link = hdr.Linkname
+		}
+		entries = append(entries, entry)
+	}
+
+	if meta != nil {
+		for i := range entries {
+			if path, err := originalPath(entries[i].Path, meta.Paths); err == nil {
+				entries[i].Path = path
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+func printContents(w io.Writer, entries []archiveEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODE\tSIZE\tPATH")
+	for _, e := range entries {
+		path := e.Path
+		if e.Link != "" {
+			path += " -> " + e.Link
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Mode, formatSize(e.Size), path)
+	}
+
+	return tw.Flush()
+}
+
+func printContentsJSON(w io.Writer, entries []archiveEntry) error {
+	if entries == nil {
+		entries = []archiveEntry{}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(entries); err != nil {
+		return fmt.Errorf("failed to encode files as JSON: %s", err)
+	}
+
+	return nil
+}
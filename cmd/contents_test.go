@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadArchiveContents(t *testing.T) {
+	setupFixturesToCache(t)
+
+	buf := new(bytes.Buffer)
+	if _, err := writeArchive(buf, []string{"tmp/foo", "tmp/abc/def"}); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	entries, err := readArchiveContents(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read the archive: %s", err)
+	}
+
+	byPath := make(map[string]archiveEntry)
+	for _, e := range entries {
+		byPath[e.Path] = e
+	}
+	var paths []string
+	for _, e := range entries {
+		paths = append(paths, e.Path)
+	}
+	for _, path := range []string{"tmp/foo", "tmp/foo/hoge.txt", "tmp/foo/bar/baz/link", "tmp/abc/def/ghe"} {
+		if _, ok := byPath[filepath.FromSlash(path)]; !ok {
+			t.Fatalf("%s is not listed: %v", path, paths)
+		}
+	}
+
+	if e := byPath[filepath.FromSlash("tmp/foo/hoge.txt")]; e.Size != 12 || !e.Mode.IsRegular() {
+		t.Fatalf("entry of a file is wrong: %#v", e)
+	}
+	if e := byPath[filepath.FromSlash("tmp/foo/bar/baz/link")]; e.Link != "../../hoge.txt" || e.Mode&os.ModeSymlink == 0 {
+		t.Fatalf("entry of a symlink is wrong: %#v", e)
+	}
+	if len(entries) != len(byPath) {
+		t.Fatalf("entries are duplicated: %v", paths)
+	}
+}
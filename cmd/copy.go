@@ -0,0 +1,349 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+	"github.com/yuya-takeyama/guruguru-cache/template"
+)
+
+// maxCopyObjectSize is the largest object CopyObject can copy, and larger ones are copied by parts
+const maxCopyObjectSize = 5 << 30
+
+const copyPartSize = 512 << 20
+
+var destS3Bucket string
+var copyOverwrite bool
+
+func init() {
+	copyCmd := &cobra.Command{
+		Use:   "copy [flags] [source cache key] [destination cache key]",
+		Short: "Copy a cache to another key or bucket without downloading it",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupTemplate(); err != nil {
+				log.Fatal(err)
+			}
+
+			var keys []string
+			var err error
+			for _, key := range args {
+				cacheKey, err := template.ExecuteTemplate(key)
+				if err != nil {
+					log.Fatal(err)
+				}
+				keys = append(keys, cacheKey)
+			}
+
+			dstBucket := destS3Bucket
+			if dstBucket == "" {
+				dstBucket = s3Bucket
+			}
+			if dstBucket == s3Bucket && keys[0] == keys[1] {
+				log.Fatalf("source and destination are the same: %s", keys[0])
+			}
+
+			if !copyOverwrite {
+				exists, err := objectExistsInBucket(dstBucket, objectKey(prefixedKey(keys[1])))
+				if err != nil {
+					log.Fatal(err)
+				}
+				if exists {
+					log.Printf("cache already exists: %s\n", keys[1])
+					return
+				}
+			}
+
+			if copyOverwrite {
+				err = overwriteCache(keys[0], dstBucket, keys[1])
+			} else {
+				_, err = copyCache(keys[0], dstBucket, keys[1])
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			log.Printf("copied cache: %s to %s/%s\n", keys[0], dstBucket, keys[1])
+		},
+	}
+
+	copyCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of the source cache")
+	copyCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(copyCmd)
+	addTemplateFlags(copyCmd)
+	copyCmd.Flags().StringVarP(&destS3Bucket, "dest-bucket", "", "", "S3 bucket to copy the cache to (defaults to --s3-bucket)")
+	copyCmd.Flags().BoolVarP(&copyOverwrite, "overwrite", "", false, "Overwrite the destination cache if it exists")
+
+	rootCmd.AddCommand(copyCmd)
+}
+
+// overwriteCache copies the cache replacing the destination cache, and deletes the objects of the replaced cache
+// which aren't copied over like extra parts, per-path archives and the index.
+// They are told by the keys copied to instead of their versions, as copies of the same generation have the keys and ETags of the replaced objects.
+func overwriteCache(srcCacheKey string, dstBucket string, dstCacheKey string) error {
+	dstKey := prefixedKey(dstCacheKey)
+
+	var replaced *cacheEntry
+	err := inBucket(dstBucket, func() error {
+		exists, err := cacheExists(dstKey)
+		if err != nil || !exists {
+			return err
+		}
+		replaced, err = findCacheEntry(dstKey)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	copied, err := copyCache(srcCacheKey, dstBucket, dstCacheKey)
+	if err != nil || replaced == nil {
+		return err
+	}
+
+	copiedKeys := make(map[string]bool)
+	for _, key := range copied {
+		copiedKeys[key] = true
+	}
+	var stale []string
+	for _, object := range replaced.objects {
+		if key := aws.StringValue(object.Key); !copiedKeys[key] {
+			stale = append(stale, key)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	log.Printf("deleting %d stale objects of the replaced cache\n", len(stale))
+	return inBucket(dstBucket, func() error {
+		return deleteObjects(stale)
+	})
+}
+
+// inBucket runs fn with s3Bucket set to the bucket, for the functions of caches in s3Bucket
+func inBucket(bucket string, fn func() error) error {
+	defer func(original string) { s3Bucket = original }(s3Bucket)
+	s3Bucket = bucket
+
+	return fn()
+}
+
+// copyCache copies all the objects of the cache with server-side copies, returning the keys copied to.
+// The manifest object is copied last so that the destination cache never exists partially,
+// and objects of other generations not deleted yet are left out.
+func copyCache(srcCacheKey string, dstBucket string, dstCacheKey string) ([]string, error) {
+	caches, err := listCaches(srcCacheKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var src *cacheEntry
+	for _, c := range caches {
+		if c.Key == srcCacheKey {
+			src = c
+		}
+	}
+	if src == nil {
+		return nil, fmt.Errorf("cache is not found: %s", srcCacheKey)
+	}
+
+	srcKey := prefixedKey(srcCacheKey)
+	dstKey := prefixedKey(dstCacheKey)
+
+	generation, err := cacheGeneration(srcKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var copied []string
+	var manifest *s3.Object
+	for _, object := range src.objects {
+		key := aws.StringValue(object.Key)
+		if key == objectKey(srcKey) {
+			manifest = object
+			continue
+		}
+		if isOtherGeneration(strings.TrimPrefix(key, srcKey), generation) {
+			continue
+		}
+
+		copiedKey := dstKey + strings.TrimPrefix(key, srcKey)
+		if err := copyObject(object, dstBucket, copiedKey); err != nil {
+			return nil, err
+		}
+		copied = append(copied, copiedKey)
+	}
+
+	if dstBucket != s3Bucket {
+		if err := copyMissingChunks(srcKey, dstBucket); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := copyObject(manifest, dstBucket, objectKey(dstKey)); err != nil {
+		return nil, err
+	}
+
+	return append(copied, objectKey(dstKey)), nil
+}
+
+// copyMissingChunks copies the chunks of a chunked cache which the destination bucket doesn't have
+func copyMissingChunks(srcKey string, dstBucket string) error {
+	item, err := getExactlyMatchedItem(srcKey)
+	if err != nil {
+		return fmt.Errorf("failed to get cache: %s", err)
+	}
+
+	defer item.Body.Close()
+
+	if _, ok := item.Metadata[chunksMetadataKey]; !ok {
+		return nil
+	}
+
+	keys, err := chunkKeysFromManifest(item.Body)
+	if err != nil {
+		return err
+	}
+
+	copied := 0
+	for _, key := range keys {
+		exists, err := chunkExists(dstBucket, key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		if err := copyObject(&s3.Object{Key: aws.String(key)}, dstBucket, key); err != nil {
+			return err
+		}
+		copied++
+	}
+
+	log.Printf("Copied %d of %d chunks\n", copied, len(keys))
+
+	return nil
+}
+
+// copyObject copies the object of s3Bucket, copying by parts when it's too large for CopyObject
+func copyObject(src *s3.Object, dstBucket string, dstKey string) error {
+	if aws.Int64Value(src.Size) > maxCopyObjectSize {
+		return copyObjectByParts(src, dstBucket, dstKey)
+	}
+
+	_, err := s3Client.CopyObject(&s3.CopyObjectInput{
+		Bucket:     &dstBucket,
+		Key:        &dstKey,
+		CopySource: aws.String(copySource(s3Bucket, aws.StringValue(src.Key))),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy %s: %s", aws.StringValue(src.Key), err)
+	}
+
+	return nil
+}
+
+func copyObjectByParts(src *s3.Object, dstBucket string, dstKey string) error {
+	head, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &s3Bucket,
+		Key:    src.Key,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %s", aws.StringValue(src.Key), err)
+	}
+
+	// tags aren't copied by parts unlike CopyObject, which keeps the tag expired by lifecycle apply
+	tagging, err := s3Client.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket: &s3Bucket,
+		Key:    src.Key,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get tags of %s: %s", aws.StringValue(src.Key), err)
+	}
+
+	upload, err := s3Client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:       &dstBucket,
+		Key:          &dstKey,
+		ContentType:  head.ContentType,
+		Metadata:     head.Metadata,
+		StorageClass: head.StorageClass,
+		Tagging:      aws.String(encodeTags(tagging.TagSet)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start copying %s: %s", aws.StringValue(src.Key), err)
+	}
+
+	parts, err := uploadPartCopies(src, dstBucket, dstKey, upload.UploadId)
+	if err != nil {
+		s3Client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   &dstBucket,
+			Key:      &dstKey,
+			UploadId: upload.UploadId,
+		})
+		return err
+	}
+
+	_, err = s3Client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          &dstBucket,
+		Key:             &dstKey,
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete copying %s: %s", aws.StringValue(src.Key), err)
+	}
+
+	return nil
+}
+
+func uploadPartCopies(src *s3.Object, dstBucket string, dstKey string, uploadID *string) ([]*s3.CompletedPart, error) {
+	size := aws.Int64Value(src.Size)
+
+	var parts []*s3.CompletedPart
+	for start := int64(0); start < size; start += copyPartSize {
+		end := start + copyPartSize - 1
+		if end >= size {
+			end = size - 1
+		}
+
+		n := int64(len(parts) + 1)
+		output, err := s3Client.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          &dstBucket,
+			Key:             &dstKey,
+			UploadId:        uploadID,
+			PartNumber:      aws.Int64(n),
+			CopySource:      aws.String(copySource(s3Bucket, aws.StringValue(src.Key))),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		})
+		if err != nil {
+			return nil, markTransient(err, fmt.Errorf("failed to copy part %d of %s: %s", n, aws.StringValue(src.Key), err))
+		}
+
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       output.CopyPartResult.ETag,
+			PartNumber: aws.Int64(n),
+		})
+	}
+
+	return parts, nil
+}
+
+// copySource is the URL-encoded source of copies like "bucket/path/to/key"
+func copySource(bucket string, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return bucket + "/" + strings.Join(segments, "/")
+}
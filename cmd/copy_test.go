@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCopySource(t *testing.T) {
+	if source := copySource("example-cache", "org/repo/v1/gem v1+linux.tar.gz"); source != "example-cache/org/repo/v1/gem%20v1+linux.tar.gz" {
+		t.Fatalf("copy source is wrong: %s", source)
+	}
+}
+
+func TestOverwriteCache(t *testing.T) {
+	setupFixturesToCache(t)
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+
+	store := func(key string, partSize int64, paths []string) {
+		err := storeTarStream(prefixedKey(key), partSize, nil, func(w io.Writer) error {
+			return writeTar(w, paths)
+		})
+		if err != nil {
+			t.Fatalf("failed to store: %s", err)
+		}
+	}
+	// the replaced cache has more parts than the copied one
+	store("src", 1024, []string{"tmp/foo"})
+	store("dst", 256, []string{"tmp/foo", "tmp/abc"})
+
+	dstKeys := func() []string {
+		var keys []string
+		for _, key := range fake.keys() {
+			if strings.HasPrefix(key, prefixedKey("dst")) {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+	assertCopied := func() {
+		generation, err := cacheGeneration(prefixedKey("src"))
+		if err != nil {
+			t.Fatalf("failed to get the generation: %s", err)
+		}
+		for _, key := range dstKeys() {
+			if isOtherGeneration(strings.TrimPrefix(key, prefixedKey("dst")), generation) {
+				t.Fatalf("the object of the replaced cache is left: %s", key)
+			}
+		}
+
+		item, err := getExactlyMatchedItem(prefixedKey("dst"))
+		if err != nil {
+			t.Fatalf("failed to get the cache: %s", err)
+		}
+		body, err := newArchiveReader(item, objectKey(prefixedKey("dst")))
+		if err != nil {
+			t.Fatalf("failed to read the cache: %s", err)
+		}
+		defer body.Close()
+		_, paths, err := readArchiveDigests(body)
+		if err != nil {
+			t.Fatalf("failed to read the archive: %s", err)
+		}
+		if len(paths) != 1 || paths[0] != "tmp/foo" {
+			t.Fatalf("the cache isn't copied: %v", paths)
+		}
+	}
+
+	if err := overwriteCache("src", s3Bucket, "dst"); err != nil {
+		t.Fatalf("failed to overwrite the cache: %s", err)
+	}
+	assertCopied()
+	copied := dstKeys()
+
+	// copying the same generation again keeps the objects copied over the replaced ones
+	if err := overwriteCache("src", s3Bucket, "dst"); err != nil {
+		t.Fatalf("failed to overwrite the cache: %s", err)
+	}
+	assertCopied()
+	if keys := dstKeys(); !reflect.DeepEqual(keys, copied) {
+		t.Fatalf("the copied objects are deleted: %v", keys)
+	}
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+)
+
+// dedupPAXKey marks a hard link entry of a file which has the same content as the linked one but is another file,
+// which is restored as a copy instead of a hard link
+const dedupPAXKey = "GURUGURU.dedup"
+
+var dedupFiles bool
+
+// dedupIndex finds files written before with the same content, comparing checksums only of files with the same size
+type dedupIndex struct {
+	bySize map[int64][]dedupCandidate
+}
+
+// dedupCandidate is a file written with its content, without keeping the content read ahead
+type dedupCandidate struct {
+	name string
+	sum  string
+}
+
+func newDedupIndex() *dedupIndex {
+	return &dedupIndex{bySize: make(map[int64][]dedupCandidate)}
+}
+
+// link makes the entry a link to the entry written before with the same content if any.
+// The checksum is computed here only when it isn't by the workers reading files ahead.
+func (x *dedupIndex) link(e *pathEntry) error {
+	// empty files are as small as hard links
+	if !e.isContent() || e.info.Size() == 0 {
+		return nil
+	}
+
+	candidates := x.bySize[e.info.Size()]
+	if len(candidates) == 0 {
+		return nil
+	}
+	if e.err != nil {
+		return e.err
+	}
+
+	if e.sum == "" {
+		sum, err := fileSHA256(e.path)
+		if err != nil {
+			return err
+		}
+		e.sum = sum
+	}
+	for _, c := range candidates {
+		if c.sum == e.sum {
+			e.header.Typeflag = tar.TypeLink
+			e.header.Linkname = c.name
+			e.header.Size = 0
+			e.header.PAXRecords = map[string]string{dedupPAXKey: "1"}
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// add records the entry written with its content and checksum, which later files can be links to
+func (x *dedupIndex) add(e *pathEntry) {
+	if !e.isContent() || e.info.Size() == 0 {
+		return
+	}
+
+	x.bySize[e.info.Size()] = append(x.bySize[e.info.Size()], dedupCandidate{name: e.header.Name, sum: e.sum})
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %s", err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("failed to read file: %s", err)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// copyDedupFile restores the file of a deduplicated entry as a copy of the file extracted before
+func copyDedupFile(src string, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open deduplicated file: %s", err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return fmt.Errorf("failed to create a file: %s", err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to copy deduplicated file: %s", err)
+	}
+
+	return out.Close()
+}
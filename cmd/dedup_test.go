@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCreateTarWithDedup(t *testing.T) {
+	setupFixturesToCache(t)
+	defer func(original bool) { dedupFiles = original }(dedupFiles)
+	dedupFiles = true
+
+	// the same content as tmp/foo/hoge.txt, and the same size with another content
+	if err := ioutil.WriteFile("tmp/abc/copy.txt", []byte("This is foo!"), 0755); err != nil {
+		t.Fatalf("failed to create a file: %s", err)
+	}
+	if err := ioutil.WriteFile("tmp/abc/other.txt", []byte("This is abc!"), 0644); err != nil {
+		t.Fatalf("failed to create a file: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := writeTarFile(filepath.Join(dir, "test.tar"), []string{"tmp/foo", "tmp/abc"}); err != nil {
+		t.Fatalf("failed to write a tar: %s", err)
+	}
+
+	hdrs := loadTarHeadersAndContents(t, filepath.Join(dir, "test.tar"))
+	copied := hdrs["0001/abc/copy.txt"].Header
+	if copied.Typeflag != tar.TypeLink || copied.Linkname != "0000/foo/hoge.txt" || copied.PAXRecords[dedupPAXKey] == "" {
+		t.Fatalf("the file with the same content isn't deduplicated: %#v", copied)
+	}
+	if hdrs["0001/abc/other.txt"].Content != "This is abc!" {
+		t.Fatalf("the file with another content is deduplicated: %#v", hdrs["0001/abc/other.txt"].Header)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "test.tar"))
+	if err != nil {
+		t.Fatalf("failed to open the tar: %s", err)
+	}
+	defer file.Close()
+
+	extracted := filepath.Join(dir, "extracted")
+	if err := os.Mkdir(extracted, 0755); err != nil {
+		t.Fatalf("failed to create a directory: %s", err)
+	}
+	extractCache(extracted, file)
+
+	content, err := ioutil.ReadFile(filepath.Join(extracted, "0001/abc/copy.txt"))
+	if err != nil || string(content) != "This is foo!" {
+		t.Fatalf("the deduplicated file isn't restored: %s: %v", content, err)
+	}
+
+	original, err := os.Stat(filepath.Join(extracted, "0000/foo/hoge.txt"))
+	if err != nil {
+		t.Fatalf("failed to stat the restored file: %s", err)
+	}
+	copiedInfo, err := os.Stat(filepath.Join(extracted, "0001/abc/copy.txt"))
+	if err != nil {
+		t.Fatalf("failed to stat the restored file: %s", err)
+	}
+	if os.SameFile(original, copiedInfo) {
+		t.Fatalf("the deduplicated file is restored as a hard link")
+	}
+	if copiedInfo.Mode().Perm()&0100 == 0 {
+		t.Fatalf("the mode of the deduplicated file is lost: %s", copiedInfo.Mode())
+	}
+}
+
+func TestCreateTarWithDedupReadAhead(t *testing.T) {
+	setupFixturesToCache(t)
+	defer func(original bool) { dedupFiles = original }(dedupFiles)
+	dedupFiles = true
+	defer func(original int) { readConcurrency = original }(readConcurrency)
+
+	// large files are hashed by the workers without being read ahead
+	large := bytes.Repeat([]byte("0123456789"), readAheadSize/5)
+	files := map[string][]byte{
+		"tmp/abc/large.bin":         large,
+		"tmp/abc/def/large.bin":     large,
+		"tmp/abc/def/other.bin":     bytes.Repeat([]byte("9876543210"), readAheadSize/5),
+		"tmp/abc/def/ghe/large.bin": large,
+		"tmp/abc/def/ghe/copy.txt":  []byte("This is foo!"),
+	}
+	for path, content := range files {
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatalf("failed to create a file: %s", err)
+		}
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		readConcurrency = concurrency
+		buf := new(bytes.Buffer)
+		if err := writeTar(buf, []string{"tmp/foo", "tmp/abc"}); err != nil {
+			t.Fatalf("failed to write a tar: %s", err)
+		}
+
+		links := make(map[string]string)
+		contents := make(map[string]int)
+		tr := tar.NewReader(buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("failed to read the tar: %s", err)
+			}
+			if hdr.Typeflag == tar.TypeLink && hdr.PAXRecords[dedupPAXKey] != "" {
+				links[hdr.Name] = hdr.Linkname
+			} else if hdr.Typeflag == tar.TypeReg {
+				contents[hdr.Name] = int(hdr.Size)
+			}
+		}
+
+		// files are walked in lexical order, where the first one of the same content has it
+		expected := map[string]string{
+			"0001/abc/def/ghe/copy.txt": "0000/foo/hoge.txt",
+			"0001/abc/def/large.bin":    "0001/abc/def/ghe/large.bin",
+			"0001/abc/large.bin":        "0001/abc/def/ghe/large.bin",
+		}
+		if !reflect.DeepEqual(links, expected) {
+			t.Fatalf("files are deduplicated wrongly with --read-concurrency %d: %v", concurrency, links)
+		}
+		if contents["0001/abc/def/ghe/large.bin"] != len(large) {
+			t.Fatalf("the first large file doesn't have the content with --read-concurrency %d", concurrency)
+		}
+		if _, ok := contents["0001/abc/def/other.bin"]; !ok {
+			t.Fatalf("the file with another content is deduplicated with --read-concurrency %d", concurrency)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/yuya-takeyama/guruguru-cache/template"
+)
+
+// baseMetadataKey is the S3 metadata key of the checksum object of the base cache a delta cache has the changes since,
+// so that prune keeps the base without reading the archive
+const baseMetadataKey = "Base"
+
+var storeBase string
+
+// deltaBase is the key of the base cache the cache being stored has only the changes since, recorded in its metadata
+var deltaBase string
+
+// deltaBaseSHA256 and deltaBaseETag identify the version of the base cache, so that restore doesn't apply the changes
+// to the base cache overwritten since
+var deltaBaseSHA256, deltaBaseETag string
+
+// deltaFiles are the files added or changed since the base cache, which are the only files stored with directories
+var deltaFiles map[string]bool
+
+// deltaRemoved are the paths of files and directories removed since the base cache, recorded in the metadata
+var deltaRemoved []string
+
+// prepareDelta compares the paths with the cache of --base, so that only the files changed since it are stored.
+// The full cache is stored instead when the base cache isn't found.
+func prepareDelta(paths []string) error {
+	deltaBase, deltaBaseSHA256, deltaBaseETag, deltaFiles, deltaRemoved = "", "", "", nil, nil
+
+	if perPath {
+		return fmt.Errorf("--base can't be used with --per-path")
+	}
+	if dereference {
+		return fmt.Errorf("--base can't be used with --dereference")
+	}
+
+	baseKey, err := template.ExecuteTemplate(storeBase)
+	if err != nil {
+		return err
+	}
+	found, err := findCacheKey([]string{prefixedKey(baseKey)})
+	if err != nil {
+		return err
+	}
+	if found == "" {
+		log.Printf("base cache is not found, storing the full cache: %s\n", baseKey)
+		return nil
+	}
+
+	item, err := getExactlyMatchedItem(found)
+	if err != nil {
+		return fmt.Errorf("failed to get base cache: %s", err)
+	}
+	if isPathArchivesManifest(item) {
+		item.Body.Close()
+		return fmt.Errorf("cache of per-path archives can't be the base: %s", found)
+	}
+
+	log.Printf("Comparing files with the base cache: %s\n", found)
+	body, err := newArchiveReader(item, objectKey(found))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	archived, meta, _, err := readArchiveMetadataDigests(body)
+	if err != nil {
+		return err
+	}
+	if meta.Base != "" {
+		return fmt.Errorf("base cache has only files changed since another cache, which can't be the base: %s", found)
+	}
+	sum, err := storedChecksum(found, objectGeneration(item.Metadata))
+	if err != nil {
+		return err
+	}
+
+	local, err := localDigests(paths)
+	if err != nil {
+		return err
+	}
+
+	deltaFiles = make(map[string]bool)
+	for _, c := range diffDigests(archived, local) {
+		if c.status == fileRemoved {
+			deltaRemoved = append(deltaRemoved, c.path)
+		} else {
+			deltaFiles[c.path] = true
+		}
+	}
+	deltaBase = strings.TrimPrefix(found, prefixedKey(""))
+	deltaBaseSHA256, deltaBaseETag = sum, aws.StringValue(item.ETag)
+	log.Printf("Storing %d added or changed and %d removed files since the base cache\n", len(deltaFiles), len(deltaRemoved))
+
+	return nil
+}
+
+// inDelta reports whether the file is stored in the cache, where directories are always stored as they're small
+func inDelta(path string, info os.FileInfo) bool {
+	return deltaFiles == nil || info.IsDir() || deltaFiles[path]
+}
+
+// deltaMetadata returns the metadata of the checksum object of the cache being stored with the base cache, or nil without it
+func deltaMetadata(metadata map[string]*string) map[string]*string {
+	if deltaBase == "" {
+		return metadata
+	}
+
+	withBase := map[string]*string{baseMetadataKey: aws.String(deltaBase)}
+	for k, v := range metadata {
+		withBase[k] = v
+	}
+
+	return withBase
+}
+
+// storedDeltaBase returns the base cache recorded with the checksum of the cache, which is empty for caches other than delta ones
+func storedDeltaBase(cacheKey string) (string, error) {
+	head, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &s3Bucket,
+		Key:    aws.String(checksumKey(cacheKey)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("failed to get checksum of cache: %s", err)
+	}
+
+	return aws.StringValue(head.Metadata[baseMetadataKey]), nil
+}
+
+// keepBaseFromExpiring removes the tag of lifecycle apply from the objects of the base cache, which delta caches need
+// as long as they exist. prune deletes the base once no delta cache refers to it.
+func keepBaseFromExpiring(baseKey string) error {
+	base, err := findCacheEntry(prefixedKey(baseKey))
+	if err != nil {
+		return err
+	}
+
+	for _, object := range base.objects {
+		output, err := s3Client.GetObjectTagging(&s3.GetObjectTaggingInput{
+			Bucket: &s3Bucket,
+			Key:    object.Key,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get tags of %s: %s", aws.StringValue(object.Key), err)
+		}
+
+		tags, err := mergeTags(output.TagSet, nil, []string{expiringTagKey})
+		if err != nil {
+			return err
+		}
+		if len(tags) == len(output.TagSet) {
+			continue
+		}
+
+		if len(tags) == 0 {
+			_, err = s3Client.DeleteObjectTagging(&s3.DeleteObjectTaggingInput{
+				Bucket: &s3Bucket,
+				Key:    object.Key,
+			})
+		} else {
+			_, err = s3Client.PutObjectTagging(&s3.PutObjectTaggingInput{
+				Bucket:  &s3Bucket,
+				Key:     object.Key,
+				Tagging: &s3.Tagging{TagSet: tags},
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to put tags of %s: %s", aws.StringValue(object.Key), err)
+		}
+	}
+
+	return nil
+}
+
+// verifyDeltaBase reports whether the base cache is the version the cache has the changes since,
+// by its checksum or the ETag of its object for bases without checksums. Caches stored by older versions record neither.
+func verifyDeltaBase(meta *metadata, baseKey string, item *s3.GetObjectOutput) (bool, error) {
+	if meta.BaseSHA256 != "" {
+		sum, err := storedChecksum(baseKey, objectGeneration(item.Metadata))
+		if err != nil {
+			return false, err
+		}
+
+		return sum == meta.BaseSHA256, nil
+	}
+	if meta.BaseETag != "" {
+		return aws.StringValue(item.ETag) == meta.BaseETag, nil
+	}
+
+	return true, nil
+}
+
+// restoreDelta restores the base cache and then the files of the paths extracted in dir over it, removing the removed ones.
+// Nothing is restored when the base cache isn't found or is overwritten since, as the cache has only a part of the files,
+// and it exits with the code of cache misses like exists.
+func restoreDelta(dir string, meta *metadata) {
+	baseKey := prefixedKey(meta.Base)
+	item, err := headItem(objectKey(baseKey))
+	if err != nil {
+		log.Printf("base cache is not found, no cache is restored: %s: %s\n", meta.Base, err)
+		os.RemoveAll(dir)
+		os.Exit(cacheMissExitCode)
+	}
+	if isPathArchivesManifest(item) {
+		item.Body.Close()
+		log.Fatalf("cache of per-path archives can't be the base: %s", meta.Base)
+	}
+	verified, err := verifyDeltaBase(meta, baseKey, item)
+	if err != nil {
+		item.Body.Close()
+		log.Fatal(err)
+	}
+	if !verified {
+		item.Body.Close()
+		log.Printf("base cache is overwritten since the cache is stored, no cache is restored: %s\n", meta.Base)
+		os.RemoveAll(dir)
+		os.Exit(cacheMissExitCode)
+	}
+
+	// paths which already exist are skipped by the base cache, and then they exist anyway
+	skipped := make(map[string]bool)
+	for _, path := range meta.Paths {
+		if path = restoredPath(meta, path); skipExisting && pathExists(path) {
+			skipped[path] = true
+		}
+	}
+
+	log.Printf("Restoring the base cache: %s\n", meta.Base)
+	baseDir := filepath.Join(dir, "base")
+	if err := os.Mkdir(baseDir, 0755); err != nil {
+		log.Fatalf("failed to create a directory: %s", err)
+	}
+	file := downloadCache(baseDir, item, objectKey(baseKey))
+	defer file.Close()
+	extractCache(baseDir, file)
+	moveToOriginalPaths(baseDir)
+
+	for i, path := range meta.Paths {
+		path = restoredPath(meta, path)
+		if skipped[path] {
+			continue
+		}
+
+		from := filepath.Join(dir, fmt.Sprintf("%04d", i), filepath.Base(meta.Paths[i]))
+		if err := mergeFiles(from, path); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, path := range meta.Removed {
+		if err := os.RemoveAll(restoredPath(meta, path)); err != nil {
+			log.Fatalf("failed to remove a removed file: %s: %s", path, err)
+		}
+	}
+}
+
+// mergeFiles moves the extracted files under from to the path, replacing the ones there and keeping the others
+func mergeFiles(from string, path string) error {
+	return filepath.Walk(from, func(src string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to traverse files: %s", err)
+		}
+
+		dst := filepath.Join(path, strings.TrimPrefix(src, from))
+		if info.IsDir() {
+			if current, err := os.Lstat(dst); err == nil && !current.IsDir() {
+				if err := os.Remove(dst); err != nil {
+					return fmt.Errorf("failed to remove current file: %s: %s", dst, err)
+				}
+			}
+			if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+				return fmt.Errorf("failed to create a directory: %s", err)
+			}
+			return nil
+		}
+
+		if err := movePath(src, dst); err != nil {
+			return fmt.Errorf("failed to move file: %s", err)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestWriteTarWithDelta(t *testing.T) {
+	setupFixturesToCache(t)
+	defer func(original map[string]bool) { deltaFiles = original }(deltaFiles)
+	defer func(original string) { deltaBase = original }(deltaBase)
+	defer func(original string) { deltaBaseSHA256 = original }(deltaBaseSHA256)
+
+	deltaFiles = map[string]bool{"tmp/foo/hoge.txt": true}
+	deltaBase = "base"
+	deltaBaseSHA256 = "abc"
+
+	buf := new(bytes.Buffer)
+	if err := writeTar(buf, []string{"tmp/foo"}); err != nil {
+		t.Fatalf("failed to write tar: %s", err)
+	}
+
+	if _, _, err := readArchiveDigests(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatalf("the cache with only changed files is compared")
+	}
+
+	digests, meta, _, err := readArchiveMetadataDigests(buf)
+	if err != nil {
+		t.Fatalf("failed to read tar: %s", err)
+	}
+	if meta.Base != "base" || meta.BaseSHA256 != "abc" {
+		t.Fatalf("the base cache isn't recorded: %s, %s", meta.Base, meta.BaseSHA256)
+	}
+	if _, ok := digests["tmp/foo/hoge.txt"]; !ok {
+		t.Fatalf("the changed file isn't stored")
+	}
+	if _, ok := digests["tmp/foo/bar/baz"]; !ok {
+		t.Fatalf("the directory isn't stored")
+	}
+	if _, ok := digests["tmp/foo/bar/baz/link"]; ok {
+		t.Fatalf("the unchanged file is stored")
+	}
+}
+
+func TestMergeFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"from/foo/changed.txt":   "new",
+		"from/foo/added/new.txt": "added",
+		"path/foo/changed.txt":   "old",
+		"path/foo/kept.txt":      "kept",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create a directory: %s", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to create a file: %s", err)
+		}
+	}
+
+	if err := mergeFiles(filepath.Join(dir, "from/foo"), filepath.Join(dir, "path/foo")); err != nil {
+		t.Fatalf("failed to merge files: %s", err)
+	}
+
+	expected := map[string]string{
+		"path/foo/changed.txt":   "new",
+		"path/foo/added/new.txt": "added",
+		"path/foo/kept.txt":      "kept",
+	}
+	for name, content := range expected {
+		actual, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(actual) != content {
+			t.Fatalf("the merged file %s is wrong: %s: %v", name, actual, err)
+		}
+	}
+}
+
+func TestVerifyDeltaBase(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+
+	baseKey := prefixedKey("base")
+	fake.put(checksumKey(baseKey), []byte("abc"), nil)
+	item := &s3.GetObjectOutput{ETag: aws.String(`"etag"`)}
+
+	cases := []struct {
+		meta     metadata
+		expected bool
+	}{
+		{metadata{BaseSHA256: "abc", BaseETag: `"other"`}, true},
+		{metadata{BaseSHA256: "def", BaseETag: `"etag"`}, false},
+		{metadata{BaseETag: `"etag"`}, true},
+		{metadata{BaseETag: `"other"`}, false},
+		// caches stored by older versions
+		{metadata{}, true},
+	}
+	for _, c := range cases {
+		verified, err := verifyDeltaBase(&c.meta, baseKey, item)
+		if err != nil {
+			t.Fatalf("failed to verify the base: %s", err)
+		}
+		if verified != c.expected {
+			t.Fatalf("the base with %+v is wrongly verified: %v", c.meta, verified)
+		}
+	}
+}
+
+func TestKeepBaseFromExpiring(t *testing.T) {
+	_, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original []string) { tags = original }(tags)
+
+	tags = []string{"team=web"}
+	for _, key := range []string{"base.tar.gz", "base.sha256"} {
+		if err := uploadToS3(prefixedKey(key), strings.NewReader(key), nil); err != nil {
+			t.Fatalf("failed to upload: %s", err)
+		}
+	}
+	tags = nil
+	if err := uploadToS3(prefixedKey("base.index.json"), strings.NewReader("{}"), nil); err != nil {
+		t.Fatalf("failed to upload: %s", err)
+	}
+
+	if err := keepBaseFromExpiring("base"); err != nil {
+		t.Fatalf("failed to keep the base: %s", err)
+	}
+
+	expected := map[string][]string{
+		"base.tar.gz":     {"team=web"},
+		"base.sha256":     {"team=web"},
+		"base.index.json": nil,
+	}
+	for key, pairs := range expected {
+		output, err := s3Client.GetObjectTagging(&s3.GetObjectTaggingInput{Bucket: &s3Bucket, Key: aws.String(prefixedKey(key))})
+		if err != nil {
+			t.Fatalf("failed to get tags: %s", err)
+		}
+		var actual []string
+		for _, tag := range output.TagSet {
+			actual = append(actual, aws.StringValue(tag.Key)+"="+aws.StringValue(tag.Value))
+		}
+		if !reflect.DeepEqual(actual, pairs) {
+			t.Fatalf("the tags of %s are wrong: %v", key, actual)
+		}
+	}
+}
+
+func TestWithoutBases(t *testing.T) {
+	caches := []*cacheEntry{{Key: "base"}, {Key: "delta"}, {Key: "other-base"}, {Key: "other-delta"}, {Key: "old"}}
+	refs := &cacheRefs{bases: map[string]string{"delta": "base", "other-delta": "other-base"}}
+
+	var actual []string
+	for _, c := range refs.withoutBases(caches, []*cacheEntry{caches[0], caches[2], caches[3], caches[4]}) {
+		actual = append(actual, c.Key)
+	}
+	if !reflect.DeepEqual(actual, []string{"other-base", "other-delta", "old"}) {
+		t.Fatalf("the pruned caches are wrong: %v", actual)
+	}
+}
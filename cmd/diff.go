@@ -0,0 +1,286 @@
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// fileDigest is what diff compares of a file, where sum is the MD5 checksum of regular files
+type fileDigest struct {
+	typeflag byte
+	mode     os.FileMode
+	size     int64
+	sum      string
+	linkname string
+}
+
+// fileChange is a file added, removed or changed in local paths since the cache is stored
+type fileChange struct {
+	status string
+	path   string
+}
+
+const (
+	fileAdded   = "A"
+	fileRemoved = "D"
+	fileChanged = "M"
+)
+
+func init() {
+	diffCmd := &cobra.Command{
+		Use:   "diff [flags] [cache keys...]",
+		Short: "Compare the local paths with the cache stored with keys",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupTemplate(); err != nil {
+				log.Fatal(err)
+			}
+
+			cacheKeys, err := renderCacheKeys(args)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			item, itemKey := findCache(cacheKeys)
+			if item == nil {
+				log.Println("no cache is found")
+				os.Exit(cacheMissExitCode)
+			}
+			if isPathArchivesManifest(item) {
+				item.Body.Close()
+				log.Fatalf("cache of per-path archives can't be compared: %s", itemKey)
+			}
+
+			body, err := newArchiveReader(item, itemKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer body.Close()
+
+			archived, paths, err := readArchiveDigests(body)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			local, err := localDigests(paths)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			changes := diffDigests(archived, local)
+			for _, c := range changes {
+				fmt.Printf("%s %s\n", c.status, c.path)
+			}
+			log.Printf("%d files are changed since %s\n", len(changes), itemKey)
+		},
+	}
+
+	diffCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches")
+	diffCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(diffCmd)
+	addTemplateFlags(diffCmd)
+	addKeyFlags(diffCmd)
+	diffCmd.Flags().BoolVarP(&s3Anonymous, "anonymous", "", false, "Access the public S3 bucket without credentials")
+	diffCmd.Flags().StringVarP(&ageIdentityFile, "age-identity-file", "", "", "age identity file to decrypt encrypted caches")
+	diffCmd.Flags().StringVarP(&passphraseFile, "passphrase-file", "", "", "Decrypt encrypted caches with the passphrase in the file")
+
+	rootCmd.AddCommand(diffCmd)
+}
+
+// readArchiveDigests reads the archive and returns the digests of its files by the paths they're restored to, with the paths of the cache.
+// Caches stored with --base have only files changed since the base, so they can't be compared.
+func readArchiveDigests(r io.Reader) (map[string]fileDigest, []string, error) {
+	digests, meta, paths, err := readArchiveMetadataDigests(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta.Base != "" {
+		return nil, nil, fmt.Errorf("cache has only files changed since the base cache: %s", meta.Base)
+	}
+
+	return digests, paths, nil
+}
+
+// readArchiveMetadataDigests reads the archive like readArchiveDigests, returning its metadata too
+func readArchiveMetadataDigests(r io.Reader) (map[string]fileDigest, *metadata, []string, error) {
+	tr, err := openTarReader(r)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	entries := make(map[string]fileDigest)
+	var meta *metadata
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read tar entry: %s", err)
+		}
+
+		name := strings.TrimPrefix(filepath.ToSlash(hdr.Name), "./")
+		if name == "metadata.json" {
+			meta = new(metadata)
+			if err := json.NewDecoder(tr).Decode(meta); err != nil {
+				return nil, nil, nil, fmt.Errorf("invalid metadata.json: %s", err)
+			}
+			continue
+		}
+		if name == manifestName {
+			continue
+		}
+
+		d := fileDigest{typeflag: hdr.Typeflag, mode: os.FileMode(hdr.Mode).Perm(), linkname: hdr.Linkname}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+			h := md5.New()
+			if d.size, err = io.Copy(h, tr); err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to read %s: %s", hdr.Name, err)
+			}
+			d.typeflag = tar.TypeReg
+			d.sum = fmt.Sprintf("%x", h.Sum(nil))
+		case tar.TypeLink:
+			// hard links have the content of the entry linked first
+			target, ok := entries[strings.TrimPrefix(filepath.ToSlash(hdr.Linkname), "./")]
+			if !ok {
+				return nil, nil, nil, fmt.Errorf("target of hard link is not found: %s", hdr.Name)
+			}
+			d = target
+			// deduplicated files are copies with their own modes
+			if hdr.PAXRecords[dedupPAXKey] != "" {
+				d.mode = os.FileMode(hdr.Mode).Perm()
+			}
+		}
+		// the directories of paths like 0000/ aren't restored as they are
+		if name = strings.TrimSuffix(name, "/"); strings.Contains(name, "/") {
+			entries[name] = d
+		}
+	}
+
+	if meta == nil {
+		return nil, nil, nil, fmt.Errorf("metadata.json is missing")
+	}
+
+	paths := make([]string, len(meta.Paths))
+	for i, path := range meta.Paths {
+		paths[i] = restoredPath(meta, path)
+	}
+
+	digests := make(map[string]fileDigest)
+	for name, d := range entries {
+		path, err := originalPath(name, paths)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		digests[path] = d
+	}
+
+	return digests, meta, paths, nil
+}
+
+// originalPath returns the path an entry like 0000/foo/bar is restored to
+func originalPath(name string, paths []string) (string, error) {
+	kv := strings.SplitN(name, "/", 2)
+	i, err := strconv.Atoi(kv[0])
+	if err != nil || i >= len(paths) || len(kv) < 2 {
+		return "", fmt.Errorf("entry is not under the directory of a path: %s", name)
+	}
+
+	return filepath.Join(filepath.Dir(paths[i]), filepath.FromSlash(kv[1])), nil
+}
+
+// localDigests returns the digests of the files under the paths, where missing paths are skipped
+func localDigests(paths []string) (map[string]fileDigest, error) {
+	digests := make(map[string]fileDigest)
+	for _, root := range paths {
+		if !pathExists(root) {
+			continue
+		}
+
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return fmt.Errorf("failed to traverse files: %s", err)
+			}
+
+			d := fileDigest{mode: info.Mode().Perm()}
+			switch {
+			case info.IsDir():
+				d.typeflag = tar.TypeDir
+			case info.Mode()&os.ModeSymlink != 0:
+				d.typeflag = tar.TypeSymlink
+				if d.linkname, err = os.Readlink(path); err != nil {
+					return fmt.Errorf("failed to read symlink: %s", err)
+				}
+			case info.Mode().IsRegular():
+				d.typeflag = tar.TypeReg
+				d.size = info.Size()
+				if d.sum, err = localFileChecksum(path); err != nil {
+					return err
+				}
+			default:
+				return nil
+			}
+			digests[path] = d
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return digests, nil
+}
+
+func localFileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %s", err)
+	}
+	defer file.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("failed to read file: %s", err)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// diffDigests returns the changes from the archived files to the local ones sorted by paths.
+// Directories are reported only when they are added or removed.
+func diffDigests(archived map[string]fileDigest, local map[string]fileDigest) []fileChange {
+	var changes []fileChange
+	for path, a := range archived {
+		l, ok := local[path]
+		if !ok {
+			changes = append(changes, fileChange{fileRemoved, path})
+		} else if a.typeflag != l.typeflag || (a.typeflag != tar.TypeDir && a != l) {
+			changes = append(changes, fileChange{fileChanged, path})
+		}
+	}
+	for path := range local {
+		if _, ok := archived[path]; !ok {
+			changes = append(changes, fileChange{fileAdded, path})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].path < changes[j].path
+	})
+
+	return changes
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiffDigests(t *testing.T) {
+	setupFixturesToCache(t)
+
+	buf := new(bytes.Buffer)
+	if _, err := writeArchive(buf, []string{"tmp/foo", "tmp/abc/def"}); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	archived, paths, err := readArchiveDigests(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read the archive: %s", err)
+	}
+	if !reflect.DeepEqual(paths, []string{"tmp/foo", "tmp/abc/def"}) {
+		t.Fatalf("paths are wrong: %v", paths)
+	}
+
+	local, err := localDigests(paths)
+	if err != nil {
+		t.Fatalf("failed to read local files: %s", err)
+	}
+	if changes := diffDigests(archived, local); len(changes) != 0 {
+		t.Fatalf("unchanged files are reported: %v", changes)
+	}
+
+	if err := ioutil.WriteFile("tmp/foo/hoge.txt", []byte("This is changed!"), 0644); err != nil {
+		t.Fatalf("failed to write a file: %s", err)
+	}
+	if err := ioutil.WriteFile("tmp/abc/def/new.txt", []byte("new"), 0644); err != nil {
+		t.Fatalf("failed to write a file: %s", err)
+	}
+	if err := os.Remove("tmp/foo/bar/baz/link"); err != nil {
+		t.Fatalf("failed to remove a symlink: %s", err)
+	}
+
+	local, err = localDigests(paths)
+	if err != nil {
+		t.Fatalf("failed to read local files: %s", err)
+	}
+	expected := []fileChange{
+		{fileAdded, filepath.Join("tmp", "abc", "def", "new.txt")},
+		{fileRemoved, filepath.Join("tmp", "foo", "bar", "baz", "link")},
+		{fileChanged, filepath.Join("tmp", "foo", "hoge.txt")},
+	}
+	if changes := diffDigests(archived, local); !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("changes are wrong: %v", changes)
+	}
+}
+
+func TestOriginalPath(t *testing.T) {
+	paths := []string{"tmp/foo", "/var/cache/abc"}
+
+	for name, expected := range map[string]string{
+		"0000/foo/hoge.txt": filepath.Join("tmp", "foo", "hoge.txt"),
+		"0001/abc":          filepath.Join("/var/cache", "abc"),
+	} {
+		path, err := originalPath(name, paths)
+		if err != nil {
+			t.Fatalf("failed to get original path of %s: %s", name, err)
+		}
+		if path != expected {
+			t.Fatalf("original path of %s is wrong: %s", name, path)
+		}
+	}
+
+	for _, name := range []string{"0002/foo", "foo/bar", "0000"} {
+		if _, err := originalPath(name, paths); err == nil {
+			t.Fatalf("original path of %s is returned", name)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// freeSpace returns the bytes available to unprivileged users in the file system of the path
+func freeSpace(path string) (uint64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, false
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), true
+}
+
+// isCrossDevice reports whether renaming failed because the paths are in different file systems
+func isCrossDevice(err error) bool {
+	lerr, ok := err.(*os.LinkError)
+	return ok && lerr.Err == syscall.EXDEV
+}
@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// errorNotSameDevice is ERROR_NOT_SAME_DEVICE of renaming files to another drive
+const errorNotSameDevice = syscall.Errno(17)
+
+// freeSpace is unknown on Windows
+func freeSpace(path string) (uint64, bool) {
+	return 0, false
+}
+
+// isCrossDevice reports whether renaming failed because the paths are in different drives
+func isCrossDevice(err error) bool {
+	lerr, ok := err.(*os.LinkError)
+	return ok && lerr.Err == errorNotSameDevice
+}
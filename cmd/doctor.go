@@ -0,0 +1,315 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/spf13/cobra"
+)
+
+// minTempDirSpace is the free space of the temporary directory below which doctor warns
+const minTempDirSpace = 1 << 30
+
+// maxClockSkew is the clock skew above which doctor fails, as S3 rejects requests skewed by 15 minutes
+const maxClockSkew = 5 * time.Minute
+
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// checkResult is the result of a check of doctor with a hint to fix the problem
+type checkResult struct {
+	name   string
+	status string
+	detail string
+	hint   string
+}
+
+func init() {
+	doctorCmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check credentials, permissions of the S3 bucket and the environment",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+
+			failed := false
+			for _, r := range runDoctor() {
+				fmt.Printf("[%s] %s: %s\n", r.status, r.name, r.detail)
+				if r.hint != "" {
+					fmt.Printf("       %s\n", r.hint)
+				}
+				if r.status == checkFail {
+					failed = true
+				}
+			}
+
+			if failed {
+				os.Exit(1)
+			}
+		},
+	}
+
+	doctorCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches")
+	doctorCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(doctorCmd)
+	doctorCmd.Flags().BoolVarP(&s3Anonymous, "anonymous", "", false, "Access the public S3 bucket without credentials")
+	addTmpDirFlag(doctorCmd)
+
+	rootCmd.AddCommand(doctorCmd)
+}
+
+// runDoctor runs the checks in order, skipping the ones of S3 after the bucket is found unreachable
+func runDoctor() []checkResult {
+	results := []checkResult{checkCredentials()}
+	if results[0].status == checkFail {
+		return append(results, checkTempDir())
+	}
+
+	bucket, date := checkBucket()
+	results = append(results, bucket)
+	if date != "" {
+		results = append(results, checkClockSkew(date, time.Now()))
+	}
+	if bucket.status != checkFail {
+		results = append(results, checkList())
+		results = append(results, checkPutGet()...)
+	}
+
+	return append(results, checkTempDir())
+}
+
+func checkCredentials() checkResult {
+	r := checkResult{name: "credentials"}
+	if s3Anonymous {
+		r.status, r.detail = checkOK, "anonymous"
+		return r
+	}
+
+	creds, err := awsSession.Config.Credentials.Get()
+	if err != nil {
+		r.status, r.detail = checkFail, fmt.Sprintf("no credentials are found: %s", err)
+		r.hint = "set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, give --aws-profile or run on an instance with an IAM role"
+		return r
+	}
+
+	identity, err := sts.New(awsSession).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		r.status, r.detail = checkFail, fmt.Sprintf("credentials from %s are rejected: %s", creds.ProviderName, err)
+		r.hint = doctorHint(err)
+		return r
+	}
+
+	r.status, r.detail = checkOK, fmt.Sprintf("%s (from %s)", aws.StringValue(identity.Arn), creds.ProviderName)
+	return r
+}
+
+// checkBucket checks that the bucket is reachable and returns the Date header of the response to check the clock
+func checkBucket() (checkResult, string) {
+	r := checkResult{name: "bucket"}
+
+	req, _ := s3Client.HeadBucketRequest(&s3.HeadBucketInput{Bucket: &s3Bucket})
+	err := req.Send()
+
+	var date string
+	if req.HTTPResponse != nil {
+		date = req.HTTPResponse.Header.Get("Date")
+	}
+
+	if err != nil {
+		r.status, r.detail = checkFail, fmt.Sprintf("%s is unreachable: %s", s3Bucket, err)
+		r.hint = doctorHint(err)
+		region := aws.StringValue(s3Client.Config.Region)
+		if actual, err := s3manager.GetBucketRegion(aws.BackgroundContext(), awsSession, s3Bucket, region); err == nil && actual != region {
+			r.hint = fmt.Sprintf("the bucket is in %s, give --aws-region %s", actual, actual)
+		}
+		return r, date
+	}
+
+	r.status, r.detail = checkOK, fmt.Sprintf("%s in %s", s3Bucket, aws.StringValue(s3Client.Config.Region))
+	return r, date
+}
+
+// checkClockSkew compares the local clock with the Date header of S3
+func checkClockSkew(date string, now time.Time) checkResult {
+	r := checkResult{name: "clock"}
+
+	serverTime, err := http.ParseTime(date)
+	if err != nil {
+		r.status, r.detail = checkWarn, fmt.Sprintf("failed to parse Date of S3: %s", date)
+		return r
+	}
+
+	skew := now.Sub(serverTime)
+	if skew < 0 {
+		skew = -skew
+	}
+	skew = skew.Truncate(time.Second)
+
+	switch {
+	case skew > maxClockSkew:
+		r.status, r.detail = checkFail, fmt.Sprintf("skewed by %s from S3", skew)
+		r.hint = "synchronize the clock with NTP, S3 rejects requests signed with a skewed clock"
+	case skew > time.Minute:
+		r.status, r.detail = checkWarn, fmt.Sprintf("skewed by %s from S3", skew)
+		r.hint = "synchronize the clock with NTP"
+	default:
+		r.status, r.detail = checkOK, fmt.Sprintf("skewed by %s from S3", skew)
+	}
+
+	return r
+}
+
+func checkList() checkResult {
+	r := checkResult{name: "list"}
+
+	prefix := prefixedKey("")
+	_, err := s3Client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  &s3Bucket,
+		Prefix:  &prefix,
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		r.status, r.detail = checkFail, fmt.Sprintf("failed to list objects under %s: %s", prefix, err)
+		r.hint = doctorHint(err)
+		if r.hint == "" || errorCode(err) == "AccessDenied" {
+			r.hint = "allow s3:ListBucket on the bucket, which restore uses to find caches by prefix"
+		}
+		return r
+	}
+
+	r.status, r.detail = checkOK, fmt.Sprintf("objects under %s are listed", prefix)
+	return r
+}
+
+// checkPutGet writes, reads and deletes a small object under the prefix
+func checkPutGet() []checkResult {
+	put := checkResult{name: "put"}
+	get := checkResult{name: "get"}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		put.status, put.detail = checkFail, fmt.Sprintf("failed to generate key: %s", err)
+		return []checkResult{put}
+	}
+	key := prefixedKey(".doctor/" + hex.EncodeToString(suffix))
+	content := []byte("guruguru-cache doctor")
+
+	_, err := s3Client.PutObject(&s3.PutObjectInput{
+		Bucket: &s3Bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(content),
+	})
+	if err != nil {
+		put.status, put.detail = checkFail, fmt.Sprintf("failed to put %s: %s", key, err)
+		put.hint = doctorHint(err)
+		if errorCode(err) == "AccessDenied" {
+			put.hint = "allow s3:PutObject on the prefix, or check that the bucket policy doesn't require encryption options"
+		}
+		return []checkResult{put}
+	}
+	put.status, put.detail = checkOK, fmt.Sprintf("%s is written", key)
+
+	defer func() {
+		if _, err := s3Client.DeleteObject(&s3.DeleteObjectInput{Bucket: &s3Bucket, Key: &key}); err != nil {
+			log.Printf("failed to delete %s: %s\n", key, err)
+		}
+	}()
+
+	output, err := s3Client.GetObject(&s3.GetObjectInput{Bucket: &s3Bucket, Key: &key})
+	if err != nil {
+		get.status, get.detail = checkFail, fmt.Sprintf("failed to get %s: %s", key, err)
+		get.hint = doctorHint(err)
+		if errorCode(err) == "AccessDenied" {
+			get.hint = "allow s3:GetObject on the prefix"
+		}
+		return []checkResult{put, get}
+	}
+	defer output.Body.Close()
+
+	body, err := ioutil.ReadAll(output.Body)
+	if err != nil || !bytes.Equal(body, content) {
+		get.status, get.detail = checkFail, fmt.Sprintf("%s is read with different content", key)
+		get.hint = "check proxies between here and S3"
+		return []checkResult{put, get}
+	}
+	get.status, get.detail = checkOK, fmt.Sprintf("%s is read", key)
+
+	return []checkResult{put, get}
+}
+
+func checkTempDir() checkResult {
+	r := checkResult{name: "temp dir"}
+	dir := tmpDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	file, err := ioutil.TempFile(dir, "guruguru-cache-doctor-")
+	if err != nil {
+		r.status, r.detail = checkFail, fmt.Sprintf("%s isn't writable: %s", dir, err)
+		r.hint = "set TMPDIR or --tmp-dir to a writable directory, which restore downloads caches to"
+		return r
+	}
+	file.Close()
+	os.Remove(file.Name())
+
+	free, ok := freeSpace(dir)
+	switch {
+	case !ok:
+		r.status, r.detail = checkOK, fmt.Sprintf("%s is writable", dir)
+	case free < minTempDirSpace:
+		r.status, r.detail = checkWarn, fmt.Sprintf("%s has only %s free", dir, formatSize(int64(free)))
+		r.hint = "set TMPDIR or --tmp-dir to a directory with enough space for the largest cache"
+	default:
+		r.status, r.detail = checkOK, fmt.Sprintf("%s has %s free", dir, formatSize(int64(free)))
+	}
+
+	return r
+}
+
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+
+	return ""
+}
+
+// doctorHint returns how to fix the error of the AWS SDK, which is often opaque
+func doctorHint(err error) string {
+	switch errorCode(err) {
+	case "NoCredentialProviders":
+		return "set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, give --aws-profile or run on an instance with an IAM role"
+	case "InvalidClientTokenId", "InvalidAccessKeyId", "SignatureDoesNotMatch":
+		return "check the access key and the secret key, which may be mistyped or deactivated"
+	case "ExpiredToken", "ExpiredTokenException", "RequestExpired":
+		return "refresh the session token, which has expired"
+	case "RequestTimeTooSkewed":
+		return "synchronize the clock with NTP, S3 rejects requests signed with a skewed clock"
+	case "NotFound", "NoSuchBucket":
+		return "check --s3-bucket, the bucket doesn't exist"
+	case "Forbidden", "AccessDenied":
+		return "allow the IAM principal to access the bucket in its policy and the bucket policy"
+	case "RequestError":
+		return "check the network and HTTPS_PROXY, S3 is unreachable"
+	}
+
+	return ""
+}
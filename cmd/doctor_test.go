@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestCheckClockSkew(t *testing.T) {
+	now := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, c := range []struct {
+		date   string
+		status string
+		detail string
+	}{
+		{"Wed, 02 Jan 2019 03:04:05 GMT", checkOK, "skewed by 0s from S3"},
+		{"Wed, 02 Jan 2019 03:06:05 GMT", checkWarn, "skewed by 2m0s from S3"},
+		{"Wed, 02 Jan 2019 02:54:05 GMT", checkFail, "skewed by 10m0s from S3"},
+		{"invalid", checkWarn, "failed to parse Date of S3: invalid"},
+	} {
+		r := checkClockSkew(c.date, now)
+		if r.status != c.status || r.detail != c.detail {
+			t.Fatalf("the result of %s is wrong: %s: %s", c.date, r.status, r.detail)
+		}
+	}
+}
+
+func TestDoctorHint(t *testing.T) {
+	if hint := doctorHint(awserr.New("NoSuchBucket", "The specified bucket does not exist", nil)); hint != "check --s3-bucket, the bucket doesn't exist" {
+		t.Fatalf("the hint of NoSuchBucket is wrong: %s", hint)
+	}
+	if hint := doctorHint(awserr.New("SomethingElse", "unknown", nil)); hint != "" {
+		t.Fatalf("the hint of an unknown error is wrong: %s", hint)
+	}
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/spf13/cobra"
+)
+
+var downloadOutput string
+
+func init() {
+	downloadCmd := &cobra.Command{
+		Use:   "download [flags] [cache keys...]",
+		Short: "Download the archive of a cache to a file without extracting it",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupTemplate(); err != nil {
+				log.Fatal(err)
+			}
+			if err := validateDownloadOptions(); err != nil {
+				log.Fatal(err)
+			}
+
+			cacheKeys, err := renderCacheKeys(args)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			item, itemKey := findCache(cacheKeys)
+			if item == nil {
+				log.Println("no cache is found")
+				os.Exit(cacheMissExitCode)
+			}
+			if isPathArchivesManifest(item) {
+				item.Body.Close()
+				log.Fatalf("cache of per-path archives can't be downloaded as a single archive: %s", itemKey)
+			}
+
+			output := downloadOutput
+			if output == "" {
+				output = downloadFileName(itemKey)
+			}
+
+			// the archive is saved next to the output so that it's renamed without copying
+			dir, err := ioutil.TempDir(filepath.Dir(output), ".guruguru-cache-")
+			if err != nil {
+				log.Fatalf("failed to create temporal directory: %s", err)
+			}
+			defer os.RemoveAll(dir)
+
+			file := downloadCache(dir, item, itemKey)
+			file.Close()
+
+			if err := os.Rename(file.Name(), output); err != nil {
+				log.Fatalf("failed to save cache file: %s", err)
+			}
+
+			fmt.Println(output)
+		},
+	}
+
+	downloadCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches")
+	downloadCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(downloadCmd)
+	addTemplateFlags(downloadCmd)
+	addKeyFlags(downloadCmd)
+	downloadCmd.Flags().BoolVarP(&s3Anonymous, "anonymous", "", false, "Access the public S3 bucket without credentials")
+	downloadCmd.Flags().StringVarP(&downloadOutput, "output", "o", "", "File to save the archive to (default the last segment of the matched key like gem-v1-linux.tar.gz)")
+	downloadCmd.Flags().StringVarP(&downloadPartSize, "download-part-size", "", "5MB", "Size of each range of concurrent downloads")
+	downloadCmd.Flags().IntVarP(&downloadConcurrency, "download-concurrency", "", s3manager.DefaultDownloadConcurrency, "Number of ranges downloaded concurrently")
+
+	rootCmd.AddCommand(downloadCmd)
+}
+
+// downloadFileName returns the name of the file an archive is saved to by default
+func downloadFileName(objectKey string) string {
+	return fmt.Sprintf("%s.tar.gz", path.Base(cacheKeyFromObjectKey(objectKey)))
+}
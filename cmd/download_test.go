@@ -0,0 +1,15 @@
+package cmd
+
+import "testing"
+
+func TestDownloadFileName(t *testing.T) {
+	for key, expected := range map[string]string{
+		"v1/gem-v1-linux.tar.gz":          "gem-v1-linux.tar.gz",
+		"org/repo/v1/deps/abc123.tar.gz":  "abc123.tar.gz",
+		"org/repo/v1/node-10.15.0.tar.gz": "node-10.15.0.tar.gz",
+	} {
+		if name := downloadFileName(key); name != expected {
+			t.Fatalf("file name of %s is wrong: %s", key, name)
+		}
+	}
+}
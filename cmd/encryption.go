@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+var ageMagic = []byte("age-encryption.org/")
+
+func encryptionEnabled() bool {
+	return len(ageRecipients) > 0 || passphraseFile != ""
+}
+
+// validateEncryptionOptions rejects the passphrase with recipients, as age encrypts with a passphrase only for itself
+func validateEncryptionOptions() error {
+	if passphraseFile != "" && len(ageRecipients) > 0 {
+		return fmt.Errorf("--passphrase-file can't be used with --age-recipient")
+	}
+
+	return nil
+}
+
+func readPassphrase() (string, error) {
+	content, err := ioutil.ReadFile(passphraseFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase file: %s", err)
+	}
+
+	passphrase := strings.TrimRight(string(content), "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase file is empty: %s", passphraseFile)
+	}
+
+	return passphrase, nil
+}
+
+// newEncryptWriter encrypts the archive for the age recipients or with the passphrase,
+// or passes it through when encryption is disabled
+func newEncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	if !encryptionEnabled() {
+		return nopWriteCloser{w}, nil
+	}
+
+	var recipients []age.Recipient
+	if passphraseFile != "" {
+		passphrase, err := readPassphrase()
+		if err != nil {
+			return nil, err
+		}
+
+		recipient, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive a key from passphrase: %s", err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	for _, r := range ageRecipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient: %s", err)
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	ew, err := age.Encrypt(w, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt archive: %s", err)
+	}
+
+	return ew, nil
+}
+
+// decrypt detects an age encrypted archive and decrypts it with the identity file or the passphrase.
+// Archives which aren't encrypted are rejected when either is given, as they could be replaced by anyone writing to the bucket.
+func decrypt(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	head, err := br.Peek(len(ageMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read archive: %s", err)
+	}
+	if !bytes.Equal(head, ageMagic) {
+		if ageIdentityFile != "" || passphraseFile != "" {
+			return nil, fmt.Errorf("the cache isn't encrypted while --age-identity-file or --passphrase-file is given")
+		}
+		return br, nil
+	}
+
+	if ageIdentityFile == "" && passphraseFile == "" {
+		return nil, fmt.Errorf("the cache is encrypted: --age-identity-file or --passphrase-file is required")
+	}
+
+	var identities []age.Identity
+	if ageIdentityFile != "" {
+		file, err := os.Open(ageIdentityFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open age identity file: %s", err)
+		}
+
+		defer file.Close()
+
+		if identities, err = age.ParseIdentities(file); err != nil {
+			return nil, fmt.Errorf("invalid age identity file: %s", err)
+		}
+	}
+	if passphraseFile != "" {
+		passphrase, err := readPassphrase()
+		if err != nil {
+			return nil, err
+		}
+
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive a key from passphrase: %s", err)
+		}
+		identities = append(identities, identity)
+	}
+
+	dr, err := age.Decrypt(br, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt archive: %s", err)
+	}
+
+	return dr, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
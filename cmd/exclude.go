@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var excludes []string
+
+// validateExcludes checks the syntax of --exclude patterns before walking files
+func validateExcludes() error {
+	for _, pattern := range excludes {
+		for _, segment := range strings.Split(filepath.ToSlash(pattern), "/") {
+			if _, err := filepath.Match(segment, ""); err != nil {
+				return fmt.Errorf("invalid exclude pattern: %s", pattern)
+			}
+		}
+	}
+
+	return nil
+}
+
+// isExcluded reports whether the file under the root path matches any of --exclude patterns.
+// Patterns without slashes match names at any depth like .git, and others match the path relative to the root like **/*.log.
+func isExcluded(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+
+	for _, pattern := range excludes {
+		pattern = strings.Trim(filepath.ToSlash(pattern), "/")
+		if !strings.Contains(pattern, "/") {
+			pattern = "**/" + pattern
+		}
+		if matchSegments(strings.Split(pattern, "/"), strings.Split(rel, "/")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchSegments matches the segments of the path with the pattern, where ** matches any number of segments
+func matchSegments(pattern []string, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := filepath.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+
+	return matchSegments(pattern[1:], segments[1:])
+}
+
+// skipEntry is the result of walk functions for the file excluded, which excludes files under it too
+func skipEntry(info os.FileInfo) error {
+	if info.IsDir() {
+		return filepath.SkipDir
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIsExcluded(t *testing.T) {
+	defer func(original []string) { excludes = original }(excludes)
+	excludes = []string{"**/*.log", ".git", "vendor/cache/"}
+
+	testCases := []struct {
+		path     string
+		expected bool
+	}{
+		{"node_modules", false},
+		{"node_modules/debug.log", true},
+		{"node_modules/foo/debug.log", true},
+		{"node_modules/.git", true},
+		{"node_modules/foo/.git", true},
+		{"node_modules/foo/.github", false},
+		{"node_modules/vendor/cache", true},
+		{"node_modules/foo/vendor/cache", false},
+		{"node_modules/vendor/cache.txt", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			if actual := isExcluded("node_modules", tc.path); actual != tc.expected {
+				t.Errorf("expected %v but got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestValidateExcludes(t *testing.T) {
+	defer func(original []string) { excludes = original }(excludes)
+
+	excludes = []string{"**/*.log", "[a-z]*"}
+	if err := validateExcludes(); err != nil {
+		t.Errorf("valid patterns are rejected: %s", err)
+	}
+
+	excludes = []string{"foo/[a-"}
+	if err := validateExcludes(); err == nil {
+		t.Error("invalid pattern is accepted")
+	}
+}
+
+func TestWriteArchiveWithExcludes(t *testing.T) {
+	setupFixturesToCache(t)
+	defer func(original []string) { excludes = original }(excludes)
+	excludes = []string{"*.txt", "def"}
+
+	buf := new(bytes.Buffer)
+	if _, err := writeArchive(buf, []string{"tmp/foo", "tmp/abc"}); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	digests, _, err := readArchiveDigests(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read the archive: %s", err)
+	}
+	for _, path := range []string{"tmp/foo/hoge.txt", "tmp/abc/def", "tmp/abc/def/ghe"} {
+		if _, ok := digests[path]; ok {
+			t.Errorf("excluded %s is archived", path)
+		}
+	}
+	if _, ok := digests["tmp/abc"]; !ok {
+		t.Errorf("tmp/abc is missing in %v", digests)
+	}
+}
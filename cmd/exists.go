@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+	"github.com/yuya-takeyama/guruguru-cache/template"
+)
+
+// cacheMissExitCode is the exit code of exists when no cache is found, distinct from 1 of errors
+const cacheMissExitCode = 2
+
+var existsExact bool
+
+func init() {
+	existsCmd := &cobra.Command{
+		Use:   "exists [flags] [cache keys...]",
+		Short: "Check whether a cache exists, exiting with 2 when it doesn't",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupTemplate(); err != nil {
+				log.Fatal(err)
+			}
+
+			var cacheKeys []string
+			for _, key := range args {
+				cacheKey, err := template.ExecuteTemplate(key)
+				if err != nil {
+					log.Fatal(err)
+				}
+				cacheKeys = append(cacheKeys, prefixedKey(cacheKey))
+			}
+
+			code, err := checkExists(os.Stdout, cacheKeys)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if code != 0 {
+				os.Exit(code)
+			}
+		},
+	}
+
+	existsCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches")
+	existsCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(existsCmd)
+	addTemplateFlags(existsCmd)
+	existsCmd.Flags().StringArrayVarP(&fallbackS3Buckets, "fallback-s3-bucket", "", nil, "S3 bucket to try when no cache is found, optionally with its region like bucket:us-west-2 (can be repeated)")
+	existsCmd.Flags().BoolVarP(&existsExact, "exact", "", false, "Match only caches with exactly the keys, not ones starting with them")
+
+	rootCmd.AddCommand(existsCmd)
+}
+
+// checkExists prints the key of the first cache matching the keys in --s3-bucket and then --fallback-s3-bucket like restore does,
+// returning cacheMissExitCode when none is found
+func checkExists(w io.Writer, cacheKeys []string) (int, error) {
+	locations, err := bucketLocations()
+	if err != nil {
+		return 0, err
+	}
+
+	defer func(client *s3.S3, bucket string) { s3Client, s3Bucket = client, bucket }(s3Client, s3Bucket)
+	defaultClient := s3Client
+	for i, location := range locations {
+		s3Client = defaultClient
+		if location.region != "" {
+			if s3Client, err = newRegionalS3Client(location.region); err != nil {
+				return 0, err
+			}
+		}
+		s3Bucket = location.bucket
+
+		found, err := findCacheKey(cacheKeys)
+		if err != nil {
+			return 0, err
+		}
+		if found != "" {
+			if i > 0 {
+				log.Printf("cache is found in fallback bucket: %s\n", location.bucket)
+			}
+			fmt.Fprintln(w, strings.TrimPrefix(found, prefixedKey("")))
+			return 0, nil
+		}
+	}
+
+	log.Println("no cache is found")
+	return cacheMissExitCode, nil
+}
+
+// findCacheKey returns the key of the first cache matching the keys like restore does, without downloading it
+func findCacheKey(cacheKeys []string) (string, error) {
+	for _, cacheKey := range cacheKeys {
+		exists, err := cacheExists(cacheKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to check cache: %s: %s", cacheKey, err)
+		}
+		if exists {
+			return cacheKey, nil
+		}
+
+		if existsExact {
+			continue
+		}
+
+		object, err := findLatestArchive(cacheKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to find cache: %s: %s", cacheKey, err)
+		}
+		if object != nil {
+			return cacheKeyFromObjectKey(aws.StringValue(object.Key)), nil
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCheckExists(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original bool) { existsExact = original }(existsExact)
+	defer func(original []string) { fallbackS3Buckets = original }(fallbackS3Buckets)
+
+	fake.put(objectKey(prefixedKey("gem-v1-abc")), []byte("archive"), nil)
+	check := func(keys ...string) (int, string) {
+		var cacheKeys []string
+		for _, key := range keys {
+			cacheKeys = append(cacheKeys, prefixedKey(key))
+		}
+
+		out := new(bytes.Buffer)
+		code, err := checkExists(out, cacheKeys)
+		if err != nil {
+			t.Fatalf("failed to check the cache: %s", err)
+		}
+		return code, out.String()
+	}
+
+	if code, out := check("gem-v1-abc"); code != 0 || out != "gem-v1-abc\n" {
+		t.Fatalf("the exact key isn't found: %d: %s", code, out)
+	}
+	if code, out := check("gem-v1-xyz", "gem-v1-"); code != 0 || out != "gem-v1-abc\n" {
+		t.Fatalf("the prefix isn't found: %d: %s", code, out)
+	}
+
+	existsExact = true
+	if code, out := check("gem-v1-"); code != cacheMissExitCode || out != "" {
+		t.Fatalf("the prefix is found with --exact: %d: %s", code, out)
+	}
+	existsExact = false
+
+	if code, out := check("npm-v1-"); code != cacheMissExitCode || out != "" {
+		t.Fatalf("the missing cache is found: %d: %s", code, out)
+	}
+
+	// caches restore finds in fallback buckets are found too
+	bucket := s3Bucket
+	s3Bucket = "example-cache-us"
+	fake.put(objectKey(prefixedKey("npm-v1-abc")), []byte("archive"), nil)
+	s3Bucket = bucket
+	fallbackS3Buckets = []string{"example-cache-us"}
+	if code, out := check("npm-v1-"); code != 0 || out != "npm-v1-abc\n" {
+		t.Fatalf("the cache in the fallback bucket isn't found: %d: %s", code, out)
+	}
+	if s3Bucket != bucket {
+		t.Fatalf("the bucket isn't restored after checking the fallback bucket: %s", s3Bucket)
+	}
+}
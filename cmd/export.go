@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// exportManifestName is the first entry of exported files describing the caches in it
+const exportManifestName = "export.json"
+
+// exportFormatVersion is bumped on incompatible changes of the layout of exported files
+const exportFormatVersion = 1
+
+// metadataSuffix is the suffix of entries holding S3 metadata of the objects following them, like fileStore
+const metadataSuffix = ".metadata.json"
+
+// exportManifest is the content of export.json
+type exportManifest struct {
+	FormatVersion int      `json:"format_version"`
+	ToolVersion   string   `json:"tool_version"`
+	Caches        []string `json:"caches"`
+}
+
+func init() {
+	exportCmd := &cobra.Command{
+		Use:   "export [flags] [output] [cache keys...]",
+		Short: "Bundle caches with the keys into a file to import into another storage",
+		Args:  cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupTemplate(); err != nil {
+				log.Fatal(err)
+			}
+
+			output, keys := args[0], args[1:]
+			caches, err := exportedCaches(keys)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if output == "-" {
+				err = exportCaches(os.Stdout, caches)
+			} else {
+				err = exportCachesToFile(output, caches)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			log.Printf("exported %d caches to %s\n", len(caches), output)
+		},
+	}
+
+	exportCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches to export")
+	exportCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(exportCmd)
+	addTemplateFlags(exportCmd)
+	exportCmd.Flags().BoolVarP(&existsExact, "exact", "", false, "Match only caches with exactly the keys, not ones starting with them")
+	addTmpDirFlag(exportCmd)
+
+	rootCmd.AddCommand(exportCmd)
+}
+
+// exportedCaches finds the cache of each key like restore does, failing when any of them is missing
+func exportedCaches(keys []string) ([]*cacheEntry, error) {
+	cacheKeys, err := renderCacheKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var caches []*cacheEntry
+	for _, cacheKey := range cacheKeys {
+		found, err := findCacheKey([]string{cacheKey})
+		if err != nil {
+			return nil, err
+		}
+		if found == "" {
+			return nil, fmt.Errorf("no cache is found: %s", cacheKey)
+		}
+
+		key := strings.TrimPrefix(found, prefixedKey(""))
+		entries, err := listCaches(key)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range entries {
+			if c.Key == key {
+				caches = append(caches, c)
+			}
+		}
+	}
+
+	return caches, nil
+}
+
+// exportCachesToFile writes a temporal file next to the output and renames it, so that the output is never partial
+func exportCachesToFile(output string, caches []*cacheEntry) error {
+	file, err := ioutil.TempFile(filepath.Dir(output), ".guruguru-cache-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporal file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err := exportCaches(file, caches); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %s", output, err)
+	}
+
+	return os.Rename(file.Name(), output)
+}
+
+// exportCaches writes export.json followed by the objects of the caches in the order migrate copies them
+func exportCaches(w io.Writer, caches []*cacheEntry) error {
+	manifest := exportManifest{FormatVersion: exportFormatVersion, ToolVersion: Version}
+	for _, c := range caches {
+		manifest.Caches = append(manifest.Caches, c.Key)
+	}
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %s", exportManifestName, err)
+	}
+
+	dst := newTarStore(w)
+	if err := dst.writeEntry(exportManifestName, int64(len(content)), strings.NewReader(string(content))); err != nil {
+		return err
+	}
+
+	for _, c := range caches {
+		if _, err := migrateCache(c, dst); err != nil {
+			return err
+		}
+	}
+
+	return dst.tw.Close()
+}
+
+// tarStore writes objects as entries of a tar stream with their S3 metadata in "*.metadata.json" entries before them.
+// Objects are spooled to temporal files, as tar headers need their sizes.
+type tarStore struct {
+	tw      *tar.Writer
+	written map[string]bool
+}
+
+func newTarStore(w io.Writer) *tarStore {
+	return &tarStore{tw: tar.NewWriter(w), written: make(map[string]bool)}
+}
+
+// exists reports whether the object is already written, so that chunks shared by caches are written once
+func (s *tarStore) exists(key string) (bool, error) {
+	return s.written[key], nil
+}
+
+func (s *tarStore) put(key string, body io.Reader, metadata map[string]*string) error {
+	if len(metadata) > 0 {
+		metadataJSON, err := json.Marshal(metadata)
+		if err != nil {
+			return fmt.Errorf("failed to encode metadata JSON: %s", err)
+		}
+		if err := s.writeEntry(key+metadataSuffix, int64(len(metadataJSON)), strings.NewReader(string(metadataJSON))); err != nil {
+			return err
+		}
+	}
+
+	file, err := ioutil.TempFile(tmpDir, "guruguru-cache-export-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporal file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	size, err := io.Copy(file, body)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %s", key, err)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return fmt.Errorf("failed to read %s: %s", key, err)
+	}
+
+	if err := s.writeEntry(key, size, file); err != nil {
+		return err
+	}
+	s.written[key] = true
+
+	return nil
+}
+
+func (s *tarStore) writeEntry(name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		Typeflag: tar.TypeReg,
+	}
+	if err := s.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write tar header of %s: %s", name, err)
+	}
+	if _, err := io.Copy(s.tw, r); err != nil {
+		return fmt.Errorf("failed to write %s: %s", name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestExportAndImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guruguru-cache-test-")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf := new(bytes.Buffer)
+	src := newTarStore(buf)
+	content, _ := json.Marshal(exportManifest{FormatVersion: exportFormatVersion, ToolVersion: "dev", Caches: []string{"foo"}})
+	if err := src.writeEntry(exportManifestName, int64(len(content)), bytes.NewReader(content)); err != nil {
+		t.Fatalf("failed to write manifest: %s", err)
+	}
+	if err := src.put("v1/foo.part0000.tar.gz", strings.NewReader("part"), nil); err != nil {
+		t.Fatalf("failed to put part: %s", err)
+	}
+	if err := src.put("v1/foo.tar.gz", strings.NewReader(""), map[string]*string{partsMetadataKey: aws.String("1")}); err != nil {
+		t.Fatalf("failed to put manifest: %s", err)
+	}
+	if exists, _ := src.exists("v1/foo.part0000.tar.gz"); !exists {
+		t.Fatal("the put object doesn't exist")
+	}
+	if err := src.tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %s", err)
+	}
+
+	dst := &fileStore{dir: dir}
+	imported, err := importCaches(bytes.NewReader(buf.Bytes()), dst)
+	if err != nil {
+		t.Fatalf("failed to import: %s", err)
+	}
+	if imported != 1 {
+		t.Fatalf("the number of imported caches is wrong: %d", imported)
+	}
+
+	part, err := ioutil.ReadFile(filepath.Join(dir, "v1", "foo.part0000.tar.gz"))
+	if err != nil || string(part) != "part" {
+		t.Fatalf("the part is wrong: %s: %v", part, err)
+	}
+	metadata, err := ioutil.ReadFile(filepath.Join(dir, "v1", "foo.tar.gz.metadata.json"))
+	if err != nil || string(metadata) != `{"Parts":"1"}` {
+		t.Fatalf("the metadata of the manifest is wrong: %s: %v", metadata, err)
+	}
+
+	// objects which already exist are skipped
+	if imported, err := importCaches(bytes.NewReader(buf.Bytes()), dst); err != nil || imported != 0 {
+		t.Fatalf("existing caches are imported again: %d: %v", imported, err)
+	}
+}
+
+func TestImportWithObjectOptions(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(s string, keyID string, class string) {
+		sse, sseKMSKeyID, storageClass = s, keyID, class
+	}(sse, sseKMSKeyID, storageClass)
+	sse = s3.ServerSideEncryptionAwsKms
+	sseKMSKeyID = "alias/cache"
+	storageClass = s3.StorageClassStandardIa
+
+	buf := new(bytes.Buffer)
+	src := newTarStore(buf)
+	content, _ := json.Marshal(exportManifest{FormatVersion: exportFormatVersion, ToolVersion: "dev", Caches: []string{"foo"}})
+	if err := src.writeEntry(exportManifestName, int64(len(content)), bytes.NewReader(content)); err != nil {
+		t.Fatalf("failed to write manifest: %s", err)
+	}
+	if err := src.put("v1/foo.tar.gz", strings.NewReader("archive"), nil); err != nil {
+		t.Fatalf("failed to put archive: %s", err)
+	}
+	if err := src.tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %s", err)
+	}
+
+	dst := &s3Store{client: s3Client, bucket: s3Bucket, prefix: keyPrefix}
+	if imported, err := importCaches(bytes.NewReader(buf.Bytes()), dst); err != nil || imported != 1 {
+		t.Fatalf("failed to import: %d: %v", imported, err)
+	}
+
+	requests := fake.received(http.MethodPut, "v1/foo.tar.gz")
+	if len(requests) != 1 {
+		t.Fatalf("the archive isn't uploaded once: %d", len(requests))
+	}
+	header := requests[0].Header
+	if header.Get("X-Amz-Tagging") != expiringTagKey+"="+expiringTagValue {
+		t.Errorf("the archive isn't tagged as expiring: %s", header.Get("X-Amz-Tagging"))
+	}
+	if header.Get("X-Amz-Server-Side-Encryption") != sse || header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id") != sseKMSKeyID {
+		t.Errorf("the archive isn't encrypted with the KMS key: %v", header)
+	}
+	if header.Get("X-Amz-Storage-Class") != storageClass {
+		t.Errorf("the storage class of the archive is wrong: %s", header.Get("X-Amz-Storage-Class"))
+	}
+}
+
+func TestImportInvalidFile(t *testing.T) {
+	buf := new(bytes.Buffer)
+	src := newTarStore(buf)
+	if err := src.put("v1/foo.tar.gz", strings.NewReader("archive"), nil); err != nil {
+		t.Fatalf("failed to put archive: %s", err)
+	}
+	src.tw.Close()
+
+	if _, err := importCaches(bytes.NewReader(buf.Bytes()), &fileStore{dir: "tmp"}); err == nil {
+		t.Fatal("the file without export.json is imported")
+	}
+}
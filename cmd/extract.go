@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var extractTo string
+
+func init() {
+	extractCmd := &cobra.Command{
+		Use:   "extract [flags] [archive]",
+		Short: "Extract a local archive of a cache to its paths like restore",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			file, err := os.Open(args[0])
+			if err != nil {
+				log.Fatalf("failed to open archive: %s", err)
+			}
+			defer file.Close()
+
+			if extractTo != "" {
+				if err := os.MkdirAll(extractTo, 0755); err != nil {
+					log.Fatalf("failed to create a directory: %s", err)
+				}
+			}
+
+			// extracted under the destination so that the paths are moved by renaming
+			dir, err := ioutil.TempDir(extractTo, ".guruguru-cache-")
+			if err != nil {
+				log.Fatalf("failed to create temporal directory: %s", err)
+			}
+			defer os.RemoveAll(dir)
+
+			extractCache(dir, file)
+			moveToPaths(dir, extractTo)
+		},
+	}
+
+	extractCmd.Flags().StringVarP(&extractTo, "to", "", "", "Directory to extract the paths under instead of their original locations")
+	extractCmd.Flags().BoolVarP(&skipExisting, "skip-existing", "", false, "Don't extract paths which already exist")
+	extractCmd.Flags().BoolVarP(&verifyFiles, "verify-files", "", false, "Verify the checksum of each extracted file with the manifest of the archive")
+	extractCmd.Flags().StringVarP(&ageIdentityFile, "age-identity-file", "", "", "age identity file to decrypt encrypted archives")
+	extractCmd.Flags().StringVarP(&passphraseFile, "passphrase-file", "", "", "Decrypt encrypted archives with the passphrase in the file")
+
+	rootCmd.AddCommand(extractCmd)
+}
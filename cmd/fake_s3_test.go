@@ -0,0 +1,525 @@
+package cmd
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeS3 is an in-memory fake of the S3 API used by the commands: objects with metadata, ranges, copies,
+// multipart uploads, listing, batch deletes, tagging and lifecycle rules.
+// Objects are keyed by the bucket and the key like example-cache/v1/gem.tar.gz.
+type fakeS3 struct {
+	mu        sync.Mutex
+	objects   map[string]*fakeObject
+	uploads   map[string]*fakeUpload
+	requests  []fakeRequest
+	lifecycle []byte
+	nextID    int
+	// now is the time objects are modified at
+	now func() time.Time
+	// fail makes the request fail with InternalError when it returns true
+	fail func(r fakeRequest) bool
+}
+
+type fakeObject struct {
+	content      []byte
+	etag         string
+	header       http.Header
+	tags         url.Values
+	lastModified time.Time
+}
+
+type fakeUpload struct {
+	key    string
+	header http.Header
+	parts  map[int][]byte
+}
+
+// fakeRequest is a request received by fakeS3, whose Key includes the bucket
+type fakeRequest struct {
+	Method string
+	Key    string
+	Query  url.Values
+	Header http.Header
+}
+
+func setupFakeS3(t *testing.T) (*fakeS3, func()) {
+	fake := &fakeS3{
+		objects: make(map[string]*fakeObject),
+		uploads: make(map[string]*fakeUpload),
+		now:     time.Now,
+	}
+	server := httptest.NewServer(fake)
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:       aws.Int(0),
+	}))
+	s3Client = s3.New(sess)
+	s3Bucket = "example-cache"
+
+	return fake, func() {
+		server.Close()
+		s3Client = nil
+		s3Bucket = ""
+	}
+}
+
+// put adds the object to s3Bucket with the S3 metadata
+func (s *fakeS3) put(key string, content []byte, metadata map[string]string) {
+	header := make(http.Header)
+	for k, v := range metadata {
+		header.Set("X-Amz-Meta-"+k, v)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[s3Bucket+"/"+key] = s.newObject(content, header)
+}
+
+// content returns the content of the object of s3Bucket, reporting false when it doesn't exist
+func (s *fakeS3) content(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.objects[s3Bucket+"/"+key]
+	if !ok {
+		return nil, false
+	}
+
+	return o.content, true
+}
+
+// keys returns the sorted keys of the objects of s3Bucket
+func (s *fakeS3) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for k := range s.objects {
+		if strings.HasPrefix(k, s3Bucket+"/") {
+			keys = append(keys, strings.TrimPrefix(k, s3Bucket+"/"))
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// received returns the requests of the method to the key of s3Bucket
+func (s *fakeS3) received(method string, key string) []fakeRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var requests []fakeRequest
+	for _, r := range s.requests {
+		if r.Method == method && r.Key == s3Bucket+"/"+key {
+			requests = append(requests, r)
+		}
+	}
+
+	return requests
+}
+
+func (s *fakeS3) newObject(content []byte, header http.Header) *fakeObject {
+	o := &fakeObject{
+		content:      content,
+		etag:         fmt.Sprintf(`"%x"`, md5.Sum(content)),
+		header:       make(http.Header),
+		lastModified: s.now().UTC(),
+	}
+	for k, v := range header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") || k == "X-Amz-Storage-Class" || k == "X-Amz-Server-Side-Encryption" || k == "Content-Type" {
+			o.header[k] = v
+		}
+	}
+	if tagging := header.Get("X-Amz-Tagging"); tagging != "" {
+		o.tags, _ = url.ParseQuery(tagging)
+	}
+	// ETags of objects encrypted with KMS aren't MD5 of their content
+	if o.header.Get("X-Amz-Server-Side-Encryption") == s3.ServerSideEncryptionAwsKms {
+		o.etag = fmt.Sprintf(`"%x"`, md5.Sum(append([]byte("kms"), content...)))
+	}
+
+	return o
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	req := fakeRequest{Method: r.Method, Key: key, Query: r.URL.Query(), Header: r.Header}
+	s.requests = append(s.requests, req)
+	if s.fail != nil && s.fail(req) {
+		writeFakeError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+
+	query := r.URL.Query()
+	_, isBucket := splitFakeKey(key)
+	switch {
+	case isBucket && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		s.list(w, key, query)
+	case isBucket && query["lifecycle"] != nil:
+		s.serveLifecycle(w, r.Method, body)
+	case isBucket && r.Method == http.MethodPost && query["delete"] != nil:
+		s.deleteObjects(w, key, body)
+	case isBucket && r.Method == http.MethodHead:
+	case query["tagging"] != nil:
+		s.serveTagging(w, r.Method, key, body)
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = &fakeUpload{key: key, header: r.Header, parts: make(map[int][]byte)}
+		writeFakeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadID string   `xml:"UploadId"`
+		}{UploadID: id})
+	case query.Get("uploadId") != "":
+		s.serveUpload(w, r, key, body)
+	case r.Method == http.MethodPut:
+		s.putObject(w, r, key, body)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.getObject(w, r, key)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeFakeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// splitFakeKey splits the path into the bucket and the key, reporting whether it's the bucket itself
+func splitFakeKey(path string) (string, bool) {
+	i := strings.Index(path, "/")
+	if i < 0 {
+		return path, true
+	}
+
+	return path[:i], path[i+1:] == ""
+}
+
+func (s *fakeS3) putObject(w http.ResponseWriter, r *http.Request, key string, body []byte) {
+	if r.Header.Get("X-Amz-Copy-Source") == "" {
+		if sum := r.Header.Get("Content-Md5"); sum != "" && sum != base64MD5(body) {
+			writeFakeError(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+		o := s.newObject(body, r.Header)
+		s.objects[key] = o
+		w.Header().Set("ETag", o.etag)
+		return
+	}
+
+	src, ok := s.copySource(r)
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	header := src.header
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		header = r.Header
+	} else if class := r.Header.Get("X-Amz-Storage-Class"); class != "" {
+		header = cloneHeader(header)
+		header.Set("X-Amz-Storage-Class", class)
+	}
+	o := s.newObject(src.content, header)
+	if r.Header.Get("X-Amz-Tagging-Directive") != "REPLACE" {
+		o.tags = src.tags
+	}
+	s.objects[key] = o
+	writeFakeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: o.etag, LastModified: o.lastModified.Format(time.RFC3339)})
+}
+
+func (s *fakeS3) copySource(r *http.Request) (*fakeObject, bool) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return nil, false
+	}
+	o, ok := s.objects[strings.TrimPrefix(source, "/")]
+
+	return o, ok
+}
+
+func (s *fakeS3) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	o, ok := s.objects[key]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	if match := r.Header.Get("If-Match"); match != "" && match != o.etag {
+		writeFakeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+
+	for k, v := range o.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("ETag", o.etag)
+	w.Header().Set("Last-Modified", o.lastModified.Format(http.TimeFormat))
+
+	content := o.content
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		var start, end int64
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil {
+			end = int64(len(content)) - 1
+		}
+		if end >= int64(len(content)) {
+			end = int64(len(content)) - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		content = content[start : end+1]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(content)
+	}
+}
+
+func (s *fakeS3) serveUpload(w http.ResponseWriter, r *http.Request, key string, body []byte) {
+	upload, ok := s.uploads[r.URL.Query().Get("uploadId")]
+	if !ok || upload.key != key {
+		writeFakeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		n, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if r.Header.Get("X-Amz-Copy-Source") == "" {
+			if sum := r.Header.Get("Content-Md5"); sum != "" && sum != base64MD5(body) {
+				writeFakeError(w, http.StatusBadRequest, "BadDigest")
+				return
+			}
+			upload.parts[n] = body
+			w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+			return
+		}
+
+		src, ok := s.copySource(r)
+		if !ok {
+			writeFakeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		var start, end int
+		fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end)
+		upload.parts[n] = src.content[start : end+1]
+		writeFakeXML(w, struct {
+			XMLName xml.Name `xml:"CopyPartResult"`
+			ETag    string
+		}{ETag: fmt.Sprintf(`"%x"`, md5.Sum(upload.parts[n]))})
+	case http.MethodPost:
+		var numbers []int
+		for n := range upload.parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+
+		var content, sums []byte
+		for _, n := range numbers {
+			content = append(content, upload.parts[n]...)
+			sum := md5.Sum(upload.parts[n])
+			sums = append(sums, sum[:]...)
+		}
+		o := s.newObject(content, upload.header)
+		if o.header.Get("X-Amz-Server-Side-Encryption") != s3.ServerSideEncryptionAwsKms {
+			o.etag = fmt.Sprintf(`"%x-%d"`, md5.Sum(sums), len(numbers))
+		}
+		s.objects[key] = o
+		delete(s.uploads, r.URL.Query().Get("uploadId"))
+		writeFakeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key     string
+			ETag    string
+		}{Key: key, ETag: o.etag})
+	case http.MethodDelete:
+		delete(s.uploads, r.URL.Query().Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, bucket string, query url.Values) {
+	bucket = strings.TrimSuffix(bucket, "/")
+	prefix := bucket + "/" + query.Get("prefix")
+
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+		StorageClass string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{Name: bucket, Prefix: query.Get("prefix")}
+
+	var keys []string
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o := s.objects[k]
+		class := o.header.Get("X-Amz-Storage-Class")
+		if class == "" {
+			class = s3.StorageClassStandard
+		}
+		result.Contents = append(result.Contents, content{
+			Key:          strings.TrimPrefix(k, bucket+"/"),
+			LastModified: o.lastModified.Format(time.RFC3339),
+			ETag:         o.etag,
+			Size:         len(o.content),
+			StorageClass: class,
+		})
+	}
+	result.KeyCount = len(result.Contents)
+
+	writeFakeXML(w, result)
+}
+
+func (s *fakeS3) deleteObjects(w http.ResponseWriter, bucket string, body []byte) {
+	bucket = strings.TrimSuffix(bucket, "/")
+	var input struct {
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err := xml.Unmarshal(body, &input); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	type deleted struct {
+		Key string
+	}
+	result := struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+		Deleted []deleted
+	}{}
+	for _, o := range input.Objects {
+		delete(s.objects, bucket+"/"+o.Key)
+		result.Deleted = append(result.Deleted, deleted{o.Key})
+	}
+
+	writeFakeXML(w, result)
+}
+
+func (s *fakeS3) serveLifecycle(w http.ResponseWriter, method string, body []byte) {
+	switch method {
+	case http.MethodPut:
+		s.lifecycle = body
+	case http.MethodGet:
+		if s.lifecycle == nil {
+			writeFakeError(w, http.StatusNotFound, "NoSuchLifecycleConfiguration")
+			return
+		}
+		w.Write(s.lifecycle)
+	case http.MethodDelete:
+		s.lifecycle = nil
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *fakeS3) serveTagging(w http.ResponseWriter, method string, key string, body []byte) {
+	o, ok := s.objects[key]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	type tag struct {
+		Key   string
+		Value string
+	}
+	var tagging struct {
+		XMLName xml.Name `xml:"Tagging"`
+		TagSet  []tag    `xml:"TagSet>Tag"`
+	}
+	switch method {
+	case http.MethodPut:
+		if err := xml.Unmarshal(body, &tagging); err != nil {
+			writeFakeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		o.tags = make(url.Values)
+		for _, t := range tagging.TagSet {
+			o.tags.Set(t.Key, t.Value)
+		}
+	case http.MethodGet:
+		for k := range o.tags {
+			tagging.TagSet = append(tagging.TagSet, tag{k, o.tags.Get(k)})
+		}
+		writeFakeXML(w, tagging)
+	case http.MethodDelete:
+		o.tags = nil
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeFakeXML(w http.ResponseWriter, v interface{}) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		writeFakeError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(b)
+}
+
+func writeFakeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code></Error>`, code)
+}
+
+func cloneHeader(h http.Header) http.Header {
+	cloned := make(http.Header)
+	for k, v := range h {
+		cloned[k] = v
+	}
+
+	return cloned
+}
+
+func base64MD5(b []byte) string {
+	sum := md5.Sum(b)
+
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
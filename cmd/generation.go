@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// generationMetadataKey is the S3 metadata key of the generation of a cache, which is new on each store.
+// Parts and per-path archives have keys of their generation, and the index and the checksum have it in their metadata,
+// so that readers of a cache being overwritten never mix its objects of different generations.
+const generationMetadataKey = "Generation"
+
+// newGeneration returns a random generation of the cache being stored
+func newGeneration() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate generation of cache: %s", err)
+	}
+
+	return fmt.Sprintf("%x", b), nil
+}
+
+// objectGeneration returns the generation in the metadata, which is empty for caches stored by older versions
+func objectGeneration(metadata map[string]*string) string {
+	return aws.StringValue(metadata[generationMetadataKey])
+}
+
+// withGeneration returns the metadata with the generation, keeping the metadata as it is for empty one
+func withGeneration(metadata map[string]*string, generation string) map[string]*string {
+	if generation == "" {
+		return metadata
+	}
+
+	withGeneration := map[string]*string{generationMetadataKey: aws.String(generation)}
+	for k, v := range metadata {
+		withGeneration[k] = v
+	}
+
+	return withGeneration
+}
+
+// generationSuffix is the suffix of the keys of parts and per-path archives of the generation
+func generationSuffix(generation string) string {
+	if generation == "" {
+		return ""
+	}
+
+	return "-" + generation
+}
+
+var generationSuffixPattern = regexp.MustCompile(`-([0-9a-f]{16})(\.|$)`)
+
+// isOtherGeneration reports whether the suffix of the object key after the cache key, like .part0001-GENERATION.tar.gz,
+// has a generation other than the one, like the parts of the replaced cache left until they are deleted
+func isOtherGeneration(suffix string, generation string) bool {
+	for _, m := range generationSuffixPattern.FindAllStringSubmatch(suffix, -1) {
+		if m[1] != generation {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deleteGeneration deletes the objects of the generation under the prefix uploaded before storing it failed,
+// which are never found by readers as the object of the cache key isn't replaced
+func deleteGeneration(prefix string, generation string) error {
+	var keys []string
+	err := s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &s3Bucket,
+		Prefix: &prefix,
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if strings.Contains(*object.Key, generationSuffix(generation)) {
+				keys = append(keys, *object.Key)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %s", err)
+	}
+
+	return deleteObjects(keys)
+}
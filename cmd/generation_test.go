@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestOverwriteCacheByGeneration(t *testing.T) {
+	setupFixturesToCache(t)
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original string) { uploadPartSize = original }(uploadPartSize)
+	uploadPartSize = "5MB"
+
+	cacheKey := prefixedKey("key")
+	store := func() string {
+		err := storeTarStream(cacheKey, 512, nil, func(w io.Writer) error {
+			return writeTar(w, []string{"tmp/foo"})
+		})
+		if err != nil {
+			t.Fatalf("failed to store: %s", err)
+		}
+
+		head, err := s3Client.HeadObject(&s3.HeadObjectInput{Bucket: &s3Bucket, Key: aws.String(objectKey(cacheKey))})
+		if err != nil {
+			t.Fatalf("failed to get the cache: %s", err)
+		}
+		generation := objectGeneration(head.Metadata)
+		if generation == "" {
+			t.Fatal("the cache has no generation")
+		}
+
+		return generation
+	}
+
+	first := store()
+	replaced, err := findCacheEntry(cacheKey)
+	if err != nil {
+		t.Fatalf("failed to find the cache: %s", err)
+	}
+
+	fake.requests = nil
+	second := store()
+	if first == second {
+		t.Fatalf("the generation isn't new: %s", second)
+	}
+
+	// the object of the cache key is replaced after all the others
+	var puts []string
+	for _, r := range fake.requests {
+		if r.Method == http.MethodPut && r.Query.Get("partNumber") == "" {
+			puts = append(puts, strings.TrimPrefix(r.Key, s3Bucket+"/"))
+		}
+	}
+	n := len(puts)
+	if n < 5 || puts[n-1] != objectKey(cacheKey) || puts[n-2] != checksumKey(cacheKey) || puts[n-3] != indexKey(cacheKey) {
+		t.Fatalf("the objects are uploaded in the wrong order: %v", puts)
+	}
+	for _, key := range puts[:n-3] {
+		if !strings.HasSuffix(key, "-"+second+".tar.gz") {
+			t.Fatalf("the part doesn't have the key of the generation: %s", key)
+		}
+	}
+
+	if sum, err := storedChecksum(cacheKey, first); err != nil || sum != "" {
+		t.Fatalf("the checksum of the other generation is found: %s: %v", sum, err)
+	}
+	if sum, err := storedChecksum(cacheKey, second); err != nil || sum == "" {
+		t.Fatalf("the checksum of the generation isn't found: %v", err)
+	}
+
+	if err := deleteStaleObjects(replaced); err != nil {
+		t.Fatalf("failed to delete stale objects: %s", err)
+	}
+	for _, key := range fake.keys() {
+		if strings.Contains(key, first) {
+			t.Fatalf("the object of the replaced generation is left: %s", key)
+		}
+	}
+
+	item, err := getExactlyMatchedItem(cacheKey)
+	if err != nil {
+		t.Fatalf("failed to get the cache: %s", err)
+	}
+	body, err := newArchiveReader(item, objectKey(cacheKey))
+	if err != nil {
+		t.Fatalf("failed to read the cache: %s", err)
+	}
+	defer body.Close()
+	if _, err := readArchiveEntries(body); err != nil {
+		t.Fatalf("the parts of the generation aren't read: %s", err)
+	}
+}
+
+func TestIsOtherGeneration(t *testing.T) {
+	generation := "0123456789abcdef"
+	for suffix, expected := range map[string]bool{
+		".tar.gz":                           false,
+		".index.json":                       false,
+		".part0001-0123456789abcdef.tar.gz": false,
+		"/0000-0123456789abcdef":            false,
+		".part0001-fedcba9876543210.tar.gz": true,
+		"/0001-fedcba9876543210":            true,
+		".part0001.tar.gz":                  false,
+	} {
+		if actual := isOtherGeneration(suffix, generation); actual != expected {
+			t.Fatalf("isOtherGeneration(%s) is %v", suffix, actual)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package cmd
+
+import "os"
+
+type fileID struct{}
+
+// hardLinkID always reports false since hard links are not detected on Windows
+func hardLinkID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+var restoreRelativeTo string
+
+// expandHome expands ~ at the head of the path to the home directory, which shells don't in quotes, config files and --paths-from
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") && !strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+		return path
+	}
+
+	home := homeDir()
+	if home == "" {
+		return path
+	}
+
+	return filepath.Join(home, path[1:])
+}
+
+// expandHomes expands ~ of the paths
+func expandHomes(paths []string) []string {
+	expanded := make([]string, len(paths))
+	for i, path := range paths {
+		expanded[i] = expandHome(path)
+	}
+
+	return expanded
+}
+
+// restoredPath returns where the path of the cache is restored to.
+// Paths under the home directory where the cache is stored are restored under the current one,
+// and relative paths are restored under --restore-relative-to instead of the current directory.
+func restoredPath(meta *metadata, path string) string {
+	if !filepath.IsAbs(path) {
+		if restoreRelativeTo != "" {
+			return filepath.Join(restoreRelativeTo, path)
+		}
+		return path
+	}
+
+	home := homeDir()
+	if meta.HomeDir == "" || home == "" || filepath.Clean(meta.HomeDir) == filepath.Clean(home) {
+		return path
+	}
+
+	rel, err := filepath.Rel(meta.HomeDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+
+	return filepath.Join(home, rel)
+}
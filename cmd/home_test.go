@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandHome(t *testing.T) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", "/home/alice")
+
+	cases := map[string]string{
+		"~":                "/home/alice",
+		"~/.m2/repository": "/home/alice/.m2/repository",
+		"~bob/.m2":         "~bob/.m2",
+		"vendor/~/bundle":  "vendor/~/bundle",
+		"/var/cache/apt":   "/var/cache/apt",
+	}
+	for path, expected := range cases {
+		if actual := expandHome(path); actual != filepath.FromSlash(expected) {
+			t.Fatalf("the expansion of %s is wrong: %s", path, actual)
+		}
+	}
+}
+
+func TestRestoredPath(t *testing.T) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", "/home/bob")
+	defer func(original string) { restoreRelativeTo = original }(restoreRelativeTo)
+
+	meta := &metadata{HomeDir: "/home/alice"}
+	cases := map[string]string{
+		"/home/alice/.m2/repository": "/home/bob/.m2/repository",
+		"/home/alice":                "/home/bob",
+		"/home/alicia/.m2":           "/home/alicia/.m2",
+		"/var/cache/apt":             "/var/cache/apt",
+		"vendor/bundle":              "vendor/bundle",
+	}
+	for path, expected := range cases {
+		if actual := restoredPath(meta, path); actual != expected {
+			t.Fatalf("the restored path of %s is wrong: %s", path, actual)
+		}
+	}
+
+	restoreRelativeTo = "/builds/project"
+	if actual := restoredPath(meta, "vendor/bundle"); actual != "/builds/project/vendor/bundle" {
+		t.Fatalf("the relative path isn't restored under --restore-relative-to: %s", actual)
+	}
+	if actual := restoredPath(&metadata{}, "/home/alice/.m2"); actual != "/home/alice/.m2" {
+		t.Fatalf("the path of the cache without the home directory is moved: %s", actual)
+	}
+}
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var importOverwrite bool
+
+func init() {
+	importCmd := &cobra.Command{
+		Use:   "import [flags] [file]",
+		Short: "Import caches bundled by export into the S3 bucket",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := validateObjectOptions(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+
+			var r io.Reader = os.Stdin
+			if args[0] != "-" {
+				file, err := os.Open(args[0])
+				if err != nil {
+					log.Fatalf("failed to open exported file: %s", err)
+				}
+				defer file.Close()
+				r = file
+			}
+
+			dst := &s3Store{client: s3Client, bucket: s3Bucket, prefix: keyPrefix}
+			imported, err := importCaches(r, dst)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			log.Printf("imported %d caches to %s\n", imported, s3Bucket)
+		},
+	}
+
+	importCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket to import caches into")
+	importCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(importCmd)
+	importCmd.Flags().BoolVarP(&importOverwrite, "overwrite", "", false, "Overwrite objects which already exist in the bucket")
+	addObjectFlags(importCmd)
+
+	rootCmd.AddCommand(importCmd)
+}
+
+// importCaches puts the objects in the exported file to the store in order, so that manifests of caches are put last.
+// Objects which already exist are skipped unless --overwrite is given, keeping caches stored or overwritten in the bucket since
+// the export. It returns the number of imported caches.
+func importCaches(r io.Reader, dst objectStore) (int, error) {
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != exportManifestName {
+		return 0, fmt.Errorf("%s is missing, the file isn't exported by guruguru-cache", exportManifestName)
+	}
+	var manifest exportManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", exportManifestName, err)
+	}
+	if manifest.FormatVersion != exportFormatVersion {
+		return 0, fmt.Errorf("unsupported format version of exported file: %d", manifest.FormatVersion)
+	}
+	log.Printf("importing %d caches exported by guruguru-cache %s\n", len(manifest.Caches), manifest.ToolVersion)
+
+	// the objects of the cache keys tell caches from per-path archives and chunks
+	manifests := make(map[string]bool)
+	for _, c := range manifest.Caches {
+		manifests[strings.TrimPrefix(objectKey(prefixedKey(c)), keyPrefix)] = true
+	}
+
+	imported := 0
+	var metadata map[string]*string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, fmt.Errorf("failed to read tar entry: %s", err)
+		}
+
+		if strings.HasSuffix(hdr.Name, metadataSuffix) {
+			metadata = nil
+			if err := json.NewDecoder(tr).Decode(&metadata); err != nil {
+				return imported, fmt.Errorf("invalid metadata of %s: %s", strings.TrimSuffix(hdr.Name, metadataSuffix), err)
+			}
+			continue
+		}
+
+		key := hdr.Name
+		objectMetadata := metadata
+		metadata = nil
+
+		if !importOverwrite {
+			exists, err := dst.exists(key)
+			if err != nil {
+				return imported, err
+			}
+			if exists {
+				log.Printf("object already exists: %s\n", key)
+				continue
+			}
+		}
+
+		if err := dst.put(key, tr, objectMetadata); err != nil {
+			return imported, err
+		}
+		if manifests[key] {
+			log.Printf("imported cache: %s\n", cacheKeyFromObjectKey(key))
+			imported++
+		}
+	}
+
+	return imported, nil
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+)
+
+// indexMemberSize is the uncompressed size after which a new gzip member is started at the next entry,
+// so that entries can be decompressed from the middle of the archive
+const indexMemberSize = 1 << 20
+
+func indexKey(cacheKey string) string {
+	return cacheKey + ".index.json"
+}
+
+type archiveIndex struct {
+	Entries []indexEntry `json:"entries"`
+}
+
+// indexEntry locates an entry in the archive.
+// Decompressing from Offset of the compressed archive and discarding Skip bytes reaches the tar header of the entry.
+type indexEntry struct {
+	Name     string `json:"name"`
+	Typeflag string `json:"typeflag"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+	Skip     int64  `json:"skip"`
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// indexedGzipWriter compresses a tar stream into gzip members while indexing its entries
+type indexedGzipWriter struct {
+	out          *countingWriter
+	gw           *gzip.Writer
+	memberOffset int64
+	memberSize   int64
+	index        *archiveIndex
+}
+
+func newIndexedGzipWriter(w io.Writer) *indexedGzipWriter {
+	out := &countingWriter{w: w}
+	return &indexedGzipWriter{
+		out:   out,
+		gw:    gzip.NewWriter(out),
+		index: new(archiveIndex),
+	}
+}
+
+func (w *indexedGzipWriter) Write(p []byte) (int, error) {
+	n, err := w.gw.Write(p)
+	w.memberSize += int64(n)
+	return n, err
+}
+
+func (w *indexedGzipWriter) indexEntry(hdr *tar.Header) error {
+	if w.memberSize >= indexMemberSize {
+		if err := w.gw.Close(); err != nil {
+			return err
+		}
+
+		w.gw.Reset(w.out)
+		w.memberOffset = w.out.n
+		w.memberSize = 0
+	}
+
+	w.index.Entries = append(w.index.Entries, indexEntry{
+		Name:     hdr.Name,
+		Typeflag: string(hdr.Typeflag),
+		Size:     hdr.Size,
+		Offset:   w.memberOffset,
+		Skip:     w.memberSize,
+	})
+
+	return nil
+}
+
+func (w *indexedGzipWriter) Close() error {
+	return w.gw.Close()
+}
+
+type entryIndexer interface {
+	indexEntry(hdr *tar.Header) error
+}
+
+// writeHeader writes the tar header, indexing the entry when w supports it
+func writeHeader(tw *tar.Writer, w io.Writer, hdr *tar.Header) error {
+	if indexer, ok := w.(entryIndexer); ok {
+		// Write the padding of the previous entry so that the entry starts here
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		if err := indexer.indexEntry(hdr); err != nil {
+			return err
+		}
+	}
+
+	return tw.WriteHeader(hdr)
+}
@@ -0,0 +1,389 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+	"github.com/yuya-takeyama/guruguru-cache/template"
+)
+
+// compressionHeadSize is the size of the head of an archive read to detect its compression format
+const compressionHeadSize = tarMagicOffset + 8
+
+func init() {
+	inspectCmd := &cobra.Command{
+		Use:   "inspect [flags] [cache key]",
+		Short: "Print details of a cache without downloading it",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupTemplate(); err != nil {
+				log.Fatal(err)
+			}
+
+			cacheKey, err := template.ExecuteTemplate(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			details, err := inspectCache(cacheKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			for _, d := range details {
+				fmt.Fprintf(w, "%s:\t%s\n", d[0], d[1])
+			}
+			if err := w.Flush(); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	inspectCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of the cache")
+	inspectCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(inspectCmd)
+	addTemplateFlags(inspectCmd)
+
+	rootCmd.AddCommand(inspectCmd)
+}
+
+// inspectCache returns the details of the cache as pairs of names and values,
+// reading only the heads of archives and the index instead of whole archives
+func inspectCache(cacheKey string) ([][2]string, error) {
+	key := prefixedKey(cacheKey)
+	head, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &s3Bucket,
+		Key:    aws.String(objectKey(key)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find cache: %s: %s", cacheKey, err)
+	}
+
+	size := aws.Int64Value(head.ContentLength)
+	caches, err := listCaches(cacheKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range caches {
+		if c.Key == cacheKey {
+			size = c.Size
+		}
+	}
+
+	toolVersion := aws.StringValue(head.Metadata[toolVersionMetadataKey])
+	if toolVersion == "" {
+		toolVersion = "unknown"
+	}
+	if commit := aws.StringValue(head.Metadata[toolCommitMetadataKey]); commit != "" {
+		toolVersion += " (" + commit + ")"
+	}
+
+	layout, dataKey, err := cacheLayout(key, head.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	compression := "per path"
+	if dataKey != "" {
+		if compression, err = objectCompression(dataKey); err != nil {
+			return nil, err
+		}
+	}
+
+	meta, unknown, err := cacheMetadata(key, head.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	details := [][2]string{
+		{"Key", cacheKey},
+		{"Size", fmt.Sprintf("%s (%d bytes)", formatSize(size), size)},
+		{"Created", aws.TimeValue(head.LastModified).Format(time.RFC3339)},
+		{"Tool version", toolVersion},
+		{"Layout", layout},
+		{"Compression", compression},
+	}
+	if meta == nil {
+		return append(details, [2]string{"Paths", unknown}), nil
+	}
+
+	// the time recorded on archiving is before uploading, which may take long
+	if meta.CreatedAt != nil {
+		details[2][1] = meta.CreatedAt.Format(time.RFC3339)
+	}
+	if meta.Hostname != "" {
+		details = append(details, [2]string{"Hostname", meta.Hostname})
+	}
+	if meta.CI != nil {
+		details = append(details, [2]string{"CI", formatCI(meta.CI)})
+	}
+	if meta.KeyTemplate != "" {
+		details = append(details, [2]string{"Key template", meta.KeyTemplate})
+	}
+	if meta.Base != "" {
+		details = append(details, [2]string{"Base", fmt.Sprintf("%s (%d files removed since it)", meta.Base, len(meta.Removed))})
+	}
+
+	return append(details, [2]string{"Paths", formatPaths(meta)}), nil
+}
+
+// formatCI describes the CI build like "circleci, job test, build 42, branch master, revision 0123abc"
+func formatCI(ci *ciMetadata) string {
+	var parts []string
+	for _, p := range [][2]string{
+		{"", ci.Service},
+		{"job ", ci.JobName},
+		{"build ", ci.BuildNum},
+		{"branch ", ci.Branch},
+		{"revision ", ci.Revision},
+	} {
+		if p[1] != "" {
+			parts = append(parts, p[0]+p[1])
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// formatPaths describes the paths with their sizes and numbers of files when they're recorded
+func formatPaths(meta *metadata) string {
+	if len(meta.PathStats) != len(meta.Paths) {
+		return strings.Join(meta.Paths, ", ")
+	}
+
+	paths := make([]string, len(meta.PathStats))
+	for i, s := range meta.PathStats {
+		paths[i] = fmt.Sprintf("%s (%s in %d files)", s.Path, formatSize(s.Size), s.Files)
+	}
+
+	return strings.Join(paths, ", ")
+}
+
+// cacheLayout describes how the cache is stored and returns the key of the object starting its archive
+func cacheLayout(key string, objectMetadata map[string]*string) (string, string, error) {
+	switch {
+	case objectMetadata[partsMetadataKey] != nil:
+		return fmt.Sprintf("%s parts", aws.StringValue(objectMetadata[partsMetadataKey])), partKey(key, objectGeneration(objectMetadata), 1), nil
+	case objectMetadata[chunksMetadataKey] != nil:
+		output, err := s3Client.GetObject(&s3.GetObjectInput{
+			Bucket: &s3Bucket,
+			Key:    aws.String(objectKey(key)),
+		})
+		if err != nil {
+			return "", "", fmt.Errorf("failed to get manifest of chunks: %s", err)
+		}
+
+		defer output.Body.Close()
+
+		keys, err := chunkKeysFromManifest(output.Body)
+		if err != nil {
+			return "", "", err
+		}
+		if len(keys) < 1 {
+			return "", "", fmt.Errorf("manifest of chunks is empty: %s", key)
+		}
+
+		return fmt.Sprintf("%d chunks", len(keys)), keys[0], nil
+	case objectMetadata[pathArchivesMetadataKey] != nil:
+		return fmt.Sprintf("%s per-path archives", aws.StringValue(objectMetadata[pathArchivesMetadataKey])), "", nil
+	}
+
+	return "single object", objectKey(key), nil
+}
+
+// objectCompression detects the compression format from the head of the object
+func objectCompression(key string) (string, error) {
+	body, err := getObjectRange(key, 0, compressionHeadSize)
+	if err != nil {
+		return "", err
+	}
+
+	defer body.Close()
+
+	head, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read head of %s: %s", key, err)
+	}
+
+	switch format := compressionFormat(head); format {
+	case "":
+		return "unknown", nil
+	case "age":
+		return "encrypted with age", nil
+	default:
+		return format, nil
+	}
+}
+
+// cacheMetadata returns the metadata from the manifest of per-path archives,
+// or from metadata.json located by the index, with why it's unknown when it can't be read without downloading the cache
+func cacheMetadata(key string, objectMetadata map[string]*string) (*metadata, string, error) {
+	var meta metadata
+	if objectMetadata[pathArchivesMetadataKey] != nil {
+		output, err := s3Client.GetObject(&s3.GetObjectInput{
+			Bucket: &s3Bucket,
+			Key:    aws.String(objectKey(key)),
+		})
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get manifest of per-path archives: %s", err)
+		}
+
+		defer output.Body.Close()
+
+		br := bufio.NewReader(output.Body)
+		if head, _ := br.Peek(len(ageMagic)); bytes.Equal(head, ageMagic) {
+			return nil, "unknown (the manifest is encrypted)", nil
+		}
+
+		manifest, err := readPathArchivesManifest(br)
+		return manifest, "", err
+	}
+
+	// offsets in the index of split caches are of the whole archive over the parts
+	if objectMetadata[partsMetadataKey] != nil {
+		return nil, "unknown (the cache is split into parts)", nil
+	}
+
+	index, err := getArchiveIndex(key, objectGeneration(objectMetadata))
+	if err != nil {
+		return nil, "", err
+	}
+	if index == nil {
+		return nil, "unknown (the cache has no index)", nil
+	}
+
+	for _, entry := range index.Entries {
+		if entry.Name != "metadata.json" {
+			continue
+		}
+
+		content, err := readIndexedEntry(objectKey(key), entry)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := json.Unmarshal(content, &meta); err != nil {
+			return nil, "", fmt.Errorf("failed to decode metadata file: %s", err)
+		}
+
+		return &meta, "", nil
+	}
+
+	return nil, "", fmt.Errorf("metadata.json is not found in the index")
+}
+
+// getArchiveIndex returns the index of the archive of the generation, or nil if the cache has no index of it
+// like while the cache is being overwritten
+func getArchiveIndex(key string, generation string) (*archiveIndex, error) {
+	ixKey := indexKey(key)
+	exists, err := objectExists(ixKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check index: %s", err)
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: &s3Bucket,
+		Key:    &ixKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get index: %s", err)
+	}
+
+	defer output.Body.Close()
+
+	if objectGeneration(output.Metadata) != generation {
+		return nil, nil
+	}
+
+	index := new(archiveIndex)
+	if err := json.NewDecoder(output.Body).Decode(index); err != nil {
+		return nil, fmt.Errorf("failed to decode index: %s", err)
+	}
+
+	return index, nil
+}
+
+// readIndexedEntry reads the content of the entry, downloading the archive only from its gzip member
+func readIndexedEntry(key string, entry indexEntry) ([]byte, error) {
+	body, err := getObjectRange(key, entry.Offset, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	defer body.Close()
+
+	return readEntry(body, entry)
+}
+
+// readEntry reads the content of the entry from the archive starting at the gzip member of the entry
+func readEntry(r io.Reader, entry indexEntry) ([]byte, error) {
+	tr, err := openEntry(r, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", entry.Name, err)
+	}
+
+	return content, nil
+}
+
+// openEntry returns the reader of the content of the entry from the archive starting at the gzip member of the entry
+func openEntry(r io.Reader, entry indexEntry) (io.Reader, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress archive: %s", err)
+	}
+	if _, err := io.CopyN(ioutil.Discard, gr, entry.Skip); err != nil {
+		return nil, fmt.Errorf("failed to seek to %s: %s", entry.Name, err)
+	}
+
+	tr := tar.NewReader(gr)
+	if _, err := tr.Next(); err != nil {
+		return nil, fmt.Errorf("failed to read tar header of %s: %s", entry.Name, err)
+	}
+
+	return tr, nil
+}
+
+// getObjectRange gets length bytes of the object from start, or the rest of it when length is negative
+func getObjectRange(key string, start int64, length int64) (io.ReadCloser, error) {
+	r := "bytes=" + strconv.FormatInt(start, 10) + "-"
+	if length >= 0 {
+		r += strconv.FormatInt(start+length-1, 10)
+	}
+
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: &s3Bucket,
+		Key:    &key,
+		Range:  &r,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %s", key, err)
+	}
+
+	return output.Body, nil
+}
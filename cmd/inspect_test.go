@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestReadEntry(t *testing.T) {
+	setupFixturesToCache(t)
+
+	buf := new(bytes.Buffer)
+	index, err := writeArchive(buf, []string{"tmp/foo", "tmp/abc/def"})
+	if err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	var entry *indexEntry
+	for i := range index.Entries {
+		if index.Entries[i].Name == "metadata.json" {
+			entry = &index.Entries[i]
+		}
+	}
+	if entry == nil {
+		t.Fatalf("metadata.json is not indexed")
+	}
+
+	content, err := readEntry(bytes.NewReader(buf.Bytes()[entry.Offset:]), *entry)
+	if err != nil {
+		t.Fatalf("failed to read the indexed entry: %s", err)
+	}
+	var meta metadata
+	if err := json.Unmarshal(content, &meta); err != nil {
+		t.Fatalf("failed to decode metadata.json: %s", err)
+	}
+	if !reflect.DeepEqual(meta.Paths, []string{"tmp/foo", "tmp/abc/def"}) || meta.ToolVersion != "dev" || meta.CreatedAt == nil {
+		t.Fatalf("the content of metadata.json is wrong: %s", content)
+	}
+
+	expected := []pathStats{
+		{Path: "tmp/foo", Size: 12, Files: 1},
+		{Path: "tmp/abc/def", Size: 0, Files: 0},
+	}
+	if !reflect.DeepEqual(meta.PathStats, expected) {
+		t.Fatalf("the stats of paths are wrong: %#v", meta.PathStats)
+	}
+}
+
+func TestFormatCI(t *testing.T) {
+	ci := &ciMetadata{Service: "circleci", Branch: "master", Revision: "0123abc", BuildNum: "42", JobName: "test"}
+	if actual := formatCI(ci); actual != "circleci, job test, build 42, branch master, revision 0123abc" {
+		t.Fatalf("the description of the CI build is wrong: %s", actual)
+	}
+
+	// out of CI, only git is detected
+	if actual := formatCI(&ciMetadata{Branch: "master"}); actual != "branch master" {
+		t.Fatalf("the description of the CI build is wrong: %s", actual)
+	}
+}
+
+func TestFormatPaths(t *testing.T) {
+	meta := &metadata{Paths: []string{"tmp/foo", "tmp/abc"}}
+	if actual := formatPaths(meta); actual != "tmp/foo, tmp/abc" {
+		t.Fatalf("paths without stats are wrong: %s", actual)
+	}
+
+	meta.PathStats = []pathStats{{Path: "tmp/foo", Size: 12, Files: 1}, {Path: "tmp/abc", Size: 2048, Files: 3}}
+	if actual := formatPaths(meta); actual != "tmp/foo (12B in 1 files), tmp/abc (2.0KB in 3 files)" {
+		t.Fatalf("paths with stats are wrong: %s", actual)
+	}
+}
+
+func TestCompressionFormat(t *testing.T) {
+	tarHead := make([]byte, tarMagicOffset+8)
+	copy(tarHead[tarMagicOffset:], tarMagic)
+
+	cases := map[string][]byte{
+		"gzip": {0x1f, 0x8b, 0x08},
+		"zstd": {0x28, 0xb5, 0x2f, 0xfd, 0x00},
+		"lz4":  {0x04, 0x22, 0x4d, 0x18},
+		"age":  []byte("age-encryption.org/v1\n"),
+		"tar":  tarHead,
+		"":     []byte("PK\x03\x04"),
+	}
+
+	for expected, head := range cases {
+		if actual := compressionFormat(head); actual != expected {
+			t.Fatalf("the format of %q is wrong: %s", expected, actual)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/yuya-takeyama/guruguru-cache/template"
+)
+
+var explainKey bool
+
+func init() {
+	keyCmd := &cobra.Command{
+		Use:   "key [flags] [cache key templates...]",
+		Short: "Print cache keys rendered from templates without storing or restoring caches",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupTemplate(); err != nil {
+				log.Fatal(err)
+			}
+
+			first, rest, err := keyTemplateArgs(args)
+			if err != nil {
+				log.Fatal(err)
+			}
+			named, err := selectedCache()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			for _, key := range append(append([]string{first}, rest...), named.RestoreKeys...) {
+				if !explainKey {
+					cacheKey, err := template.ExecuteTemplate(key)
+					if err != nil {
+						log.Fatal(err)
+					}
+					fmt.Println(cacheKey)
+					continue
+				}
+
+				cacheKey, calls, err := template.ExplainTemplate(key)
+				printCalls(os.Stderr, calls)
+				if err != nil {
+					log.Fatal(err)
+				}
+				fmt.Println(cacheKey)
+			}
+		},
+	}
+
+	addTemplateFlags(keyCmd)
+	addKeyFlags(keyCmd)
+	keyCmd.Flags().BoolVarP(&explainKey, "explain", "", false, "Print calls of functions and the files they read to stderr")
+
+	rootCmd.AddCommand(keyCmd)
+}
+
+// printCalls prints the calls of functions in a cache key template like `checksum "go.sum" => 0123abcd`
+func printCalls(w io.Writer, calls []template.Call) {
+	for _, call := range calls {
+		fmt.Fprintf(w, "%s => %s\n", strings.Join(append([]string{call.Func}, call.Args...), " "), call.Result)
+		for _, file := range call.Files {
+			fmt.Fprintf(w, "  %s\n", file)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+	"github.com/yuya-takeyama/guruguru-cache/template"
+)
+
+var valuesFile string
+var hashLongKeys bool
+var templateDelims string
+var allowedEnvs []string
+var keyFile string
+var cacheName string
+
+// addTemplateFlags adds the flags for cache key templates shared by commands
+func addTemplateFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVarP(&hashLongKeys, "hash-long-keys", "", false, "Shorten too long cache keys with their hash instead of failing")
+	cmd.Flags().StringVarP(&templateDelims, "template-delims", "", "", "Delimiters of cache key templates like \"[[ ]]\" instead of \"{{ }}\"")
+	cmd.Flags().StringArrayVarP(&allowedEnvs, "allow-env", "", nil, "Expose only environment variables matching the pattern like NODE_* to cache key templates (can be repeated)")
+	cmd.Flags().StringVarP(&valuesFile, "values", "", "", "JSON or YAML file exposed to cache key templates as .Values")
+}
+
+// addKeyFlags adds the flags giving the cache key instead of the first argument
+func addKeyFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&keyFile, "key-file", "", "", "File of the cache key template used instead of the cache key argument")
+	cmd.Flags().StringVarP(&cacheName, "cache", "", "", "Name of the cache in the config file used instead of the cache key argument")
+	cmd.MarkFlagCustom("cache", cacheNamesCompletion)
+}
+
+// keyTemplateArgs returns the first cache key template from --key-file, --cache or the arguments, and the rest of the arguments
+func keyTemplateArgs(args []string) (string, []string, error) {
+	if keyFile != "" && cacheName != "" {
+		return "", nil, fmt.Errorf("--key-file can't be used with --cache")
+	}
+
+	if keyFile != "" {
+		content, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read key file: %s", err)
+		}
+
+		return string(content), args, nil
+	}
+
+	if cacheName != "" {
+		c, err := selectedCache()
+		if err != nil {
+			return "", nil, err
+		}
+
+		return c.Key, args, nil
+	}
+
+	if len(args) < 1 {
+		return "", nil, fmt.Errorf("cache key is required")
+	}
+
+	return args[0], args[1:], nil
+}
+
+// renderCacheKeys returns the prefixed cache keys rendered from the arguments or the named cache, followed by its restore keys
+func renderCacheKeys(args []string) ([]string, error) {
+	keyTemplate, fallbackKeys, err := keyTemplateArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	named, err := selectedCache()
+	if err != nil {
+		return nil, err
+	}
+
+	var cacheKeys []string
+	for _, key := range append(append([]string{keyTemplate}, fallbackKeys...), named.RestoreKeys...) {
+		cacheKey, err := template.ExecuteTemplate(key)
+		if err != nil {
+			return nil, err
+		}
+		cacheKeys = append(cacheKeys, prefixedKey(cacheKey))
+	}
+
+	return cacheKeys, nil
+}
+
+// selectedCache returns the named cache given by --cache, or an empty one without it
+func selectedCache() (namedCache, error) {
+	if cacheName == "" {
+		return namedCache{}, nil
+	}
+
+	c, ok := loadedConfig.Caches[cacheName]
+	if !ok {
+		return namedCache{}, fmt.Errorf("cache is not defined in config: %s", cacheName)
+	}
+
+	return c, nil
+}
+
+// setupTemplate applies the options given by flags to cache key templates
+func setupTemplate() error {
+	template.HashLongKeys = hashLongKeys
+	template.ToolVersion = Version
+
+	if templateDelims != "" {
+		if err := template.SetDelims(templateDelims); err != nil {
+			return err
+		}
+	}
+
+	if len(allowedEnvs) > 0 {
+		if err := template.SetAllowedEnvs(allowedEnvs); err != nil {
+			return err
+		}
+	}
+
+	if valuesFile != "" {
+		if err := template.LoadValues(valuesFile); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestKeyTemplateArgs(t *testing.T) {
+	key, rest, err := keyTemplateArgs([]string{"gem-v1", "vendor/bundle"})
+	if err != nil || key != "gem-v1" || !reflect.DeepEqual(rest, []string{"vendor/bundle"}) {
+		t.Fatalf("arguments are split wrongly: %s %v: %v", key, rest, err)
+	}
+	if _, _, err := keyTemplateArgs(nil); err == nil {
+		t.Fatal("missing cache key is accepted")
+	}
+
+	dir, err := ioutil.TempDir("", "guruguru-cache-test-")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { keyFile = "" }()
+
+	keyFile = filepath.Join(dir, "key.tmpl")
+	if err := ioutil.WriteFile(keyFile, []byte("gem-v1-\n{{- checksum \"Gemfile.lock\" }}\n"), 0644); err != nil {
+		log.Fatalf("failed to write key file: %s", err)
+	}
+
+	key, rest, err = keyTemplateArgs([]string{"vendor/bundle"})
+	if err != nil || key != "gem-v1-\n{{- checksum \"Gemfile.lock\" }}\n" || !reflect.DeepEqual(rest, []string{"vendor/bundle"}) {
+		t.Fatalf("key file is read wrongly: %q %v: %v", key, rest, err)
+	}
+}
@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/yuya-takeyama/guruguru-cache/template"
+)
+
+func TestPrintCalls(t *testing.T) {
+	buf := new(bytes.Buffer)
+	printCalls(buf, []template.Call{
+		{Func: "checksum", Args: []string{`"go.sum"`, `"web/*.lock"`}, Result: "0123abcd", Files: []string{"go.sum", "web/yarn.lock"}},
+		{Func: "arch", Result: "amd64"},
+	})
+
+	expected := `checksum "go.sum" "web/*.lock" => 0123abcd
+  go.sum
+  web/yarn.lock
+arch => amd64
+`
+	if buf.String() != expected {
+		t.Fatalf("output is wrong: %s", buf.String())
+	}
+}
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+)
+
+var ttlDays int64
+var abortIncompleteDays int64
+var lifecycleWholeBucket bool
+
+func init() {
+	lifecycleCmd := &cobra.Command{
+		Use:   "lifecycle",
+		Short: "Manage lifecycle rules of the S3 bucket for caches",
+	}
+
+	applyCmd := &cobra.Command{
+		Use:   "apply [flags]",
+		Short: "Configure a lifecycle rule expiring caches under the prefix",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+
+			if err := validateLifecycleOptions(); err != nil {
+				log.Fatal(err)
+			}
+
+			if err := applyLifecycleRule(); err != nil {
+				log.Fatal(err)
+			}
+
+			log.Printf("lifecycle rule is applied: %s\n", lifecycleRuleID(keyPrefix))
+		},
+	}
+
+	applyCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket to configure")
+	applyCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(applyCmd)
+	applyCmd.Flags().Int64VarP(&ttlDays, "ttl-days", "", 14, "Days to keep caches after they are stored")
+	applyCmd.Flags().Int64VarP(&abortIncompleteDays, "abort-incomplete-days", "", 1, "Days to abort incomplete multipart uploads after they are started")
+	applyCmd.Flags().BoolVarP(&lifecycleWholeBucket, "whole-bucket", "", false, "Apply the rules to the whole bucket without --prefix")
+
+	lifecycleCmd.AddCommand(applyCmd)
+	rootCmd.AddCommand(lifecycleCmd)
+}
+
+// validateLifecycleOptions requires --prefix unless --whole-bucket is given,
+// as the rule aborting incomplete uploads applies to all the objects under the prefix
+func validateLifecycleOptions() error {
+	if ttlDays < 1 {
+		return fmt.Errorf("TTL days must be positive: %d", ttlDays)
+	}
+	if abortIncompleteDays < 1 {
+		return fmt.Errorf("days to abort incomplete uploads must be positive: %d", abortIncompleteDays)
+	}
+	if keyPrefix == "" && !lifecycleWholeBucket {
+		return fmt.Errorf("--prefix is required to apply the rules, or give --whole-bucket to apply them to the whole bucket")
+	}
+
+	return nil
+}
+
+// lifecycleRuleID identifies the rule for a prefix so that applying it again replaces the rule
+func lifecycleRuleID(prefix string) string {
+	return "guruguru-cache:" + prefix
+}
+
+// applyLifecycleRule adds or replaces the rules for the prefix, keeping the other rules of the bucket.
+// Only objects with the tag of caches expire, as chunks shared with newer caches don't have it and are deleted by prune.
+func applyLifecycleRule() error {
+	rules, err := getLifecycleRules()
+	if err != nil {
+		return err
+	}
+
+	id := lifecycleRuleID(keyPrefix)
+	rules = replaceLifecycleRule(rules, &s3.LifecycleRule{
+		ID:     aws.String(id),
+		Status: aws.String(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{
+			And: &s3.LifecycleRuleAndOperator{
+				Prefix: aws.String(keyPrefix),
+				Tags:   []*s3.Tag{{Key: aws.String(expiringTagKey), Value: aws.String(expiringTagValue)}},
+			},
+		},
+		Expiration: &s3.LifecycleExpiration{
+			Days: aws.Int64(ttlDays),
+		},
+	})
+	// S3 doesn't allow rules filtered by tags to abort incomplete multipart uploads
+	rules = replaceLifecycleRule(rules, &s3.LifecycleRule{
+		ID:     aws.String(id + ":abort-incomplete"),
+		Status: aws.String(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{
+			Prefix: aws.String(keyPrefix),
+		},
+		AbortIncompleteMultipartUpload: &s3.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int64(abortIncompleteDays),
+		},
+	})
+
+	_, err = s3Client.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket: &s3Bucket,
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{
+			Rules: rules,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put lifecycle configuration: %s", err)
+	}
+
+	return nil
+}
+
+// replaceLifecycleRule replaces the rule of the same ID, or adds the rule
+func replaceLifecycleRule(rules []*s3.LifecycleRule, rule *s3.LifecycleRule) []*s3.LifecycleRule {
+	for i, r := range rules {
+		if aws.StringValue(r.ID) == aws.StringValue(rule.ID) {
+			rules[i] = rule
+			return rules
+		}
+	}
+
+	return append(rules, rule)
+}
+
+func getLifecycleRules() ([]*s3.LifecycleRule, error) {
+	output, err := s3Client.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{
+		Bucket: &s3Bucket,
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchLifecycleConfiguration" {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to get lifecycle configuration: %s", err)
+	}
+
+	return output.Rules, nil
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestValidateLifecycleOptions(t *testing.T) {
+	defer func(prefix string, ttl int64, abort int64, whole bool) {
+		keyPrefix, ttlDays, abortIncompleteDays, lifecycleWholeBucket = prefix, ttl, abort, whole
+	}(keyPrefix, ttlDays, abortIncompleteDays, lifecycleWholeBucket)
+	ttlDays, abortIncompleteDays = 14, 1
+
+	keyPrefix, lifecycleWholeBucket = "", false
+	if err := validateLifecycleOptions(); err == nil {
+		t.Fatal("rules for the whole bucket are applied without --whole-bucket")
+	}
+
+	keyPrefix = "org/repo/"
+	if err := validateLifecycleOptions(); err != nil {
+		t.Fatalf("rules for the prefix are invalid: %s", err)
+	}
+
+	keyPrefix, lifecycleWholeBucket = "", true
+	if err := validateLifecycleOptions(); err != nil {
+		t.Fatalf("rules for the whole bucket are invalid: %s", err)
+	}
+
+	ttlDays = 0
+	if err := validateLifecycleOptions(); err == nil {
+		t.Fatal("zero TTL days is valid")
+	}
+}
+
+func TestApplyLifecycleRule(t *testing.T) {
+	_, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(prefix string, ttl int64, abort int64) {
+		keyPrefix, ttlDays, abortIncompleteDays = prefix, ttl, abort
+	}(keyPrefix, ttlDays, abortIncompleteDays)
+	keyPrefix, ttlDays, abortIncompleteDays = "org/repo/", 14, 1
+
+	other := &s3.LifecycleRule{
+		ID:         aws.String("logs"),
+		Status:     aws.String(s3.ExpirationStatusEnabled),
+		Filter:     &s3.LifecycleRuleFilter{Prefix: aws.String("logs/")},
+		Expiration: &s3.LifecycleExpiration{Days: aws.Int64(30)},
+	}
+	_, err := s3Client.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 &s3Bucket,
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: []*s3.LifecycleRule{other}},
+	})
+	if err != nil {
+		t.Fatalf("failed to put lifecycle configuration: %s", err)
+	}
+
+	if err := applyLifecycleRule(); err != nil {
+		t.Fatalf("failed to apply the rules: %s", err)
+	}
+	ttlDays = 7
+	if err := applyLifecycleRule(); err != nil {
+		t.Fatalf("failed to apply the rules again: %s", err)
+	}
+
+	rules, err := getLifecycleRules()
+	if err != nil {
+		t.Fatalf("failed to get the rules: %s", err)
+	}
+	if len(rules) != 3 || aws.StringValue(rules[0].ID) != "logs" {
+		t.Fatalf("rules aren't replaced keeping the others: %v", rules)
+	}
+
+	expiration := rules[1]
+	if aws.Int64Value(expiration.Expiration.Days) != 7 {
+		t.Fatalf("TTL days aren't replaced: %v", expiration)
+	}
+	filter := expiration.Filter.And
+	if filter == nil || aws.StringValue(filter.Prefix) != "org/repo/" || len(filter.Tags) != 1 || aws.StringValue(filter.Tags[0].Key) != expiringTagKey {
+		t.Fatalf("caches aren't selected by the prefix and the tag: %v", expiration.Filter)
+	}
+
+	abort := rules[2]
+	if aws.StringValue(abort.Filter.Prefix) != "org/repo/" || aws.Int64Value(abort.AbortIncompleteMultipartUpload.DaysAfterInitiation) != 1 {
+		t.Fatalf("rule aborting incomplete uploads is wrong: %v", abort)
+	}
+}
@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+)
+
+var listJSON bool
+
+func init() {
+	listCmd := &cobra.Command{
+		Use:   "list [flags] [prefix]",
+		Short: "List caches with their sizes and modification times",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+
+			prefix := ""
+			if len(args) > 0 {
+				prefix = args[0]
+			}
+
+			caches, err := listCaches(prefix)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if listJSON {
+				err = printCachesJSON(caches)
+			} else {
+				err = printCaches(caches)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	listCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches")
+	listCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(listCmd)
+	listCmd.Flags().BoolVarP(&listJSON, "json", "", false, "Print caches as JSON")
+
+	rootCmd.AddCommand(listCmd)
+}
+
+// cacheEntry is a cache with all the objects it consists of, except chunks shared with other caches
+type cacheEntry struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	objects      []*s3.Object
+	complete     bool
+}
+
+// listCaches lists the caches whose keys start with the prefix, sorted by their keys
+func listCaches(prefix string) ([]*cacheEntry, error) {
+	objects, err := listObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return groupCacheObjects(prefixedKey(""), objects)
+}
+
+// listObjects lists all the objects whose keys start with the prefix after --prefix and the format version
+func listObjects(prefix string) ([]*s3.Object, error) {
+	var objects []*s3.Object
+	err := s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &s3Bucket,
+		Prefix: aws.String(prefixedKey(prefix)),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		objects = append(objects, page.Contents...)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %s", err)
+	}
+
+	return objects, nil
+}
+
+// groupCacheObjects groups objects under the root into caches.
+// Objects of caches whose manifest object doesn't exist, like ones being uploaded, are left out.
+func groupCacheObjects(root string, objects []*s3.Object) ([]*cacheEntry, error) {
+	entries := make(map[string]*cacheEntry)
+	for _, object := range objects {
+		key := strings.TrimPrefix(aws.StringValue(object.Key), root)
+		if strings.HasPrefix(key, chunkStorePrefix) {
+			continue
+		}
+
+		cacheKey := ownerCacheKey(key)
+		if cacheKey == "" {
+			continue
+		}
+
+		entry, ok := entries[cacheKey]
+		if !ok {
+			entry = &cacheEntry{Key: cacheKey}
+			entries[cacheKey] = entry
+		}
+		entry.Size += aws.Int64Value(object.Size)
+		entry.objects = append(entry.objects, object)
+		if key == objectKey(cacheKey) {
+			entry.LastModified = aws.TimeValue(object.LastModified)
+			entry.complete = true
+		}
+	}
+
+	// per-path archives like key/0000-GENERATION belong to the cache of key
+	parents := newPathArchiveParents(root)
+	for cacheKey, entry := range entries {
+		m := pathArchiveCacheKeyPattern.FindStringSubmatch(cacheKey)
+		if m == nil {
+			continue
+		}
+		if parent, ok := entries[m[1]]; !ok || !parent.complete {
+			continue
+		}
+
+		parentKey, err := parents.parentOf(cacheKey)
+		if err != nil {
+			return nil, err
+		}
+		if parent, ok := entries[parentKey]; ok {
+			parent.Size += entry.Size
+			parent.objects = append(parent.objects, entry.objects...)
+			delete(entries, cacheKey)
+		}
+	}
+
+	var caches []*cacheEntry
+	for _, entry := range entries {
+		if entry.complete {
+			caches = append(caches, entry)
+		}
+	}
+	sort.Slice(caches, func(i, j int) bool {
+		return caches[i].Key < caches[j].Key
+	})
+
+	return caches, nil
+}
+
+// ownerCacheKey returns the key of the cache the object belongs to, or empty for objects not of caches
+func ownerCacheKey(key string) string {
+	switch {
+	case strings.HasSuffix(key, ".index.json"):
+		return strings.TrimSuffix(key, ".index.json")
+	case strings.HasSuffix(key, ".sha256"):
+		return strings.TrimSuffix(key, ".sha256")
+	case partKeyPattern.MatchString(key):
+		return partKeyPattern.ReplaceAllString(key, "")
+	case strings.HasSuffix(key, ".tar.gz"):
+		return cacheKeyFromObjectKey(key)
+	}
+
+	return ""
+}
+
+func printCaches(caches []*cacheEntry) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LAST MODIFIED\tSIZE\tKEY")
+	for _, c := range caches {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.LastModified.Format(time.RFC3339), formatSize(c.Size), c.Key)
+	}
+
+	return w.Flush()
+}
+
+func printCachesJSON(caches []*cacheEntry) error {
+	if caches == nil {
+		caches = []*cacheEntry{}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(caches); err != nil {
+		return fmt.Errorf("failed to encode caches as JSON: %s", err)
+	}
+
+	return nil
+}
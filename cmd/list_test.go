@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestGroupCacheObjects(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	fake.put("v1/per-path.tar.gz", nil, map[string]string{pathArchivesMetadataKey: "2", generationMetadataKey: "0123456789abcdef"})
+	fake.put("v1/gem-v1.tar.gz", nil, nil)
+
+	modified := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	object := func(key string, size int64) *s3.Object {
+		return &s3.Object{Key: aws.String(key), Size: aws.Int64(size), LastModified: aws.Time(modified)}
+	}
+
+	objects := []*s3.Object{
+		object("v1/chunks/0123.gz", 100),
+		object("v1/gem-v1.tar.gz", 10),
+		object("v1/gem-v1.index.json", 1),
+		object("v1/gem-v1.sha256", 64),
+		object("v1/node-v1.tar.gz", 0),
+		object("v1/node-v1.part0001.tar.gz", 20),
+		object("v1/node-v1.part0002.tar.gz", 5),
+		object("v1/per-path.tar.gz", 2),
+		object("v1/gem-v1/2024.tar.gz", 4),
+		object("v1/gem-v1/0000-0123456789abcdef.tar.gz", 8),
+		object("v1/per-path/0000-0123456789abcdef.tar.gz", 30),
+		object("v1/per-path/0001-0123456789abcdef.part0001-fedcba9876543210.tar.gz", 40),
+		object("v1/uploading.part0001.tar.gz", 50),
+		object("v1/README", 3),
+	}
+
+	// keys of caches like per-path archives are told from them by the metadata of their parents
+	caches, err := groupCacheObjects("v1/", objects)
+	if err != nil {
+		t.Fatalf("failed to group objects: %s", err)
+	}
+
+	var keys []string
+	sizes := make(map[string]int64)
+	for _, c := range caches {
+		keys = append(keys, c.Key)
+		sizes[c.Key] = c.Size
+		if !c.LastModified.Equal(modified) {
+			t.Fatalf("last modified of %s is wrong: %s", c.Key, c.LastModified)
+		}
+	}
+
+	if !reflect.DeepEqual(keys, []string{"gem-v1", "gem-v1/0000-0123456789abcdef", "gem-v1/2024", "node-v1", "per-path"}) {
+		t.Fatalf("grouped caches are wrong: %v", keys)
+	}
+	expected := map[string]int64{"gem-v1": 75, "gem-v1/0000-0123456789abcdef": 8, "gem-v1/2024": 4, "node-v1": 25, "per-path": 72}
+	if !reflect.DeepEqual(sizes, expected) {
+		t.Fatalf("sizes of caches are wrong: %v", sizes)
+	}
+}
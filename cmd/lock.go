@@ -0,0 +1,297 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+	"github.com/yuya-takeyama/guruguru-cache/template"
+)
+
+// lockedExitCode is the exit code of lock when the lock is held by others, distinct from 1 of errors and 2 of cache misses
+const lockedExitCode = 3
+
+// lockPollInterval is the interval to try to acquire a lock held by others while waiting
+const lockPollInterval = 5 * time.Second
+
+// errLockHeld is returned when the lock is still held by others after waiting
+var errLockHeld = errors.New("lock is held by others")
+
+var lockTTL time.Duration
+var lockWait time.Duration
+var lockToken string
+var unlockForce bool
+var withLock bool
+var storeLockWait time.Duration
+
+// cacheLock is the content of the lock object of a cache key, where only the holder knows the token
+type cacheLock struct {
+	Token      string    `json:"token"`
+	Owner      string    `json:"owner"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func init() {
+	lockCmd := &cobra.Command{
+		Use:   "lock [flags] [cache key]",
+		Short: "Acquire the lock of a cache key, printing the token to release it",
+		Long: `Acquire the lock of a cache key, printing the token to release it.
+
+The lock is an object created with a conditional request of S3, so only one job holds it at a time.
+It exits with 3 when the lock is still held by others after --wait.
+Locks not released within --ttl are taken over, in case their holders die.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := validateObjectOptions(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupTemplate(); err != nil {
+				log.Fatal(err)
+			}
+
+			cacheKey, err := template.ExecuteTemplate(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+			cacheKey = prefixedKey(cacheKey)
+
+			token, err := acquireLock(cacheKey, lockTTL, lockWait)
+			if err == errLockHeld {
+				log.Printf("lock is held by others: %s\n", cacheKey)
+				os.Exit(lockedExitCode)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			fmt.Println(token)
+		},
+	}
+
+	lockCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches")
+	lockCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(lockCmd)
+	addTemplateFlags(lockCmd)
+	lockCmd.Flags().DurationVarP(&lockTTL, "ttl", "", time.Hour, "Duration after which the lock can be taken over by others")
+	lockCmd.Flags().DurationVarP(&lockWait, "wait", "", 0, "Duration to wait for the lock held by others like 10m")
+	lockCmd.Flags().StringVarP(&sse, "sse", "", "", "Server-side encryption algorithm of the lock object (AES256 or aws:kms)")
+	lockCmd.Flags().StringVarP(&sseKMSKeyID, "sse-kms-key-id", "", "", "KMS key ID for server-side encryption with aws:kms")
+
+	unlockCmd := &cobra.Command{
+		Use:   "unlock [flags] [cache key]",
+		Short: "Release the lock of a cache key acquired by lock",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupTemplate(); err != nil {
+				log.Fatal(err)
+			}
+			if lockToken == "" && !unlockForce {
+				log.Fatal("--token printed by lock or --force is required")
+			}
+
+			cacheKey, err := template.ExecuteTemplate(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if err := releaseLock(prefixedKey(cacheKey), lockToken, unlockForce); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	unlockCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches")
+	unlockCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(unlockCmd)
+	addTemplateFlags(unlockCmd)
+	unlockCmd.Flags().StringVarP(&lockToken, "token", "", "", "Token printed by lock")
+	unlockCmd.Flags().BoolVarP(&unlockForce, "force", "", false, "Release the lock even if it's held by others")
+
+	rootCmd.AddCommand(lockCmd)
+	rootCmd.AddCommand(unlockCmd)
+}
+
+func lockKey(cacheKey string) string {
+	return cacheKey + ".lock"
+}
+
+// acquireLock tries to acquire the lock until wait elapses, returning the token of the lock
+func acquireLock(cacheKey string, ttl time.Duration, wait time.Duration) (string, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		token, holder, err := tryLock(cacheKey, ttl)
+		if err != nil {
+			return "", err
+		}
+		if token != "" {
+			log.Printf("acquired lock: %s\n", cacheKey)
+			return token, nil
+		}
+
+		if holder != nil {
+			log.Printf("lock is held by %s until %s: %s\n", holder.Owner, holder.ExpiresAt.Format(time.RFC3339), cacheKey)
+		}
+		if !time.Now().Add(lockPollInterval).Before(deadline) {
+			return "", errLockHeld
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// tryLock creates the lock object only if it doesn't exist, or replaces it only if it's expired and unchanged.
+// It returns an empty token with the current lock when it's held by others.
+func tryLock(cacheKey string, ttl time.Duration) (string, *cacheLock, error) {
+	lock, err := newCacheLock(ttl)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ok, err := putLock(cacheKey, lock, ifHeader("If-None-Match", "*"))
+	if err != nil || ok {
+		return lock.Token, nil, err
+	}
+
+	current, etag, err := getLock(cacheKey)
+	if err != nil || current == nil {
+		// released just now, which is tried again after the interval
+		return "", nil, err
+	}
+	if time.Now().Before(current.ExpiresAt) {
+		return "", current, nil
+	}
+
+	log.Printf("taking over the lock expired at %s from %s\n", current.ExpiresAt.Format(time.RFC3339), current.Owner)
+	ok, err = putLock(cacheKey, lock, ifHeader("If-Match", etag))
+	if err != nil || ok {
+		return lock.Token, nil, err
+	}
+
+	return "", current, nil
+}
+
+// releaseLock deletes the lock object if it's held with the token, only if it's unchanged since read,
+// so that the lock taken over by others meanwhile isn't deleted
+func releaseLock(cacheKey string, token string, force bool) error {
+	current, etag, err := getLock(cacheKey)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		log.Printf("lock isn't held: %s\n", cacheKey)
+		return nil
+	}
+	if !force && current.Token != token {
+		return fmt.Errorf("lock is held by %s with another token: %s", current.Owner, cacheKey)
+	}
+
+	key := lockKey(cacheKey)
+	_, err = s3Client.DeleteObjectWithContext(aws.BackgroundContext(), &s3.DeleteObjectInput{Bucket: &s3Bucket, Key: &key}, ifHeader("If-Match", etag))
+	if err != nil {
+		if errorCode(err) == "PreconditionFailed" {
+			return fmt.Errorf("lock is taken over by others: %s", cacheKey)
+		}
+
+		return fmt.Errorf("failed to delete lock: %s", err)
+	}
+	log.Printf("released lock: %s\n", cacheKey)
+
+	return nil
+}
+
+func newCacheLock(ttl time.Duration) (*cacheLock, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("failed to generate token: %s", err)
+	}
+
+	owner := fmt.Sprintf("pid %d", os.Getpid())
+	if hostname, err := os.Hostname(); err == nil {
+		owner = fmt.Sprintf("%s (pid %d)", hostname, os.Getpid())
+	}
+
+	now := time.Now()
+	return &cacheLock{
+		Token:      hex.EncodeToString(token),
+		Owner:      owner,
+		AcquiredAt: now.UTC(),
+		ExpiresAt:  now.Add(ttl).UTC(),
+	}, nil
+}
+
+// putLock puts the lock object conditionally, reporting false when the condition fails
+func putLock(cacheKey string, lock *cacheLock, condition request.Option) (bool, error) {
+	content, err := json.Marshal(lock)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode lock: %s", err)
+	}
+
+	key := lockKey(cacheKey)
+	input := &s3.PutObjectInput{
+		Bucket: &s3Bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(content),
+	}
+	// encrypted like the objects of the cache, as the bucket policy may deny unencrypted puts
+	if sse != "" {
+		input.ServerSideEncryption = &sse
+	}
+	if sseKMSKeyID != "" {
+		input.SSEKMSKeyId = &sseKMSKeyID
+	}
+	_, err = s3Client.PutObjectWithContext(aws.BackgroundContext(), input, condition)
+	if err != nil {
+		switch errorCode(err) {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return false, nil
+		}
+
+		return false, fmt.Errorf("failed to put lock: %s", err)
+	}
+
+	return true, nil
+}
+
+// getLock returns the current lock with its ETag, or nil if it isn't held
+func getLock(cacheKey string) (*cacheLock, string, error) {
+	key := lockKey(cacheKey)
+	output, err := s3Client.GetObject(&s3.GetObjectInput{Bucket: &s3Bucket, Key: &key})
+	if err != nil {
+		if errorCode(err) == s3.ErrCodeNoSuchKey {
+			return nil, "", nil
+		}
+
+		return nil, "", fmt.Errorf("failed to get lock: %s", err)
+	}
+	defer output.Body.Close()
+
+	lock := new(cacheLock)
+	if err := json.NewDecoder(output.Body).Decode(lock); err != nil {
+		return nil, "", fmt.Errorf("invalid lock: %s: %s", key, err)
+	}
+
+	return lock, aws.StringValue(output.ETag), nil
+}
+
+// ifHeader sets the header of a conditional write, which the SDK version doesn't support yet
+func ifHeader(name string, value string) request.Option {
+	return func(r *request.Request) {
+		r.HTTPRequest.Header.Set(name, value)
+	}
+}
@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// conditionalS3 is a fake of S3 honoring If-None-Match and If-Match of PutObject and If-Match of DeleteObject
+type conditionalS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	// puts are the headers of PutObject requests
+	puts []http.Header
+	// beforeDelete is called before deleting an object, like others taking over the lock meanwhile
+	beforeDelete func()
+}
+
+func (s *conditionalS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Method == http.MethodDelete && s.beforeDelete != nil {
+		s.beforeDelete()
+	}
+
+	content, ok := s.objects[r.URL.Path]
+	etag := fmt.Sprintf(`"%x"`, md5.Sum(content))
+	switch r.Method {
+	case http.MethodPut:
+		if (r.Header.Get("If-None-Match") == "*" && ok) || (r.Header.Get("If-Match") != "" && r.Header.Get("If-Match") != etag) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprint(w, `<Error><Code>PreconditionFailed</Code></Error>`)
+			return
+		}
+		s.puts = append(s.puts, r.Header)
+		body, _ := ioutil.ReadAll(r.Body)
+		s.objects[r.URL.Path] = body
+	case http.MethodGet:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write(content)
+	case http.MethodDelete:
+		if r.Header.Get("If-Match") != "" && r.Header.Get("If-Match") != etag {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprint(w, `<Error><Code>PreconditionFailed</Code></Error>`)
+			return
+		}
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func setupConditionalS3(t *testing.T) (*conditionalS3, func()) {
+	fake := &conditionalS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	s3Client = s3.New(sess)
+	s3Bucket = "example-cache"
+
+	return fake, func() {
+		server.Close()
+		s3Client = nil
+		s3Bucket = ""
+	}
+}
+
+func TestLock(t *testing.T) {
+	fake, teardown := setupConditionalS3(t)
+	defer teardown()
+
+	token, err := acquireLock("v1/gem", time.Hour, 0)
+	if err != nil || token == "" {
+		t.Fatalf("failed to acquire lock: %v", err)
+	}
+	if _, err := acquireLock("v1/gem", time.Hour, 0); err != errLockHeld {
+		t.Fatalf("lock held by others is acquired: %v", err)
+	}
+
+	if err := releaseLock("v1/gem", "wrong", false); err == nil {
+		t.Fatal("lock is released with a wrong token")
+	}
+	if err := releaseLock("v1/gem", token, false); err != nil {
+		t.Fatalf("failed to release lock: %s", err)
+	}
+	if len(fake.objects) != 0 {
+		t.Fatalf("lock object is left: %v", fake.objects)
+	}
+
+	if token, err = acquireLock("v1/gem", time.Hour, 0); err != nil || token == "" {
+		t.Fatalf("failed to acquire released lock: %v", err)
+	}
+}
+
+func TestLockWithServerSideEncryption(t *testing.T) {
+	fake, teardown := setupConditionalS3(t)
+	defer teardown()
+	defer func(s string, keyID string) {
+		sse, sseKMSKeyID = s, keyID
+	}(sse, sseKMSKeyID)
+	sse = s3.ServerSideEncryptionAwsKms
+	sseKMSKeyID = "alias/cache"
+
+	if _, err := acquireLock("v1/gem", -time.Minute, 0); err != nil {
+		t.Fatalf("failed to acquire lock: %s", err)
+	}
+	if _, err := acquireLock("v1/gem", time.Hour, 0); err != nil {
+		t.Fatalf("failed to take over expired lock: %s", err)
+	}
+
+	if len(fake.puts) != 2 {
+		t.Fatalf("the lock isn't put twice: %d", len(fake.puts))
+	}
+	for _, h := range fake.puts {
+		if h.Get("X-Amz-Server-Side-Encryption") != sse || h.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id") != sseKMSKeyID {
+			t.Errorf("the lock isn't encrypted with the KMS key: %v", h)
+		}
+	}
+}
+
+func TestLockTakeOver(t *testing.T) {
+	fake, teardown := setupConditionalS3(t)
+	defer teardown()
+
+	if _, err := acquireLock("v1/gem", -time.Minute, 0); err != nil {
+		t.Fatalf("failed to acquire lock: %s", err)
+	}
+
+	token, err := acquireLock("v1/gem", time.Hour, 0)
+	if err != nil {
+		t.Fatalf("failed to take over expired lock: %s", err)
+	}
+	if !strings.Contains(string(fake.objects["/example-cache/v1/gem.lock"]), token) {
+		t.Fatalf("lock isn't taken over: %s", fake.objects["/example-cache/v1/gem.lock"])
+	}
+}
+
+func TestUnlockTakenOver(t *testing.T) {
+	fake, teardown := setupConditionalS3(t)
+	defer teardown()
+
+	token, err := acquireLock("v1/gem", time.Hour, 0)
+	if err != nil {
+		t.Fatalf("failed to acquire lock: %s", err)
+	}
+
+	// the lock expires and is taken over by others between reading and deleting it
+	taken := []byte(`{"token":"others","owner":"others"}`)
+	fake.beforeDelete = func() {
+		fake.objects["/example-cache/v1/gem.lock"] = taken
+	}
+	if err := releaseLock("v1/gem", token, false); err == nil || !strings.Contains(err.Error(), "taken over") {
+		t.Fatalf("the lock taken over is released: %v", err)
+	}
+	if string(fake.objects["/example-cache/v1/gem.lock"]) != string(taken) {
+		t.Fatalf("the lock of others is deleted: %s", fake.objects["/example-cache/v1/gem.lock"])
+	}
+}
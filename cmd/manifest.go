@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// manifestName is the entry of the checksums of the files in the archive, written just before metadata.json
+const manifestName = "manifest.json"
+
+var verifyFiles bool
+
+// fileManifest is the size, mode and SHA-256 of the content of each regular file in the archive by its name like 0000/foo/bar.
+// Hard links have the checksum of the file they link to, and sparse files have the checksum of the content with holes.
+type fileManifest struct {
+	Files []manifestFile `json:"files"`
+	names map[string]int
+}
+
+type manifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Mode   int64  `json:"mode"`
+	SHA256 string `json:"sha256"`
+}
+
+func newFileManifest() *fileManifest {
+	return &fileManifest{Files: []manifestFile{}, names: make(map[string]int)}
+}
+
+// readManifest decodes manifest.json
+func readManifest(r io.Reader) (*fileManifest, error) {
+	m := newFileManifest()
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", manifestName, err)
+	}
+	for i, f := range m.Files {
+		m.names[f.Name] = i
+	}
+
+	return m, nil
+}
+
+func (m *fileManifest) add(f manifestFile) {
+	m.names[f.Name] = len(m.Files)
+	m.Files = append(m.Files, f)
+}
+
+// addEntry adds the regular file of the entry written with its checksum, or the hard link with the checksum of its target
+func (m *fileManifest) addEntry(e *pathEntry) {
+	if !e.info.Mode().IsRegular() {
+		return
+	}
+	if e.isContent() {
+		m.add(manifestFile{Name: e.header.Name, Size: e.info.Size(), Mode: e.header.Mode, SHA256: e.sum})
+		return
+	}
+
+	m.addLink(e.header)
+}
+
+// addLink adds the hard link with the size and checksum of its target, unless the target isn't in the manifest
+// like the files of caches stored by older versions
+func (m *fileManifest) addLink(hdr *tar.Header) {
+	i, ok := m.names[hdr.Linkname]
+	if !ok {
+		return
+	}
+
+	target := m.Files[i]
+	m.add(manifestFile{Name: hdr.Name, Size: target.Size, Mode: hdr.Mode, SHA256: target.SHA256})
+}
+
+// writeManifest writes manifest.json to the tar stream
+func writeManifest(tw *tar.Writer, w io.Writer, m *fileManifest) error {
+	manifestJSON, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %s", manifestName, err)
+	}
+
+	tarHeader := &tar.Header{
+		Name:   manifestName,
+		Mode:   0600,
+		Size:   int64(len(manifestJSON)),
+		Format: tar.FormatPAX,
+	}
+	if err := writeHeader(tw, w, tarHeader); err != nil {
+		return fmt.Errorf("failed to write tar header: %s", err)
+	}
+
+	if _, err := tw.Write(manifestJSON); err != nil {
+		return fmt.Errorf("failed to add %s to tar: %s", manifestName, err)
+	}
+
+	return nil
+}
+
+// isManifestEntry reports whether the entry is manifest.json, which isn't a file of the paths
+func isManifestEntry(hdr *tar.Header) bool {
+	return strings.TrimPrefix(filepath.ToSlash(hdr.Name), "./") == manifestName
+}
+
+// entrySum returns the SHA-256 of the content of the regular file entry, where archive/tar reads the holes of sparse files as zeros
+func entrySum(tr io.Reader, hdr *tar.Header) (string, int64, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, tr)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), size, nil
+}
+
+// corruptedFiles compares the files read from the archive or the disk with the manifest, returning the names of ones which differ or are missing
+func corruptedFiles(m *fileManifest, files map[string]manifestFile, compareMode bool) []string {
+	var corrupted []string
+	for _, expected := range m.Files {
+		actual, ok := files[expected.Name]
+		if !ok || actual.Size != expected.Size || actual.SHA256 != expected.SHA256 || (compareMode && actual.Mode != expected.Mode) {
+			corrupted = append(corrupted, expected.Name)
+		}
+	}
+	sort.Strings(corrupted)
+
+	return corrupted
+}
+
+// corruptedFilesError reports the corrupted files, listing a few of them
+func corruptedFilesError(corrupted []string) error {
+	const listed = 10
+	names := corrupted
+	if len(names) > listed {
+		names = append(names[:listed:listed], "...")
+	}
+
+	return fmt.Errorf("%d files don't match %s: %s", len(corrupted), manifestName, strings.Join(names, ", "))
+}
+
+// verifyExtractedFiles compares the files extracted in dir with manifest.json there by --verify-files.
+// Modes aren't compared as the umask applies to extracted files.
+func verifyExtractedFiles(dir string) error {
+	file, err := os.Open(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		log.Printf("no %s is in the cache stored by an older version, skipped verifying files\n", manifestName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %s", manifestName, err)
+	}
+	defer file.Close()
+
+	m, err := readManifest(file)
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]manifestFile)
+	for _, expected := range m.Files {
+		f, err := os.Open(filepath.Join(dir, expected.Name))
+		if err != nil {
+			continue
+		}
+		h := sha256.New()
+		size, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read extracted file: %s: %s", expected.Name, err)
+		}
+		files[expected.Name] = manifestFile{Name: expected.Name, Size: size, SHA256: fmt.Sprintf("%x", h.Sum(nil))}
+	}
+
+	if corrupted := corruptedFiles(m, files, false); len(corrupted) > 0 {
+		return corruptedFilesError(corrupted)
+	}
+	log.Printf("verified %d files\n", len(m.Files))
+
+	return nil
+}
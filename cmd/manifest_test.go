@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadArchiveEntriesWithCorruptedFile(t *testing.T) {
+	setupFixturesToCache(t)
+
+	buf := new(bytes.Buffer)
+	if err := writeTar(buf, []string{"tmp/foo"}); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+	if _, err := readArchiveEntries(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("failed to read the archive: %s", err)
+	}
+
+	// the content is replaced without breaking the tar stream
+	corrupted := bytes.Replace(buf.Bytes(), []byte("This is foo!"), []byte("This is bad!"), 1)
+	_, err := readArchiveEntries(bytes.NewReader(corrupted))
+	if err == nil || !strings.Contains(err.Error(), "0000/foo/hoge.txt") {
+		t.Fatalf("the corrupted file isn't detected: %v", err)
+	}
+}
+
+func TestVerifyExtractedFiles(t *testing.T) {
+	setupFixturesToCache(t)
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := writeTarFile(filepath.Join(dir, "test.tar"), []string{"tmp/foo"}); err != nil {
+		t.Fatalf("failed to write a tar: %s", err)
+	}
+	file, err := os.Open(filepath.Join(dir, "test.tar"))
+	if err != nil {
+		t.Fatalf("failed to open the tar: %s", err)
+	}
+	defer file.Close()
+
+	extracted := filepath.Join(dir, "extracted")
+	if err := os.Mkdir(extracted, 0755); err != nil {
+		t.Fatalf("failed to create a directory: %s", err)
+	}
+	extractCache(extracted, file)
+
+	if err := verifyExtractedFiles(extracted); err != nil {
+		t.Fatalf("the extracted files aren't verified: %s", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(extracted, "0000/foo/hoge.txt"), []byte("This is bad!"), 0644); err != nil {
+		t.Fatalf("failed to write a file: %s", err)
+	}
+	if err := verifyExtractedFiles(extracted); err == nil || !strings.Contains(err.Error(), "0000/foo/hoge.txt") {
+		t.Fatalf("the corrupted file isn't detected: %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(extracted, manifestName)); err != nil {
+		t.Fatalf("failed to remove %s: %s", manifestName, err)
+	}
+	if err := verifyExtractedFiles(extracted); err != nil {
+		t.Fatalf("the files without manifest aren't skipped: %s", err)
+	}
+}
+
+func TestAppendTarWithManifest(t *testing.T) {
+	setupFixturesToCache(t)
+
+	if err := ioutil.WriteFile("tmp/abc/def/ghe/file.txt", []byte("This is ghe!"), 0644); err != nil {
+		t.Fatalf("failed to create a file: %s", err)
+	}
+
+	base := new(bytes.Buffer)
+	if err := writeTar(base, []string{"tmp/foo"}); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+	appended := new(bytes.Buffer)
+	if err := appendTar(appended, bytes.NewReader(base.Bytes()), []string{"tmp/abc/def"}); err != nil {
+		t.Fatalf("failed to append to the archive: %s", err)
+	}
+
+	if _, err := readArchiveEntries(bytes.NewReader(appended.Bytes())); err != nil {
+		t.Fatalf("failed to read the appended archive: %s", err)
+	}
+
+	// manifest.json is replaced by the one of all the files
+	if n := bytes.Count(appended.Bytes(), []byte(manifestName)); n != 1 {
+		t.Fatalf("the number of %s is wrong: %d", manifestName, n)
+	}
+	for _, name := range []string{"0000/foo/hoge.txt", "0001/def/ghe/file.txt"} {
+		if !bytes.Contains(appended.Bytes(), []byte(`"name":"`+name+`"`)) {
+			t.Fatalf("%s is not in %s", name, manifestName)
+		}
+	}
+}
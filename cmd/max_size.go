@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	maxSizePolicyFail = "fail"
+	maxSizePolicyWarn = "warn"
+)
+
+// maxSizeBreakdownLimit is the number of the largest paths reported when the cache exceeds --max-size
+const maxSizeBreakdownLimit = 10
+
+var maxSize string
+var maxSizePolicy string
+
+// archiveBudget is --max-size shared by the archives of the cache being stored, which is nil without the limit
+var archiveBudget *sizeBudget
+
+// truncateReserve is the part of --max-size kept for the compressed data not written yet and the manifest
+// when --max-size-policy warn truncates the archive
+const truncateReserve = 1 << 20
+
+// cacheTooLargeError is returned when the archive exceeds --max-size, after the upload is aborted
+type cacheTooLargeError struct {
+	limit int64
+}
+
+func (e *cacheTooLargeError) Error() string {
+	return fmt.Sprintf("archive exceeds --max-size %s", formatSize(e.limit))
+}
+
+// sizeBudget is the total size of the archives of a cache, which are written concurrently with --per-path
+type sizeBudget struct {
+	limit    int64
+	truncate bool
+
+	mu        sync.Mutex
+	n         int64
+	truncated bool
+	skipped   int
+}
+
+func newSizeBudget(limit int64, truncate bool) *sizeBudget {
+	return &sizeBudget{limit: limit, truncate: truncate}
+}
+
+// reserve adds n bytes to the total unless it exceeds the limit
+func (b *sizeBudget) reserve(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.n+n > b.limit {
+		return false
+	}
+	b.n += n
+
+	return true
+}
+
+// release removes the bytes of an archive whose upload failed, which is written again by a retry or not stored
+func (b *sizeBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.n -= n
+}
+
+// truncates reports whether the entry is left out of the archive by --max-size-policy warn,
+// which leaves out the first file not fitting in the rest of the limit and all the files after it.
+// Directories and symlinks are still written, so that the paths of the cache are restored with the files kept.
+func (b *sizeBudget) truncates(e *pathEntry) bool {
+	if b == nil || !b.truncate || !e.info.Mode().IsRegular() {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// the size before compression is the most the file adds to the archive
+	if !b.truncated && e.isContent() && b.n+e.info.Size()+truncateReserve > b.limit {
+		b.truncated = true
+	}
+	if b.truncated {
+		b.skipped++
+	}
+
+	return b.truncated
+}
+
+// skippedEntries returns the number of the entries left out by truncating the archive
+func (b *sizeBudget) skippedEntries() int {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.skipped
+}
+
+// limitedWriter fails writes beyond the budget, which aborts the upload reading the archive
+type limitedWriter struct {
+	w        io.Writer
+	budget   *sizeBudget
+	n        int64
+	exceeded bool
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if !w.budget.reserve(int64(len(p))) {
+		w.exceeded = true
+		return 0, &cacheTooLargeError{w.budget.limit}
+	}
+	w.n += int64(len(p))
+
+	return w.w.Write(p)
+}
+
+func validateMaxSize() error {
+	if maxSizePolicy != maxSizePolicyFail && maxSizePolicy != maxSizePolicyWarn {
+		return fmt.Errorf("--max-size-policy must be %s or %s: %s", maxSizePolicyFail, maxSizePolicyWarn, maxSizePolicy)
+	}
+
+	size, err := parseSize(maxSize)
+	if err != nil {
+		return err
+	}
+	archiveBudget = nil
+	if size > 0 {
+		archiveBudget = newSizeBudget(size, maxSizePolicy == maxSizePolicyWarn)
+	}
+
+	return nil
+}
+
+// pathSize is the total size of regular files under the path, which are stored uncompressed
+type pathSize struct {
+	path string
+	size int64
+}
+
+// largestPaths returns the paths and the files and directories right under them sorted by their sizes
+func largestPaths(paths []string, limit int) ([]pathSize, error) {
+	var sizes []pathSize
+	for _, root := range paths {
+		children := make(map[string]int64)
+		var total int64
+		err := walkArchivedFiles(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return fmt.Errorf("failed to traverse files: %s", err)
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			total += info.Size()
+			if rel, err := filepath.Rel(root, path); err == nil && rel != "." {
+				child := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+				children[filepath.Join(root, child)] += info.Size()
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		sizes = append(sizes, pathSize{root, total})
+		for child, size := range children {
+			sizes = append(sizes, pathSize{child, size})
+		}
+	}
+
+	sort.SliceStable(sizes, func(i, j int) bool {
+		return sizes[i].size > sizes[j].size
+	})
+	if len(sizes) > limit {
+		sizes = sizes[:limit]
+	}
+
+	return sizes, nil
+}
+
+// reportTooLarge logs the largest paths to find what makes the cache exceed --max-size
+func reportTooLarge(paths []string) {
+	sizes, err := largestPaths(paths, maxSizeBreakdownLimit)
+	if err != nil {
+		log.Printf("failed to compute sizes of paths: %s\n", err)
+		return
+	}
+
+	log.Println("Largest paths before compression:")
+	for _, s := range sizes {
+		log.Printf("  %8s  %s\n", formatSize(s.size), s.path)
+	}
+}
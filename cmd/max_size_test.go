@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestLimitedWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := &limitedWriter{w: buf, budget: newSizeBudget(8, false)}
+
+	if _, err := w.Write([]byte("12345")); err != nil {
+		t.Fatalf("failed to write within the limit: %s", err)
+	}
+	if _, err := w.Write([]byte("6789")); err == nil {
+		t.Fatal("write beyond the limit succeeded")
+	}
+	if !w.exceeded || buf.String() != "12345" {
+		t.Fatalf("write beyond the limit is written: %v, %s", w.exceeded, buf.String())
+	}
+}
+
+func TestLargestPaths(t *testing.T) {
+	setupFixturesToCache(t)
+
+	if err := ioutil.WriteFile("tmp/abc/large.txt", bytes.Repeat([]byte("a"), 1000), 0644); err != nil {
+		t.Fatalf("failed to write a file: %s", err)
+	}
+
+	sizes, err := largestPaths([]string{"tmp/foo", "tmp/abc"}, 3)
+	if err != nil {
+		t.Fatalf("failed to compute sizes: %s", err)
+	}
+
+	expected := []pathSize{
+		{"tmp/abc", 1000},
+		{"tmp/abc/large.txt", 1000},
+		{"tmp/foo", int64(len("This is foo!"))},
+	}
+	if !reflect.DeepEqual(sizes, expected) {
+		t.Fatalf("expected %v but got %v", expected, sizes)
+	}
+}
+
+// writeRandomFiles writes incompressible files of the size to the directory
+func writeRandomFiles(t *testing.T, dir string, n int, size int) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("failed to create a directory: %s", err)
+	}
+	for i := 0; i < n; i++ {
+		content := make([]byte, size)
+		if _, err := rand.Read(content); err != nil {
+			t.Fatalf("failed to generate content: %s", err)
+		}
+		if err := ioutil.WriteFile(fmt.Sprintf("%s/%d.bin", dir, i), content, 0644); err != nil {
+			t.Fatalf("failed to write a file: %s", err)
+		}
+	}
+}
+
+func TestStoreTruncatedToMaxSize(t *testing.T) {
+	setupFixturesToCache(t)
+	_, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original *sizeBudget) { archiveBudget = original }(archiveBudget)
+
+	writeRandomFiles(t, "tmp/large", 4, 1<<20)
+	archiveBudget = newSizeBudget(4<<20, true)
+
+	cacheKey := prefixedKey("key")
+	if err := storeCache(cacheKey, []string{"tmp/large"}, 0, nil); err != nil {
+		t.Fatalf("failed to store the truncated cache: %s", err)
+	}
+	if skipped := archiveBudget.skippedEntries(); skipped == 0 || skipped == 4 {
+		t.Fatalf("the archive isn't truncated by files: %d", skipped)
+	}
+
+	item, err := getExactlyMatchedItem(cacheKey)
+	if err != nil {
+		t.Fatalf("failed to get the cache: %s", err)
+	}
+	if size := aws.Int64Value(item.ContentLength); size > 4<<20 {
+		t.Fatalf("the archive exceeds the size: %d", size)
+	}
+	body, err := newArchiveReader(item, objectKey(cacheKey))
+	if err != nil {
+		t.Fatalf("failed to read the cache: %s", err)
+	}
+	defer body.Close()
+	if _, err := readArchiveEntries(body); err != nil {
+		t.Fatalf("the truncated archive is broken: %s", err)
+	}
+}
+
+func TestRestoreTruncatedCacheOfPaths(t *testing.T) {
+	setupFixturesToCache(t)
+	_, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original *sizeBudget) { archiveBudget = original }(archiveBudget)
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeRandomFiles(t, "tmp/large", 4, 1<<20)
+	writeRandomFiles(t, "tmp/single", 1, 1<<20)
+	archiveBudget = newSizeBudget(4<<20, true)
+
+	// the files after the truncated one are left out, while the paths after it are still restored
+	cacheKey := prefixedKey("key")
+	paths := []string{"tmp/foo", "tmp/large", "tmp/abc", "tmp/single/0.bin"}
+	if err := storeCache(cacheKey, paths, 0, nil); err != nil {
+		t.Fatalf("failed to store the truncated cache: %s", err)
+	}
+
+	item, err := getExactlyMatchedItem(cacheKey)
+	if err != nil {
+		t.Fatalf("failed to get the cache: %s", err)
+	}
+	clearFixturesToCache(t)
+
+	file := downloadCache(dir, item, objectKey(cacheKey))
+	defer file.Close()
+	extractCache(dir, file)
+	moveToOriginalPaths(dir)
+
+	assertFixtures(t)
+	if pathExists("tmp/single/0.bin") {
+		t.Fatal("the file truncated from the cache is restored")
+	}
+}
+
+func TestStoreAbortedByMaxSize(t *testing.T) {
+	setupFixturesToCache(t)
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original *sizeBudget) { archiveBudget = original }(archiveBudget)
+	defer func(original string) { uploadPartSize = original }(uploadPartSize)
+	uploadPartSize = "5MB"
+
+	writeRandomFiles(t, "tmp/large", 4, 1<<20)
+	archiveBudget = newSizeBudget(2<<20, false)
+
+	// parts uploaded before exceeding the size are deleted
+	err := storeCache(prefixedKey("key"), []string{"tmp/large"}, 256<<10, nil)
+	if _, tooLarge := err.(*cacheTooLargeError); !tooLarge {
+		t.Fatalf("the archive exceeding the size is stored: %v", err)
+	}
+	if keys := fake.keys(); len(keys) > 0 {
+		t.Fatalf("objects of the aborted upload are left: %v", keys)
+	}
+	if archiveBudget.n != 0 {
+		t.Fatalf("the size of the aborted archive is counted: %d", archiveBudget.n)
+	}
+
+	// the size is the total of the archives of --per-path
+	writeRandomFiles(t, "tmp/other", 1, 1<<20)
+	archiveBudget = newSizeBudget(1536<<10, false)
+	err = storePathArchives(prefixedKey("per-path"), []string{"tmp/large/0.bin", "tmp/other"}, 0)
+	if _, tooLarge := err.(*cacheTooLargeError); !tooLarge {
+		t.Fatalf("the archives exceeding the size in total are stored: %v", err)
+	}
+	for _, key := range fake.keys() {
+		if strings.HasPrefix(key, prefixedKey("per-path")) {
+			t.Fatalf("the archive of the aborted upload is left: %s", key)
+		}
+	}
+}
+
+func TestStoreExceedingMaxSizeWhileUploadFails(t *testing.T) {
+	setupFixturesToCache(t)
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original *sizeBudget) { archiveBudget = original }(archiveBudget)
+	defer func(original string) { uploadPartSize = original }(uploadPartSize)
+	uploadPartSize = "5MB"
+
+	writeRandomFiles(t, "tmp/large", 4, 1<<20)
+	archiveBudget = newSizeBudget(1<<20, false)
+
+	// parts fail slowly, while the archive keeps being written until it exceeds the size
+	fake.fail = func(r fakeRequest) bool {
+		if r.Method != http.MethodPut {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+		return true
+	}
+	err := storeCache(prefixedKey("key"), []string{"tmp/large"}, 256<<10, nil)
+	if _, tooLarge := err.(*cacheTooLargeError); !tooLarge {
+		t.Fatalf("the archive exceeding the size isn't reported: %v", err)
+	}
+	if archiveBudget.n != 0 {
+		t.Fatalf("the size of the failed archive is counted: %d", archiveBudget.n)
+	}
+}
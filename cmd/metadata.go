@@ -1,5 +1,110 @@
 package cmd
 
+import (
+	"os"
+	"time"
+
+	"github.com/yuya-takeyama/guruguru-cache/template"
+)
+
+// toolVersionMetadataKey is the S3 metadata key of the version of guruguru-cache which stored the object
+const toolVersionMetadataKey = "Tool-Version"
+
+// toolCommitMetadataKey is the S3 metadata key of the git commit of guruguru-cache which stored the object
+const toolCommitMetadataKey = "Tool-Commit"
+
+// storedKeyTemplate is the template of the key of the cache being stored, recorded in its metadata
+var storedKeyTemplate string
+
 type metadata struct {
-	Paths []string `json:"paths"`
+	Paths       []string    `json:"paths"`
+	ToolVersion string      `json:"tool_version,omitempty"`
+	ToolCommit  string      `json:"tool_commit,omitempty"`
+	CreatedAt   *time.Time  `json:"created_at,omitempty"`
+	Hostname    string      `json:"hostname,omitempty"`
+	HomeDir     string      `json:"home_dir,omitempty"`
+	KeyTemplate string      `json:"key_template,omitempty"`
+	CI          *ciMetadata `json:"ci,omitempty"`
+	PathStats   []pathStats `json:"path_stats,omitempty"`
+	Base        string      `json:"base,omitempty"`
+	BaseSHA256  string      `json:"base_sha256,omitempty"`
+	BaseETag    string      `json:"base_etag,omitempty"`
+	Removed     []string    `json:"removed,omitempty"`
+	Truncated   bool        `json:"truncated,omitempty"`
+
+	// manifest is written to manifest.json, as it's too large to read with the paths
+	manifest *fileManifest
+}
+
+// ciMetadata is the CI build which stored the cache
+type ciMetadata struct {
+	Service  string `json:"service,omitempty"`
+	Branch   string `json:"branch,omitempty"`
+	Revision string `json:"revision,omitempty"`
+	BuildNum string `json:"build_num,omitempty"`
+	JobName  string `json:"job_name,omitempty"`
+}
+
+// pathStats is the total size and the number of regular files of a path in the archive
+type pathStats struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Files int    `json:"files"`
+}
+
+// newMetadata returns the metadata of the archive with the version of guruguru-cache and where it's stored
+func newMetadata(paths []string) *metadata {
+	now := time.Now().UTC().Truncate(time.Second)
+	hostname, _ := os.Hostname()
+
+	meta := &metadata{
+		Paths:       paths,
+		ToolVersion: Version,
+		ToolCommit:  Commit,
+		CreatedAt:   &now,
+		Hostname:    hostname,
+		HomeDir:     homeDir(),
+		KeyTemplate: storedKeyTemplate,
+		Base:        deltaBase,
+		BaseSHA256:  deltaBaseSHA256,
+		BaseETag:    deltaBaseETag,
+		Removed:     deltaRemoved,
+		manifest:    newFileManifest(),
+	}
+	if build := template.DetectCIBuild(); build != (template.CIBuild{}) {
+		meta.CI = &ciMetadata{
+			Service:  build.Service,
+			Branch:   build.Branch,
+			Revision: build.Revision,
+			BuildNum: build.BuildNum,
+			JobName:  build.JobName,
+		}
+	}
+
+	return meta
+}
+
+// addPathStats adds the stats of the paths numbered from first, reporting false when the paths before have no stats like in caches stored by older versions
+func (m *metadata) addPathStats(first int, paths []string) bool {
+	if len(m.PathStats) != first {
+		return false
+	}
+
+	for _, path := range paths {
+		m.PathStats = append(m.PathStats, pathStats{Path: path})
+	}
+
+	return true
+}
+
+// countEntry adds the regular file of the entry to the stats of its path, where hard links are counted as files without their size
+func (m *metadata) countEntry(e *pathEntry) {
+	if !e.info.Mode().IsRegular() {
+		return
+	}
+
+	m.PathStats[e.index].Files++
+	if e.isContent() {
+		m.PathStats[e.index].Size += e.info.Size()
+	}
 }
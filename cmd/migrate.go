@@ -0,0 +1,321 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/spf13/cobra"
+)
+
+// gcsEndpoint is the endpoint of the XML API of Google Cloud Storage compatible with S3
+const gcsEndpoint = "https://storage.googleapis.com"
+
+var migrateDestination string
+var destAWSProfile string
+var migrateOverwrite bool
+
+func init() {
+	migrateCmd := &cobra.Command{
+		Use:   "migrate [flags] [prefix]",
+		Short: "Copy all caches under the prefix to another storage",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := validateObjectOptions(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+
+			dst, err := parseDestination(migrateDestination)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			prefix := ""
+			if len(args) > 0 {
+				prefix = args[0]
+			}
+
+			caches, err := listCaches(prefix)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			migrated := 0
+			for _, c := range caches {
+				ok, err := migrateCache(c, dst)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if ok {
+					migrated++
+				}
+			}
+
+			log.Printf("migrated %d of %d caches to %s\n", migrated, len(caches), migrateDestination)
+		},
+	}
+
+	migrateCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches to migrate")
+	migrateCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(migrateCmd)
+	migrateCmd.Flags().StringVarP(&migrateDestination, "to", "", "", "Destination like s3://bucket/prefix/, gs://bucket/prefix/ or file:///path/to/dir")
+	migrateCmd.MarkFlagRequired("to")
+	migrateCmd.Flags().StringVarP(&destAWSProfile, "dest-aws-profile", "", "", "AWS profile of credentials for the destination, like HMAC keys of Google Cloud Storage")
+	migrateCmd.Flags().BoolVarP(&migrateOverwrite, "overwrite", "", false, "Overwrite caches which already exist in the destination")
+	addObjectFlags(migrateCmd)
+
+	rootCmd.AddCommand(migrateCmd)
+}
+
+// objectStore is a destination of migrated objects, keeping keys relative to --prefix
+type objectStore interface {
+	exists(key string) (bool, error)
+	put(key string, body io.Reader, metadata map[string]*string) error
+}
+
+// parseDestination parses the URL of the destination into its store
+func parseDestination(s string) (objectStore, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination: %s: %s", s, err)
+	}
+
+	prefix := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "s3", "gs":
+		if u.Host == "" {
+			return nil, fmt.Errorf("bucket of the destination is required: %s", s)
+		}
+
+		client, err := newDestinationS3Client(u.Scheme, u.Query().Get("region"))
+		if err != nil {
+			return nil, err
+		}
+
+		return &s3Store{client: client, bucket: u.Host, prefix: prefix}, nil
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("directory of the destination is required: %s", s)
+		}
+
+		return &fileStore{dir: filepath.FromSlash(u.Path)}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported destination: %s (must be s3://, gs:// or file://)", s)
+}
+
+// newDestinationS3Client returns the client of S3 or the S3 compatible API of Google Cloud Storage
+func newDestinationS3Client(scheme string, region string) (*s3.S3, error) {
+	sess := awsSession
+	if destAWSProfile != "" {
+		httpClient, err := newHTTPClient()
+		if err != nil {
+			return nil, err
+		}
+
+		opts := session.Options{Profile: destAWSProfile, SharedConfigState: session.SharedConfigEnable}
+		opts.Config.HTTPClient = httpClient
+		opts.Config.Credentials = profileCredentials(destAWSProfile)
+		if sess, err = session.NewSessionWithOptions(opts); err != nil {
+			return nil, fmt.Errorf("failed to create AWS session for the destination: %s", err)
+		}
+	}
+
+	config := &aws.Config{}
+	if region != "" {
+		config.Region = &region
+	}
+	if scheme == "gs" {
+		config.Endpoint = aws.String(gcsEndpoint)
+		if region == "" {
+			config.Region = aws.String("auto")
+		}
+	}
+
+	c := s3.New(sess, config)
+	c.Retryer = newBackoffRetryer(retryMaxAttempts, retryMaxElapsed)
+
+	return c, nil
+}
+
+type s3Store struct {
+	client *s3.S3
+	bucket string
+	prefix string
+}
+
+func (s *s3Store) exists(key string) (bool, error) {
+	_, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    aws.String(s.prefix + key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("failed to check %s: %s", key, err)
+	}
+
+	return true, nil
+}
+
+// put uploads the object with the server-side encryption, tags and storage class of the flags like uploadObject,
+// telling chunks from the objects of caches by the key under --prefix
+func (s *s3Store) put(key string, body io.Reader, metadata map[string]*string) error {
+	input := &s3manager.UploadInput{
+		Bucket:   &s.bucket,
+		Key:      aws.String(s.prefix + key),
+		Body:     body,
+		Metadata: metadata,
+	}
+	setObjectOptions(input, keyPrefix+key, storageClass)
+
+	uploader := s3manager.NewUploaderWithClient(s.client)
+	if _, err := uploader.Upload(input); err != nil {
+		return fmt.Errorf("failed to upload %s: %s", key, err)
+	}
+
+	return nil
+}
+
+// fileStore keeps objects as files in the directory, with their S3 metadata in "*.metadata.json" files
+type fileStore struct {
+	dir string
+}
+
+func (s *fileStore) exists(key string) (bool, error) {
+	_, err := os.Stat(filepath.Join(s.dir, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check %s: %s", key, err)
+	}
+
+	return true, nil
+}
+
+func (s *fileStore) put(key string, body io.Reader, metadata map[string]*string) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create a directory: %s", err)
+	}
+
+	if len(metadata) > 0 {
+		metadataJSON, err := json.Marshal(metadata)
+		if err != nil {
+			return fmt.Errorf("failed to encode metadata JSON: %s", err)
+		}
+		if err := ioutil.WriteFile(path+".metadata.json", metadataJSON, 0644); err != nil {
+			return fmt.Errorf("failed to write metadata of %s: %s", key, err)
+		}
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %s", path, err)
+	}
+
+	defer file.Close()
+
+	if _, err := io.Copy(file, body); err != nil {
+		return fmt.Errorf("failed to write %s: %s", path, err)
+	}
+
+	return file.Close()
+}
+
+// migrateCache copies the objects of the cache and its chunks to the destination, the manifest object last.
+// It returns false when the cache already exists in the destination.
+func migrateCache(c *cacheEntry, dst objectStore) (bool, error) {
+	key := prefixedKey(c.Key)
+	manifestKey := strings.TrimPrefix(objectKey(key), keyPrefix)
+
+	if !migrateOverwrite {
+		exists, err := dst.exists(manifestKey)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			log.Printf("cache already exists in the destination: %s\n", c.Key)
+			return false, nil
+		}
+	}
+
+	log.Printf("migrating cache: %s (%s)\n", c.Key, formatSize(c.Size))
+
+	var keys []string
+	for _, object := range c.objects {
+		if k := aws.StringValue(object.Key); k != objectKey(key) {
+			keys = append(keys, k)
+		}
+	}
+
+	chunkKeys, err := manifestChunkKeys(key)
+	if err != nil {
+		return false, err
+	}
+	for _, k := range chunkKeys {
+		exists, err := dst.exists(strings.TrimPrefix(k, keyPrefix))
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			keys = append(keys, k)
+		}
+	}
+
+	for _, k := range append(keys, objectKey(key)) {
+		if err := migrateObject(k, dst); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// manifestChunkKeys returns the keys of chunks the cache consists of, or nil if it's not chunked
+func manifestChunkKeys(key string) ([]string, error) {
+	item, err := getExactlyMatchedItem(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cache: %s", err)
+	}
+
+	defer item.Body.Close()
+
+	if _, ok := item.Metadata[chunksMetadataKey]; !ok {
+		return nil, nil
+	}
+
+	return chunkKeysFromManifest(item.Body)
+}
+
+// migrateObject streams the object of s3Bucket with its metadata to the destination
+func migrateObject(key string, dst objectStore) error {
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: &s3Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %s", key, err)
+	}
+
+	defer output.Body.Close()
+
+	return dst.put(strings.TrimPrefix(key, keyPrefix), output.Body, output.Metadata)
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestParseDestination(t *testing.T) {
+	dst, err := parseDestination("file:///var/cache/guruguru")
+	if err != nil {
+		t.Fatalf("failed to parse destination: %s", err)
+	}
+	if store, ok := dst.(*fileStore); !ok || store.dir != filepath.FromSlash("/var/cache/guruguru") {
+		t.Fatalf("parsed destination is wrong: %#v", dst)
+	}
+
+	for _, s := range []string{"", "s3:///prefix/", "file://", "ftp://example.com/"} {
+		if _, err := parseDestination(s); err == nil {
+			t.Fatalf("invalid destination is parsed: %q", s)
+		}
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guruguru-cache-test-")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &fileStore{dir: dir}
+	if exists, err := store.exists("v1/gem-v1.tar.gz"); err != nil || exists {
+		t.Fatalf("missing object exists: %v", err)
+	}
+
+	metadata := map[string]*string{partsMetadataKey: aws.String("2")}
+	if err := store.put("v1/gem-v1.tar.gz", strings.NewReader(""), metadata); err != nil {
+		t.Fatalf("failed to put object: %s", err)
+	}
+
+	if exists, err := store.exists("v1/gem-v1.tar.gz"); err != nil || !exists {
+		t.Fatalf("put object doesn't exist: %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "v1", "gem-v1.tar.gz.metadata.json"))
+	if err != nil || string(content) != `{"Parts":"2"}` {
+		t.Fatalf("metadata is wrong: %s: %v", content, err)
+	}
+}
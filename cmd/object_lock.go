@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Object Lock isn't supported by the SDK version yet, so its headers are set directly
+const (
+	objectLockModeHeader        = "X-Amz-Object-Lock-Mode"
+	objectLockRetainUntilHeader = "X-Amz-Object-Lock-Retain-Until-Date"
+	objectLockLegalHoldHeader   = "X-Amz-Object-Lock-Legal-Hold"
+)
+
+var objectLockModes = []string{"GOVERNANCE", "COMPLIANCE"}
+
+var objectLockMode string
+var objectLockRetention time.Duration
+var objectLockLegalHold bool
+
+func objectLockEnabled() bool {
+	return objectLockMode != "" || objectLockLegalHold
+}
+
+func validateObjectLockOptions() error {
+	if objectLockMode != "" && !containsString(objectLockModes, objectLockMode) {
+		return fmt.Errorf("unsupported Object Lock mode: %s", objectLockMode)
+	}
+	if objectLockMode != "" && objectLockRetention <= 0 {
+		return fmt.Errorf("--object-lock-mode requires positive --object-lock-retention")
+	}
+	if objectLockMode == "" && objectLockRetention != 0 {
+		return fmt.Errorf("--object-lock-retention requires --object-lock-mode")
+	}
+
+	return nil
+}
+
+// objectLockOption sets the Object Lock headers to the requests creating objects
+func objectLockOption(retainUntil time.Time) request.Option {
+	return func(r *request.Request) {
+		switch r.Operation.Name {
+		case "PutObject", "CreateMultipartUpload", "CopyObject":
+		default:
+			return
+		}
+
+		if objectLockMode != "" {
+			r.HTTPRequest.Header.Set(objectLockModeHeader, objectLockMode)
+			r.HTTPRequest.Header.Set(objectLockRetainUntilHeader, retainUntil.UTC().Format(time.RFC3339))
+		}
+		if objectLockLegalHold {
+			r.HTTPRequest.Header.Set(objectLockLegalHoldHeader, "ON")
+		}
+	}
+}
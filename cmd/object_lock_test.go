@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestObjectLockOption(t *testing.T) {
+	objectLockMode = "COMPLIANCE"
+	objectLockLegalHold = true
+	defer func() {
+		objectLockMode = ""
+		objectLockLegalHold = false
+	}()
+
+	retainUntil := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	option := objectLockOption(retainUntil)
+
+	for _, op := range []string{"PutObject", "CreateMultipartUpload"} {
+		r := &request.Request{
+			Operation:   &request.Operation{Name: op},
+			HTTPRequest: &http.Request{Header: http.Header{}},
+		}
+		option(r)
+
+		if mode := r.HTTPRequest.Header.Get(objectLockModeHeader); mode != "COMPLIANCE" {
+			t.Fatalf("Object Lock mode of %s is wrong: %s", op, mode)
+		}
+		if until := r.HTTPRequest.Header.Get(objectLockRetainUntilHeader); until != "2020-01-02T03:04:05Z" {
+			t.Fatalf("retain until date of %s is wrong: %s", op, until)
+		}
+		if hold := r.HTTPRequest.Header.Get(objectLockLegalHoldHeader); hold != "ON" {
+			t.Fatalf("legal hold of %s is wrong: %s", op, hold)
+		}
+	}
+
+	r := &request.Request{
+		Operation:   &request.Operation{Name: "UploadPart"},
+		HTTPRequest: &http.Request{Header: http.Header{}},
+	}
+	option(r)
+	if len(r.HTTPRequest.Header) != 0 {
+		t.Fatalf("Object Lock headers are set to UploadPart: %v", r.HTTPRequest.Header)
+	}
+}
+
+func TestUploadToS3WithObjectLock(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original string) { uploadPartSize = original }(uploadPartSize)
+	defer func(original time.Duration) { objectLockRetention = original }(objectLockRetention)
+	uploadPartSize = "5MB"
+	objectLockMode = "GOVERNANCE"
+	objectLockRetention = time.Hour
+	defer func() { objectLockMode = "" }()
+
+	contentMD5 := func(content []byte) string {
+		sum := md5.Sum(content)
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	assertLocked := func(r fakeRequest) {
+		if mode := r.Header.Get(objectLockModeHeader); mode != "GOVERNANCE" {
+			t.Fatalf("Object Lock mode of %s is wrong: %s", r.Key, mode)
+		}
+		if r.Header.Get(objectLockRetainUntilHeader) == "" {
+			t.Fatalf("retain until date of %s isn't set", r.Key)
+		}
+	}
+
+	// S3 requires Content-MD5 of PUT requests with Object Lock
+	small := []byte("locked")
+	if err := uploadToS3("v1/small.tar.gz", bytes.NewReader(small), nil); err != nil {
+		t.Fatalf("failed to upload: %s", err)
+	}
+	puts := fake.received(http.MethodPut, "v1/small.tar.gz")
+	if len(puts) != 1 {
+		t.Fatalf("the object isn't uploaded by a PUT: %v", puts)
+	}
+	assertLocked(puts[0])
+	if md5 := puts[0].Header.Get("Content-Md5"); md5 != contentMD5(small) {
+		t.Fatalf("Content-MD5 is wrong: %s", md5)
+	}
+
+	large := bytes.Repeat([]byte("a"), 6<<20)
+	if err := uploadToS3("v1/large.tar.gz", bytes.NewReader(large), nil); err != nil {
+		t.Fatalf("failed to upload: %s", err)
+	}
+	creates := fake.received(http.MethodPost, "v1/large.tar.gz")
+	if len(creates) == 0 {
+		t.Fatal("the multipart upload isn't created")
+	}
+	assertLocked(creates[0])
+	parts := fake.received(http.MethodPut, "v1/large.tar.gz")
+	if len(parts) != 2 {
+		t.Fatalf("the parts aren't uploaded: %d", len(parts))
+	}
+	expected := map[string]string{"1": contentMD5(large[:5<<20]), "2": contentMD5(large[5<<20:])}
+	for _, part := range parts {
+		n := part.Query.Get("partNumber")
+		if md5 := part.Header.Get("Content-Md5"); md5 != expected[n] {
+			t.Fatalf("Content-MD5 of part %s is wrong: %s", n, md5)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	packCmd := &cobra.Command{
+		Use:   "pack [flags] [output] [paths...]",
+		Short: "Write the archive of paths to a file without uploading it",
+		Args:  cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := packArchive(args[0], args[1:]); err != nil {
+				log.Fatal(err)
+			}
+
+			log.Printf("Created an archive: %s\n", args[0])
+		},
+	}
+
+	packCmd.Flags().StringArrayVarP(&ageRecipients, "age-recipient", "", nil, "Encrypt the archive for the age recipient public key (can be repeated)")
+	packCmd.Flags().StringVarP(&passphraseFile, "passphrase-file", "", "", "Encrypt the archive with the passphrase in the file")
+
+	rootCmd.AddCommand(packCmd)
+}
+
+// packArchive writes the archive of paths like store does, which doesn't leave a broken file on failures
+func packArchive(output string, paths []string) error {
+	if err := validateEncryptionOptions(); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(output), ".guruguru-cache-pack-")
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %s", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	w, err := newEncryptWriter(file)
+	if err != nil {
+		return err
+	}
+	if _, err := writeArchive(w, paths); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to encrypt archive: %s", err)
+	}
+	// temporal files are only readable by the owner
+	if err := file.Chmod(0644); err != nil {
+		return fmt.Errorf("failed to write archive: %s", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %s", err)
+	}
+
+	if err := os.Rename(file.Name(), output); err != nil {
+		return fmt.Errorf("failed to create archive: %s", err)
+	}
+
+	return nil
+}
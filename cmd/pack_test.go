@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPackArchive(t *testing.T) {
+	setupFixturesToCache(t)
+
+	dir, err := ioutil.TempDir("", "guruguru-cache-test-")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "cache.tar.gz")
+	if err := packArchive(output, []string{"tmp/foo", "tmp/abc/def"}); err != nil {
+		t.Fatalf("failed to pack archive: %s", err)
+	}
+
+	file, err := os.Open(output)
+	if err != nil {
+		t.Fatalf("failed to open archive: %s", err)
+	}
+	defer file.Close()
+
+	paths, err := validateArchive(file)
+	if err != nil {
+		t.Fatalf("packed archive is invalid: %s", err)
+	}
+	if !reflect.DeepEqual(paths, []string{"tmp/foo", "tmp/abc/def"}) {
+		t.Fatalf("paths are wrong: %v", paths)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read directory: %s", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("temporal files are left: %d files", len(files))
+	}
+}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// partsMetadataKey is the S3 metadata key of the number of parts a cache is split into
+const partsMetadataKey = "Parts"
+
+var partKeyPattern = regexp.MustCompile(`\.part\d{4,}(-[0-9a-f]{16})?\.tar\.gz$`)
+
+func objectKey(cacheKey string) string {
+	return cacheKey + ".tar.gz"
+}
+
+func cacheKeyFromObjectKey(key string) string {
+	return strings.TrimSuffix(key, ".tar.gz")
+}
+
+func partKey(cacheKey string, generation string, n int) string {
+	return fmt.Sprintf("%s.part%04d%s.tar.gz", cacheKey, n, generationSuffix(generation))
+}
+
+// uploadPartsToS3 splits the archive into parts of partSize bytes with the keys of the generation.
+// The object of the cache key itself is uploaded last as an empty manifest holding the number of parts
+// after beforeHead uploads the other objects, so the cache never exists partially.
+func uploadPartsToS3(cacheKey string, generation string, r io.Reader, partSize int64, beforeHead func() error) error {
+	br := bufio.NewReader(r)
+	concurrency := partUploadConcurrency(partSize)
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var uploadErr error
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return uploadErr != nil
+	}
+
+	n := 0
+	var err error
+	for {
+		n++
+		log.Printf("Uploading part %d\n", n)
+		key := partKey(cacheKey, generation, n)
+		if concurrency == 1 {
+			// large parts are streamed, as the uploader of each part uploads its chunks concurrently
+			if err = uploadToS3(key, io.LimitReader(br, partSize), nil); err != nil {
+				break
+			}
+		} else {
+			var part []byte
+			if part, err = ioutil.ReadAll(io.LimitReader(br, partSize)); err != nil {
+				err = fmt.Errorf("failed to read archive: %s", err)
+				break
+			}
+
+			sem <- struct{}{}
+			if failed() {
+				<-sem
+				break
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				if err := uploadToS3(key, bytes.NewReader(part), nil); err != nil {
+					mu.Lock()
+					if uploadErr == nil {
+						uploadErr = err
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+
+		if _, err = br.Peek(1); err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			err = fmt.Errorf("failed to read archive: %s", err)
+			break
+		}
+	}
+	// parts in progress are finished before returning, so that the ones of a failed upload can be deleted
+	wg.Wait()
+	if err == nil {
+		err = uploadErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := beforeHead(); err != nil {
+		return err
+	}
+
+	metadata := map[string]*string{
+		partsMetadataKey: aws.String(strconv.Itoa(n)),
+	}
+
+	return uploadToS3(objectKey(cacheKey), bytes.NewReader(nil), withGeneration(metadata, generation))
+}
+
+// partUploadConcurrency returns the number of parts uploaded at once up to --upload-concurrency.
+// Parts uploaded concurrently are read into memory, which is limited to the memory the uploader of a part takes.
+func partUploadConcurrency(partSize int64) int {
+	// validated by validateUploadOptions
+	uploadPart, _ := parseSize(uploadPartSize)
+
+	c := int64(uploadConcurrency) * uploadPart / partSize
+	if c > int64(uploadConcurrency) {
+		c = int64(uploadConcurrency)
+	}
+	if c < 1 {
+		c = 1
+	}
+
+	return int(c)
+}
+
+func partKeys(cacheKey string, generation string, parts int) []string {
+	keys := make([]string, parts)
+	for i := range keys {
+		keys[i] = partKey(cacheKey, generation, i+1)
+	}
+
+	return keys
+}
+
+// objectsReader reads S3 objects sequentially as a single stream
+type objectsReader struct {
+	keys    []string
+	next    int
+	current io.ReadCloser
+}
+
+func (r *objectsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.next >= len(r.keys) {
+				return 0, io.EOF
+			}
+
+			key := r.keys[r.next]
+			r.next++
+			output, err := s3Client.GetObject(&s3.GetObjectInput{
+				Bucket: &s3Bucket,
+				Key:    &key,
+			})
+			if err != nil {
+				return 0, fmt.Errorf("failed to get %s: %s", key, err)
+			}
+
+			r.current = output.Body
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+
+		return n, err
+	}
+}
+
+func (r *objectsReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+
+	return nil
+}
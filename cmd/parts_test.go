@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestUploadPartsToS3(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original string) { uploadPartSize = original }(uploadPartSize)
+	defer func(original int) { uploadConcurrency = original }(uploadConcurrency)
+	uploadPartSize = "5MB"
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	cacheKey := prefixedKey("key")
+
+	// small parts are uploaded concurrently, and large ones one by one
+	for _, concurrency := range []int{1, 4} {
+		uploadConcurrency = concurrency
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			headUploaded := false
+			err := uploadPartsToS3(cacheKey, "0123456789abcdef", bytes.NewReader(content), 3000, func() error {
+				if _, ok := fake.content(partKey(cacheKey, "0123456789abcdef", 4)); !ok {
+					t.Fatal("the head is uploaded before all the parts")
+				}
+				headUploaded = true
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("failed to upload parts: %s", err)
+			}
+			if !headUploaded {
+				t.Fatal("beforeHead isn't called")
+			}
+
+			part, _ := fake.content(partKey(cacheKey, "0123456789abcdef", 4))
+			if len(part) != 1000 {
+				t.Fatalf("the last part is wrong: %d bytes", len(part))
+			}
+			if _, ok := fake.content(partKey(cacheKey, "0123456789abcdef", 5)); ok {
+				t.Fatal("an extra part is uploaded")
+			}
+
+			read, err := ioutil.ReadAll(&objectsReader{keys: partKeys(cacheKey, "0123456789abcdef", 4)})
+			if err != nil {
+				t.Fatalf("failed to read parts: %s", err)
+			}
+			if !bytes.Equal(read, content) {
+				t.Fatalf("the parts are read with different content: %d bytes", len(read))
+			}
+		})
+	}
+}
+
+func TestStoreTarStreamDeletesPartsOfFailedUpload(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original bool) { chunked = original }(chunked)
+
+	// random content isn't compressed smaller than the parts
+	content := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(content)
+	writeTar := func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	}
+	listedParts := func() bool {
+		for _, r := range fake.requests {
+			if r.Method == http.MethodGet && strings.HasSuffix(r.Query.Get("prefix"), ".part") {
+				return true
+			}
+		}
+		return false
+	}
+
+	fake.fail = func(r fakeRequest) bool { return r.Method == http.MethodPut && strings.Contains(r.Key, ".part0003") }
+	if err := storeTarStream(prefixedKey("parts"), 3000, nil, writeTar); err == nil {
+		t.Fatal("the failure of uploading parts isn't returned")
+	}
+	for _, key := range fake.keys() {
+		if strings.Contains(key, ".part") {
+			t.Fatalf("the part of the failed upload is left: %s", key)
+		}
+	}
+
+	// only uploads split into parts have parts to delete
+	for _, c := range []bool{false, true} {
+		chunked = c
+		fake.requests = nil
+		fake.fail = func(r fakeRequest) bool { return r.Method == http.MethodPut }
+		if err := storeTarStream(prefixedKey("whole"), 0, nil, writeTar); err == nil {
+			t.Fatal("the failure of uploading isn't returned")
+		}
+		if listedParts() {
+			t.Fatalf("parts are deleted after the failed upload with --chunked=%t", c)
+		}
+	}
+}
+
+func TestPartUploadConcurrency(t *testing.T) {
+	defer func(original string) { uploadPartSize = original }(uploadPartSize)
+	defer func(original int) { uploadConcurrency = original }(uploadConcurrency)
+	uploadPartSize = "5MB"
+	uploadConcurrency = 5
+
+	for partSize, expected := range map[int64]int{1 << 20: 5, 10 << 20: 2, 25 << 20: 1, 5 << 30: 1} {
+		if c := partUploadConcurrency(partSize); c != expected {
+			t.Fatalf("concurrency of parts of %d bytes is wrong: %d", partSize, c)
+		}
+	}
+}
+
+func TestUploadPartsInStorageClass(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original string) { storageClass = original }(storageClass)
+	defer func(original string) { uploadPartSize = original }(uploadPartSize)
+	storageClass = s3.StorageClassOnezoneIa
+	uploadPartSize = "5MB"
+
+	cacheKey := prefixedKey("key")
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	if err := uploadPartsToS3(cacheKey, "0123456789abcdef", bytes.NewReader(content), 3000, func() error { return nil }); err != nil {
+		t.Fatalf("failed to upload parts: %s", err)
+	}
+
+	for n := 1; n <= 4; n++ {
+		requests := fake.received(http.MethodPut, partKey(cacheKey, "0123456789abcdef", n))
+		if len(requests) != 1 || requests[0].Header.Get("X-Amz-Storage-Class") != storageClass {
+			t.Fatalf("part %d isn't uploaded in %s: %v", n, storageClass, requests)
+		}
+	}
+}
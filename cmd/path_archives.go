@@ -0,0 +1,274 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// pathArchivesMetadataKey is the S3 metadata key of the number of per-path archives a cache consists of
+const pathArchivesMetadataKey = "Path-Archives"
+
+// maxDefaultPathConcurrency caps the default of --concurrency, as each archive is also uploaded in --upload-concurrency parts
+const maxDefaultPathConcurrency = 4
+
+var pathConcurrency int
+
+// pathArchiveCacheKeyPattern matches the keys of per-path archives like key/0000-GENERATION, which may also be keys of caches like deps/2024-0123456789abcdef
+var pathArchiveCacheKeyPattern = regexp.MustCompile(`^(.+)/\d{4,}-([0-9a-f]{16})$`)
+
+func pathArchiveKey(cacheKey string, generation string, i int) string {
+	return fmt.Sprintf("%s/%04d%s", cacheKey, i, generationSuffix(generation))
+}
+
+// storePathArchives stores each path as its own archive under the cache key by --concurrency workers.
+// The object of the cache key itself is uploaded last as a manifest listing the paths.
+func storePathArchives(cacheKey string, paths []string, partSize int64) error {
+	generation, err := newGeneration()
+	if err != nil {
+		return err
+	}
+
+	jobs := make(chan int)
+	errs := make(chan error, len(paths))
+
+	var wg sync.WaitGroup
+	for w := 0; w < pathArchiveConcurrency(len(paths)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// each archive is uploaded and retried on its own without uploading the others again
+			for i := range jobs {
+				log.Printf("Creating an archive of %s\n", paths[i])
+				key := pathArchiveKey(cacheKey, generation, i)
+				err := retryStore(key, func() error {
+					return storeCache(key, []string{paths[i]}, partSize, nil)
+				})
+				if err != nil {
+					log.Printf("failed to store the archive of %s\n", paths[i])
+					errs <- err
+				}
+			}
+		}()
+	}
+
+	// archives in progress are finished after a failure, but no more are started
+	for i := range paths {
+		if len(errs) > 0 {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		// archives of the other paths of the generation are useless without the manifest
+		if err := deleteGeneration(cacheKey+"/", generation); err != nil {
+			log.Printf("failed to delete archives of the failed upload: %s\n", err)
+		}
+		return err
+	}
+
+	recorded := make([]string, len(paths))
+	for i, path := range paths {
+		recorded[i] = recordedPath(path)
+	}
+
+	// the manifest is encrypted like the archives, as the paths are also in them
+	manifest := new(bytes.Buffer)
+	w, err := newEncryptWriter(manifest)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(w).Encode(newMetadata(recorded)); err != nil {
+		return fmt.Errorf("failed to encode metadata JSON: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to encrypt manifest: %s", err)
+	}
+
+	metadata := map[string]*string{
+		pathArchivesMetadataKey: aws.String(strconv.Itoa(len(paths))),
+	}
+
+	return uploadToS3(objectKey(cacheKey), manifest, withGeneration(metadata, generation))
+}
+
+// readPathArchivesManifest decodes the manifest of per-path archives, decrypting it when it's encrypted
+func readPathArchivesManifest(r io.Reader) (*metadata, error) {
+	dr, err := decrypt(r)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := new(metadata)
+	if err := json.NewDecoder(dr).Decode(meta); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest of per-path archives: %s", err)
+	}
+
+	return meta, nil
+}
+
+// pathArchiveConcurrency returns the number of the archives of n paths stored concurrently,
+// which is the number of CPUs compressing them up to maxDefaultPathConcurrency unless --concurrency is given
+func pathArchiveConcurrency(n int) int {
+	c := pathConcurrency
+	if c < 1 {
+		if c = runtime.NumCPU(); c > maxDefaultPathConcurrency {
+			c = maxDefaultPathConcurrency
+		}
+	}
+	if c > n {
+		c = n
+	}
+
+	return c
+}
+
+// pathArchiveParents tells per-path archives from caches whose keys look like them by the metadata of their parents,
+// which are the manifests of per-path archives of the same generation
+type pathArchiveParents struct {
+	root        string
+	generations map[string]string
+}
+
+// newPathArchiveParents returns pathArchiveParents of the cache keys under the root
+func newPathArchiveParents(root string) *pathArchiveParents {
+	return &pathArchiveParents{root: root, generations: make(map[string]string)}
+}
+
+// parentOf returns the key of the cache which the cache key is a per-path archive of, or empty if it's not one
+func (p *pathArchiveParents) parentOf(cacheKey string) (string, error) {
+	m := pathArchiveCacheKeyPattern.FindStringSubmatch(cacheKey)
+	if m == nil {
+		return "", nil
+	}
+
+	parent := m[1]
+	generation, ok := p.generations[parent]
+	if !ok {
+		head, err := s3Client.HeadObject(&s3.HeadObjectInput{
+			Bucket: &s3Bucket,
+			Key:    aws.String(objectKey(p.root + parent)),
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "NotFound" {
+				return "", fmt.Errorf("failed to get metadata of %s: %s", p.root+parent, err)
+			}
+		} else if _, ok := head.Metadata[pathArchivesMetadataKey]; ok {
+			generation = objectGeneration(head.Metadata)
+		}
+		p.generations[parent] = generation
+	}
+
+	if generation == "" || generation != m[2] {
+		return "", nil
+	}
+
+	return parent, nil
+}
+
+func isPathArchivesManifest(item *s3.GetObjectOutput) bool {
+	_, ok := item.Metadata[pathArchivesMetadataKey]
+	return ok
+}
+
+// restorePathArchives downloads and extracts per-path archives by as many workers as CPUs up to maxDefaultPathConcurrency
+func restorePathArchives(dir string, cacheKey string, item *s3.GetObjectOutput) error {
+	manifest, generation := item.Body, objectGeneration(item.Metadata)
+	defer manifest.Close()
+
+	meta, err := readPathArchivesManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	if size, ok := pathStatsSize(meta); ok {
+		if err := checkTmpSpace(dir, func() int64 { return size }); err != nil {
+			return err
+		}
+	}
+
+	// progress of archives restored concurrently can't be reported on a line
+	progressMode = progressNone
+
+	var restored []int
+	for i, path := range meta.Paths {
+		path = restoredPath(meta, path)
+		if skipExisting && pathExists(path) {
+			log.Printf("skipped existing path: %s", path)
+			continue
+		}
+		restored = append(restored, i)
+	}
+
+	restore := func(i int) error {
+		key := pathArchiveKey(cacheKey, generation, i)
+		item, err := headItem(objectKey(key))
+		if err != nil {
+			return fmt.Errorf("failed to get the archive of %s: %s", meta.Paths[i], err)
+		}
+
+		subdir := filepath.Join(dir, fmt.Sprintf("%04d", i))
+		if err := os.MkdirAll(subdir, 0755); err != nil {
+			return fmt.Errorf("failed to create a directory: %s", err)
+		}
+
+		file := downloadCache(subdir, item, objectKey(key))
+
+		defer file.Close()
+
+		extractCache(subdir, file)
+		moveToOriginalPaths(subdir)
+
+		return nil
+	}
+
+	jobs := make(chan int)
+	errs := make(chan error, len(restored))
+
+	var wg sync.WaitGroup
+	for w := 0; w < pathArchiveConcurrency(len(restored)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := restore(i); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+
+	// archives in progress are finished after a failure, but no more are started
+	for _, i := range restored {
+		if len(errs) > 0 {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+func pathExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
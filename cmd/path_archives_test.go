@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestPathArchiveConcurrency(t *testing.T) {
+	defer func(original int) { pathConcurrency = original }(pathConcurrency)
+
+	pathConcurrency = 3
+	if c := pathArchiveConcurrency(10); c != 3 {
+		t.Fatalf("--concurrency is ignored: %d", c)
+	}
+	if c := pathArchiveConcurrency(2); c != 2 {
+		t.Fatalf("concurrency exceeds the number of paths: %d", c)
+	}
+
+	pathConcurrency = 0
+	expected := runtime.NumCPU()
+	if expected > maxDefaultPathConcurrency {
+		expected = maxDefaultPathConcurrency
+	}
+	if c := pathArchiveConcurrency(10); c != expected {
+		t.Fatalf("the default concurrency is wrong: %d", c)
+	}
+}
+
+func TestPathArchivesNextToCacheKeysLikeThem(t *testing.T) {
+	setupFixturesToCache(t)
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+
+	now := time.Now()
+	fake.now = func() time.Time { return now.Add(-time.Hour) }
+	if err := storePathArchives(prefixedKey("deps"), []string{"tmp/foo", "tmp/abc"}, 0); err != nil {
+		t.Fatalf("failed to store per-path archives: %s", err)
+	}
+	fake.now = func() time.Time { return now }
+	if err := storeCache(prefixedKey("deps/2024"), []string{"tmp/abc"}, 0, nil); err != nil {
+		t.Fatalf("failed to store the cache: %s", err)
+	}
+
+	caches, err := listCaches("")
+	if err != nil {
+		t.Fatalf("failed to list caches: %s", err)
+	}
+	var keys []string
+	for _, c := range caches {
+		keys = append(keys, c.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"deps", "deps/2024"}) {
+		t.Fatalf("listed caches are wrong: %v", keys)
+	}
+	// the manifest and the archives with their checksums and indexes
+	if len(caches[0].objects) != 7 {
+		t.Fatalf("per-path archives aren't of their cache: %d objects", len(caches[0].objects))
+	}
+
+	// the newer cache is restored by the partial match, while per-path archives never are
+	latest, err := findLatestArchive(prefixedKey("deps"))
+	if err != nil {
+		t.Fatalf("failed to find the latest archive: %s", err)
+	}
+	if key := aws.StringValue(latest.Key); key != objectKey(prefixedKey("deps/2024")) {
+		t.Fatalf("the latest archive is wrong: %s", key)
+	}
+	for _, key := range fake.keys() {
+		if strings.HasPrefix(key, prefixedKey("deps/0000-")) && isArchiveKey(key) {
+			content, _ := fake.content(key)
+			fake.now = func() time.Time { return now.Add(time.Hour) }
+			fake.put(key, content, nil)
+		}
+	}
+	if latest, err = findLatestArchive(prefixedKey("deps")); err != nil {
+		t.Fatalf("failed to find the latest archive: %s", err)
+	}
+	if key := aws.StringValue(latest.Key); key != objectKey(prefixedKey("deps/2024")) {
+		t.Fatalf("the per-path archive is found as the latest: %s", key)
+	}
+
+	// pruning the cache leaves the other cache under its key
+	caches, err = listCaches("")
+	if err != nil {
+		t.Fatalf("failed to list caches: %s", err)
+	}
+	if err := deleteCaches(caches[:1]); err != nil {
+		t.Fatalf("failed to delete the cache: %s", err)
+	}
+	for _, key := range fake.keys() {
+		if !strings.HasPrefix(key, prefixedKey("deps/2024.")) {
+			t.Fatalf("the object of the pruned cache is left: %s", key)
+		}
+	}
+	if _, ok := fake.content(objectKey(prefixedKey("deps/2024"))); !ok {
+		t.Fatal("the cache under the key of the pruned cache is deleted")
+	}
+}
+
+func TestRestorePathArchives(t *testing.T) {
+	setupFixturesToCache(t)
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original int) { pathConcurrency = original }(pathConcurrency)
+	pathConcurrency = 1
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cacheKey := prefixedKey("key")
+	if err := storePathArchives(cacheKey, []string{"tmp/foo", "tmp/abc"}, 0); err != nil {
+		t.Fatalf("failed to store per-path archives: %s", err)
+	}
+	clearFixturesToCache(t)
+
+	item, err := headItem(objectKey(cacheKey))
+	if err != nil {
+		t.Fatalf("failed to get the manifest: %s", err)
+	}
+	if err := restorePathArchives(dir, cacheKey, item); err != nil {
+		t.Fatalf("failed to restore per-path archives: %s", err)
+	}
+	assertFixtures(t)
+
+	// the archive missing is reported instead of exiting
+	for _, key := range fake.keys() {
+		if strings.HasPrefix(key, cacheKey+"/0001-") && isArchiveKey(key) {
+			fake.mu.Lock()
+			delete(fake.objects, s3Bucket+"/"+key)
+			fake.mu.Unlock()
+		}
+	}
+	if item, err = headItem(objectKey(cacheKey)); err != nil {
+		t.Fatalf("failed to get the manifest: %s", err)
+	}
+	if err := restorePathArchives(dir, cacheKey, item); err == nil || !strings.Contains(err.Error(), "tmp/abc") {
+		t.Fatalf("the missing archive isn't reported: %v", err)
+	}
+}
+
+func TestStorePathArchivesWithAgeEncryption(t *testing.T) {
+	setupFixturesToCache(t)
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("failed to generate an age identity: %s", err)
+	}
+	identityFile := filepath.Join(dir, "identity.txt")
+	if err := ioutil.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatalf("failed to write an age identity file: %s", err)
+	}
+
+	ageRecipients = []string{identity.Recipient().String()}
+	defer func() {
+		ageRecipients = nil
+		ageIdentityFile = ""
+	}()
+
+	cacheKey := prefixedKey("key")
+	if err := storePathArchives(cacheKey, []string{"tmp/foo", "tmp/abc"}, 0); err != nil {
+		t.Fatalf("failed to store per-path archives: %s", err)
+	}
+	clearFixturesToCache(t)
+
+	manifest, _ := fake.content(objectKey(cacheKey))
+	for _, path := range []string{"tmp/foo", "tmp/abc"} {
+		if strings.Contains(string(manifest), path) {
+			t.Errorf("the manifest contains the path %s: %q", path, manifest)
+		}
+	}
+
+	item, err := headItem(objectKey(cacheKey))
+	if err != nil {
+		t.Fatalf("failed to get the manifest: %s", err)
+	}
+	if err := restorePathArchives(dir, cacheKey, item); err == nil {
+		t.Fatal("the encrypted manifest is read without --age-identity-file")
+	}
+
+	ageIdentityFile = identityFile
+	if item, err = headItem(objectKey(cacheKey)); err != nil {
+		t.Fatalf("failed to get the manifest: %s", err)
+	}
+	if err := restorePathArchives(dir, cacheKey, item); err != nil {
+		t.Fatalf("failed to restore per-path archives: %s", err)
+	}
+	assertFixtures(t)
+}
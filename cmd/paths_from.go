@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var pathsFrom string
+
+// resolvePaths returns the paths given by arguments and --paths-from, or the ones of the named cache without them, with ~ expanded
+func resolvePaths(args []string) ([]string, error) {
+	paths := args
+	if pathsFrom != "" {
+		listed, err := readPathsFile(pathsFrom)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, listed...)
+	}
+
+	if len(paths) < 1 {
+		named, _ := selectedCache()
+		paths = named.Paths
+	}
+	if len(paths) < 1 {
+		return nil, fmt.Errorf("at least one path is required")
+	}
+
+	return expandHomes(paths), nil
+}
+
+// readPathsFile reads paths from the file or stdin with -
+func readPathsFile(name string) ([]string, error) {
+	if name == "-" {
+		return readPaths(os.Stdin)
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open paths file: %s", err)
+	}
+	defer file.Close()
+
+	return readPaths(file)
+}
+
+// readPaths reads a path per line, skipping blank lines and comments starting with #
+func readPaths(r io.Reader) ([]string, error) {
+	var paths []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read paths file: %s", err)
+	}
+
+	return paths, nil
+}
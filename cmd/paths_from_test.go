@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadPaths(t *testing.T) {
+	content := `# dependencies
+vendor/bundle
+  node_modules  
+
+# build outputs
+.cache/webpack
+`
+
+	paths, err := readPaths(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("failed to read paths: %s", err)
+	}
+
+	expected := []string{"vendor/bundle", "node_modules", ".cache/webpack"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("expected %v but got %v", expected, paths)
+	}
+}
+
+func TestResolvePaths(t *testing.T) {
+	defer func(original string) { pathsFrom = original }(pathsFrom)
+
+	dir, err := ioutil.TempDir("", "guruguru-cache-test-")
+	if err != nil {
+		t.Fatalf("failed to create a temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pathsFrom = filepath.Join(dir, "paths.txt")
+	if err := ioutil.WriteFile(pathsFrom, []byte("node_modules\n"), 0644); err != nil {
+		t.Fatalf("failed to write a paths file: %s", err)
+	}
+
+	paths, err := resolvePaths([]string{"vendor/bundle"})
+	if err != nil {
+		t.Fatalf("failed to resolve paths: %s", err)
+	}
+	if !reflect.DeepEqual(paths, []string{"vendor/bundle", "node_modules"}) {
+		t.Fatalf("paths are wrong: %v", paths)
+	}
+
+	pathsFrom = filepath.Join(dir, "missing.txt")
+	if _, err := resolvePaths(nil); err == nil {
+		t.Fatal("missing paths file is accepted")
+	}
+}
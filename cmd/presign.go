@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+	"github.com/yuya-takeyama/guruguru-cache/template"
+)
+
+// maxPresignExpiry is the longest expiry Signature Version 4 allows
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+var presignExpiry time.Duration
+
+func init() {
+	presignCmd := &cobra.Command{
+		Use:   "presign [flags] [cache key]",
+		Short: "Print a time-limited URL to download a cache",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupTemplate(); err != nil {
+				log.Fatal(err)
+			}
+
+			if err := validatePresignExpiry(); err != nil {
+				log.Fatal(err)
+			}
+
+			cacheKey, err := template.ExecuteTemplate(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+			cacheKey = prefixedKey(cacheKey)
+
+			url, err := presignCache(cacheKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			fmt.Println(url)
+		},
+	}
+
+	presignCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of the cache")
+	presignCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(presignCmd)
+	addTemplateFlags(presignCmd)
+	presignCmd.Flags().DurationVarP(&presignExpiry, "expires-in", "", time.Hour, "Duration the URL is valid for like 30m or 24h")
+
+	rootCmd.AddCommand(presignCmd)
+}
+
+func validatePresignExpiry() error {
+	if presignExpiry <= 0 || presignExpiry > maxPresignExpiry {
+		return fmt.Errorf("expiry must be positive and at most %s: %s", maxPresignExpiry, presignExpiry)
+	}
+
+	return nil
+}
+
+// presignCache returns the URL of the archive of the cache, which must be a single object
+func presignCache(cacheKey string) (string, error) {
+	key := objectKey(cacheKey)
+	head, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &s3Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to find cache: %s: %s", cacheKey, err)
+	}
+
+	for _, k := range []string{partsMetadataKey, chunksMetadataKey, pathArchivesMetadataKey} {
+		if _, ok := head.Metadata[k]; ok {
+			return "", fmt.Errorf("cache consisting of multiple objects can't be presigned: %s", cacheKey)
+		}
+	}
+
+	req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: &s3Bucket,
+		Key:    &key,
+	})
+	url, err := req.Presign(presignExpiry)
+	if err != nil {
+		return "", fmt.Errorf("failed to presign URL: %s", err)
+	}
+
+	return url, nil
+}
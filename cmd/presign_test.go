@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPresignCache(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original time.Duration) { presignExpiry = original }(presignExpiry)
+	presignExpiry = 30 * time.Minute
+
+	fake.put(objectKey(prefixedKey("key")), []byte("archive"), nil)
+	presigned, err := presignCache(prefixedKey("key"))
+	if err != nil {
+		t.Fatalf("failed to presign the cache: %s", err)
+	}
+
+	u, err := url.Parse(presigned)
+	if err != nil {
+		t.Fatalf("the presigned URL is invalid: %s", err)
+	}
+	if u.Path != "/"+s3Bucket+"/"+objectKey(prefixedKey("key")) || u.Query().Get("X-Amz-Expires") != "1800" || u.Query().Get("X-Amz-Signature") == "" {
+		t.Fatalf("the presigned URL is wrong: %s", presigned)
+	}
+
+	res, err := http.Get(presigned)
+	if err != nil {
+		t.Fatalf("failed to download the cache: %s", err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil || string(body) != "archive" {
+		t.Fatalf("the cache isn't downloaded by the URL: %s: %v", body, err)
+	}
+
+	if _, err := presignCache(prefixedKey("missing")); err == nil {
+		t.Fatal("the missing cache is presigned")
+	}
+}
+
+func TestPresignCacheOfMultipleObjects(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original time.Duration) { presignExpiry = original }(presignExpiry)
+	presignExpiry = time.Hour
+
+	for key, metadata := range map[string]string{
+		"split":    partsMetadataKey,
+		"chunked":  chunksMetadataKey,
+		"per-path": pathArchivesMetadataKey,
+	} {
+		fake.put(objectKey(prefixedKey(key)), []byte("manifest"), map[string]string{metadata: "2"})
+		if _, err := presignCache(prefixedKey(key)); err == nil {
+			t.Fatalf("the %s cache is presigned", key)
+		}
+	}
+}
+
+func TestValidatePresignExpiry(t *testing.T) {
+	defer func(original time.Duration) { presignExpiry = original }(presignExpiry)
+
+	for expiry, valid := range map[time.Duration]bool{
+		0:                            false,
+		-time.Hour:                   false,
+		time.Second:                  true,
+		7 * 24 * time.Hour:           true,
+		7*24*time.Hour + time.Second: false,
+	} {
+		presignExpiry = expiry
+		if err := validatePresignExpiry(); (err == nil) != valid {
+			t.Fatalf("the expiry %s is validated wrongly: %v", expiry, err)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	progressAuto = "auto"
+	progressBar  = "bar"
+	progressLog  = "log"
+	progressNone = "none"
+)
+
+var progressModes = []string{progressAuto, progressBar, progressLog, progressNone}
+
+// progressBarInterval is the interval to redraw progress bars on terminals
+const progressBarInterval = 200 * time.Millisecond
+
+// progressLogInterval is the interval of logs of progress, which are kept short in logs of CI
+const progressLogInterval = 10 * time.Second
+
+// progressBarWidth is the number of characters of the bar of progress
+const progressBarWidth = 30
+
+var progressMode string
+
+// archiveProgress counts files archived and uploaded by store, which is nil when progress isn't reported
+var archiveProgress *progress
+
+// progress reports bytes processed of the total periodically, where 0 total means it's unknown
+type progress struct {
+	n           int64
+	transferred int64
+	label       string
+	total       int64
+	mode        string
+	start       time.Time
+	done        chan struct{}
+	wg          sync.WaitGroup
+	mu          sync.Mutex
+}
+
+func validateProgress() error {
+	for _, mode := range progressModes {
+		if progressMode == mode {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("--progress must be one of %s: %s", strings.Join(progressModes, ", "), progressMode)
+}
+
+// effectiveProgressMode resolves auto into bars on terminals and none on others like CI, without the flag meaning none
+func effectiveProgressMode() string {
+	switch progressMode {
+	case progressAuto:
+		if isTerminal(os.Stderr) {
+			return progressBar
+		}
+		return progressNone
+	case "":
+		return progressNone
+	}
+
+	return progressMode
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// startProgress starts reporting the progress, returning nil when it's disabled.
+// Methods of progress can be called on nil, so that callers don't need to check it.
+func startProgress(label string, total int64) *progress {
+	mode := effectiveProgressMode()
+	if mode == progressNone {
+		return nil
+	}
+
+	p := &progress{label: label, total: total, mode: mode, start: time.Now(), done: make(chan struct{})}
+	interval := progressLogInterval
+	if mode == progressBar {
+		interval = progressBarInterval
+		// logs are written over the bar, which is drawn again under them
+		log.SetOutput(&barLogWriter{p})
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.report(time.Now())
+			case <-p.done:
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+func (p *progress) add(n int64) {
+	if p != nil {
+		atomic.AddInt64(&p.n, n)
+	}
+}
+
+func (p *progress) addTransferred(n int64) {
+	if p != nil {
+		atomic.AddInt64(&p.transferred, n)
+	}
+}
+
+// finish stops reporting after reporting the last progress
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+
+	close(p.done)
+	p.wg.Wait()
+	p.report(time.Now())
+	if p.mode == progressBar {
+		log.SetOutput(os.Stderr)
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func (p *progress) report(now time.Time) {
+	if p.mode != progressBar {
+		log.Println(p.line(now))
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(os.Stderr, "%s%s", clearLine, p.line(now))
+}
+
+// clearLine moves the cursor to the start of the line and erases it
+const clearLine = "\r\033[K"
+
+// barLogWriter writes logs on the line of the progress bar and draws the bar again
+type barLogWriter struct {
+	p *progress
+}
+
+func (w *barLogWriter) Write(b []byte) (int, error) {
+	w.p.mu.Lock()
+	defer w.p.mu.Unlock()
+
+	fmt.Fprint(os.Stderr, clearLine)
+	n, err := os.Stderr.Write(b)
+	fmt.Fprint(os.Stderr, w.p.line(time.Now()))
+	return n, err
+}
+
+// line formats the progress like "Storing [====>    ] 45.0% 1.2GB/2.6GB 30.5MB/s, 400.0MB uploaded"
+func (p *progress) line(now time.Time) string {
+	n := atomic.LoadInt64(&p.n)
+
+	var rate string
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+		rate = formatSize(int64(float64(n)/elapsed)) + "/s"
+	}
+
+	var line string
+	if p.total > 0 {
+		ratio := float64(n) / float64(p.total)
+		if ratio > 1 {
+			ratio = 1
+		}
+		line = fmt.Sprintf("%s %5.1f%% %s/%s %s", p.label, ratio*100, formatSize(n), formatSize(p.total), rate)
+		if p.mode == progressBar {
+			filled := int(ratio * progressBarWidth)
+			bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+			line = fmt.Sprintf("%s [%s] %5.1f%% %s/%s %s", p.label, bar, ratio*100, formatSize(n), formatSize(p.total), rate)
+		}
+	} else {
+		line = fmt.Sprintf("%s %s %s", p.label, formatSize(n), rate)
+	}
+
+	if transferred := atomic.LoadInt64(&p.transferred); transferred > 0 {
+		line += fmt.Sprintf(", %s uploaded", formatSize(transferred))
+	}
+
+	return line
+}
+
+// progressReader counts bytes read into the progress
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.add(int64(n))
+	return n, err
+}
+
+// reader returns the reader counting bytes read, or r as it is when the progress is disabled
+func (p *progress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+
+	return &progressReader{r: r, p: p}
+}
+
+// progressWriterAt counts bytes written by concurrent downloads into the progress
+type progressWriterAt struct {
+	w io.WriterAt
+	p *progress
+}
+
+func (w *progressWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	n, err := w.w.WriteAt(b, off)
+	w.p.add(int64(n))
+	return n, err
+}
+
+// writerAt returns the writer counting bytes written, or w as it is when the progress is disabled
+func (p *progress) writerAt(w io.WriterAt) io.WriterAt {
+	if p == nil {
+		return w
+	}
+
+	return &progressWriterAt{w: w, p: p}
+}
+
+// transferWriter counts bytes written into the bytes transferred of the progress
+type transferWriter struct {
+	w io.Writer
+	p *progress
+}
+
+func (w *transferWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.p.addTransferred(int64(n))
+	return n, err
+}
+
+// archivedSize returns the total size of files stored from the paths, which is the total of the progress of store
+func archivedSize(paths []string) int64 {
+	var total int64
+	for _, root := range paths {
+		walkArchivedFiles(root, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				total += info.Size()
+			}
+			return nil
+		})
+	}
+
+	return total
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestProgressLine(t *testing.T) {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		p        *progress
+		expected string
+	}{
+		{
+			"log with total",
+			&progress{label: "Storing", total: 4 << 20, n: 1 << 20, mode: progressLog, start: start},
+			"Storing  25.0% 1.0MB/4.0MB 512.0KB/s",
+		},
+		{
+			"bar with total",
+			&progress{label: "Storing", total: 4 << 20, n: 1 << 20, transferred: 300 << 10, mode: progressBar, start: start},
+			"Storing [=======                       ]  25.0% 1.0MB/4.0MB 512.0KB/s, 300.0KB uploaded",
+		},
+		{
+			"unknown total",
+			&progress{label: "Downloading", n: 3 << 30, mode: progressLog, start: start},
+			"Downloading 3.0GB 1.5GB/s",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := tc.p.line(start.Add(2 * time.Second)); actual != tc.expected {
+				t.Errorf("expected %q but got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDisabledProgress(t *testing.T) {
+	defer func(original string) { progressMode = original }(progressMode)
+	progressMode = progressNone
+
+	p := startProgress("Storing", 100)
+	if p != nil {
+		t.Fatal("progress is started while disabled")
+	}
+
+	content, err := ioutil.ReadAll(p.reader(bytes.NewReader([]byte("foo"))))
+	if err != nil || string(content) != "foo" {
+		t.Fatalf("failed to read through disabled progress: %s, %s", content, err)
+	}
+	p.add(1)
+	p.finish()
+}
+
+func TestProgressReader(t *testing.T) {
+	defer func(original string) { progressMode = original }(progressMode)
+	progressMode = progressLog
+
+	p := startProgress("Extracting", 6)
+	if _, err := ioutil.ReadAll(p.reader(bytes.NewReader([]byte("foobar")))); err != nil {
+		t.Fatalf("failed to read: %s", err)
+	}
+	p.finish()
+
+	if p.n != 6 {
+		t.Fatalf("expected 6 bytes but got %d", p.n)
+	}
+}
+
+func TestValidateProgress(t *testing.T) {
+	defer func(original string) { progressMode = original }(progressMode)
+
+	for _, mode := range progressModes {
+		progressMode = mode
+		if err := validateProgress(); err != nil {
+			t.Errorf("%s is rejected: %s", mode, err)
+		}
+	}
+
+	progressMode = "always"
+	if err := validateProgress(); err == nil {
+		t.Error("invalid mode is accepted")
+	}
+}
@@ -0,0 +1,256 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/spf13/cobra"
+)
+
+// errPathArchives is returned for caches of per-path archives, which can't be served as a single archive
+var errPathArchives = errors.New("cache of per-path archives can't be served as a single archive")
+
+var proxyCacheDir string
+var proxyMaxSize string
+
+func init() {
+	proxyCmd := &cobra.Command{
+		Use:   "proxy",
+		Short: "Serve caches over HTTP keeping recently downloaded archives on local disk",
+		Long: `Serve caches over HTTP keeping recently downloaded archives on local disk.
+
+The API is the same as serve. Keys are still matched in S3 on each request,
+but archives are downloaded only once for each ETag and served from --cache-dir afterwards.
+The least recently used archives are removed when they exceed --max-size.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+
+			maxSize, err := parseSize(proxyMaxSize)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := os.MkdirAll(proxyCacheDir, 0755); err != nil {
+				log.Fatalf("failed to create cache directory: %s", err)
+			}
+
+			server, err := newCacheServer()
+			if err != nil {
+				log.Fatal(err)
+			}
+			server.local = newDiskCache(proxyCacheDir, maxSize)
+
+			runServer(server)
+		},
+	}
+
+	proxyCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches")
+	proxyCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(proxyCmd)
+	addServeFlags(proxyCmd)
+	proxyCmd.Flags().StringVarP(&proxyCacheDir, "cache-dir", "", filepath.Join(os.TempDir(), "guruguru-cache-proxy"), "Directory to keep downloaded archives in")
+	proxyCmd.Flags().StringVarP(&proxyMaxSize, "max-size", "", "10GB", "Max total size of archives kept in the cache directory")
+
+	rootCmd.AddCommand(proxyCmd)
+}
+
+// diskCache keeps archives in files named by the hash of their object keys and ETags,
+// so that caches overwritten like by --also-key or --force are downloaded again instead of served stale.
+// The modification times of the files are updated on reads to find the least recently used ones.
+type diskCache struct {
+	dir     string
+	maxSize int64
+
+	mu          sync.Mutex
+	downloading map[string]chan struct{}
+}
+
+func newDiskCache(dir string, maxSize int64) *diskCache {
+	return &diskCache{dir: dir, maxSize: maxSize, downloading: make(map[string]chan struct{})}
+}
+
+func (c *diskCache) path(objectKey string, etag string) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%x.tar.gz", sha256.Sum256([]byte(objectKey+"\x00"+etag))))
+}
+
+// open returns the file of the archive at the ETag, downloading it with fetch when it's not kept yet.
+// Concurrent requests of the same archive wait for the first one to download it.
+func (c *diskCache) open(objectKey string, etag string, fetch func(w io.Writer) error) (*os.File, bool, error) {
+	path := c.path(objectKey, etag)
+	for {
+		c.mu.Lock()
+		if file, err := os.Open(path); err == nil {
+			c.mu.Unlock()
+			now := time.Now()
+			os.Chtimes(path, now, now)
+			return file, true, nil
+		}
+		if ch, ok := c.downloading[path]; ok {
+			c.mu.Unlock()
+			<-ch
+			if _, err := os.Stat(path); err != nil {
+				return nil, false, fmt.Errorf("failed to download %s in another request", objectKey)
+			}
+			continue
+		}
+		ch := make(chan struct{})
+		c.downloading[path] = ch
+		c.mu.Unlock()
+
+		err := c.download(path, fetch)
+
+		c.mu.Lock()
+		delete(c.downloading, path)
+		close(ch)
+		c.mu.Unlock()
+
+		if err != nil {
+			return nil, false, err
+		}
+		if err := c.evict(path); err != nil {
+			log.Println(err)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to open cached archive: %s", err)
+		}
+		return file, false, nil
+	}
+}
+
+// download writes the archive to a temporal file in the directory and renames it, so that partial files are never read
+func (c *diskCache) download(path string, fetch func(w io.Writer) error) error {
+	file, err := ioutil.TempFile(c.dir, ".download-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporal file: %s", err)
+	}
+	defer os.Remove(file.Name())
+
+	err = fetch(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("failed to save archive: %s", err)
+	}
+
+	return nil
+}
+
+// evict removes the least recently used archives until their total size is at most maxSize, except the one just kept
+func (c *diskCache) evict(keep string) error {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory: %s", err)
+	}
+
+	var archives []os.FileInfo
+	var total int64
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		archives = append(archives, f)
+		total += f.Size()
+	}
+
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].ModTime().Before(archives[j].ModTime())
+	})
+
+	for _, f := range archives {
+		if total <= c.maxSize {
+			break
+		}
+
+		path := filepath.Join(c.dir, f.Name())
+		if path == keep {
+			continue
+		}
+		// files being read are still readable after removed on Unix
+		if err := os.Remove(path); err != nil {
+			log.Printf("failed to remove %s: %s\n", path, err)
+			continue
+		}
+		total -= f.Size()
+	}
+
+	return nil
+}
+
+// getLocal serves the archive from the disk cache, downloading it from S3 on the first request
+func (s *cacheServer) getLocal(w http.ResponseWriter, r *http.Request, key string) {
+	found, err := findCacheKey([]string{prefixedKey(key)})
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if found == "" {
+		http.Error(w, "no cache is found", http.StatusNotFound)
+		return
+	}
+
+	// the body is got at the ETag of HEAD, so that the file kept for the ETag has the archive of it
+	item, err := headItem(objectKey(found))
+	if err != nil {
+		serverError(w, fmt.Errorf("failed to get cache: %s: %s", found, err))
+		return
+	}
+	if isPathArchivesManifest(item) {
+		http.Error(w, errPathArchives.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	file, hit, err := s.local.open(objectKey(found), aws.StringValue(item.ETag), func(w io.Writer) error {
+		body, err := newArchiveReader(item, objectKey(found))
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		if _, err := io.Copy(w, body); err != nil {
+			return fmt.Errorf("failed to download cache: %s: %s", found, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		serverError(w, fmt.Errorf("failed to stat cached archive: %s", err))
+		return
+	}
+
+	if hit {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(cacheKeyHeader, strings.TrimPrefix(found, prefixedKey("")))
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskCacheOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guruguru-cache-test-")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newDiskCache(dir, 1<<20)
+	fetched := 0
+	fetch := func(w io.Writer) error {
+		fetched++
+		_, err := io.WriteString(w, "archive")
+		return err
+	}
+
+	for i, expectedHit := range []bool{false, true} {
+		file, hit, err := c.open("v1/foo.tar.gz", `"etag"`, fetch)
+		if err != nil {
+			t.Fatalf("failed to open archive: %s", err)
+		}
+		content, _ := ioutil.ReadAll(file)
+		file.Close()
+
+		if hit != expectedHit || string(content) != "archive" {
+			t.Fatalf("the archive of request %d is wrong: hit=%t %s", i, hit, content)
+		}
+	}
+	if fetched != 1 {
+		t.Fatalf("the archive is fetched %d times", fetched)
+	}
+
+	if _, _, err := c.open("v1/bar.tar.gz", `"etag"`, func(w io.Writer) error {
+		return fmt.Errorf("failed")
+	}); err == nil {
+		t.Fatal("the archive is opened though fetching failed")
+	}
+	if _, err := os.Stat(c.path("v1/bar.tar.gz", `"etag"`)); !os.IsNotExist(err) {
+		t.Fatalf("the archive failed to fetch is kept: %s", err)
+	}
+}
+
+func TestDiskCacheEvict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guruguru-cache-test-")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newDiskCache(dir, 10)
+	now := time.Now()
+	for i, key := range []string{"old", "middle", "new"} {
+		path := c.path(key, "")
+		if err := ioutil.WriteFile(path, []byte("12345"), 0644); err != nil {
+			log.Fatalf("failed to write archive: %s", err)
+		}
+		modTime := now.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(path, modTime, modTime)
+	}
+
+	if err := c.evict(c.path("new", "")); err != nil {
+		t.Fatalf("failed to evict archives: %s", err)
+	}
+
+	for key, kept := range map[string]bool{"old": false, "middle": true, "new": true} {
+		if _, err := os.Stat(c.path(key, "")); (err == nil) != kept {
+			t.Fatalf("%s is kept=%t: %v", key, !kept, err)
+		}
+	}
+}
+
+func TestProxyServesOverwrittenCache(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+
+	dir, err := ioutil.TempDir("", "guruguru-cache-test-")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := &cacheServer{local: newDiskCache(dir, 1<<20)}
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/caches/latest-main", nil))
+		return rec
+	}
+
+	// the archive of the overwritten cache is downloaded again
+	for _, content := range []string{"old", "new"} {
+		fake.put(objectKey(prefixedKey("latest-main")), []byte(content), nil)
+		for _, expected := range []string{"MISS", "HIT"} {
+			rec := get()
+			if rec.Code != http.StatusOK || rec.Body.String() != content || rec.Header().Get("X-Cache") != expected {
+				t.Fatalf("the %s archive is served wrong: %d %s: %s", content, rec.Code, rec.Header().Get("X-Cache"), rec.Body.String())
+			}
+		}
+	}
+}
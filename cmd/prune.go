@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+)
+
+// deleteObjectsLimit is the max number of keys of a DeleteObjects request
+const deleteObjectsLimit = 1000
+
+var pruneOlderThan string
+var pruneKeepLatest int
+var pruneMaxTotalSize string
+var pruneDryRun bool
+var pruneChunkGrace string
+
+func init() {
+	pruneCmd := &cobra.Command{
+		Use:   "prune [flags] [prefix]",
+		Short: "Delete stale caches by age, count or total size",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+
+			var olderThan time.Duration
+			var maxTotalSize int64
+			var err error
+			if pruneOlderThan != "" {
+				if olderThan, err = parseAge(pruneOlderThan); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if pruneMaxTotalSize != "" {
+				if maxTotalSize, err = parseSize(pruneMaxTotalSize); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if pruneKeepLatest < 0 {
+				log.Fatalf("number of caches to keep must not be negative: %d", pruneKeepLatest)
+			}
+			if olderThan == 0 && pruneKeepLatest == 0 && maxTotalSize == 0 {
+				log.Fatal("at least one of --older-than, --keep-latest or --max-total-size is required")
+			}
+			chunkGrace, err := parseAge(pruneChunkGrace)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if chunkGrace <= chunkRefreshAge {
+				log.Fatalf("--chunk-grace must be longer than %s, the age of chunks stores refresh: %s", chunkRefreshAge, pruneChunkGrace)
+			}
+
+			prefix := ""
+			if len(args) > 0 {
+				prefix = args[0]
+			}
+
+			refs, err := listCacheRefs()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			// chunks and base caches are shared with caches out of the prefix, so all the caches are listed to find the ones referred to
+			all, err := listCaches("")
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := refs.readRefs(all, true); err != nil {
+				log.Fatal(err)
+			}
+
+			var caches []*cacheEntry
+			for _, c := range all {
+				if strings.HasPrefix(c.Key, prefix) {
+					caches = append(caches, c)
+				}
+			}
+
+			now := time.Now()
+			pruned := refs.withoutBases(all, selectPrunedCaches(caches, refs, now, olderThan, pruneKeepLatest, maxTotalSize))
+
+			var reclaimed int64
+			for _, c := range pruned {
+				log.Printf("pruning cache: %s (%s, %s)\n", c.Key, formatSize(c.Size), c.LastModified.Format(time.RFC3339))
+				reclaimed += c.Size
+			}
+
+			if !pruneDryRun {
+				if err := deleteCaches(pruned); err != nil {
+					log.Fatal(err)
+				}
+			}
+
+			swept := refs.unreferenced(keptCaches(all, pruned), now.Add(-chunkGrace))
+			var sweptSize int64
+			var sweptKeys []string
+			for _, object := range swept {
+				sweptSize += aws.Int64Value(object.Size)
+				sweptKeys = append(sweptKeys, aws.StringValue(object.Key))
+			}
+			if len(swept) > 0 {
+				log.Printf("sweeping %d chunks no cache refers to (%s)\n", len(swept), formatSize(sweptSize))
+			}
+			reclaimed += sweptSize
+
+			if !pruneDryRun {
+				if err := deleteObjects(sweptKeys); err != nil {
+					log.Fatal(err)
+				}
+			}
+
+			log.Printf("pruned %d of %d caches and %d of %d chunks, reclaiming %s\n", len(pruned), len(caches), len(swept), len(refs.chunks), formatSize(reclaimed))
+		},
+	}
+
+	pruneCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches")
+	pruneCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(pruneCmd)
+	pruneCmd.Flags().StringVarP(&pruneOlderThan, "older-than", "", "", "Delete caches older than the age like 14d or 36h")
+	pruneCmd.Flags().IntVarP(&pruneKeepLatest, "keep-latest", "", 0, "Delete caches except the latest ones of this number (0 means no limit)")
+	pruneCmd.Flags().StringVarP(&pruneMaxTotalSize, "max-total-size", "", "", "Delete the oldest caches until the total size is at most this size like 100GB")
+	pruneCmd.Flags().BoolVarP(&pruneDryRun, "dry-run", "", false, "Print caches to prune without deleting them")
+	pruneCmd.Flags().StringVarP(&pruneChunkGrace, "chunk-grace", "", "2d", "Delete chunks no cache refers to only when they're older than the age, longer than 1d")
+
+	rootCmd.AddCommand(pruneCmd)
+}
+
+// parseAge parses a duration like "36h", also accepting days like "14d"
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid age: %s", s)
+		}
+
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age: %s", s)
+	}
+
+	return d, nil
+}
+
+// selectPrunedCaches returns the caches any of the rules deletes, where zero values disable the rules.
+// The total size includes the chunks kept caches refer to, each counted once for the newest cache referring to it.
+func selectPrunedCaches(caches []*cacheEntry, chunks *cacheRefs, now time.Time, olderThan time.Duration, keepLatest int, maxTotalSize int64) []*cacheEntry {
+	sorted := append([]*cacheEntry{}, caches...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].LastModified.After(sorted[j].LastModified)
+	})
+
+	var pruned []*cacheEntry
+	// the total size counts only caches kept so far, and caches older than the one exceeding it are deleted too
+	var totalSize int64
+	exceeded := false
+	counted := make(map[string]bool)
+	for i, c := range sorted {
+		size := c.Size + chunks.newSize(c, counted)
+		if maxTotalSize > 0 && totalSize+size > maxTotalSize {
+			exceeded = true
+		}
+
+		switch {
+		case olderThan > 0 && now.Sub(c.LastModified) > olderThan:
+		case keepLatest > 0 && i >= keepLatest:
+		case exceeded:
+		default:
+			totalSize += size
+			chunks.count(c, counted)
+			continue
+		}
+
+		pruned = append(pruned, c)
+	}
+
+	return pruned
+}
+
+// keptCaches returns the caches except the pruned ones
+func keptCaches(caches []*cacheEntry, pruned []*cacheEntry) []*cacheEntry {
+	deleted := make(map[*cacheEntry]bool)
+	for _, c := range pruned {
+		deleted[c] = true
+	}
+
+	var kept []*cacheEntry
+	for _, c := range caches {
+		if !deleted[c] {
+			kept = append(kept, c)
+		}
+	}
+
+	return kept
+}
+
+// deleteCaches deletes the manifest objects of the caches first, so that no cache is found partially
+func deleteCaches(caches []*cacheEntry) error {
+	var manifests, others []string
+	for _, c := range caches {
+		for _, object := range c.objects {
+			key := aws.StringValue(object.Key)
+			if key == objectKey(prefixedKey(c.Key)) {
+				manifests = append(manifests, key)
+			} else {
+				others = append(others, key)
+			}
+		}
+	}
+
+	if err := deleteObjects(manifests); err != nil {
+		return err
+	}
+
+	return deleteObjects(others)
+}
+
+func deleteObjects(keys []string) error {
+	for start := 0; start < len(keys); start += deleteObjectsLimit {
+		end := start + deleteObjectsLimit
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		var objects []*s3.ObjectIdentifier
+		for _, key := range keys[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		output, err := s3Client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: &s3Bucket,
+			Delete: &s3.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete objects: %s", err)
+		}
+		if len(output.Errors) > 0 {
+			e := output.Errors[0]
+			return fmt.Errorf("failed to delete %d objects like %s: %s", len(output.Errors), aws.StringValue(e.Key), aws.StringValue(e.Message))
+		}
+	}
+
+	return nil
+}
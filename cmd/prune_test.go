@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestParseAge(t *testing.T) {
+	cases := map[string]time.Duration{
+		"14d":  14 * 24 * time.Hour,
+		"0.5d": 12 * time.Hour,
+		"36h":  36 * time.Hour,
+	}
+
+	for s, expected := range cases {
+		actual, err := parseAge(s)
+		if err != nil {
+			t.Fatalf("failed to parse age: %s: %s", s, err)
+		}
+		if actual != expected {
+			t.Fatalf("the parsed age of %q is wrong: %s", s, actual)
+		}
+	}
+
+	for _, s := range []string{"", "d", "-1d", "14days"} {
+		if _, err := parseAge(s); err == nil {
+			t.Fatalf("invalid age is parsed: %q", s)
+		}
+	}
+}
+
+func TestSelectPrunedCaches(t *testing.T) {
+	now := time.Date(2019, 3, 15, 0, 0, 0, 0, time.UTC)
+	caches := []*cacheEntry{
+		{Key: "a", Size: 10, LastModified: now.Add(-1 * 24 * time.Hour)},
+		{Key: "b", Size: 20, LastModified: now.Add(-20 * 24 * time.Hour)},
+		{Key: "c", Size: 30, LastModified: now.Add(-2 * 24 * time.Hour)},
+		{Key: "d", Size: 40, LastModified: now.Add(-3 * 24 * time.Hour)},
+	}
+
+	cases := []struct {
+		olderThan    time.Duration
+		keepLatest   int
+		maxTotalSize int64
+		expected     []string
+	}{
+		{14 * 24 * time.Hour, 0, 0, []string{"b"}},
+		{0, 2, 0, []string{"d", "b"}},
+		{0, 0, 50, []string{"d", "b"}},
+		{0, 0, 80, []string{"b"}},
+		{0, 3, 35, []string{"c", "d", "b"}},
+		{14 * 24 * time.Hour, 0, 60, []string{"d", "b"}},
+		{0, 0, 0, nil},
+	}
+
+	for _, c := range cases {
+		var actual []string
+		for _, entry := range selectPrunedCaches(caches, nil, now, c.olderThan, c.keepLatest, c.maxTotalSize) {
+			actual = append(actual, entry.Key)
+		}
+		if !reflect.DeepEqual(actual, c.expected) {
+			t.Fatalf("pruned caches with %+v are wrong: %v", c, actual)
+		}
+	}
+}
+
+func TestSelectPrunedCachesWithChunks(t *testing.T) {
+	now := time.Date(2019, 3, 15, 0, 0, 0, 0, time.UTC)
+	caches := []*cacheEntry{
+		{Key: "a", Size: 10, LastModified: now.Add(-1 * 24 * time.Hour)},
+		{Key: "b", Size: 10, LastModified: now.Add(-2 * 24 * time.Hour)},
+		{Key: "c", Size: 10, LastModified: now.Add(-3 * 24 * time.Hour)},
+	}
+	chunks := &cacheRefs{
+		chunks: map[string]*s3.Object{
+			"x": {Key: aws.String("x"), Size: aws.Int64(100)},
+			"y": {Key: aws.String("y"), Size: aws.Int64(50)},
+		},
+		refs: map[string][]string{
+			"a": {"x", "x"},
+			"b": {"x"},
+			"c": {"x", "y"},
+		},
+	}
+
+	cases := []struct {
+		olderThan    time.Duration
+		maxTotalSize int64
+		expected     []string
+	}{
+		// the shared chunk is counted only for the newest cache
+		{0, 120, []string{"c"}},
+		{0, 180, nil},
+		{0, 100, []string{"a", "b", "c"}},
+		// the chunk is counted for the newest kept cache when newer ones are deleted
+		{36 * time.Hour, 120, []string{"b", "c"}},
+	}
+
+	for _, c := range cases {
+		var actual []string
+		for _, entry := range selectPrunedCaches(caches, chunks, now, c.olderThan, 0, c.maxTotalSize) {
+			actual = append(actual, entry.Key)
+		}
+		if !reflect.DeepEqual(actual, c.expected) {
+			t.Fatalf("pruned caches with %+v are wrong: %v", c, actual)
+		}
+	}
+}
+
+func TestUnreferencedChunks(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+
+	now := time.Now()
+	fake.now = func() time.Time { return now.Add(-72 * time.Hour) }
+	fake.put(prefixedKey("chunks/x.gz"), []byte("x"), nil)
+	fake.put(prefixedKey("chunks/y.gz"), []byte("y"), nil)
+	fake.now = func() time.Time { return now }
+	fake.put(prefixedKey("chunks/z.gz"), []byte("z"), nil)
+	fake.put(prefixedKey("a.tar.gz"), []byte("x\n"), map[string]string{chunksMetadataKey: "1"})
+	fake.put(prefixedKey("b.tar.gz"), []byte("y\n"), map[string]string{chunksMetadataKey: "1"})
+	fake.put(prefixedKey("c.tar.gz"), []byte("not chunked"), nil)
+	fake.put(checksumKey(prefixedKey("c")), []byte("abc"), map[string]string{baseMetadataKey: "a"})
+
+	chunks, err := listCacheRefs()
+	if err != nil {
+		t.Fatalf("failed to list chunks: %s", err)
+	}
+	caches, err := listCaches("")
+	if err != nil {
+		t.Fatalf("failed to list caches: %s", err)
+	}
+	if err := chunks.readRefs(caches, true); err != nil {
+		t.Fatalf("failed to read chunks caches refer to: %s", err)
+	}
+	if !reflect.DeepEqual(chunks.bases, map[string]string{"c": "a"}) {
+		t.Fatalf("the base caches are wrong: %v", chunks.bases)
+	}
+	if size := chunks.size(caches); size != 2 {
+		t.Fatalf("the size of the chunks caches refer to is wrong: %d", size)
+	}
+
+	// b is pruned, and z is too new to be swept even though no cache refers to it
+	kept := keptCaches(caches, caches[1:2])
+	var swept []string
+	for _, object := range chunks.unreferenced(kept, now.Add(-48*time.Hour)) {
+		swept = append(swept, strings.TrimPrefix(aws.StringValue(object.Key), prefixedKey("")))
+	}
+	if !reflect.DeepEqual(swept, []string{"chunks/y.gz"}) {
+		t.Fatalf("the swept chunks are wrong: %v", swept)
+	}
+}
+
+func TestChunkExistsRefreshesOldChunk(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+
+	now := time.Now()
+	fake.now = func() time.Time { return now.Add(-36 * time.Hour) }
+	fake.put(prefixedKey("chunks/x.gz"), []byte("x"), map[string]string{toolVersionMetadataKey: "1.0.0"})
+	fake.put(prefixedKey("chunks/y.gz"), []byte("y"), nil)
+	fake.now = func() time.Time { return now }
+	fake.put(prefixedKey("chunks/z.gz"), []byte("z"), nil)
+
+	for _, key := range []string{"x", "z"} {
+		exists, err := chunkExists(s3Bucket, prefixedKey("chunks/"+key+".gz"))
+		if err != nil || !exists {
+			t.Fatalf("the chunk %s isn't found: %v", key, err)
+		}
+	}
+	if exists, err := chunkExists(s3Bucket, prefixedKey("chunks/missing.gz")); err != nil || exists {
+		t.Fatalf("the missing chunk is found: %v", err)
+	}
+
+	if copies := len(fake.received("PUT", prefixedKey("chunks/x.gz"))); copies != 1 {
+		t.Fatalf("the old chunk isn't refreshed: %d", copies)
+	}
+	if copies := len(fake.received("PUT", prefixedKey("chunks/z.gz"))); copies != 0 {
+		t.Fatalf("the new chunk is refreshed: %d", copies)
+	}
+
+	chunks, err := listCacheRefs()
+	if err != nil {
+		t.Fatalf("failed to list chunks: %s", err)
+	}
+	if old := chunks.unreferenced(nil, now.Add(-24*time.Hour)); len(old) != 1 || !strings.HasSuffix(aws.StringValue(old[0].Key), "chunks/y.gz") {
+		t.Fatalf("the refreshed chunk is still old: %v", old)
+	}
+	if content, _ := fake.content(prefixedKey("chunks/x.gz")); string(content) != "x" {
+		t.Fatalf("the content of the refreshed chunk is wrong: %s", content)
+	}
+	head, err := s3Client.HeadObject(&s3.HeadObjectInput{Bucket: &s3Bucket, Key: aws.String(prefixedKey("chunks/x.gz"))})
+	if err != nil || aws.StringValue(head.Metadata[toolVersionMetadataKey]) != "1.0.0" {
+		t.Fatalf("the metadata of the refreshed chunk isn't kept: %v", err)
+	}
+}
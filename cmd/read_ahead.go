@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// defaultReadConcurrency is the number of workers reading files ahead, as reading many small files is bound by latency of the disk
+const defaultReadConcurrency = 8
+
+// readAheadSize is the max size of files read ahead into memory, where larger ones are streamed from the disk
+const readAheadSize = 1 << 20
+
+// readAheadEntries is the number of entries read ahead per worker, which bounds memory to read ahead
+const readAheadEntries = 4
+
+var readConcurrency int
+
+var errWalkCanceled = errors.New("walking files is canceled")
+
+// writeReadAheadEntries walks the paths and gives entries to write in order, while workers read small files ahead of it
+func writeReadAheadEntries(paths []string, first int, write func(e *pathEntry) error) error {
+	entries := make(chan *pathEntry, readConcurrency*readAheadEntries)
+	jobs := make(chan *pathEntry)
+	done := make(chan struct{})
+	defer close(done)
+
+	for i := 0; i < readConcurrency; i++ {
+		go func() {
+			for e := range jobs {
+				e.readAhead()
+				close(e.ready)
+			}
+		}()
+	}
+
+	walkErr := make(chan error, 1)
+	go func() {
+		defer close(entries)
+		defer close(jobs)
+
+		walkErr <- walkPathEntries(paths, first, func(e *pathEntry) error {
+			if e.isContent() && (e.info.Size() <= readAheadSize || e.hashAhead) {
+				e.ready = make(chan struct{})
+			}
+
+			select {
+			case entries <- e:
+			case <-done:
+				return errWalkCanceled
+			}
+
+			if e.ready != nil {
+				select {
+				case jobs <- e:
+				case <-done:
+					return errWalkCanceled
+				}
+			}
+
+			return nil
+		})
+	}()
+
+	for e := range entries {
+		if e.ready != nil {
+			<-e.ready
+		}
+		if err := write(e); err != nil {
+			return err
+		}
+	}
+
+	return <-walkErr
+}
+
+// readAhead reads the content of the file into memory with its checksum, leaving sparse files to be streamed with their holes detected.
+// Larger files are only hashed for --dedup, as they are streamed from the disk.
+func (e *pathEntry) readAhead() {
+	if e.info.Size() > readAheadSize {
+		e.sum, e.err = fileSHA256(e.path)
+		return
+	}
+
+	file, err := os.Open(e.path)
+	if err != nil {
+		e.err = fmt.Errorf("failed to open: %s", err)
+		return
+	}
+	defer file.Close()
+
+	segments, err := sparseSegments(file, e.info)
+	if err != nil {
+		e.err = fmt.Errorf("failed to detect holes of sparse file: %s", err)
+		return
+	}
+	if segments != nil {
+		if e.hashAhead {
+			e.sum, e.err = fileSHA256(e.path)
+		}
+		return
+	}
+
+	// only the size in the header is read, as the file may be changed since walked
+	data := make([]byte, e.info.Size())
+	if _, err := io.ReadFull(file, data); err != nil {
+		e.err = fmt.Errorf("failed to read file: %s", err)
+		return
+	}
+	e.data = data
+	e.sum = fmt.Sprintf("%x", sha256.Sum256(data))
+	e.prefetched = true
+}
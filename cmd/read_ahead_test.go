@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestWriteReadAheadEntries(t *testing.T) {
+	setupFixturesToCache(t)
+	defer func(original int) { readConcurrency = original }(readConcurrency)
+
+	if err := ioutil.WriteFile("tmp/abc/large.bin", bytes.Repeat([]byte("0123456789"), readAheadSize/5), 0644); err != nil {
+		t.Fatalf("failed to write a file: %s", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := ioutil.WriteFile(fmt.Sprintf("tmp/abc/def/%03d.txt", i), []byte(fmt.Sprintf("file %d", i)), 0644); err != nil {
+			t.Fatalf("failed to write a file: %s", err)
+		}
+	}
+	paths := []string{"tmp/foo", "tmp/abc"}
+
+	readConcurrency = 1
+	sequential := new(bytes.Buffer)
+	if err := writeTar(sequential, paths); err != nil {
+		t.Fatalf("failed to write a tar sequentially: %s", err)
+	}
+
+	readConcurrency = 4
+	concurrent := new(bytes.Buffer)
+	if err := writeTar(concurrent, paths); err != nil {
+		t.Fatalf("failed to write a tar with read-ahead: %s", err)
+	}
+
+	// headers differ only in access times of files read by the first one
+	seqEntries, err := readArchiveContents(bytes.NewReader(sequential.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read the tar: %s", err)
+	}
+	conEntries, err := readArchiveContents(bytes.NewReader(concurrent.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read the tar: %s", err)
+	}
+	if len(conEntries) != 109 || !reflect.DeepEqual(seqEntries, conEntries) {
+		t.Fatalf("entries are written differently with read-ahead: %v", conEntries)
+	}
+
+	seqDigests, _, err := readArchiveDigests(bytes.NewReader(sequential.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read the tar: %s", err)
+	}
+	conDigests, _, err := readArchiveDigests(bytes.NewReader(concurrent.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read the tar: %s", err)
+	}
+	if !reflect.DeepEqual(seqDigests, conDigests) {
+		t.Fatal("files are written differently with read-ahead")
+	}
+}
+
+func TestWriteReadAheadEntriesWithError(t *testing.T) {
+	setupFixturesToCache(t)
+	defer func(original int) { readConcurrency = original }(readConcurrency)
+	readConcurrency = 4
+
+	if err := writeTar(new(bytes.Buffer), []string{"tmp/foo", "tmp/missing"}); err == nil {
+		t.Fatal("missing path is archived")
+	}
+}
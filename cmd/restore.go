@@ -2,7 +2,6 @@ package cmd
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -10,71 +9,108 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/spf13/cobra"
 	"github.com/yuya-takeyama/guruguru-cache/template"
 )
 
+var skipExisting bool
+var downloadPartSize string
+var downloadConcurrency int
+var ageIdentityFile string
+
 func init() {
 	restoreCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket to upload")
 	restoreCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(restoreCmd)
+	addTemplateFlags(restoreCmd)
+	addKeyFlags(restoreCmd)
+	restoreCmd.Flags().StringArrayVarP(&fallbackS3Buckets, "fallback-s3-bucket", "", nil, "S3 bucket to try when no cache is found, optionally with its region like bucket:us-west-2 (can be repeated)")
+	restoreCmd.Flags().BoolVarP(&s3Anonymous, "anonymous", "", false, "Access the public S3 bucket without credentials")
+	restoreCmd.Flags().BoolVarP(&skipExisting, "skip-existing", "", false, "Don't restore paths which already exist")
+	restoreCmd.Flags().StringVarP(&restoreRelativeTo, "restore-relative-to", "", "", "Directory to restore relative paths under instead of the current directory")
+	restoreCmd.Flags().BoolVarP(&verifyFiles, "verify-files", "", false, "Verify the checksum of each restored file with the manifest of the cache")
+	restoreCmd.Flags().StringVarP(&downloadPartSize, "download-part-size", "", "5MB", "Size of each range of concurrent downloads")
+	restoreCmd.Flags().IntVarP(&downloadConcurrency, "download-concurrency", "", s3manager.DefaultDownloadConcurrency, "Number of ranges downloaded concurrently")
+	restoreCmd.Flags().StringVarP(&ageIdentityFile, "age-identity-file", "", "", "age identity file to decrypt encrypted caches")
+	restoreCmd.Flags().StringVarP(&passphraseFile, "passphrase-file", "", "", "Decrypt encrypted caches with the passphrase in the file")
+	addTmpSpaceFlags(restoreCmd)
+	restoreCmd.Flags().StringVarP(&progressMode, "progress", "", progressAuto, "Report progress as bars on terminals, logs or none ("+strings.Join(progressModes, ", ")+")")
 
 	rootCmd.AddCommand(restoreCmd)
-
-	sess := session.Must(session.NewSession())
-	s3Client = s3.New(sess)
 }
 
 var restoreCmd = &cobra.Command{
 	Use:   "restore [flags] [cache keys...]",
 	Short: "Restore cache files with keys",
-	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		dir, err := ioutil.TempDir("", "guruguru-cache-")
+		if err := setupS3Client(); err != nil {
+			log.Fatal(err)
+		}
+		if err := setupTemplate(); err != nil {
+			log.Fatal(err)
+		}
+
+		if err := validateDownloadOptions(); err != nil {
+			log.Fatal(err)
+		}
+		if err := validateProgress(); err != nil {
+			log.Fatal(err)
+		}
+
+		dir, err := ioutil.TempDir(tmpDir, "guruguru-cache-")
 		if err != nil {
 			log.Fatalf("failed to create temporal directory: %s", err)
 		}
 
 		defer os.RemoveAll(dir)
 
-		var item *s3.GetObjectOutput
-		for _, key := range args {
+		keyTemplate, fallbackKeys, err := keyTemplateArgs(args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		named, _ := selectedCache()
+		fallbackKeys = append(fallbackKeys, named.RestoreKeys...)
+
+		var cacheKeys []string
+		for _, key := range append([]string{keyTemplate}, fallbackKeys...) {
 			cacheKey, err := template.ExecuteTemplate(key)
 			if err != nil {
 				log.Fatal(err)
 			}
+			cacheKeys = append(cacheKeys, prefixedKey(cacheKey))
+		}
 
-			log.Printf("checking cache for: %s", cacheKey)
+		locations, err := bucketLocations()
+		if err != nil {
+			log.Fatal(err)
+		}
 
-			item, err = getExactlyMatchedItem(cacheKey)
-			if err != nil {
-				if aerr, ok := err.(awserr.Error); ok {
-					if aerr.Code() != s3.ErrCodeNoSuchKey {
-						log.Printf("error occurred when fetching exactly matched item: %s", err)
-					}
-				}
-			}
-			if item != nil && item.Body != nil {
-				log.Printf("exact matched cache is found: %s", cacheKey)
-				break
+		defaultClient := s3Client
+		var item *s3.GetObjectOutput
+		var itemKey string
+		for i, location := range locations {
+			if i > 0 {
+				log.Printf("checking fallback bucket: %s", location.bucket)
 			}
-
-			var itemKey string
-			item, itemKey, err = getPartiallyMatchedItem(cacheKey)
-			if err != nil {
-				if aerr, ok := err.(awserr.Error); ok {
-					if aerr.Code() != s3.ErrCodeNoSuchKey {
-						log.Printf("error occurred when fetching partially matched item: %s", err)
-					}
+			s3Client = defaultClient
+			if location.region != "" {
+				if s3Client, err = newRegionalS3Client(location.region); err != nil {
+					log.Fatal(err)
 				}
 			}
-			if item != nil && item.Body != nil {
-				log.Printf("partially matched cache is found for %s: %s", cacheKey, itemKey)
+			s3Bucket = location.bucket
+
+			if item, itemKey = findCache(cacheKeys); item != nil {
 				break
 			}
 		}
@@ -84,7 +120,22 @@ var restoreCmd = &cobra.Command{
 			return
 		}
 
-		file := saveCacheFileFromS3Item(dir, item)
+		if isPathArchivesManifest(item) {
+			if err := restorePathArchives(dir, cacheKeyFromObjectKey(itemKey), item); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		err = checkTmpSpace(dir, func() int64 {
+			return cacheSize(cacheKeyFromObjectKey(itemKey), item)
+		})
+		if err != nil {
+			item.Body.Close()
+			log.Fatal(err)
+		}
+
+		file := downloadCache(dir, item, itemKey)
 
 		defer file.Close()
 
@@ -93,8 +144,44 @@ var restoreCmd = &cobra.Command{
 	},
 }
 
+// findCache returns the first cache matching the keys in the bucket.
+// Its body is got only when it's read, so that archives downloaded by ranges aren't got as a whole.
+func findCache(cacheKeys []string) (*s3.GetObjectOutput, string) {
+	for _, cacheKey := range cacheKeys {
+		log.Printf("checking cache for: %s", cacheKey)
+
+		item, err := headItem(objectKey(cacheKey))
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				if aerr.Code() != "NotFound" {
+					log.Printf("error occurred when fetching exactly matched item: %s", err)
+				}
+			}
+		}
+		if item != nil && item.Body != nil {
+			log.Printf("exact matched cache is found: %s", cacheKey)
+			return item, objectKey(cacheKey)
+		}
+
+		item, itemKey, err := getPartiallyMatchedItem(cacheKey)
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				if aerr.Code() != s3.ErrCodeNoSuchKey {
+					log.Printf("error occurred when fetching partially matched item: %s", err)
+				}
+			}
+		}
+		if item != nil && item.Body != nil {
+			log.Printf("partially matched cache is found for %s: %s", cacheKey, itemKey)
+			return item, itemKey
+		}
+	}
+
+	return nil, ""
+}
+
 func getExactlyMatchedItem(cacheKey string) (*s3.GetObjectOutput, error) {
-	key := cacheKey + ".tar.gz"
+	key := objectKey(cacheKey)
 	input := &s3.GetObjectInput{
 		Bucket: &s3Bucket,
 		Key:    &key,
@@ -102,9 +189,85 @@ func getExactlyMatchedItem(cacheKey string) (*s3.GetObjectOutput, error) {
 	return s3Client.GetObject(input)
 }
 
+// headItem returns the object with the metadata of HEAD and the body got at its ETag when it's first read
+func headItem(key string) (*s3.GetObjectOutput, error) {
+	head, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &s3Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3.GetObjectOutput{
+		Body:                 &objectBody{client: s3Client, bucket: s3Bucket, key: key, etag: head.ETag},
+		ContentEncoding:      head.ContentEncoding,
+		ContentLength:        head.ContentLength,
+		ContentType:          head.ContentType,
+		ETag:                 head.ETag,
+		LastModified:         head.LastModified,
+		Metadata:             head.Metadata,
+		SSEKMSKeyId:          head.SSEKMSKeyId,
+		ServerSideEncryption: head.ServerSideEncryption,
+		StorageClass:         head.StorageClass,
+	}, nil
+}
+
+// objectBody gets the object when it's first read, failing when the object is replaced since its ETag was read
+type objectBody struct {
+	client *s3.S3
+	bucket string
+	key    string
+	etag   *string
+	body   io.ReadCloser
+}
+
+func (b *objectBody) Read(p []byte) (int, error) {
+	if b.body == nil {
+		output, err := b.client.GetObject(&s3.GetObjectInput{
+			Bucket:  &b.bucket,
+			Key:     &b.key,
+			IfMatch: b.etag,
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to get %s: %s", b.key, err)
+		}
+		b.body = output.Body
+	}
+
+	return b.body.Read(p)
+}
+
+func (b *objectBody) Close() error {
+	if b.body == nil {
+		return nil
+	}
+
+	return b.body.Close()
+}
+
 var maxKeys = int64(1000)
 
 func getPartiallyMatchedItem(cacheKey string) (*s3.GetObjectOutput, string, error) {
+	result, err := findLatestArchive(cacheKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if result != nil {
+		output, err := headItem(*result.Key)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return output, *result.Key, nil
+	}
+
+	return nil, "", nil
+}
+
+// findLatestArchive returns the latest archive whose key starts with the cache key, or nil if none
+func findLatestArchive(cacheKey string) (*s3.Object, error) {
 	ctx := context.Background()
 	input := &s3.ListObjectsV2Input{
 		Bucket:  &s3Bucket,
@@ -112,49 +275,144 @@ func getPartiallyMatchedItem(cacheKey string) (*s3.GetObjectOutput, string, erro
 		MaxKeys: &maxKeys,
 	}
 
-	var result *s3.Object
-	latest := new(time.Time)
+	var archives []*s3.Object
 	err := s3Client.ListObjectsV2PagesWithContext(ctx, input, func(output *s3.ListObjectsV2Output, haxNextPage bool) bool {
 		for _, object := range output.Contents {
-			if latest.Before(*object.LastModified) {
-				result = object
-				latest = object.LastModified
+			if isArchiveKey(*object.Key) {
+				archives = append(archives, object)
 			}
 		}
 
 		return true
 	})
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 
-	if result != nil {
-		input := &s3.GetObjectInput{
-			Bucket: &s3Bucket,
-			Key:    result.Key,
+	// only archives newer than the latest are told from per-path archives, which needs HEAD of their parents
+	var result *s3.Object
+	latest := new(time.Time)
+	parents := newPathArchiveParents("")
+	for _, object := range archives {
+		if !latest.Before(*object.LastModified) {
+			continue
+		}
+		if parent, err := parents.parentOf(cacheKeyFromObjectKey(*object.Key)); err != nil {
+			return nil, err
+		} else if parent != "" {
+			continue
 		}
-		output, err := s3Client.GetObject(input)
+		result = object
+		latest = object.LastModified
+	}
+
+	return result, nil
+}
+
+// isArchiveKey reports whether the object is the archive of a cache or a per-path archive, not a part or an index of one
+func isArchiveKey(key string) bool {
+	return strings.HasSuffix(key, ".tar.gz") && !partKeyPattern.MatchString(key)
+}
+
+func isSplitArchive(item *s3.GetObjectOutput) bool {
+	_, parts := item.Metadata[partsMetadataKey]
+	_, chunks := item.Metadata[chunksMetadataKey]
+	return parts || chunks
+}
+
+// downloadCache saves the archive into dir, downloading ranges of a single object concurrently
+func downloadCache(dir string, item *s3.GetObjectOutput, key string) *os.File {
+	if isSplitArchive(item) {
+		body, err := newArchiveReader(item, key)
 		if err != nil {
-			return nil, "", err
+			log.Fatal(err)
 		}
 
-		return output, *result.Key, nil
+		return saveCacheFile(dir, body)
 	}
 
-	return nil, "", nil
+	item.Body.Close()
+	p := startProgress("Downloading", aws.Int64Value(item.ContentLength))
+
+	file, err := os.Create(filepath.Join(dir, "cache.tar.gz"))
+	if err != nil {
+		log.Fatalf("failed to create cache file: %s", err)
+	}
+
+	downloader := s3manager.NewDownloaderWithClient(s3Client, func(d *s3manager.Downloader) {
+		// validated by validateDownloadOptions
+		d.PartSize, _ = parseSize(downloadPartSize)
+		d.Concurrency = downloadConcurrency
+	})
+	// ranges are of the object found, not of the one overwriting it meanwhile
+	input := &s3.GetObjectInput{
+		Bucket:  &s3Bucket,
+		Key:     &key,
+		IfMatch: item.ETag,
+	}
+	if _, err := downloader.Download(p.writerAt(file), input); err != nil {
+		log.Fatalf("failed to save cache file: %s", err)
+	}
+	p.finish()
+
+	file.Seek(0, 0)
+
+	return file
 }
 
-func saveCacheFileFromS3Item(dir string, item *s3.GetObjectOutput) *os.File {
-	defer item.Body.Close()
+func validateDownloadOptions() error {
+	partSize, err := parseSize(downloadPartSize)
+	if err != nil {
+		return err
+	}
+	if partSize < 1 {
+		return fmt.Errorf("download part size must be positive: %s", downloadPartSize)
+	}
+
+	if downloadConcurrency < 1 {
+		return fmt.Errorf("download concurrency must be positive: %d", downloadConcurrency)
+	}
+
+	return nil
+}
+
+// newArchiveReader returns the archive body, reassembling it when the cache is split into parts or chunks
+func newArchiveReader(item *s3.GetObjectOutput, key string) (io.ReadCloser, error) {
+	var keys []string
+	if parts, ok := item.Metadata[partsMetadataKey]; ok && parts != nil {
+		n, err := strconv.Atoi(*parts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number of parts: %s", *parts)
+		}
+
+		keys = partKeys(cacheKeyFromObjectKey(key), objectGeneration(item.Metadata), n)
+	} else if _, ok := item.Metadata[chunksMetadataKey]; ok {
+		var err error
+		if keys, err = chunkKeysFromManifest(item.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		return item.Body, nil
+	}
+
+	item.Body.Close()
+
+	return &objectsReader{keys: keys}, nil
+}
+
+func saveCacheFile(dir string, body io.ReadCloser) *os.File {
+	defer body.Close()
 
 	file, err := os.Create(filepath.Join(dir, "cache.tar.gz"))
 	if err != nil {
 		log.Fatalf("failed to create cache file: %s", err)
 	}
 
-	if _, err := io.Copy(file, item.Body); err != nil {
+	p := startProgress("Downloading", 0)
+	if _, err := io.Copy(file, p.reader(body)); err != nil {
 		log.Fatalf("failed to save cache file: %s", err)
 	}
+	p.finish()
 
 	file.Seek(0, 0)
 
@@ -162,13 +420,20 @@ func saveCacheFileFromS3Item(dir string, item *s3.GetObjectOutput) *os.File {
 }
 
 func extractCache(dir string, file *os.File) {
-	gzr, err := gzip.NewReader(file)
-	if err != nil {
-		log.Fatalf("failed to open gzip file: %s", err)
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
 	}
+	p := startProgress("Extracting", size)
+	defer p.finish()
 
-	tr := tar.NewReader(gzr)
+	tr, err := openTarReader(p.reader(file))
+	if err != nil {
+		log.Fatal(err)
+	}
 
+	// symlinks extracted, which other entries must not be written through
+	symlinks := make(map[string]bool)
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
@@ -177,6 +442,9 @@ func extractCache(dir string, file *os.File) {
 		if err != nil {
 			log.Fatalf("failed to extract tar file: %s", err)
 		}
+		if err := checkExtractedEntry(hdr, symlinks); err != nil {
+			log.Fatal(err)
+		}
 
 		if hdr.Typeflag&tar.TypeDir == tar.TypeDir {
 			dirpath := filepath.Join(dir, hdr.Name)
@@ -188,6 +456,16 @@ func extractCache(dir string, file *os.File) {
 			if err := os.Symlink(hdr.Linkname, symlinkpath); err != nil {
 				log.Fatalf("failed to create a symlink: %s: %s", symlinkpath, err)
 			}
+			symlinks[cleanEntryName(hdr.Name)] = true
+		} else if hdr.Typeflag == tar.TypeLink && hdr.PAXRecords[dedupPAXKey] != "" {
+			if err := copyDedupFile(filepath.Join(dir, hdr.Linkname), filepath.Join(dir, hdr.Name), os.FileMode(hdr.Mode)); err != nil {
+				log.Fatal(err)
+			}
+		} else if hdr.Typeflag == tar.TypeLink {
+			linkpath := filepath.Join(dir, hdr.Name)
+			if err := os.Link(filepath.Join(dir, hdr.Linkname), linkpath); err != nil {
+				log.Fatalf("failed to create a hard link: %s: %s", linkpath, err)
+			}
 		} else {
 			target := filepath.Join(dir, hdr.Name)
 
@@ -198,14 +476,63 @@ func extractCache(dir string, file *os.File) {
 
 			defer f.Close()
 
-			if _, err := io.Copy(f, tr); err != nil {
+			if isSparseHeader(hdr) {
+				err = extractSparseFile(f, tr, hdr)
+			} else {
+				_, err = io.Copy(f, tr)
+			}
+			if err != nil {
 				log.Fatalf("failed to write to a file: %s", err)
 			}
 		}
 	}
+
+	if verifyFiles {
+		if err := verifyExtractedFiles(dir); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// checkExtractedEntry rejects the entry written out of the directory by its name or the target of its hard link,
+// including ones through the symlinks extracted before.
+// Symlinks out of their paths are extracted as they are, since store keeps symlinks like ones to absolute paths.
+func checkExtractedEntry(hdr *tar.Header, symlinks map[string]bool) error {
+	if nameEscapes(hdr.Name) || underSymlink(cleanEntryName(hdr.Name), symlinks) {
+		return fmt.Errorf("entry is out of the directory: %s", hdr.Name)
+	}
+	if hdr.Typeflag == tar.TypeLink && (nameEscapes(hdr.Linkname) || underSymlink(cleanEntryName(hdr.Linkname), symlinks)) {
+		return fmt.Errorf("hard link is to a file out of the directory: %s: %s", hdr.Name, hdr.Linkname)
+	}
+
+	return nil
+}
+
+// underSymlink reports whether the cleaned name or one of its parents is a symlink
+func underSymlink(name string, symlinks map[string]bool) bool {
+	for ; name != "." && name != "/"; name = path.Dir(name) {
+		if symlinks[name] {
+			return true
+		}
+	}
+
+	return false
 }
 
 func moveToOriginalPaths(dir string) {
+	moveToPaths(dir, "")
+}
+
+// pathEscapesRoot reports whether the path in metadata.json is out of root or root itself once joined to it,
+// as extract --to removes the paths under root before moving extracted ones to them
+func pathEscapesRoot(root string, p string) bool {
+	rel, err := filepath.Rel(root, filepath.Join(root, p))
+
+	return err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// moveToPaths moves the extracted paths under root, or to the original paths when root is empty
+func moveToPaths(dir string, root string) {
 	metadataFile, err := os.Open(filepath.Join(dir, "metadata.json"))
 	if err != nil {
 		if err != nil {
@@ -220,17 +547,47 @@ func moveToOriginalPaths(dir string) {
 		log.Fatalf("failed to decode metadata file: %s", err)
 	}
 
+	if meta.Base != "" {
+		if root != "" {
+			log.Fatalf("cache has only files changed since the base cache, which only restore can restore: %s", meta.Base)
+		}
+
+		restoreDelta(dir, &meta)
+		log.Println("finished")
+		return
+	}
+
+	if root != "" {
+		// checked before moving any path, so that a cache with such a path is extracted nowhere
+		for _, p := range meta.Paths {
+			if pathEscapesRoot(root, p) {
+				log.Fatalf("path in the cache is out of the directory given by --to: %s", p)
+			}
+		}
+	}
+
 	for i, path := range meta.Paths {
-		if err := os.RemoveAll(path); err != nil {
-			log.Fatalf("failed to remove current path: %s: %s", path, err)
+		if root != "" {
+			path = filepath.Join(root, path)
+		} else {
+			path = restoredPath(&meta, path)
+		}
+		if skipExisting && pathExists(path) {
+			log.Printf("skipped existing path: %s", path)
+			continue
 		}
 
-		from := filepath.Join(dir, fmt.Sprintf("%04d", i), filepath.Base(path))
+		from := filepath.Join(dir, fmt.Sprintf("%04d", i), filepath.Base(meta.Paths[i]))
+		// a file given as a path is left out of the cache truncated by --max-size-policy warn
+		if meta.Truncated && !pathExists(from) {
+			log.Printf("skipped path truncated from the cache: %s", path)
+			continue
+		}
 		pathBaseDir := filepath.Dir(path)
 		if err := os.MkdirAll(pathBaseDir, 0755); err != nil {
 			log.Fatalf("failed to create a directory: %s", err)
 		}
-		if err := os.Rename(from, path); err != nil {
+		if err := movePath(from, path); err != nil {
 			log.Fatalf("failed to move file: %s", err)
 		}
 	}
@@ -1,11 +1,21 @@
 package cmd
 
 import (
+	"archive/tar"
+	"bytes"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"filippo.io/age"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
 )
 
 func TestExtractCache(t *testing.T) {
@@ -19,11 +29,8 @@ func TestExtractCache(t *testing.T) {
 	defer os.RemoveAll(dir)
 
 	paths := []string{"tmp/foo", "tmp/abc/def"}
-	if err := createTar(dir, "test", paths); err != nil {
-		t.Fatalf("failed to create a tar: %s", err)
-	}
-	if err := compressGzip(dir, "test"); err != nil {
-		t.Fatalf("failed to compress to gzip file: %s", err)
+	if err := writeArchiveFile(filepath.Join(dir, "test.tar.gz"), paths); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
 	} else {
 		if file, err := os.Open(filepath.Join(dir, "test.tar.gz")); err != nil {
 			t.Fatalf("failed to open the gzip file: %s", err)
@@ -83,11 +90,8 @@ func TestMoveToOriginalPathWithRelativePaths(t *testing.T) {
 	defer os.RemoveAll(dir)
 
 	paths := []string{"tmp/foo", "tmp/abc/def"}
-	if err := createTar(dir, "test", paths); err != nil {
-		t.Fatalf("failed to create a tar: %s", err)
-	}
-	if err := compressGzip(dir, "test"); err != nil {
-		t.Fatalf("failed to compress to gzip file: %s", err)
+	if err := writeArchiveFile(filepath.Join(dir, "test.tar.gz"), paths); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
 	} else {
 		clearFixturesToCache(t)
 
@@ -101,6 +105,73 @@ func TestMoveToOriginalPathWithRelativePaths(t *testing.T) {
 	}
 }
 
+func TestMoveToPathsWithRoot(t *testing.T) {
+	setupFixturesToCache(t)
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	root, err := ioutil.TempDir("", "test")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+
+	defer os.RemoveAll(root)
+
+	paths := []string{"tmp/foo", "tmp/abc/def"}
+	if err := writeArchiveFile(filepath.Join(dir, "test.tar.gz"), paths); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "test.tar.gz"))
+	if err != nil {
+		t.Fatalf("failed to open the gzip file: %s", err)
+	}
+	defer file.Close()
+
+	extractCache(dir, file)
+	moveToPaths(dir, root)
+
+	content, err := ioutil.ReadFile(filepath.Join(root, "tmp/foo/hoge.txt"))
+	if err != nil {
+		t.Fatalf("failed to read a file under the root: %s", err)
+	}
+	if string(content) != "This is foo!" {
+		t.Fatalf("the content of a file under the root is wrong: %s", content)
+	}
+	if _, err := os.Stat(filepath.Join(root, "tmp/abc/def/ghe")); err != nil {
+		t.Fatalf("failed to stat a directory under the root: %s", err)
+	}
+	if _, err := os.Stat("tmp/foo/hoge.txt"); err != nil {
+		t.Fatalf("the original path is changed: %s", err)
+	}
+}
+
+func TestPathEscapesRoot(t *testing.T) {
+	testCases := []struct {
+		path     string
+		expected bool
+	}{
+		{"tmp/foo", false},
+		{"/home/foo/.gem", false},
+		{"tmp/../foo", false},
+		{"../../etc/x", true},
+		{"tmp/../../foo", true},
+		{"..", true},
+		{".", true},
+	}
+
+	for _, tc := range testCases {
+		if actual := pathEscapesRoot("/tmp/extracted", tc.path); actual != tc.expected {
+			t.Errorf("expected %v for %s but got %v", tc.expected, tc.path, actual)
+		}
+	}
+}
+
 func TestMoveToOriginalPathWithAbsolutePaths(t *testing.T) {
 	setupFixturesToCache(t)
 
@@ -119,11 +190,8 @@ func TestMoveToOriginalPathWithAbsolutePaths(t *testing.T) {
 	foopath := filepath.Join(cwd, "tmp/foo")
 	defpath := filepath.Join(cwd, "tmp/abc/def")
 	paths := []string{foopath, defpath}
-	if err := createTar(dir, "test", paths); err != nil {
-		t.Fatalf("failed to create a tar: %s", err)
-	}
-	if err := compressGzip(dir, "test"); err != nil {
-		t.Fatalf("failed to compress to gzip file: %s", err)
+	if err := writeArchiveFile(filepath.Join(dir, "test.tar.gz"), paths); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
 	} else {
 		clearFixturesToCache(t)
 
@@ -136,3 +204,453 @@ func TestMoveToOriginalPathWithAbsolutePaths(t *testing.T) {
 		}
 	}
 }
+
+func TestExtractCacheWithHardLinks(t *testing.T) {
+	setupFixturesToCache(t)
+
+	if err := os.Link("tmp/foo/hoge.txt", "tmp/foo/hoge-link.txt"); err != nil {
+		t.Fatalf("failed to create a hard link to cache: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	paths := []string{"tmp/foo"}
+	if err := writeArchiveFile(filepath.Join(dir, "test.tar.gz"), paths); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "test.tar.gz"))
+	if err != nil {
+		t.Fatalf("failed to open the gzip file: %s", err)
+	}
+
+	defer file.Close()
+
+	extractCache(dir, file)
+
+	orig, err := os.Stat(filepath.Join(dir, "0000/foo/hoge-link.txt"))
+	if err != nil {
+		t.Fatalf("failed to stat a fixture file: %s", err)
+	}
+	link, err := os.Stat(filepath.Join(dir, "0000/foo/hoge.txt"))
+	if err != nil {
+		t.Fatalf("failed to stat a fixture hard link: %s", err)
+	}
+	if !os.SameFile(orig, link) {
+		t.Fatalf("0000/foo/hoge.txt is not hard-linked to 0000/foo/hoge-link.txt")
+	}
+}
+
+func TestExtractCacheWithSparseFiles(t *testing.T) {
+	setupFixturesToCache(t)
+	createSparseFixture(t, "tmp/foo/sparse.img")
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	paths := []string{"tmp/foo"}
+	if err := writeArchiveFile(filepath.Join(dir, "test.tar.gz"), paths); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "test.tar.gz"))
+	if err != nil {
+		t.Fatalf("failed to open the gzip file: %s", err)
+	}
+
+	defer file.Close()
+
+	extractCache(dir, file)
+
+	expected, err := ioutil.ReadFile("tmp/foo/sparse.img")
+	if err != nil {
+		t.Fatalf("failed to read a fixture file: %s", err)
+	}
+	actual, err := ioutil.ReadFile(filepath.Join(dir, "0000/foo/sparse.img"))
+	if err != nil {
+		t.Fatalf("failed to read an extracted sparse file: %s", err)
+	}
+	if !bytes.Equal(expected, actual) {
+		t.Fatalf("the content of the extracted sparse file is wrong")
+	}
+	extracted, err := os.Open(filepath.Join(dir, "0000/foo/sparse.img"))
+	if err != nil {
+		t.Fatalf("failed to open an extracted sparse file: %s", err)
+	}
+	defer extracted.Close()
+	if segments, err := sparseSegments(extracted, mustStat(t, extracted.Name())); err != nil || segments == nil {
+		t.Fatalf("the holes of the extracted sparse file aren't left: %v", err)
+	}
+}
+
+func TestExtractSparseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// archive/tar reads the holes as zeros
+	expected := "\x00\x00\x00\x00\x00data\x00\x00\x00"
+	f, err := os.Create(filepath.Join(dir, "sparse"))
+	if err != nil {
+		t.Fatalf("failed to create a file: %s", err)
+	}
+	err = extractSparseFile(f, strings.NewReader(expected), &tar.Header{Size: 12, PAXRecords: map[string]string{paxGNUSparseMap: "5,4,12,0"}})
+	f.Close()
+	if err != nil {
+		t.Fatalf("failed to extract the sparse file: %s", err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "sparse"))
+	if err != nil || string(content) != expected {
+		t.Fatalf("the content of the sparse file is wrong: %q: %v", content, err)
+	}
+
+	hdr := &tar.Header{Size: 12, PAXRecords: map[string]string{paxGNUSparseMap: "5,4,3,4"}}
+	if _, err := parseSparseHeader(hdr); err == nil {
+		t.Fatal("the overlapping segments are parsed")
+	}
+}
+
+func TestExtractCacheWithLongAndUTF8Paths(t *testing.T) {
+	setupFixturesToCache(t)
+	setupLongAndUTF8FixturesToCache(t)
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	paths := []string{"tmp/foo"}
+	if err := writeArchiveFile(filepath.Join(dir, "test.tar.gz"), paths); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	clearFixturesToCache(t)
+
+	file, err := os.Open(filepath.Join(dir, "test.tar.gz"))
+	if err != nil {
+		t.Fatalf("failed to open the gzip file: %s", err)
+	}
+
+	defer file.Close()
+
+	extractCache(dir, file)
+	moveToOriginalPaths(dir)
+
+	if content, err := ioutil.ReadFile(filepath.Join(longFixtureDir, "index.js")); err != nil {
+		t.Fatalf("failed to read a restored file with a long path: %s", err)
+	} else if string(content) != "This is long!" {
+		t.Fatalf("the content of a restored file with a long path is wrong: %s", content)
+	}
+	if content, err := ioutil.ReadFile("tmp/foo/ぐるぐる.txt"); err != nil {
+		t.Fatalf("failed to read a restored file with a UTF-8 path: %s", err)
+	} else if string(content) != "This is UTF-8!" {
+		t.Fatalf("the content of a restored file with a UTF-8 path is wrong: %s", content)
+	}
+}
+
+func TestMoveToOriginalPathWithSkipExisting(t *testing.T) {
+	setupFixturesToCache(t)
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	paths := []string{"tmp/foo", "tmp/abc/def"}
+	if err := writeArchiveFile(filepath.Join(dir, "test.tar.gz"), paths); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	if err := os.RemoveAll("tmp/abc"); err != nil {
+		t.Fatalf("failed to remove a fixture: %s", err)
+	}
+	if err := ioutil.WriteFile("tmp/foo/hoge.txt", []byte("This is modified!"), 0644); err != nil {
+		t.Fatalf("failed to modify a fixture: %s", err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "test.tar.gz"))
+	if err != nil {
+		t.Fatalf("failed to open the gzip file: %s", err)
+	}
+
+	defer file.Close()
+
+	skipExisting = true
+	defer func() { skipExisting = false }()
+
+	extractCache(dir, file)
+	moveToOriginalPaths(dir)
+
+	if content, err := ioutil.ReadFile("tmp/foo/hoge.txt"); err != nil {
+		t.Fatalf("failed to read a fixture file: %s", err)
+	} else if string(content) != "This is modified!" {
+		t.Fatalf("the existing path is overwritten: %s", content)
+	}
+	if stat, err := os.Stat("tmp/abc/def/ghe"); err != nil {
+		t.Fatalf("the missing path is not restored: %s", err)
+	} else if !stat.IsDir() {
+		t.Fatalf("assertion failed: tmp/abc/def/ghe is not a directory")
+	}
+}
+
+func TestExtractCacheWithCompressionFormats(t *testing.T) {
+	formats := map[string]func(w io.Writer) (io.WriteCloser, error){
+		"tar": func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		"tar.zst": func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+		"tar.lz4": func(w io.Writer) (io.WriteCloser, error) {
+			return lz4.NewWriter(w), nil
+		},
+	}
+
+	for ext, newWriter := range formats {
+		setupFixturesToCache(t)
+
+		dir, err := ioutil.TempDir("", "test")
+		if err != nil {
+			log.Fatalf("failed to create temporal directory: %s", err)
+		}
+
+		defer os.RemoveAll(dir)
+
+		paths := []string{"tmp/foo", "tmp/abc/def"}
+		if err := writeTarFile(filepath.Join(dir, "test.tar"), paths); err != nil {
+			t.Fatalf("failed to write a tar: %s", err)
+		}
+
+		tarFile, err := os.Open(filepath.Join(dir, "test.tar"))
+		if err != nil {
+			t.Fatalf("failed to open the tar file: %s", err)
+		}
+
+		defer tarFile.Close()
+
+		file, err := os.Create(filepath.Join(dir, "test."+ext+".archive"))
+		if err != nil {
+			t.Fatalf("failed to create an archive: %s", err)
+		}
+
+		defer file.Close()
+
+		w, err := newWriter(file)
+		if err != nil {
+			t.Fatalf("failed to create a writer for %s: %s", ext, err)
+		}
+		if _, err := io.Copy(w, tarFile); err != nil {
+			t.Fatalf("failed to write %s: %s", ext, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("failed to close %s: %s", ext, err)
+		}
+
+		file.Seek(0, 0)
+		clearFixturesToCache(t)
+
+		extractCache(dir, file)
+		moveToOriginalPaths(dir)
+		assertFixtures(t)
+	}
+}
+
+func assertEncryptedRoundTrip(t *testing.T, dir string) {
+	file, err := os.Create(filepath.Join(dir, "test.tar.gz.age"))
+	if err != nil {
+		t.Fatalf("failed to create an archive: %s", err)
+	}
+
+	defer file.Close()
+
+	w, err := newEncryptWriter(file)
+	if err != nil {
+		t.Fatalf("failed to create an encrypt writer: %s", err)
+	}
+	paths := []string{"tmp/foo", "tmp/abc/def"}
+	if _, err := writeArchive(w, paths); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close the encrypt writer: %s", err)
+	}
+
+	file.Seek(0, 0)
+	if _, err := decompress(file); err == nil {
+		t.Fatalf("the encrypted archive is readable without decryption")
+	}
+
+	file.Seek(0, 0)
+	clearFixturesToCache(t)
+
+	extractCache(dir, file)
+	moveToOriginalPaths(dir)
+	assertFixtures(t)
+}
+
+func TestExtractCacheWithAgeEncryption(t *testing.T) {
+	setupFixturesToCache(t)
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("failed to generate an age identity: %s", err)
+	}
+
+	identityFile := filepath.Join(dir, "identity.txt")
+	if err := ioutil.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatalf("failed to write an age identity file: %s", err)
+	}
+
+	ageRecipients = []string{identity.Recipient().String()}
+	ageIdentityFile = identityFile
+	defer func() {
+		ageRecipients = nil
+		ageIdentityFile = ""
+	}()
+
+	assertEncryptedRoundTrip(t, dir)
+}
+
+func TestExtractCacheWithPassphraseEncryption(t *testing.T) {
+	setupFixturesToCache(t)
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	passphraseFile = filepath.Join(dir, "passphrase.txt")
+	defer func() { passphraseFile = "" }()
+
+	if err := ioutil.WriteFile(passphraseFile, []byte("guruguru\n"), 0600); err != nil {
+		t.Fatalf("failed to write a passphrase file: %s", err)
+	}
+
+	assertEncryptedRoundTrip(t, dir)
+}
+
+func TestDecryptUnencryptedArchive(t *testing.T) {
+	setupFixturesToCache(t)
+
+	buf := new(bytes.Buffer)
+	if _, err := writeArchive(buf, []string{"tmp/foo"}); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+	if _, err := decrypt(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("the archive isn't read without encryption: %s", err)
+	}
+
+	passphraseFile = "passphrase.txt"
+	defer func() { passphraseFile = "" }()
+	if _, err := decrypt(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatal("the unencrypted archive is read with the passphrase")
+	}
+}
+
+func TestValidateDownloadOptions(t *testing.T) {
+	defer func(original string) { downloadPartSize = original }(downloadPartSize)
+	defer func(original int) { downloadConcurrency = original }(downloadConcurrency)
+
+	for _, c := range []struct {
+		partSize    string
+		concurrency int
+		valid       bool
+	}{
+		{"5MB", 5, true},
+		{"1", 1, true},
+		{"0", 5, false},
+		{"5XB", 5, false},
+		{"5MB", 0, false},
+	} {
+		downloadPartSize, downloadConcurrency = c.partSize, c.concurrency
+		if err := validateDownloadOptions(); (err == nil) != c.valid {
+			t.Fatalf("validation of %s and %d is wrong: %v", c.partSize, c.concurrency, err)
+		}
+	}
+}
+
+func TestDownloadCacheByRanges(t *testing.T) {
+	setupFixturesToCache(t)
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original string) { downloadPartSize = original }(downloadPartSize)
+	defer func(original int) { downloadConcurrency = original }(downloadConcurrency)
+	downloadPartSize, downloadConcurrency = "100", 2
+
+	archive := new(bytes.Buffer)
+	if _, err := writeArchive(archive, []string{"tmp/foo"}); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+	fake.put(objectKey(prefixedKey("key")), archive.Bytes(), nil)
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	item, itemKey := findCache([]string{prefixedKey("key")})
+	if item == nil {
+		t.Fatal("the cache isn't found")
+	}
+	file := downloadCache(dir, item, itemKey)
+	defer file.Close()
+
+	content, err := ioutil.ReadAll(file)
+	if err != nil || !bytes.Equal(content, archive.Bytes()) {
+		t.Fatalf("the archive is downloaded with different content: %v", err)
+	}
+	// the archive is found by HEAD and got only by ranges of the found object
+	for _, r := range fake.received(http.MethodGet, itemKey) {
+		if r.Header.Get("Range") == "" || r.Header.Get("If-Match") != aws.StringValue(item.ETag) {
+			t.Fatalf("the archive is got as a whole or not at the ETag: %v", r.Header)
+		}
+	}
+	if len(fake.received(http.MethodHead, itemKey)) == 0 {
+		t.Fatal("the archive isn't found by HEAD")
+	}
+}
+
+func TestHeadItemOverwritten(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+
+	fake.put(objectKey(prefixedKey("key")), []byte("old"), nil)
+	item, err := headItem(objectKey(prefixedKey("key")))
+	if err != nil {
+		t.Fatalf("failed to find the cache: %s", err)
+	}
+	if len(fake.received(http.MethodGet, objectKey(prefixedKey("key")))) != 0 {
+		t.Fatal("the body is got before it's read")
+	}
+
+	fake.put(objectKey(prefixedKey("key")), []byte("new"), nil)
+	if _, err := ioutil.ReadAll(item.Body); err == nil {
+		t.Fatal("the body of the overwriting object is read")
+	}
+}
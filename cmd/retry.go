@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const retryBaseDelay = 100 * time.Millisecond
+const retryMaxDelay = 20 * time.Second
+
+var retryMaxAttempts int
+var retryMaxElapsed time.Duration
+
+// backoffRetryer retries S3 requests with full-jittered exponential backoff until maxElapsed passes
+type backoffRetryer struct {
+	client.DefaultRetryer
+	maxElapsed time.Duration
+}
+
+func newBackoffRetryer(maxAttempts int, maxElapsed time.Duration) backoffRetryer {
+	return backoffRetryer{
+		DefaultRetryer: client.DefaultRetryer{NumMaxRetries: maxAttempts - 1},
+		maxElapsed:     maxElapsed,
+	}
+}
+
+func (b backoffRetryer) ShouldRetry(r *request.Request) bool {
+	if b.maxElapsed > 0 && time.Since(r.Time) >= b.maxElapsed {
+		return false
+	}
+
+	return b.DefaultRetryer.ShouldRetry(r)
+}
+
+func (b backoffRetryer) RetryRules(r *request.Request) time.Duration {
+	delay := retryMaxDelay
+	if r.RetryCount < 30 {
+		if d := retryBaseDelay << uint(r.RetryCount); d < delay {
+			delay = d
+		}
+	}
+	delay = time.Duration(rand.Int63n(int64(delay))) + 1
+
+	log.Printf("retrying %s in %s (attempt %d): %s", r.Operation.Name, delay, r.RetryCount+2, r.Error)
+
+	return delay
+}
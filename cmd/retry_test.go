@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestBackoffRetryer(t *testing.T) {
+	retryer := newBackoffRetryer(5, time.Minute)
+	if retryer.MaxRetries() != 4 {
+		t.Fatalf("the number of retries is wrong: %d", retryer.MaxRetries())
+	}
+
+	r := &request.Request{
+		Operation:    &request.Operation{Name: "GetObject"},
+		Time:         time.Now(),
+		HTTPResponse: &http.Response{StatusCode: http.StatusServiceUnavailable},
+		Error:        errors.New("SlowDown"),
+	}
+	if !retryer.ShouldRetry(r) {
+		t.Fatal("503 is not retried")
+	}
+
+	for n := 0; n < 20; n++ {
+		r.RetryCount = n
+		delay := retryer.RetryRules(r)
+		if delay <= 0 || delay > retryMaxDelay || delay > retryBaseDelay<<uint(n) {
+			t.Fatalf("the delay of retry %d is out of range: %s", n, delay)
+		}
+	}
+
+	r.Time = time.Now().Add(-2 * time.Minute)
+	if retryer.ShouldRetry(r) {
+		t.Fatal("retried after the max elapsed time")
+	}
+
+	r = &request.Request{
+		Time:         time.Now(),
+		HTTPResponse: &http.Response{StatusCode: http.StatusNotFound},
+	}
+	if retryer.ShouldRetry(r) {
+		t.Fatal("404 is retried")
+	}
+}
@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+)
+
+var s3Accelerate bool
+var keyPrefix string
+var awsProfile string
+var awsRegion string
+var assumeRoleARN string
+var assumeRoleExternalID string
+var s3Anonymous bool
+var caBundle string
+var fallbackS3Buckets []string
+
+// awsSession is created by setupS3Client when a command runs, not on init
+var awsSession *session.Session
+
+// addS3Flags adds the flags for the S3 client shared by commands
+func addS3Flags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&keyPrefix, "prefix", "", "", "Prefix of S3 keys like org/repo/ to share the bucket with other projects")
+	cmd.Flags().BoolVarP(&s3Accelerate, "s3-accelerate", "", false, "Use S3 Transfer Acceleration endpoints")
+	cmd.Flags().StringVarP(&awsProfile, "aws-profile", "", "", "AWS profile in the shared config and credentials files")
+	cmd.Flags().StringVarP(&awsRegion, "aws-region", "", "", "AWS region of the S3 bucket")
+	cmd.Flags().StringVarP(&assumeRoleARN, "assume-role-arn", "", "", "ARN of the IAM role to assume to access the S3 bucket")
+	cmd.Flags().StringVarP(&assumeRoleExternalID, "assume-role-external-id", "", "", "External ID to assume the IAM role with")
+	cmd.Flags().StringVarP(&caBundle, "ca-bundle", "", "", "PEM file of CA certificates to trust in addition to the system ones")
+	cmd.Flags().IntVarP(&retryMaxAttempts, "retry-max-attempts", "", 5, "Max number of attempts of each S3 request")
+	cmd.Flags().DurationVarP(&retryMaxElapsed, "retry-max-elapsed", "", 5*time.Minute, "Max elapsed time to retry each S3 request (0 means no limit)")
+}
+
+// setupS3Client creates the S3 client with the options given by flags
+func setupS3Client() error {
+	if assumeRoleExternalID != "" && assumeRoleARN == "" {
+		return fmt.Errorf("--assume-role-external-id requires --assume-role-arn")
+	}
+	if s3Anonymous && (awsProfile != "" || assumeRoleARN != "") {
+		return fmt.Errorf("--anonymous can't be used with --aws-profile or --assume-role-arn")
+	}
+	if retryMaxAttempts < 1 {
+		return fmt.Errorf("max attempts of retry must be positive: %d", retryMaxAttempts)
+	}
+
+	sess, err := newAWSSession()
+	if err != nil {
+		return err
+	}
+
+	awsSession = sess
+	s3Client = s3.New(sess)
+	configureS3Client(s3Client)
+
+	return nil
+}
+
+func configureS3Client(c *s3.S3) {
+	c.Retryer = newBackoffRetryer(retryMaxAttempts, retryMaxElapsed)
+	// errors which the SDK marks retryable also need to be checked for the max elapsed time
+	c.Config.EnforceShouldRetryCheck = aws.Bool(true)
+
+	if s3Accelerate {
+		c.Config.S3UseAccelerate = aws.Bool(true)
+	}
+}
+
+// newRegionalS3Client returns the client for a bucket in another region with the same options
+func newRegionalS3Client(region string) (*s3.S3, error) {
+	c := s3.New(awsSession, &aws.Config{Region: &region})
+	configureS3Client(c)
+
+	return c, nil
+}
+
+type bucketLocation struct {
+	bucket string
+	region string
+}
+
+// bucketLocations returns --s3-bucket followed by --fallback-s3-bucket in order
+func bucketLocations() ([]bucketLocation, error) {
+	locations := []bucketLocation{{bucket: s3Bucket}}
+	for _, s := range fallbackS3Buckets {
+		location, err := parseBucketLocation(s)
+		if err != nil {
+			return nil, err
+		}
+
+		locations = append(locations, location)
+	}
+
+	return locations, nil
+}
+
+// parseBucketLocation parses a bucket optionally followed by its region like "bucket:us-west-2"
+func parseBucketLocation(s string) (bucketLocation, error) {
+	kv := strings.SplitN(s, ":", 2)
+	if kv[0] == "" || (len(kv) == 2 && kv[1] == "") {
+		return bucketLocation{}, fmt.Errorf("invalid bucket: %s (must be bucket or bucket:region)", s)
+	}
+
+	location := bucketLocation{bucket: kv[0]}
+	if len(kv) == 2 {
+		location.region = kv[1]
+	}
+
+	return location, nil
+}
+
+func newAWSSession() (*session.Session, error) {
+	httpClient, err := newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := session.Options{Profile: awsProfile}
+	opts.Config.HTTPClient = httpClient
+	if awsProfile != "" {
+		// the region of the profile is written in the shared config file
+		opts.SharedConfigState = session.SharedConfigEnable
+		opts.Config.Credentials = profileCredentials(awsProfile)
+	}
+	if awsRegion != "" {
+		opts.Config.Region = &awsRegion
+	}
+
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %s", err)
+	}
+
+	if s3Anonymous {
+		// requests to public buckets are sent unsigned
+		sess = sess.Copy(&aws.Config{Credentials: credentials.AnonymousCredentials})
+	} else if assumeRoleARN != "" {
+		creds := stscreds.NewCredentials(sess, assumeRoleARN, func(p *stscreds.AssumeRoleProvider) {
+			if assumeRoleExternalID != "" {
+				p.ExternalID = &assumeRoleExternalID
+			}
+		})
+		sess = sess.Copy(&aws.Config{Credentials: creds})
+	}
+
+	return sess, nil
+}
+
+// profileCredentials returns the credentials of the profile given by the flag when access keys are also in the environment,
+// which the SDK would prefer to the profile, or nil to leave the profile to the SDK, which also assumes the role of the profile
+func profileCredentials(profile string) *credentials.Credentials {
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" && os.Getenv("AWS_ACCESS_KEY") == "" {
+		return nil
+	}
+
+	return credentials.NewSharedCredentials("", profile)
+}
+
+// newHTTPClient returns the client honoring HTTPS_PROXY and trusting --ca-bundle.
+// The SDK's own CA bundle support drops the proxy settings of the default transport,
+// so the transport is built with the dialer and timeouts of the default one instead.
+func newHTTPClient() (*http.Client, error) {
+	defaultTransport := http.DefaultTransport.(*http.Transport)
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           defaultTransport.DialContext,
+		TLSClientConfig:       defaultTransport.TLSClientConfig,
+		TLSHandshakeTimeout:   defaultTransport.TLSHandshakeTimeout,
+		MaxIdleConns:          defaultTransport.MaxIdleConns,
+		MaxIdleConnsPerHost:   defaultTransport.MaxIdleConnsPerHost,
+		IdleConnTimeout:       defaultTransport.IdleConnTimeout,
+		ResponseHeaderTimeout: defaultTransport.ResponseHeaderTimeout,
+		ExpectContinueTimeout: defaultTransport.ExpectContinueTimeout,
+	}
+
+	if caBundle != "" {
+		pem, err := ioutil.ReadFile(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %s", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates are found in CA bundle: %s", caBundle)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// cacheFormatVersion is bumped on incompatible changes of the archive format, so that old caches never collide with new ones
+const cacheFormatVersion = 1
+
+// prefixedKey namespaces the cache key with --prefix so that projects can share a bucket, followed by the format version
+func prefixedKey(cacheKey string) string {
+	return fmt.Sprintf("%sv%d/%s", keyPrefix, cacheFormatVersion, cacheKey)
+}
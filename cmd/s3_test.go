@@ -0,0 +1,333 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestParseBucketLocation(t *testing.T) {
+	cases := map[string]bucketLocation{
+		"example-cache":           {bucket: "example-cache"},
+		"example-cache:us-west-2": {bucket: "example-cache", region: "us-west-2"},
+	}
+
+	for s, expected := range cases {
+		actual, err := parseBucketLocation(s)
+		if err != nil {
+			t.Fatalf("failed to parse bucket: %s: %s", s, err)
+		}
+		if actual != expected {
+			t.Fatalf("the parsed bucket of %q is wrong: %+v", s, actual)
+		}
+	}
+
+	for _, s := range []string{"", ":us-west-2", "example-cache:"} {
+		if _, err := parseBucketLocation(s); err == nil {
+			t.Fatalf("invalid bucket is parsed: %q", s)
+		}
+	}
+}
+
+func TestPrefixedKey(t *testing.T) {
+	defer func() { keyPrefix = "" }()
+
+	if key := prefixedKey("gem-v1"); key != "v1/gem-v1" {
+		t.Fatalf("key without prefix is wrong: %s", key)
+	}
+
+	keyPrefix = "org/repo/"
+	if key := prefixedKey("gem-v1"); key != "org/repo/v1/gem-v1" {
+		t.Fatalf("key with prefix is wrong: %s", key)
+	}
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	client, err := newHTTPClient()
+	if err != nil {
+		t.Fatalf("failed to create HTTP client: %s", err)
+	}
+
+	transport := client.Transport.(*http.Transport)
+	if transport.Proxy == nil {
+		t.Fatal("proxy settings of the environment are not honored")
+	}
+	if transport.DialContext == nil || transport.TLSHandshakeTimeout != http.DefaultTransport.(*http.Transport).TLSHandshakeTimeout {
+		t.Fatal("dialer and timeouts of the default transport are not kept")
+	}
+	if transport.TLSClientConfig != nil && transport.TLSClientConfig.RootCAs != nil {
+		t.Fatal("root CAs are set without CA bundle")
+	}
+
+	dir, err := ioutil.TempDir("", "guruguru-cache-test-")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caBundle = filepath.Join(dir, "ca.pem")
+	defer func() { caBundle = "" }()
+	if err := ioutil.WriteFile(caBundle, []byte("not a certificate"), 0644); err != nil {
+		log.Fatalf("failed to write CA bundle: %s", err)
+	}
+
+	if _, err := newHTTPClient(); err == nil {
+		t.Fatal("invalid CA bundle is loaded")
+	}
+}
+
+func TestConfigureS3ClientWithAccelerate(t *testing.T) {
+	defer func() { s3Accelerate = false }()
+	s3Accelerate = true
+
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1"), Credentials: credentials.AnonymousCredentials}))
+	c := s3.New(sess)
+	configureS3Client(c)
+	if !aws.BoolValue(c.Config.S3UseAccelerate) {
+		t.Fatal("Transfer Acceleration isn't enabled")
+	}
+
+	req, _ := c.HeadObjectRequest(&s3.HeadObjectInput{Bucket: aws.String("example-cache"), Key: aws.String("v1/gem.tar.gz")})
+	if err := req.Build(); err != nil {
+		t.Fatalf("failed to build request: %s", err)
+	}
+	if host := req.HTTPRequest.URL.Host; host != "example-cache.s3-accelerate.amazonaws.com" {
+		t.Fatalf("the request isn't sent to the accelerate endpoint: %s", host)
+	}
+}
+
+// redirectAWSRequests sends the requests of sessions created by newAWSSession to the handler over TLS,
+// whichever endpoints like STS and S3 they're for
+func redirectAWSRequests(handler http.Handler) func() {
+	server := httptest.NewTLSServer(handler)
+	original := http.DefaultTransport
+	transport := original.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	}
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	http.DefaultTransport = transport
+
+	return func() {
+		http.DefaultTransport = original
+		server.Close()
+	}
+}
+
+// setenv sets the environment variable until the returned function restores it
+func setenv(key string, value string) func() {
+	original, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+
+	return func() {
+		if ok {
+			os.Setenv(key, original)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestNewAWSSessionWithProfileAndAssumeRole(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guruguru-cache-test-")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	credentialsFile := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(credentialsFile, []byte("[ci]\naws_access_key_id = PROFILEKEY\naws_secret_access_key = profile-secret\n"), 0600); err != nil {
+		log.Fatalf("failed to write credentials file: %s", err)
+	}
+	configFile := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(configFile, []byte("[profile ci]\nregion = ap-northeast-1\n"), 0600); err != nil {
+		log.Fatalf("failed to write config file: %s", err)
+	}
+
+	for k, v := range map[string]string{
+		"AWS_SHARED_CREDENTIALS_FILE": credentialsFile,
+		"AWS_CONFIG_FILE":             configFile,
+		"AWS_ACCESS_KEY_ID":           "ENVKEY",
+		"AWS_SECRET_ACCESS_KEY":       "env-secret",
+		"AWS_REGION":                  "",
+		"AWS_PROFILE":                 "",
+		"AWS_SDK_LOAD_CONFIG":         "",
+	} {
+		defer setenv(k, v)()
+	}
+	defer func() {
+		awsProfile, awsRegion, assumeRoleARN, assumeRoleExternalID = "", "", "", ""
+		awsSession, s3Client = nil, nil
+	}()
+
+	accessKey := func() (string, string) {
+		sess, err := newAWSSession()
+		if err != nil {
+			t.Fatalf("failed to create session: %s", err)
+		}
+		creds, err := sess.Config.Credentials.Get()
+		if err != nil {
+			t.Fatalf("failed to get credentials: %s", err)
+		}
+		return creds.AccessKeyID, aws.StringValue(sess.Config.Region)
+	}
+
+	if key, _ := accessKey(); key != "ENVKEY" {
+		t.Fatalf("the environment isn't used without --aws-profile: %s", key)
+	}
+
+	// the profile given by the flag takes precedence over the environment, and --aws-region over the profile
+	awsProfile = "ci"
+	if key, region := accessKey(); key != "PROFILEKEY" || region != "ap-northeast-1" {
+		t.Fatalf("the profile isn't used with --aws-profile: %s in %s", key, region)
+	}
+	awsRegion = "us-west-2"
+	if key, region := accessKey(); key != "PROFILEKEY" || region != "us-west-2" {
+		t.Fatalf("the region isn't given by --aws-region: %s in %s", key, region)
+	}
+
+	// the role is assumed with the credentials of the profile, and S3 is accessed with the credentials of the role
+	var mu sync.Mutex
+	var sts, s3Requests []*http.Request
+	defer redirectAWSRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if strings.HasPrefix(r.Host, "sts.") {
+			r.ParseForm()
+			sts = append(sts, r)
+			fmt.Fprint(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><AssumeRoleResult>`+
+				`<Credentials><AccessKeyId>ROLEKEY</AccessKeyId><SecretAccessKey>role-secret</SecretAccessKey>`+
+				`<SessionToken>role-token</SessionToken><Expiration>2100-01-01T00:00:00Z</Expiration></Credentials>`+
+				`</AssumeRoleResult></AssumeRoleResponse>`)
+			return
+		}
+		s3Requests = append(s3Requests, r)
+	}))()
+
+	assumeRoleARN = "arn:aws:iam::123456789012:role/cache"
+	assumeRoleExternalID = "external-id"
+	if err := setupS3Client(); err != nil {
+		t.Fatalf("failed to set up S3 client: %s", err)
+	}
+	if _, err := s3Client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("example-cache"), Key: aws.String("v1/gem.tar.gz")}); err != nil {
+		t.Fatalf("failed to access S3: %s", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sts) != 1 {
+		t.Fatalf("the role is assumed %d times", len(sts))
+	}
+	if r := sts[0]; r.Form.Get("Action") != "AssumeRole" || r.Form.Get("RoleArn") != assumeRoleARN || r.Form.Get("ExternalId") != assumeRoleExternalID {
+		t.Fatalf("the role is assumed with wrong parameters: %v", r.Form)
+	}
+	if auth := sts[0].Header.Get("Authorization"); !strings.Contains(auth, "Credential=PROFILEKEY/") {
+		t.Fatalf("the role isn't assumed with the credentials of the profile: %s", auth)
+	}
+	if len(s3Requests) != 1 {
+		t.Fatalf("S3 is requested %d times", len(s3Requests))
+	}
+	if r := s3Requests[0]; !strings.Contains(r.Header.Get("Authorization"), "Credential=ROLEKEY/") || r.Header.Get("X-Amz-Security-Token") != "role-token" {
+		t.Fatalf("S3 isn't accessed with the credentials of the role: %v", r.Header)
+	}
+}
+
+func TestSetupS3ClientWithAnonymous(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer redirectAWSRequests(fake)()
+	defer setenv("AWS_ACCESS_KEY_ID", "ENVKEY")()
+	defer setenv("AWS_SECRET_ACCESS_KEY", "env-secret")()
+	defer func() {
+		s3Anonymous, awsRegion = false, ""
+		awsSession = nil
+	}()
+
+	s3Anonymous = true
+	awsRegion = "us-east-1"
+	if err := setupS3Client(); err != nil {
+		t.Fatalf("failed to set up S3 client: %s", err)
+	}
+	s3Client.Config.S3ForcePathStyle = aws.Bool(true)
+
+	fake.put("v1/gem.tar.gz", []byte("archive"), nil)
+	item, err := headItem("v1/gem.tar.gz")
+	if err != nil {
+		t.Fatalf("failed to get the public cache: %s", err)
+	}
+	content, err := ioutil.ReadAll(item.Body)
+	item.Body.Close()
+	if err != nil || string(content) != "archive" {
+		t.Fatalf("failed to read the public cache: %q: %v", content, err)
+	}
+
+	requests := append(fake.received(http.MethodHead, "v1/gem.tar.gz"), fake.received(http.MethodGet, "v1/gem.tar.gz")...)
+	if len(requests) != 2 {
+		t.Fatalf("the cache is requested %d times", len(requests))
+	}
+	for _, r := range requests {
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			t.Fatalf("the %s request to the public bucket is signed: %s", r.Method, auth)
+		}
+	}
+}
+
+func TestCommandsWithoutS3DontCreateSession(t *testing.T) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", os.DevNull, err)
+	}
+	defer devNull.Close()
+	defer func(original *os.File) { os.Stdout = original }(os.Stdout)
+	os.Stdout = devNull
+
+	rootCmd.SetOutput(ioutil.Discard)
+	defer rootCmd.SetOutput(nil)
+	defer rootCmd.SetArgs(nil)
+	defer func() {
+		for _, name := range []string{"store", "restore"} {
+			if cmd, _, err := rootCmd.Find([]string{name}); err == nil {
+				cmd.Flags().Set("help", "false")
+			}
+		}
+	}()
+
+	cases := []struct {
+		args  []string
+		fails bool
+	}{
+		{[]string{"key", "gem-v1-{{ arch }}"}, false},
+		{[]string{"--help"}, false},
+		{[]string{"store", "--no-such-flag", "gem-v1", "vendor/bundle"}, true},
+		{[]string{"store", "--lock-ttl", "an hour", "--s3-bucket", "example-cache", "gem-v1", "vendor/bundle"}, true},
+		{[]string{"restore", "gem-v1"}, true},
+		{[]string{"store", "--help"}, false},
+		{[]string{"restore", "--help"}, false},
+	}
+	for _, c := range cases {
+		awsSession, s3Client = nil, nil
+		rootCmd.SetArgs(c.args)
+		if err := rootCmd.Execute(); (err != nil) != c.fails {
+			t.Fatalf("%v is expected to fail %v: %v", c.args, c.fails, err)
+		}
+		if awsSession != nil || s3Client != nil {
+			t.Fatalf("AWS session is created by %v", c.args)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+var searchKeyPrefix string
+var searchJSON bool
+
+func init() {
+	searchCmd := &cobra.Command{
+		Use:   "search [flags] [key=value | key...]",
+		Short: "List caches with all the tags, matching any values of tags given only by keys",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+
+			matched, err := searchCaches(searchKeyPrefix, args)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if searchJSON {
+				err = printCachesJSON(matched)
+			} else {
+				err = printCaches(matched)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	searchCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches")
+	searchCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(searchCmd)
+	searchCmd.Flags().StringVarP(&searchKeyPrefix, "key-prefix", "", "", "Search only caches whose keys start with it")
+	searchCmd.Flags().BoolVarP(&searchJSON, "json", "", false, "Print caches as JSON")
+
+	rootCmd.AddCommand(searchCmd)
+}
+
+// searchCaches returns the caches whose keys start with the prefix and whose tags match all the queries
+func searchCaches(prefix string, queries []string) ([]*cacheEntry, error) {
+	caches, err := listCaches(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// S3 can't list objects by tags, so tags of each cache are fetched
+	var matched []*cacheEntry
+	for _, c := range caches {
+		tags, err := getCacheTags(prefixedKey(c.Key))
+		if err != nil {
+			return nil, err
+		}
+		if matchTags(tags, queries) {
+			matched = append(matched, c)
+		}
+	}
+
+	return matched, nil
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSearchCaches(t *testing.T) {
+	_, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original []string) { tags = original }(tags)
+
+	uploads := map[string][]string{
+		"gem-master.tar.gz":  {"branch=master", "team=web"},
+		"gem-feature.tar.gz": {"branch=feature", "team=web"},
+		"npm-master.tar.gz":  {"branch=master"},
+		"npm-none.tar.gz":    nil,
+	}
+	for key, pairs := range uploads {
+		tags = pairs
+		if err := uploadToS3(prefixedKey(key), strings.NewReader(key), nil); err != nil {
+			t.Fatalf("failed to upload: %s", err)
+		}
+	}
+
+	cases := []struct {
+		prefix   string
+		queries  []string
+		expected []string
+	}{
+		{"", []string{"branch=master"}, []string{"gem-master", "npm-master"}},
+		{"", []string{"branch"}, []string{"gem-feature", "gem-master", "npm-master"}},
+		{"", []string{"branch=master", "team"}, []string{"gem-master"}},
+		{"npm-", []string{"branch"}, []string{"npm-master"}},
+		{"", []string{"branch=release"}, nil},
+	}
+	for _, c := range cases {
+		caches, err := searchCaches(c.prefix, c.queries)
+		if err != nil {
+			t.Fatalf("failed to search caches: %s", err)
+		}
+
+		var actual []string
+		for _, cache := range caches {
+			actual = append(actual, cache.Key)
+		}
+		if !reflect.DeepEqual(actual, c.expected) {
+			t.Fatalf("the caches matching %v in %q are wrong: %v", c.queries, c.prefix, actual)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package cmd
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/spf13/cobra"
+)
+
+// cachesPath is the path of the API under which caches are addressed by their keys like /caches/gem-v1-linux
+const cachesPath = "/caches/"
+
+// cacheKeyHeader is the response header of the key of the matched cache, which may differ from the requested one
+const cacheKeyHeader = "X-Cache-Key"
+
+var serveListen string
+var serveTokenFile string
+var serveMaxUploadSize string
+
+func init() {
+	serveCmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve caches over HTTP for clients without AWS credentials",
+		Long: `Serve caches over HTTP for clients without AWS credentials.
+
+  HEAD /caches/{key}  check whether a cache matching the key exists
+  GET  /caches/{key}  download the archive of the cache matching the key
+  PUT  /caches/{key}  upload an archive like upload does
+
+Keys are matched like restore does, exactly and then as the prefix of the latest cache.
+The key of the matched cache is returned in the X-Cache-Key header.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+
+			server, err := newCacheServer()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			runServer(server)
+		},
+	}
+
+	serveCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches")
+	serveCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(serveCmd)
+	addServeFlags(serveCmd)
+
+	rootCmd.AddCommand(serveCmd)
+}
+
+// addServeFlags adds the flags of the HTTP API shared by serve and proxy
+func addServeFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&serveListen, "listen", "", "127.0.0.1:8080", "Address to listen on like :8080")
+	cmd.Flags().StringVarP(&serveTokenFile, "token-file", "", "", "File of the token which clients must send as Authorization: Bearer <token>")
+	cmd.Flags().StringVarP(&serveMaxUploadSize, "max-upload-size", "", "10GB", "Reject archives uploaded by PUT larger than this size (0 means no limit)")
+	cmd.Flags().StringVarP(&uploadPartSize, "upload-part-size", "", "5MB", "Size of each part of multipart uploads")
+	cmd.Flags().IntVarP(&uploadConcurrency, "upload-concurrency", "", s3manager.DefaultUploadConcurrency, "Number of parts uploaded concurrently")
+	cmd.Flags().StringVarP(&sse, "sse", "", "", "Server-side encryption algorithm (AES256 or aws:kms)")
+	cmd.Flags().StringVarP(&sseKMSKeyID, "sse-kms-key-id", "", "", "KMS key ID for server-side encryption with aws:kms")
+	cmd.Flags().StringArrayVarP(&tags, "tag", "", nil, "S3 object tag of uploaded caches as key=value (can be repeated)")
+	cmd.Flags().StringVarP(&storageClass, "storage-class", "", "", "S3 storage class ("+strings.Join(storageClasses, ", ")+")")
+	cmd.Flags().StringVarP(&ageIdentityFile, "age-identity-file", "", "", "age identity file to validate encrypted archives")
+	cmd.Flags().StringVarP(&passphraseFile, "passphrase-file", "", "", "Validate encrypted archives with the passphrase in the file")
+	addTmpDirFlag(cmd)
+}
+
+// newCacheServer validates the upload options and reads the token given by flags
+func newCacheServer() (*cacheServer, error) {
+	if err := validateUploadOptions(); err != nil {
+		return nil, err
+	}
+
+	maxUploadSize, err := parseSize(serveMaxUploadSize)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &cacheServer{maxUploadSize: maxUploadSize}
+	if serveTokenFile != "" {
+		content, err := ioutil.ReadFile(serveTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token file: %s", err)
+		}
+		if server.token = strings.TrimSpace(string(content)); server.token == "" {
+			return nil, fmt.Errorf("token file is empty: %s", serveTokenFile)
+		}
+	}
+
+	return server, nil
+}
+
+// runServer serves the handler on --listen until SIGINT or SIGTERM.
+// Requests in flight are finished before exiting, so that no caches are partially uploaded.
+func runServer(handler http.Handler) {
+	httpServer := &http.Server{Addr: serveListen, Handler: handler}
+
+	done := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		log.Println("shutting down")
+		if err := httpServer.Shutdown(context.Background()); err != nil {
+			log.Printf("failed to shut down: %s\n", err)
+		}
+		close(done)
+	}()
+
+	log.Printf("listening on %s\n", serveListen)
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+}
+
+// cacheServer is the handler of the API of serve, where an empty token allows any clients and maxUploadSize of 0 allows any archives.
+// Archives are kept in local when it's given by proxy.
+type cacheServer struct {
+	token         string
+	maxUploadSize int64
+	local         *diskCache
+}
+
+func (s *cacheServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	key := cacheKeyOfPath(r.URL.Path)
+	if key == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		s.head(w, key)
+	case http.MethodGet:
+		if s.local != nil {
+			s.getLocal(w, r, key)
+		} else {
+			s.get(w, key)
+		}
+	case http.MethodPut:
+		s.put(w, r, key)
+	default:
+		w.Header().Set("Allow", "HEAD, GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// cacheKeyOfPath returns the cache key of the path under cachesPath, or empty for other paths.
+// The key is cleaned like a/../b to b, so that no key addresses objects out of --prefix.
+func cacheKeyOfPath(urlPath string) string {
+	if !strings.HasPrefix(urlPath, cachesPath) {
+		return ""
+	}
+
+	key := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(urlPath, cachesPath)), "/")
+	// a trailing slash matches caches under the key as a prefix
+	if key != "" && strings.HasSuffix(urlPath, "/") {
+		key += "/"
+	}
+
+	return key
+}
+
+func (s *cacheServer) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return true
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *cacheServer) head(w http.ResponseWriter, key string) {
+	found, err := findCacheKey([]string{prefixedKey(key)})
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if found == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set(cacheKeyHeader, strings.TrimPrefix(found, prefixedKey("")))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *cacheServer) get(w http.ResponseWriter, key string) {
+	item, itemKey := findCache([]string{prefixedKey(key)})
+	if item == nil {
+		http.Error(w, "no cache is found", http.StatusNotFound)
+		return
+	}
+	if isPathArchivesManifest(item) {
+		item.Body.Close()
+		http.Error(w, "cache of per-path archives can't be served as a single archive", http.StatusNotImplemented)
+		return
+	}
+
+	body, err := newArchiveReader(item, itemKey)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(cacheKeyHeader, strings.TrimPrefix(cacheKeyFromObjectKey(itemKey), prefixedKey("")))
+	if body == item.Body && item.ContentLength != nil {
+		// caches split into parts or chunks have no length until all of them are read
+		w.Header().Set("Content-Length", strconv.FormatInt(aws.Int64Value(item.ContentLength), 10))
+	}
+
+	if _, err := io.Copy(w, body); err != nil {
+		// the status is already sent, so the client sees the truncated body
+		log.Printf("failed to send cache: %s: %s\n", itemKey, err)
+	}
+}
+
+// put saves the body to a temporal file to validate it before uploading, as a broken cache is worse than no cache
+func (s *cacheServer) put(w http.ResponseWriter, r *http.Request, key string) {
+	cacheKey := prefixedKey(key)
+
+	if s.maxUploadSize > 0 {
+		if r.ContentLength > s.maxUploadSize {
+			http.Error(w, fmt.Sprintf("archive exceeds --max-upload-size %s", formatSize(s.maxUploadSize)), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadSize)
+	}
+
+	file, err := ioutil.TempFile(tmpDir, "guruguru-cache-serve-")
+	if err != nil {
+		serverError(w, fmt.Errorf("failed to create temporal file: %s", err))
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if n, err := io.Copy(file, r.Body); err != nil {
+		if s.maxUploadSize > 0 && n >= s.maxUploadSize {
+			http.Error(w, fmt.Sprintf("archive exceeds --max-upload-size %s", formatSize(s.maxUploadSize)), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("failed to read archive: %s", err), http.StatusBadRequest)
+		return
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		serverError(w, fmt.Errorf("failed to read archive: %s", err))
+		return
+	}
+	if _, err := validateArchive(file); err != nil {
+		http.Error(w, fmt.Sprintf("invalid archive: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	exists, err := cacheExists(cacheKey)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	// the cache stored by others is as good as the uploaded one, so it isn't an error
+	if exists {
+		log.Printf("cache already exists: %s\n", cacheKey)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if _, err := file.Seek(0, 0); err != nil {
+		serverError(w, fmt.Errorf("failed to read archive: %s", err))
+		return
+	}
+	if err := uploadArchive(cacheKey, file); err != nil {
+		serverError(w, err)
+		return
+	}
+
+	log.Printf("cache is uploaded: %s\n", cacheKey)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func serverError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCacheServerAuthorization(t *testing.T) {
+	server := &cacheServer{token: "secret"}
+
+	for _, c := range []struct {
+		authorization string
+		status        int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusMethodNotAllowed},
+	} {
+		req := httptest.NewRequest(http.MethodDelete, "/caches/foo", nil)
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+
+		if rec.Code != c.status {
+			t.Fatalf("the status with %q is wrong: %d", c.authorization, rec.Code)
+		}
+	}
+}
+
+func TestCacheServerRoutes(t *testing.T) {
+	server := &cacheServer{}
+
+	for _, c := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/", http.StatusNotFound},
+		{http.MethodGet, "/caches/", http.StatusNotFound},
+		{http.MethodGet, "/other/foo", http.StatusNotFound},
+		{http.MethodPost, "/caches/foo", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/caches/foo/bar", http.StatusMethodNotAllowed},
+	} {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(c.method, c.path, nil))
+
+		if rec.Code != c.status {
+			t.Fatalf("the status of %s %s is wrong: %d", c.method, c.path, rec.Code)
+		}
+	}
+}
+
+func TestCacheKeyOfPath(t *testing.T) {
+	for urlPath, expected := range map[string]string{
+		"/caches/foo":          "foo",
+		"/caches/foo/bar":      "foo/bar",
+		"/caches/gem-v1-/":     "gem-v1-/",
+		"/caches/a/../b":       "b",
+		"/caches/../../secret": "secret",
+		"/caches/./a//b":       "a/b",
+		"/caches/..":           "",
+		"/caches/":             "",
+		"/other/foo":           "",
+	} {
+		if key := cacheKeyOfPath(urlPath); key != expected {
+			t.Fatalf("the key of %s is wrong: %s", urlPath, key)
+		}
+	}
+}
+
+func TestCacheServerPut(t *testing.T) {
+	setupFixturesToCache(t)
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+
+	archive := new(bytes.Buffer)
+	if _, err := writeArchive(archive, []string{"tmp/foo"}); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	server := &cacheServer{maxUploadSize: int64(archive.Len())}
+	put := func(key string, body []byte) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/caches/"+key, bytes.NewReader(body)))
+		return rec
+	}
+
+	if rec := put("foo", archive.Bytes()); rec.Code != http.StatusCreated {
+		t.Fatalf("the archive isn't uploaded: %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := fake.content(objectKey(prefixedKey("foo"))); !ok {
+		t.Fatal("the cache isn't stored")
+	}
+
+	// uploading the existing cache isn't an error
+	if rec := put("bar/../foo", archive.Bytes()); rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Fatalf("the existing cache is reported wrong: %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec := put("large", append(archive.Bytes(), 0))
+	if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), "--max-upload-size") {
+		t.Fatalf("the too large archive isn't rejected: %d: %s", rec.Code, rec.Body.String())
+	}
+}
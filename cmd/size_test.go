@@ -0,0 +1,48 @@
+package cmd
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{
+		"0":      0,
+		"512":    512,
+		"100B":   100,
+		"1KB":    1024,
+		"5MB":    5 * 1024 * 1024,
+		"1.5GB":  1536 * 1024 * 1024,
+		"2tb":    2 * 1024 * 1024 * 1024 * 1024,
+		" 10 MB": 10 * 1024 * 1024,
+	}
+
+	for s, expected := range cases {
+		actual, err := parseSize(s)
+		if err != nil {
+			t.Fatalf("failed to parse size: %s: %s", s, err)
+		}
+		if actual != expected {
+			t.Fatalf("the parsed size of %q is wrong: %d", s, actual)
+		}
+	}
+
+	for _, s := range []string{"", "GB", "-1MB", "1XB"} {
+		if _, err := parseSize(s); err == nil {
+			t.Fatalf("invalid size is parsed: %q", s)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	cases := map[int64]string{
+		0:                  "0B",
+		512:                "512B",
+		1024:               "1.0KB",
+		1536 * 1024 * 1024: "1.5GB",
+		2 << 40:            "2.0TB",
+	}
+
+	for n, expected := range cases {
+		if actual := formatSize(n); actual != expected {
+			t.Fatalf("the formatted size of %d is wrong: %s", n, actual)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+)
+
+var skipMissing bool
+
+// existingPaths returns the paths which exist, failing on missing ones unless --skip-missing is given
+func existingPaths(paths []string) ([]string, error) {
+	var existing []string
+	for _, path := range paths {
+		if pathExists(path) {
+			existing = append(existing, path)
+			continue
+		}
+
+		if !skipMissing {
+			return nil, fmt.Errorf("path doesn't exist, give --skip-missing to store the others: %s", path)
+		}
+		log.Printf("skipped missing path: %s\n", path)
+	}
+
+	return existing, nil
+}
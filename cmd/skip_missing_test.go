@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExistingPaths(t *testing.T) {
+	setupFixturesToCache(t)
+	defer func(original bool) { skipMissing = original }(skipMissing)
+
+	paths := []string{"tmp/foo", "tmp/missing", "tmp/abc"}
+
+	skipMissing = false
+	if _, err := existingPaths(paths); err == nil {
+		t.Fatalf("missing path is accepted without --skip-missing")
+	}
+
+	skipMissing = true
+	existing, err := existingPaths(paths)
+	if err != nil {
+		t.Fatalf("failed to skip missing path: %s", err)
+	}
+	if !reflect.DeepEqual(existing, []string{"tmp/foo", "tmp/abc"}) {
+		t.Fatalf("existing paths are wrong: %v", existing)
+	}
+}
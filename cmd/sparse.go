@@ -0,0 +1,260 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PAX records of the GNU sparse format 0.1, where the entry has only the data segments of the file.
+// GNU tar, bsdtar and archive/tar extract it with the holes, though archive/tar can't write it.
+const (
+	paxGNUSparseSize      = "GNU.sparse.size"
+	paxGNUSparseNumBlocks = "GNU.sparse.numblocks"
+	paxGNUSparseMap       = "GNU.sparse.map"
+)
+
+// paxSparsePlaceholder makes archive/tar write a PAX header, which the records of the sparse file replace
+const paxSparsePlaceholder = "GURUGURU.sparse"
+
+type sparseSegment struct {
+	Offset int64
+	Length int64
+}
+
+func isSparseHeader(hdr *tar.Header) bool {
+	_, ok := hdr.PAXRecords[paxGNUSparseMap]
+	return ok
+}
+
+// parseSparseHeader returns the data segments of the sparse file read by archive/tar, whose size is the size with the holes
+func parseSparseHeader(hdr *tar.Header) ([]sparseSegment, error) {
+	return parseSparseSegments(hdr.PAXRecords[paxGNUSparseMap], hdr.Size)
+}
+
+// parseSparseSegments parses the offsets and the lengths of data segments in order within the size
+func parseSparseSegments(sparseMap string, size int64) ([]sparseSegment, error) {
+	if sparseMap == "" {
+		return nil, nil
+	}
+
+	fields := strings.Split(sparseMap, ",")
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid sparse map: %s", sparseMap)
+	}
+
+	var segments []sparseSegment
+	var end int64
+	for i := 0; i < len(fields); i += 2 {
+		offset, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sparse map: %s", err)
+		}
+		length, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sparse map: %s", err)
+		}
+		if offset < end || length < 0 || offset+length > size {
+			return nil, fmt.Errorf("invalid sparse map: %s", sparseMap)
+		}
+		segments = append(segments, sparseSegment{Offset: offset, Length: length})
+		end = offset + length
+	}
+
+	return segments, nil
+}
+
+// writeSparseFile writes the entry of the sparse file of the size with only its data segments read from data in order,
+// writing its content with zeros in the holes to sum without reading them.
+// The entry is written to w after the entries written by tw, which writes the entries after it.
+func writeSparseFile(tw *tar.Writer, w io.Writer, hdr *tar.Header, segments []sparseSegment, data io.Reader, sum io.Writer) error {
+	// the file ending with a hole has an empty segment at its end like GNU tar writes, so that the map is never empty
+	if n := len(segments); n == 0 || segments[n-1].Offset+segments[n-1].Length < hdr.Size {
+		segments = append(segments[:n:n], sparseSegment{Offset: hdr.Size})
+	}
+
+	header, dataSize, err := formatSparseHeader(hdr, segments)
+	if err != nil {
+		return err
+	}
+
+	// the padding of the previous entry is written so that the entry starts here
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if indexer, ok := w.(entryIndexer); ok {
+		if err := indexer.indexEntry(hdr); err != nil {
+			return err
+		}
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	var offset int64
+	for _, segment := range segments {
+		if sum != nil {
+			if _, err := io.CopyN(sum, zeros{}, segment.Offset-offset); err != nil {
+				return err
+			}
+		}
+		out := w
+		if sum != nil {
+			out = io.MultiWriter(w, sum)
+		}
+		if _, err := io.CopyN(out, data, segment.Length); err != nil {
+			return err
+		}
+		offset = segment.Offset + segment.Length
+	}
+
+	_, err = w.Write(make([]byte, tarPadding(dataSize)))
+	return err
+}
+
+// formatSparseHeader returns the PAX header and the header of the sparse file formatted by archive/tar with the size of the data segments,
+// replacing the placeholder record with the records of the sparse file
+func formatSparseHeader(hdr *tar.Header, segments []sparseSegment) ([]byte, int64, error) {
+	var dataSize int64
+	fields := make([]string, 0, len(segments)*2)
+	for _, segment := range segments {
+		dataSize += segment.Length
+		fields = append(fields, strconv.FormatInt(segment.Offset, 10), strconv.FormatInt(segment.Length, 10))
+	}
+
+	compact := *hdr
+	compact.Size = dataSize
+	compact.Format = tar.FormatPAX
+	compact.PAXRecords = map[string]string{paxSparsePlaceholder: "1"}
+	for k, v := range hdr.PAXRecords {
+		compact.PAXRecords[k] = v
+	}
+
+	buf := new(bytes.Buffer)
+	if err := tar.NewWriter(buf).WriteHeader(&compact); err != nil {
+		return nil, 0, fmt.Errorf("failed to write tar header: %s", err)
+	}
+	written, err := tar.NewReader(bytes.NewReader(buf.Bytes())).Next()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read tar header: %s", err)
+	}
+
+	records := written.PAXRecords
+	delete(records, paxSparsePlaceholder)
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var paxData []byte
+	for _, k := range keys {
+		paxData = append(paxData, formatPAXRecord(k, records[k])...)
+	}
+	// GNU tar reads the number of the segments before the map
+	paxData = append(paxData, formatPAXRecord(paxGNUSparseSize, strconv.FormatInt(hdr.Size, 10))...)
+	paxData = append(paxData, formatPAXRecord(paxGNUSparseNumBlocks, strconv.Itoa(len(segments)))...)
+	paxData = append(paxData, formatPAXRecord(paxGNUSparseMap, strings.Join(fields, ","))...)
+
+	// the PAX header is the first block written by archive/tar, and the header of the file is the last one
+	raw := buf.Bytes()
+	paxHeader := append([]byte{}, raw[:tarBlockSize]...)
+	copy(paxHeader[124:136], fmt.Sprintf("%011o\x00", len(paxData)))
+	copy(paxHeader[148:156], "        ")
+	var chksum int64
+	for _, b := range paxHeader {
+		chksum += int64(b)
+	}
+	copy(paxHeader[148:156], fmt.Sprintf("%06o\x00 ", chksum))
+
+	header := append(paxHeader, paxData...)
+	header = append(header, make([]byte, tarPadding(int64(len(paxData))))...)
+	header = append(header, raw[len(raw)-tarBlockSize:]...)
+
+	return header, dataSize, nil
+}
+
+const tarBlockSize = 512
+
+func tarPadding(size int64) int64 {
+	return -size & (tarBlockSize - 1)
+}
+
+// formatPAXRecord formats the record like "30 mtime=1432668921.098285006\n", whose length includes the length itself
+func formatPAXRecord(k, v string) string {
+	record := " " + k + "=" + v + "\n"
+	size := len(record)
+	for size < len(strconv.Itoa(size))+len(record) {
+		size++
+	}
+
+	return strconv.Itoa(size) + record
+}
+
+// sparseData reads only the data segments of the content of a sparse file with the holes read as zeros
+func sparseData(r io.Reader, segments []sparseSegment) io.Reader {
+	var readers []io.Reader
+	var offset int64
+	for _, segment := range segments {
+		readers = append(readers, &discardReader{r: r, n: segment.Offset - offset}, io.LimitReader(r, segment.Length))
+		offset = segment.Offset + segment.Length
+	}
+
+	return io.MultiReader(readers...)
+}
+
+// discardReader discards n bytes of r on the first read, reading nothing
+type discardReader struct {
+	r io.Reader
+	n int64
+}
+
+func (d *discardReader) Read(p []byte) (int, error) {
+	if _, err := io.CopyN(ioutil.Discard, d.r, d.n); err != nil {
+		return 0, err
+	}
+	d.n = 0
+
+	return 0, io.EOF
+}
+
+// zeros reads the holes of sparse files
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+
+	return len(b), nil
+}
+
+// extractSparseFile writes data segments to their offsets and leaves holes between them,
+// skipping the zeros of the holes which archive/tar reads
+func extractSparseFile(f *os.File, r io.Reader, hdr *tar.Header) error {
+	segments, err := parseSparseHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	for _, segment := range segments {
+		if _, err := io.CopyN(ioutil.Discard, r, segment.Offset-offset); err != nil {
+			return err
+		}
+		if _, err := f.Seek(segment.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(f, r, segment.Length); err != nil {
+			return err
+		}
+		offset = segment.Offset + segment.Length
+	}
+
+	return f.Truncate(hdr.Size)
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	seekData = 3 // SEEK_DATA
+	seekHole = 4 // SEEK_HOLE
+)
+
+// sparseSegments returns data segments of the file, or nil if the file is not sparse
+func sparseSegments(file *os.File, info os.FileInfo) ([]sparseSegment, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Blocks*512 >= stat.Size {
+		return nil, nil
+	}
+
+	segments := []sparseSegment{}
+	size := info.Size()
+	for offset := int64(0); offset < size; {
+		data, err := file.Seek(offset, seekData)
+		if err != nil {
+			if perr, ok := err.(*os.PathError); ok && perr.Err == syscall.ENXIO {
+				break
+			}
+			return nil, err
+		}
+
+		hole, err := file.Seek(data, seekHole)
+		if err != nil {
+			return nil, err
+		}
+
+		segments = append(segments, sparseSegment{Offset: data, Length: hole - data})
+		offset = hole
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return segments, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package cmd
+
+import "os"
+
+// sparseSegments always reports the file is not sparse since holes are detected only on Linux
+func sparseSegments(file *os.File, info os.FileInfo) ([]sparseSegment, error) {
+	return nil, nil
+}
@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// stagingKeyInfix is between the key of an archive and a random ID in the key it's uploaded to before being verified
+const stagingKeyInfix = ".tmp-"
+
+// uploadStaged uploads the archive to a staging key like key.tar.gz.tmp-<uuid>, and copies it to the key on S3
+// after its size and ETag are verified, so that a job killed while uploading never leaves a truncated archive at the key.
+// Staging objects left by killed jobs aren't caches, and expire by lifecycle apply.
+// The staging object has the metadata copied to the key, and beforePromote uploads the objects uploaded before the archive.
+func uploadStaged(s3Key string, body io.Reader, metadata map[string]*string, beforePromote func() error) error {
+	id, err := newStagingID()
+	if err != nil {
+		return err
+	}
+	stagingKey := s3Key + stagingKeyInfix + id
+
+	// validated by validateUploadOptions
+	partSize, _ := parseSize(uploadPartSize)
+	digest := newETagDigest(partSize)
+
+	// locked staging objects couldn't be deleted, so only the archive at the key is locked,
+	// and it's STANDARD so that the staging object isn't charged for the minimum storage duration of its class
+	err = uploadObject(stagingKey, io.TeeReader(body, digest), metadata, false, "")
+	defer func() {
+		if _, err := s3Client.DeleteObject(&s3.DeleteObjectInput{Bucket: &s3Bucket, Key: &stagingKey}); err != nil {
+			log.Printf("failed to delete staging object: %s: %s\n", stagingKey, err)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	head, err := s3Client.HeadObject(&s3.HeadObjectInput{Bucket: &s3Bucket, Key: &stagingKey})
+	if err != nil {
+		return markTransient(err, fmt.Errorf("failed to get staging object: %s: %s", stagingKey, err))
+	}
+	if err := digest.verify(head); err != nil {
+		// corrupted on the way, which uploading again may not be
+		return &transientError{fmt.Errorf("staging object is corrupted: %s: %s", stagingKey, err)}
+	}
+	if err := beforePromote(); err != nil {
+		return err
+	}
+
+	return promoteStaged(stagingKey, s3Key, head)
+}
+
+// newStagingID returns a random UUID
+func newStagingID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate staging key: %s", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// promoteStaged copies the verified staging object to the key with its metadata and tags,
+// giving the options of the storage class, encryption and Object Lock, which aren't copied
+func promoteStaged(stagingKey string, s3Key string, head *s3.HeadObjectOutput) error {
+	var options []request.Option
+	if objectLockEnabled() {
+		options = append(options, objectLockOption(time.Now().Add(objectLockRetention)))
+	}
+
+	if aws.Int64Value(head.ContentLength) > maxCopyObjectSize {
+		return promoteStagedByParts(stagingKey, s3Key, head, options)
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:     &s3Bucket,
+		Key:        &s3Key,
+		CopySource: aws.String(copySource(s3Bucket, stagingKey)),
+	}
+	if sse != "" {
+		input.ServerSideEncryption = &sse
+	}
+	if sseKMSKeyID != "" {
+		input.SSEKMSKeyId = &sseKMSKeyID
+	}
+	if storageClass != "" {
+		input.StorageClass = &storageClass
+	}
+
+	if _, err := s3Client.CopyObjectWithContext(aws.BackgroundContext(), input, options...); err != nil {
+		return markTransient(err, fmt.Errorf("failed to copy staging object to %s: %s", s3Key, err))
+	}
+
+	return nil
+}
+
+// promoteStagedByParts copies the staging object too large for CopyObject by parts like copy does
+func promoteStagedByParts(stagingKey string, s3Key string, head *s3.HeadObjectOutput, options []request.Option) error {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:      &s3Bucket,
+		Key:         &s3Key,
+		ContentType: head.ContentType,
+		Metadata:    head.Metadata,
+	}
+	if sse != "" {
+		input.ServerSideEncryption = &sse
+	}
+	if sseKMSKeyID != "" {
+		input.SSEKMSKeyId = &sseKMSKeyID
+	}
+	if storageClass != "" {
+		input.StorageClass = &storageClass
+	}
+	input.Tagging = aws.String(objectTagging(s3Key))
+
+	upload, err := s3Client.CreateMultipartUploadWithContext(aws.BackgroundContext(), input, options...)
+	if err != nil {
+		return markTransient(err, fmt.Errorf("failed to start copying staging object to %s: %s", s3Key, err))
+	}
+
+	src := &s3.Object{Key: &stagingKey, Size: head.ContentLength}
+	parts, err := uploadPartCopies(src, s3Bucket, s3Key, upload.UploadId)
+	if err != nil {
+		s3Client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   &s3Bucket,
+			Key:      &s3Key,
+			UploadId: upload.UploadId,
+		})
+		return err
+	}
+
+	_, err = s3Client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          &s3Bucket,
+		Key:             &s3Key,
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return markTransient(err, fmt.Errorf("failed to complete copying staging object to %s: %s", s3Key, err))
+	}
+
+	return nil
+}
+
+// etagDigest computes the size and the ETag of the object uploaded by s3manager in parts of partSize,
+// which is the MD5 of the object, or the MD5 of the MD5s of its parts with the number of parts
+type etagDigest struct {
+	partSize int64
+	size     int64
+	whole    hash.Hash
+	part     hash.Hash
+	partN    int64
+	partSums []byte
+}
+
+func newETagDigest(partSize int64) *etagDigest {
+	return &etagDigest{partSize: partSize, whole: md5.New(), part: md5.New()}
+}
+
+func (d *etagDigest) Write(b []byte) (int, error) {
+	written := len(b)
+	d.whole.Write(b)
+	d.size += int64(written)
+
+	for len(b) > 0 {
+		n := d.partSize - d.partN
+		if n > int64(len(b)) {
+			n = int64(len(b))
+		}
+		d.part.Write(b[:n])
+		d.partN += n
+		b = b[n:]
+
+		if d.partN == d.partSize {
+			d.partSums = d.part.Sum(d.partSums)
+			d.part.Reset()
+			d.partN = 0
+		}
+	}
+
+	return written, nil
+}
+
+// etag returns the ETag of the object uploaded at once, or in parts when multipart is true
+func (d *etagDigest) etag(multipart bool) string {
+	if !multipart {
+		return hex.EncodeToString(d.whole.Sum(nil))
+	}
+
+	sums := d.partSums
+	if d.partN > 0 {
+		sums = d.part.Sum(append([]byte{}, sums...))
+	}
+
+	return fmt.Sprintf("%x-%d", md5.Sum(sums), len(sums)/md5.Size)
+}
+
+// verify compares the size of the object and its ETag. Only the size is compared for objects encrypted with KMS,
+// whose ETags aren't MD5, as S3 has already checked Content-MD5 sent with each request of their content.
+func (d *etagDigest) verify(head *s3.HeadObjectOutput) error {
+	if size := aws.Int64Value(head.ContentLength); size != d.size {
+		return fmt.Errorf("size is %d bytes instead of %d bytes", size, d.size)
+	}
+	if aws.StringValue(head.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms {
+		return nil
+	}
+
+	etag := strings.Trim(aws.StringValue(head.ETag), `"`)
+	if expected := d.etag(strings.Contains(etag, "-")); etag != expected {
+		return fmt.Errorf("ETag is %s instead of %s", etag, expected)
+	}
+
+	return nil
+}
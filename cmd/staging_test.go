@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestETagDigest(t *testing.T) {
+	content := strings.Repeat("guruguru", 5)
+
+	d := newETagDigest(16)
+	for _, chunk := range []string{content[:5], content[5:30], content[30:]} {
+		if _, err := d.Write([]byte(chunk)); err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+	}
+
+	if etag := d.etag(false); etag != fmt.Sprintf("%x", md5.Sum([]byte(content))) {
+		t.Fatalf("the ETag of the single object is wrong: %s", etag)
+	}
+
+	var sums []byte
+	for _, part := range []string{content[:16], content[16:32], content[32:]} {
+		sum := md5.Sum([]byte(part))
+		sums = append(sums, sum[:]...)
+	}
+	expected := fmt.Sprintf("%x-3", md5.Sum(sums))
+	if etag := d.etag(true); etag != expected {
+		t.Fatalf("the ETag of the multipart object is wrong: %s", etag)
+	}
+
+	head := &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(content))), ETag: aws.String(`"` + expected + `"`)}
+	if err := d.verify(head); err != nil {
+		t.Fatalf("the uploaded object isn't verified: %s", err)
+	}
+
+	head.ContentLength = aws.Int64(int64(len(content) - 1))
+	if err := d.verify(head); err == nil {
+		t.Fatalf("the truncated object is verified")
+	}
+
+	head.ContentLength = aws.Int64(int64(len(content)))
+	head.ETag = aws.String(`"0123456789abcdef0123456789abcdef-3"`)
+	if err := d.verify(head); err == nil {
+		t.Fatalf("the object with a wrong ETag is verified")
+	}
+
+	// the ETag of the object encrypted with KMS isn't MD5, so only its size is compared
+	head.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+	if err := d.verify(head); err != nil {
+		t.Fatalf("the object encrypted with KMS isn't verified: %s", err)
+	}
+
+	head.ContentLength = aws.Int64(int64(len(content) - 1))
+	if err := d.verify(head); err == nil {
+		t.Fatalf("the truncated object encrypted with KMS is verified")
+	}
+}
+
+func TestUploadStagedWithKMSWithoutDownloading(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original string) { sse = original }(sse)
+	defer func(original string) { uploadPartSize = original }(uploadPartSize)
+	sse = s3.ServerSideEncryptionAwsKms
+	uploadPartSize = "5MB"
+
+	if err := uploadStaged("v1/key.tar.gz", strings.NewReader("archive"), nil, func() error { return nil }); err != nil {
+		t.Fatalf("failed to upload: %s", err)
+	}
+	for _, r := range fake.requests {
+		if r.Method == http.MethodGet {
+			t.Fatalf("the staging object is downloaded to verify: %s", r.Key)
+		}
+	}
+	if content, ok := fake.content("v1/key.tar.gz"); !ok || string(content) != "archive" {
+		t.Fatalf("the archive isn't promoted: %s", content)
+	}
+}
+
+func TestUploadStagedInStorageClass(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original string) { storageClass = original }(storageClass)
+	defer func(original string) { uploadPartSize = original }(uploadPartSize)
+	storageClass = s3.StorageClassStandardIa
+	uploadPartSize = "5MB"
+
+	promoted := false
+	err := uploadStaged("v1/key.tar.gz", strings.NewReader("archive"), nil, func() error {
+		promoted = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to upload: %s", err)
+	}
+	if !promoted {
+		t.Fatal("the objects before the archive aren't uploaded")
+	}
+
+	for _, r := range fake.requests {
+		if r.Method != http.MethodPut {
+			continue
+		}
+		class := r.Header.Get("X-Amz-Storage-Class")
+		if staging := strings.Contains(r.Key, stagingKeyInfix); staging && class != "" {
+			t.Fatalf("the staging object is uploaded in %s", class)
+		} else if !staging && class != s3.StorageClassStandardIa {
+			t.Fatalf("the archive is copied in %q", class)
+		}
+	}
+	if content, ok := fake.content("v1/key.tar.gz"); !ok || string(content) != "archive" {
+		t.Fatalf("the archive isn't promoted: %s", content)
+	}
+
+	// staging objects too large for CopyObject are copied by parts into the class
+	fake.put("v1/large.tar.gz.tmp-id", []byte("large"), nil)
+	if err := promoteStagedByParts("v1/large.tar.gz.tmp-id", "v1/large.tar.gz", &s3.HeadObjectOutput{ContentLength: aws.Int64(5)}, nil); err != nil {
+		t.Fatalf("failed to promote: %s", err)
+	}
+	for _, r := range fake.received(http.MethodPost, "v1/large.tar.gz") {
+		if _, ok := r.Query["uploads"]; ok && r.Header.Get("X-Amz-Storage-Class") != s3.StorageClassStandardIa {
+			t.Fatalf("the archive is copied by parts in %q", r.Header.Get("X-Amz-Storage-Class"))
+		}
+	}
+}
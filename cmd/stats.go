@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+)
+
+var statsJSON bool
+var statsDelimiter string
+var statsDepth int
+
+// ageRanges are the ranges of the age distribution of caches, the last one without the upper bound
+var ageRanges = []struct {
+	name string
+	max  time.Duration
+}{
+	{"< 1d", 24 * time.Hour},
+	{"1d - 7d", 7 * 24 * time.Hour},
+	{"7d - 30d", 30 * 24 * time.Hour},
+	{">= 30d", 0},
+}
+
+func init() {
+	statsCmd := &cobra.Command{
+		Use:   "stats [flags] [prefix]",
+		Short: "Print statistics of cache storage",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+			if statsDepth < 1 {
+				log.Fatalf("depth of prefixes must be positive: %d", statsDepth)
+			}
+
+			prefix := ""
+			if len(args) > 0 {
+				prefix = args[0]
+			}
+
+			objects, err := listObjects(prefix)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			stats, err := computeStats(prefixedKey(""), objects, time.Now(), statsDelimiter, statsDepth)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if statsJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				err = enc.Encode(stats)
+			} else {
+				err = printStats(stats)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	statsCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches")
+	statsCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(statsCmd)
+	statsCmd.Flags().BoolVarP(&statsJSON, "json", "", false, "Print statistics as JSON")
+	statsCmd.Flags().StringVarP(&statsDelimiter, "delimiter", "", "-", "Delimiter of cache keys to group them by prefixes")
+	statsCmd.Flags().IntVarP(&statsDepth, "depth", "", 1, "Number of segments separated by the delimiter in prefixes to group caches by")
+
+	rootCmd.AddCommand(statsCmd)
+}
+
+type cacheStats struct {
+	Caches     int          `json:"caches"`
+	Objects    int          `json:"objects"`
+	TotalSize  int64        `json:"total_size"`
+	Chunks     int          `json:"chunks"`
+	ChunksSize int64        `json:"chunks_size"`
+	Prefixes   []groupStats `json:"prefixes"`
+	Ages       []groupStats `json:"ages"`
+}
+
+type groupStats struct {
+	Name   string `json:"name"`
+	Caches int    `json:"caches"`
+	Size   int64  `json:"size"`
+}
+
+// computeStats aggregates the objects under the root, where chunks shared by caches are counted separately
+func computeStats(root string, objects []*s3.Object, now time.Time, delimiter string, depth int) (*cacheStats, error) {
+	stats := &cacheStats{
+		Objects:  len(objects),
+		Prefixes: []groupStats{},
+	}
+
+	for _, object := range objects {
+		stats.TotalSize += aws.Int64Value(object.Size)
+		if strings.HasPrefix(strings.TrimPrefix(aws.StringValue(object.Key), root), chunkStorePrefix) {
+			stats.Chunks++
+			stats.ChunksSize += aws.Int64Value(object.Size)
+		}
+	}
+
+	prefixes := make(map[string]*groupStats)
+	for _, r := range ageRanges {
+		stats.Ages = append(stats.Ages, groupStats{Name: r.name})
+	}
+
+	caches, err := groupCacheObjects(root, objects)
+	if err != nil {
+		return nil, err
+	}
+	stats.Caches = len(caches)
+	for _, c := range caches {
+		name := keyGroup(c.Key, delimiter, depth)
+		g, ok := prefixes[name]
+		if !ok {
+			g = &groupStats{Name: name}
+			prefixes[name] = g
+		}
+		g.Caches++
+		g.Size += c.Size
+
+		age := now.Sub(c.LastModified)
+		for i, r := range ageRanges {
+			if r.max == 0 || age < r.max {
+				stats.Ages[i].Caches++
+				stats.Ages[i].Size += c.Size
+				break
+			}
+		}
+	}
+
+	for _, g := range prefixes {
+		stats.Prefixes = append(stats.Prefixes, *g)
+	}
+	sort.Slice(stats.Prefixes, func(i, j int) bool {
+		return stats.Prefixes[i].Size > stats.Prefixes[j].Size ||
+			(stats.Prefixes[i].Size == stats.Prefixes[j].Size && stats.Prefixes[i].Name < stats.Prefixes[j].Name)
+	})
+
+	return stats, nil
+}
+
+// keyGroup returns the first depth segments of the cache key separated by the delimiter, including the delimiter
+func keyGroup(cacheKey string, delimiter string, depth int) string {
+	if delimiter == "" {
+		return cacheKey
+	}
+
+	segments := strings.SplitAfterN(cacheKey, delimiter, depth+1)
+	if len(segments) <= depth {
+		return cacheKey
+	}
+
+	return strings.Join(segments[:depth], "")
+}
+
+func printStats(stats *cacheStats) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Caches:\t%d\n", stats.Caches)
+	fmt.Fprintf(w, "Objects:\t%d\n", stats.Objects)
+	fmt.Fprintf(w, "Total size:\t%s\n", formatSize(stats.TotalSize))
+	fmt.Fprintf(w, "Chunks:\t%d (%s)\n", stats.Chunks, formatSize(stats.ChunksSize))
+
+	fmt.Fprintln(w, "\nPREFIX\tCACHES\tSIZE")
+	for _, g := range stats.Prefixes {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", g.Name, g.Caches, formatSize(g.Size))
+	}
+
+	fmt.Fprintln(w, "\nAGE\tCACHES\tSIZE")
+	for _, g := range stats.Ages {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", g.Name, g.Caches, formatSize(g.Size))
+	}
+
+	return w.Flush()
+}
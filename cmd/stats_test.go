@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestKeyGroup(t *testing.T) {
+	cases := []struct {
+		key       string
+		delimiter string
+		depth     int
+		expected  string
+	}{
+		{"gem-v1-linux-0123", "-", 1, "gem-"},
+		{"gem-v1-linux-0123", "-", 2, "gem-v1-"},
+		{"gem", "-", 1, "gem"},
+		{"org/repo/gem-v1", "/", 2, "org/repo/"},
+		{"gem-v1", "", 1, "gem-v1"},
+	}
+
+	for _, c := range cases {
+		if actual := keyGroup(c.key, c.delimiter, c.depth); actual != c.expected {
+			t.Fatalf("group of %+v is wrong: %s", c, actual)
+		}
+	}
+}
+
+func TestComputeStats(t *testing.T) {
+	now := time.Date(2019, 3, 15, 0, 0, 0, 0, time.UTC)
+	object := func(key string, size int64, age time.Duration) *s3.Object {
+		return &s3.Object{Key: aws.String(key), Size: aws.Int64(size), LastModified: aws.Time(now.Add(-age))}
+	}
+
+	objects := []*s3.Object{
+		object("v1/chunks/0123.gz", 100, time.Hour),
+		object("v1/gem-v1-a.tar.gz", 10, time.Hour),
+		object("v1/gem-v1-b.tar.gz", 20, 10*24*time.Hour),
+		object("v1/node-v1.tar.gz", 0, 40*24*time.Hour),
+		object("v1/node-v1.part0001.tar.gz", 30, 40*24*time.Hour),
+	}
+
+	stats, err := computeStats("v1/", objects, now, "-", 1)
+	if err != nil {
+		t.Fatalf("failed to compute stats: %s", err)
+	}
+	if stats.Caches != 3 || stats.Objects != 5 || stats.TotalSize != 160 || stats.Chunks != 1 || stats.ChunksSize != 100 {
+		t.Fatalf("totals are wrong: %+v", stats)
+	}
+
+	expectedPrefixes := []groupStats{{"gem-", 2, 30}, {"node-", 1, 30}}
+	if !reflect.DeepEqual(stats.Prefixes, expectedPrefixes) {
+		t.Fatalf("stats of prefixes are wrong: %+v", stats.Prefixes)
+	}
+
+	expectedAges := []groupStats{{"< 1d", 1, 10}, {"1d - 7d", 0, 0}, {"7d - 30d", 1, 20}, {">= 30d", 1, 30}}
+	if !reflect.DeepEqual(stats.Ages, expectedAges) {
+		t.Fatalf("stats of ages are wrong: %+v", stats.Ages)
+	}
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var storeStdin bool
+var stdinName string
+
+// recordedPaths maps paths to the ones recorded in metadata instead, like the name of stdin spooled to a temporal file
+var recordedPaths map[string]string
+
+// recordedPath returns the path recorded in metadata, which the path is restored to
+func recordedPath(path string) string {
+	if recorded, ok := recordedPaths[path]; ok {
+		return recorded
+	}
+
+	return path
+}
+
+// storeStdinFile stores the content of stdin spooled to a temporal directory, which is removed even when storing fails
+func storeStdinFile(cacheKey string, stdin *os.File) error {
+	dir, err := ioutil.TempDir(tmpDir, "guruguru-cache-stdin-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := checkSpoolSpace(dir, stdin); err != nil {
+		return err
+	}
+	log.Println("Reading stdin")
+	path, err := spoolStdin(dir, stdin)
+	if err != nil {
+		return err
+	}
+
+	return storePathsWithAliases(cacheKey, []string{path})
+}
+
+// spoolStdin saves stdin to the file named by --stdin-name in the directory, as tar headers need the size of contents.
+// The file is recorded as the name, so that it's restored to the current directory or printed by cat.
+func spoolStdin(dir string, r io.Reader) (string, error) {
+	if stdinName == "" || filepath.Base(stdinName) != stdinName || stdinName == "." || stdinName == ".." {
+		return "", fmt.Errorf("stdin name must be a file name: %s", stdinName)
+	}
+
+	path := filepath.Join(dir, stdinName)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporal file: %s", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return "", fmt.Errorf("failed to read stdin: %s", err)
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("failed to write temporal file: %s", err)
+	}
+
+	recordedPaths = map[string]string{path: stdinName}
+
+	return path, nil
+}
+
+// checkSpoolSpace fails before spooling stdin redirected from a file larger than the free space of the temp directory.
+// The size of stdin from a pipe is unknown until it's read.
+func checkSpoolSpace(dir string, stdin *os.File) error {
+	info, err := stdin.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	free, ok := freeSpace(dir)
+	if !ok || free >= uint64(info.Size()) {
+		return nil
+	}
+
+	return fmt.Errorf("not enough space in the temp directory %s: %s is free, but stdin is %s, set --tmp-dir to a directory with more space",
+		dir, formatSize(int64(free)), formatSize(info.Size()))
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSpoolStdin(t *testing.T) {
+	defer func(original string) { stdinName = original }(stdinName)
+	defer func(original map[string]string) { recordedPaths = original }(recordedPaths)
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stdinName = "../image.tar"
+	if _, err := spoolStdin(dir, strings.NewReader("image")); err == nil {
+		t.Fatalf("the name out of the directory is accepted")
+	}
+
+	stdinName = "image.tar"
+	path, err := spoolStdin(dir, strings.NewReader("This is an image!"))
+	if err != nil {
+		t.Fatalf("failed to spool stdin: %s", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := writeTar(buf, []string{path}); err != nil {
+		t.Fatalf("failed to write tar: %s", err)
+	}
+
+	digests, paths, err := readArchiveDigests(buf)
+	if err != nil {
+		t.Fatalf("failed to read tar: %s", err)
+	}
+	if len(paths) != 1 || paths[0] != "image.tar" {
+		t.Fatalf("the recorded path is wrong: %v", paths)
+	}
+	if d, ok := digests["image.tar"]; !ok || d.size != int64(len("This is an image!")) {
+		t.Fatalf("the file of stdin is wrong: %v", digests)
+	}
+}
+
+func TestStoreStdinFile(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original string) { stdinName = original }(stdinName)
+	defer func(original map[string]string) { recordedPaths = original }(recordedPaths)
+	defer func(original string) { tmpDir = original }(tmpDir)
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	tmpDir = filepath.Join(dir, "tmp")
+	if err := os.Mkdir(tmpDir, 0755); err != nil {
+		t.Fatalf("failed to create a directory: %s", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "image.tar"), []byte("This is an image!"), 0644); err != nil {
+		t.Fatalf("failed to write a file: %s", err)
+	}
+	storeStdin := func(key string) error {
+		stdin, err := os.Open(filepath.Join(dir, "image.tar"))
+		if err != nil {
+			t.Fatalf("failed to open the file: %s", err)
+		}
+		defer stdin.Close()
+
+		return storeStdinFile(prefixedKey(key), stdin)
+	}
+	spooled := func() []os.FileInfo {
+		files, err := ioutil.ReadDir(tmpDir)
+		if err != nil {
+			t.Fatalf("failed to read the temp directory: %s", err)
+		}
+		return files
+	}
+
+	stdinName = "image.tar"
+	if err := storeStdin("image"); err != nil {
+		t.Fatalf("failed to store stdin: %s", err)
+	}
+	if exists, err := cacheExists(prefixedKey("image")); err != nil || !exists {
+		t.Fatalf("the cache isn't stored: %v", err)
+	}
+	if files := spooled(); len(files) != 0 {
+		t.Fatalf("the spooled stdin is left: %s", files[0].Name())
+	}
+
+	// the spool is removed also when storing fails
+	fake.fail = func(r fakeRequest) bool { return r.Method == http.MethodPut }
+	if err := storeStdin("failed"); err == nil {
+		t.Fatal("the failure of storing isn't returned")
+	}
+	if files := spooled(); len(files) != 0 {
+		t.Fatalf("the spool of the failure is left: %s", files[0].Name())
+	}
+}
@@ -2,83 +2,331 @@ package cmd
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/spf13/cobra"
 	"github.com/yuya-takeyama/guruguru-cache/template"
 )
 
 var s3Bucket string
 var s3Client *s3.S3
+var maxPartSize string
+var perPath bool
+var chunked bool
+var uploadPartSize string
+var uploadConcurrency int
+var sse string
+var sseKMSKeyID string
+var ageRecipients []string
+var passphraseFile string
+var storageClass string
+var tags []string
+var forceStore bool
+var storeIfNewerThan time.Duration
+
+// storageClassIntelligentTiering isn't defined in the SDK version yet
+const storageClassIntelligentTiering = "INTELLIGENT_TIERING"
+
+// storageClasses are classes which caches can be restored from immediately
+var storageClasses = []string{
+	s3.StorageClassStandard,
+	s3.StorageClassReducedRedundancy,
+	s3.StorageClassStandardIa,
+	s3.StorageClassOnezoneIa,
+	storageClassIntelligentTiering,
+}
 
 func init() {
 	storeCmd := &cobra.Command{
 		Use:   "store [flags] [cache key] [paths...]",
 		Short: "Store cache files with a key",
-		Args:  cobra.MinimumNArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
-			cacheKey, err := template.ExecuteTemplate(args[0])
-			if err != nil {
+			if err := setupS3Client(); err != nil {
 				log.Fatal(err)
 			}
-
-			exists, err := cacheExists(cacheKey)
-			if err != nil {
+			if err := setupTemplate(); err != nil {
 				log.Fatal(err)
 			}
 
-			if exists {
-				log.Printf("cache already exists: %s\n", cacheKey)
-				return
+			keyTemplate, args, err := keyTemplateArgs(args)
+			if err != nil {
+				log.Fatal(err)
 			}
-
-			paths := args[1:]
-			dir, err := ioutil.TempDir("", cacheKey)
+			cacheKey, err := template.ExecuteTemplate(keyTemplate)
 			if err != nil {
-				log.Fatalf("failed to create temporal directory: %s", err)
+				log.Fatal(err)
 			}
+			cacheKey = prefixedKey(cacheKey)
+			storedKeyTemplate = keyTemplate
 
-			defer os.RemoveAll(dir)
+			if storeStdin {
+				if len(args) > 0 || pathsFrom != "" {
+					log.Fatal("paths can't be given with --stdin")
+				}
 
-			log.Printf("Creating a cache: %s\n", cacheKey)
-			if err := createTar(dir, cacheKey, paths); err != nil {
-				log.Fatal(err)
+				// failing after returning, so that the spooled stdin is removed
+				if err := storeStdinFile(cacheKey, os.Stdin); err != nil {
+					failStore(err)
+				}
+				return
 			}
-			if err := compressGzip(dir, cacheKey); err != nil {
+
+			paths, err := resolvePaths(args)
+			if err != nil {
 				log.Fatal(err)
 			}
-			if err := uploadToS3(dir, cacheKey); err != nil {
-				log.Fatal(err)
+			if err := storePathsWithAliases(cacheKey, paths); err != nil {
+				failStore(err)
 			}
 		},
 	}
 
 	storeCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket to upload")
 	storeCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(storeCmd)
+	addTemplateFlags(storeCmd)
+	addKeyFlags(storeCmd)
+	addStoreFlags(storeCmd)
+	storeCmd.Flags().BoolVarP(&storeStdin, "stdin", "", false, "Store the content of stdin like the output of docker save as a file instead of paths")
+	storeCmd.Flags().StringVarP(&stdinName, "stdin-name", "", "stdin", "Name of the file of --stdin, which it's restored to and printed by cat as")
+	addTmpDirFlag(storeCmd)
+	storeCmd.Flags().BoolVarP(&allowStoreFailure, "allow-failure", "", false, "Log the failure of storing and exit with 0, so that the build still succeeds")
 
 	rootCmd.AddCommand(storeCmd)
+}
+
+// addStoreFlags adds the flags of how caches are archived and uploaded shared by store and watch
+func addStoreFlags(cmd *cobra.Command) {
+	addArchiveFlags(cmd)
+	addUploadFlags(cmd)
+	cmd.Flags().StringArrayVarP(&alsoKeys, "also-key", "", nil, "Cache key template to copy the stored cache to like latest-main, replacing the existing one (can be repeated)")
+	cmd.Flags().StringVarP(&storeBase, "base", "", "", "Cache key template of the base cache to store only files changed since it, which restore restores first")
+	cmd.Flags().StringVarP(&pathsFrom, "paths-from", "", "", "File of paths to store in addition to arguments, one per line with # comments (- means stdin)")
+	cmd.Flags().BoolVarP(&skipMissing, "skip-missing", "", false, "Skip paths which don't exist with a warning instead of failing")
+	cmd.Flags().StringVarP(&progressMode, "progress", "", progressAuto, "Report progress as bars on terminals, logs or none ("+strings.Join(progressModes, ", ")+")")
+	cmd.Flags().BoolVarP(&perPath, "per-path", "", false, "Store each path as its own archive under the key")
+	cmd.Flags().IntVarP(&storeRetries, "store-retries", "", 2, "Number of times to archive and upload the cache again after it fails transiently, after each S3 request is retried")
+	cmd.Flags().IntVarP(&pathConcurrency, "concurrency", "", 0, "Number of archives of --per-path stored concurrently (0 means the number of CPUs up to 4)")
+	cmd.Flags().StringVarP(&passphraseFile, "passphrase-file", "", "", "Encrypt the cache with the passphrase in the file")
+	cmd.Flags().BoolVarP(&forceStore, "force", "", false, "Overwrite the cache even if it already exists")
+	cmd.Flags().DurationVarP(&storeIfNewerThan, "if-newer-than", "", 0, "Overwrite the existing cache stored longer ago than the duration like 24h")
+	cmd.Flags().BoolVarP(&skipIfIdentical, "skip-if-identical", "", false, "Skip overwriting the cache when its files have the same content, recording the digest of files")
+	cmd.Flags().BoolVarP(&withLock, "with-lock", "", false, "Hold the lock of the key while storing, so that concurrent jobs don't upload the same cache")
+	cmd.Flags().DurationVarP(&lockTTL, "lock-ttl", "", time.Hour, "Duration after which the lock can be taken over by others")
+	cmd.Flags().DurationVarP(&storeLockWait, "lock-wait", "", 30*time.Minute, "Duration to wait for the lock held by others")
+}
+
+// addArchiveFlags adds the flags of archiving paths shared by store and append
+func addArchiveFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVarP(&excludes, "exclude", "", nil, "Exclude files matching the pattern like **/*.log or .git (can be repeated)")
+	cmd.Flags().StringVarP(&maxSize, "max-size", "", "0", "Abort storing the archive exceeding this size like 2GB (0 means no limit)")
+	cmd.Flags().StringVarP(&maxSizePolicy, "max-size-policy", "", maxSizePolicyFail, "Fail, or warn and store the archive truncated to --max-size when it exceeds the size (fail or warn)")
+	cmd.Flags().BoolVarP(&dedupFiles, "dedup", "", false, "Store files with the same content once, restoring the others as copies of it")
+	cmd.Flags().BoolVarP(&dereference, "dereference", "", false, "Store files symlinks point to instead of the symlinks like tar -h")
+	cmd.Flags().IntVarP(&readConcurrency, "read-concurrency", "", defaultReadConcurrency, "Number of files read ahead concurrently while archiving (1 means sequential)")
+}
+
+// addUploadFlags adds the flags of uploading the archive shared by store and append, except --passphrase-file which append also decrypts with
+func addUploadFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&maxPartSize, "max-part-size", "", "0", "Split the cache into parts of this size like 5GB (0 means no split)")
+	cmd.Flags().BoolVarP(&chunked, "chunked", "", false, "Split the cache into content-defined chunks to upload only changed ones")
+	cmd.Flags().StringVarP(&uploadPartSize, "upload-part-size", "", "5MB", "Size of each part of multipart uploads")
+	cmd.Flags().IntVarP(&uploadConcurrency, "upload-concurrency", "", s3manager.DefaultUploadConcurrency, "Number of parts uploaded concurrently")
+	cmd.Flags().StringArrayVarP(&ageRecipients, "age-recipient", "", nil, "Encrypt the cache for the age recipient public key (can be repeated)")
+	cmd.Flags().StringVarP(&objectLockMode, "object-lock-mode", "", "", "Object Lock mode of the cache ("+strings.Join(objectLockModes, " or ")+")")
+	cmd.Flags().DurationVarP(&objectLockRetention, "object-lock-retention", "", 0, "Duration to retain the cache with Object Lock like 720h")
+	cmd.Flags().BoolVarP(&objectLockLegalHold, "object-lock-legal-hold", "", false, "Place an Object Lock legal hold on the cache")
+	addObjectFlags(cmd)
+}
+
+// addObjectFlags adds the flags of server-side encryption, tags and the storage class of uploaded objects, shared by the upload flags, import and migrate
+func addObjectFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&sse, "sse", "", "", "Server-side encryption algorithm (AES256 or aws:kms)")
+	cmd.Flags().StringVarP(&sseKMSKeyID, "sse-kms-key-id", "", "", "KMS key ID for server-side encryption with aws:kms")
+	cmd.Flags().StringArrayVarP(&tags, "tag", "", nil, "S3 object tag of the cache as key=value (can be repeated)")
+	cmd.Flags().StringVarP(&storageClass, "storage-class", "", "", "S3 storage class ("+strings.Join(storageClasses, ", ")+")")
+}
+
+// storePathsWithAliases stores the paths as the key followed by the aliases of --also-key
+func storePathsWithAliases(cacheKey string, paths []string) error {
+	if _, err := storePaths(cacheKey, paths); err != nil {
+		return err
+	}
+
+	return storeAliases(cacheKey)
+}
+
+// storePaths stores the paths as the cache unless it already exists and isn't overwritten, reporting whether it's stored
+func storePaths(cacheKey string, paths []string) (bool, error) {
+	// options are validated before taking the lock or looking up the cache
+	if err := validateExcludes(); err != nil {
+		return false, err
+	}
+
+	partSize, err := parseSize(maxPartSize)
+	if err != nil {
+		return false, err
+	}
+
+	if err := validateUploadOptions(); err != nil {
+		return false, err
+	}
+
+	if err := validateMaxSize(); err != nil {
+		return false, err
+	}
+
+	if err := validateProgress(); err != nil {
+		return false, err
+	}
+
+	if skipIfIdentical && perPath {
+		return false, fmt.Errorf("--skip-if-identical can't be used with --per-path")
+	}
+
+	paths, err = existingPaths(paths)
+	if err != nil {
+		return false, err
+	}
+	if len(paths) < 1 {
+		log.Println("no paths exist, skipped storing")
+		return false, nil
+	}
+
+	if withLock {
+		token, err := acquireLock(cacheKey, lockTTL, storeLockWait)
+		if err != nil {
+			return false, err
+		}
+		defer func() {
+			if err := releaseLock(cacheKey, token, false); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
+	// the cache may be stored by the holder of the lock while waiting
+	exists, err := cacheExists(cacheKey)
+	if err != nil {
+		return false, err
+	}
+
+	var replaced *cacheEntry
+	if exists {
+		if replaced, err = findCacheEntry(cacheKey); err != nil {
+			return false, err
+		}
+		if !overwritesCache(replaced, time.Now()) {
+			log.Printf("cache already exists: %s\n", cacheKey)
+			return false, nil
+		}
+		log.Printf("Overwriting the cache stored at %s: %s\n", replaced.LastModified.Format(time.RFC3339), cacheKey)
+	}
 
-	sess := session.Must(session.NewSession())
-	s3Client = s3.New(sess)
+	if storeBase != "" {
+		if err := prepareDelta(paths); err != nil {
+			return false, err
+		}
+	}
+
+	var checksumMetadata map[string]*string
+	if skipIfIdentical {
+		log.Println("Computing the digest of files")
+		digest, err := contentDigest(paths)
+		if err != nil {
+			return false, err
+		}
+		if replaced != nil {
+			stored, err := storedContentDigest(cacheKey)
+			if err != nil {
+				return false, err
+			}
+			if stored == digest {
+				log.Printf("cache has the identical files: %s\n", cacheKey)
+				return false, nil
+			}
+		}
+		checksumMetadata = map[string]*string{contentDigestMetadataKey: aws.String(digest)}
+	}
+
+	log.Printf("Creating a cache: %s\n", cacheKey)
+	if effectiveProgressMode() != progressNone {
+		archiveProgress = startProgress("Storing", archivedSize(paths))
+	}
+	if perPath {
+		err = storePathArchives(cacheKey, paths, partSize)
+	} else {
+		err = retryStore(cacheKey, func() error {
+			return storeCache(cacheKey, paths, partSize, deltaMetadata(checksumMetadata))
+		})
+	}
+	archiveProgress.finish()
+	archiveProgress = nil
+	if _, tooLarge := err.(*cacheTooLargeError); tooLarge {
+		reportTooLarge(paths)
+		if maxSizePolicy == maxSizePolicyWarn {
+			log.Printf("cache is not stored: %s\n", err)
+			return false, nil
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	if skipped := archiveBudget.skippedEntries(); skipped > 0 {
+		log.Printf("cache is truncated to --max-size %s, leaving out %d entries: %s\n", formatSize(archiveBudget.limit), skipped, cacheKey)
+		reportTooLarge(paths)
+	}
+
+	if replaced != nil {
+		if err := deleteStaleObjects(replaced); err != nil {
+			return false, err
+		}
+	}
+	if deltaBase != "" {
+		if err := keepBaseFromExpiring(deltaBase); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// overwritesCache reports whether the existing cache is overwritten by --force or --if-newer-than
+func overwritesCache(existing *cacheEntry, now time.Time) bool {
+	if forceStore {
+		return true
+	}
+
+	return storeIfNewerThan > 0 && now.Sub(existing.LastModified) > storeIfNewerThan
 }
 
 func cacheExists(cacheKey string) (bool, error) {
-	key := cacheKey + ".tar.gz"
+	return objectExists(objectKey(cacheKey))
+}
+
+func objectExists(key string) (bool, error) {
+	return objectExistsInBucket(s3Bucket, key)
+}
+
+func objectExistsInBucket(bucket string, key string) (bool, error) {
 	input := &s3.HeadObjectInput{
-		Bucket: &s3Bucket,
+		Bucket: &bucket,
 		Key:    &key,
 	}
 	_, err := s3Client.HeadObject(input)
@@ -93,37 +341,218 @@ func cacheExists(cacheKey string) (bool, error) {
 	return true, nil
 }
 
-func createTar(dir string, key string, paths []string) error {
-	tarPath := filepath.Join(dir, key+".tar")
-	tarFile, createErr := os.Create(tarPath)
-	if createErr != nil {
-		return fmt.Errorf("failed to create tar file: %s", createErr)
+// storeCache streams the archive of paths to S3 without writing it to disk
+func storeCache(cacheKey string, paths []string, partSize int64, checksumMetadata map[string]*string) error {
+	return storeTarStream(cacheKey, partSize, checksumMetadata, func(w io.Writer) error {
+		return writeTar(w, paths)
+	})
+}
+
+// storeTarStream compresses, encrypts and uploads the tar stream written by writeTarTo like store does, as a new generation of the cache.
+// checksumMetadata is the S3 metadata of the checksum object uploaded just before the object of the cache key.
+func storeTarStream(cacheKey string, partSize int64, checksumMetadata map[string]*string, writeTarTo func(w io.Writer) error) error {
+	generation, err := newGeneration()
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+
+	var index *archiveIndex
+	// the checksum of the stream before being split into parts or chunks is verified by verify
+	sum := sha256.New()
+	var out io.Writer = io.MultiWriter(pw, sum)
+	if archiveProgress != nil {
+		out = &transferWriter{w: out, p: archiveProgress}
 	}
+	var limited *limitedWriter
+	if archiveBudget != nil {
+		limited = &limitedWriter{w: out, budget: archiveBudget}
+		out = limited
+	}
+	// the writer is finished before reading the size it wrote after the upload fails
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		pw.CloseWithError(func() error {
+			w, err := newEncryptWriter(out)
+			if err != nil {
+				return err
+			}
+
+			if chunked {
+				err = writeTarTo(w)
+			} else {
+				gw := newIndexedGzipWriter(w)
+				if err = writeTarTo(gw); err == nil {
+					if err = gw.Close(); err != nil {
+						err = fmt.Errorf("failed to flush gzip stream: %s", err)
+					}
+				}
+				// offsets in the index are meaningless for an encrypted archive
+				if !encryptionEnabled() {
+					index = gw.index
+				}
+			}
+			if err != nil {
+				return err
+			}
+
+			return w.Close()
+		}())
+	}()
 
-	defer tarFile.Close()
+	// the index and the checksum of the generation are uploaded before the object of the cache key,
+	// which readers of the cache being overwritten find only after it's replaced
+	beforeHead := func() error {
+		if index != nil {
+			indexJSON, err := json.Marshal(index)
+			if err != nil {
+				return fmt.Errorf("failed to encode index JSON: %s", err)
+			}
 
-	log.Println("Creating a tar file")
-	tw := tar.NewWriter(tarFile)
+			if err := uploadToS3(indexKey(cacheKey), bytes.NewReader(indexJSON), withGeneration(nil, generation)); err != nil {
+				return err
+			}
+		}
 
-	defer tw.Close()
+		return uploadToS3(checksumKey(cacheKey), strings.NewReader(fmt.Sprintf("%x", sum.Sum(nil))), withGeneration(checksumMetadata, generation))
+	}
 
-	metadataPath := filepath.Join(dir, "metadata.json")
-	metadataFile, err := os.Create(metadataPath)
+	if chunked {
+		err = uploadChunksToS3(cacheKey, generation, pr, beforeHead)
+	} else if partSize > 0 {
+		err = uploadPartsToS3(cacheKey, generation, pr, partSize, beforeHead)
+	} else {
+		err = uploadStaged(objectKey(cacheKey), pr, withGeneration(nil, generation), beforeHead)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create metadata file: %s", err)
+		pr.CloseWithError(err)
+		<-written
+		// parts of the generation never become a cache, while new chunks are swept by prune
+		if !chunked && partSize > 0 {
+			if err := deleteGeneration(cacheKey+".part", generation); err != nil {
+				log.Printf("failed to delete parts of the failed upload: %s\n", err)
+			}
+		}
+		if limited != nil {
+			limited.budget.release(limited.n)
+			if limited.exceeded {
+				return &cacheTooLargeError{limited.budget.limit}
+			}
+		}
+		return err
 	}
 
-	defer metadataFile.Close()
+	return nil
+}
 
-	meta := new(metadata)
+// writeArchive writes the gzipped tar of paths and returns the index of its entries
+func writeArchive(w io.Writer, paths []string) (*archiveIndex, error) {
+	gw := newIndexedGzipWriter(w)
+
+	if err := writeTar(gw, paths); err != nil {
+		return nil, err
+	}
+
+	if err := gw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to flush gzip stream: %s", err)
+	}
+
+	return gw.index, nil
+}
+
+func writeTar(w io.Writer, paths []string) error {
+	log.Println("Creating a tar stream")
+	tw := tar.NewWriter(w)
+
+	meta := newMetadata(nil)
+	if err := writePathEntries(tw, w, meta, paths); err != nil {
+		return err
+	}
+
+	return closeTar(tw, w, meta)
+}
+
+// writePathEntries writes the entries of the paths under the directories numbered after the paths already in meta.
+// Files are read ahead by --read-concurrency workers while entries are written in the order of walking,
+// and files with the same content by --dedup are written as links to the first one written.
+func writePathEntries(tw *tar.Writer, w io.Writer, meta *metadata, paths []string) error {
+	first := len(meta.Paths)
+	for _, path := range paths {
+		meta.Paths = append(meta.Paths, recordedPath(path))
+	}
+	countStats := meta.addPathStats(first, meta.Paths[first:])
+	var dedup *dedupIndex
+	if dedupFiles {
+		dedup = newDedupIndex()
+	}
+
+	write := func(e *pathEntry) error {
+		if dedup != nil {
+			if err := dedup.link(e); err != nil {
+				return err
+			}
+		}
+		if archiveBudget.truncates(e) {
+			meta.Truncated = true
+			return nil
+		}
+		if countStats {
+			meta.countEntry(e)
+		}
+		if err := writePathEntry(tw, w, e); err != nil {
+			return err
+		}
+		meta.manifest.addEntry(e)
+		if dedup != nil {
+			dedup.add(e)
+		}
+
+		return nil
+	}
+
+	if readConcurrency <= 1 {
+		return walkPathEntries(paths, first, write)
+	}
+
+	return writeReadAheadEntries(paths, first, write)
+}
+
+// pathEntry is a file walked under a path with its tar header, which may have its content read ahead
+type pathEntry struct {
+	index      int
+	path       string
+	info       os.FileInfo
+	header     *tar.Header
+	ready      chan struct{}
+	prefetched bool
+	data       []byte
+	err        error
+	sum        string
+	// hashAhead is set for files of --dedup with the same size as another, whose checksums are needed before writing them
+	hashAhead bool
+}
+
+func (e *pathEntry) isContent() bool {
+	return e.info.Mode().IsRegular() && e.header.Typeflag != tar.TypeLink
+}
+
+// walkPathEntries walks the paths numbered from first and gives entries to fn in order.
+// Hard links are detected here, so that only the first one of them has the content.
+func walkPathEntries(paths []string, first int, fn func(e *pathEntry) error) error {
+	links := make(map[fileID]string)
+	sizes := make(map[int64]bool)
 
 	for i, path := range paths {
-		meta.Paths = append(meta.Paths, path)
-		childDir := fmt.Sprintf("%04d", i)
-		walkErr := filepath.Walk(path, func(elempath string, info os.FileInfo, err error) error {
+		childDir := fmt.Sprintf("%04d", first+i)
+		walkErr := walkArchivedFiles(path, func(elempath string, info os.FileInfo, err error) error {
 			if err != nil {
 				return fmt.Errorf("failed to traverse files: %s", err)
 			}
+			if !inDelta(elempath, info) {
+				return nil
+			}
 
 			var link string
 			if info.Mode()&os.ModeSymlink == os.ModeSymlink {
@@ -133,57 +562,132 @@ func createTar(dir string, key string, paths []string) error {
 			}
 
 			tarHeader, thErr := tar.FileInfoHeader(info, link)
-			if err != nil {
+			if thErr != nil {
 				return fmt.Errorf("failed to create tar Header: %s", thErr)
 			}
 
 			tarHeader.Name = filepath.Join(childDir, strings.TrimPrefix(elempath, filepath.Dir(path)))
-
-			if err := tw.WriteHeader(tarHeader); err != nil {
-				return fmt.Errorf("failed to write tar header: %s", err)
+			// PAX supports long paths and UTF-8 names without truncation
+			tarHeader.Format = tar.FormatPAX
+
+			e := &pathEntry{index: first + i, path: elempath, info: info, header: tarHeader}
+			if info.Mode().IsRegular() {
+				id, hasID := hardLinkID(info)
+				if target, seen := links[id]; hasID && seen {
+					tarHeader.Typeflag = tar.TypeLink
+					tarHeader.Linkname = target
+					tarHeader.Size = 0
+				} else {
+					if hasID {
+						links[id] = tarHeader.Name
+					}
+
+					// only sizes are compared here, and the checksums are computed by the workers reading files ahead
+					if dedupFiles && info.Size() > 0 {
+						e.hashAhead = sizes[info.Size()]
+						sizes[info.Size()] = true
+					}
+				}
 			}
 
-			if !info.Mode().IsRegular() {
-				return nil
-			}
+			return fn(e)
+		})
 
-			file, fileErr := os.Open(elempath)
-			if fileErr != nil {
-				return fmt.Errorf("failed to open: %s", fileErr)
-			}
+		if walkErr != nil {
+			return walkErr
+		}
+	}
 
-			if _, err := io.Copy(tw, file); err != nil {
-				return fmt.Errorf("failed to write file: %s", err)
-			}
+	return nil
+}
 
-			if err := tw.Flush(); err != nil {
-				return fmt.Errorf("failed to flush tar file: %s", err)
-			}
+// writePathEntry writes the header of the entry and the content of the file read ahead or from the disk
+func writePathEntry(tw *tar.Writer, w io.Writer, e *pathEntry) error {
+	if e.err != nil {
+		return e.err
+	}
 
-			return nil
-		})
+	if !e.isContent() {
+		if err := writeHeader(tw, w, e.header); err != nil {
+			return fmt.Errorf("failed to write tar header: %s", err)
+		}
 
-		if walkErr != nil {
-			return walkErr
+		return nil
+	}
+
+	if e.prefetched {
+		if err := writeHeader(tw, w, e.header); err != nil {
+			return fmt.Errorf("failed to write tar header: %s", err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			return fmt.Errorf("failed to write file: %s", err)
 		}
+		if err := tw.Flush(); err != nil {
+			return fmt.Errorf("failed to flush tar file: %s", err)
+		}
+		archiveProgress.add(e.info.Size())
+
+		return nil
 	}
 
-	metadataJSON, err := json.Marshal(meta)
+	file, fileErr := os.Open(e.path)
+	if fileErr != nil {
+		return fmt.Errorf("failed to open: %s", fileErr)
+	}
+
+	defer file.Close()
+
+	segments, err := sparseSegments(file, e.info)
 	if err != nil {
-		return fmt.Errorf("failed to encode metadata JSON: %s", err)
+		return fmt.Errorf("failed to detect holes of sparse file: %s", err)
 	}
 
-	_, err = metadataFile.Write(metadataJSON)
+	h := sha256.New()
+	if segments != nil {
+		// only the data segments are read, and the holes are left out of the archive
+		var data []io.Reader
+		for _, segment := range segments {
+			data = append(data, io.NewSectionReader(file, segment.Offset, segment.Length))
+		}
+		if err := writeSparseFile(tw, w, e.header, segments, io.MultiReader(data...), h); err != nil {
+			return fmt.Errorf("failed to write sparse file: %s", err)
+		}
+	} else {
+		if err := writeHeader(tw, w, e.header); err != nil {
+			return fmt.Errorf("failed to write tar header: %s", err)
+		}
+		if _, err = io.Copy(tw, io.TeeReader(file, h)); err != nil {
+			return fmt.Errorf("failed to write file: %s", err)
+		}
+	}
+	e.sum = fmt.Sprintf("%x", h.Sum(nil))
+
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("failed to flush tar file: %s", err)
+	}
+	archiveProgress.add(e.info.Size())
+
+	return nil
+}
+
+// closeTar writes manifest.json and metadata.json as the last entries and closes the tar stream
+func closeTar(tw *tar.Writer, w io.Writer, meta *metadata) error {
+	if err := writeManifest(tw, w, meta.manifest); err != nil {
+		return err
+	}
+
+	metadataJSON, err := json.Marshal(meta)
 	if err != nil {
-		return fmt.Errorf("failed to write metadata: %s", err)
+		return fmt.Errorf("failed to encode metadata JSON: %s", err)
 	}
 
 	tarHeader := &tar.Header{
-		Name: "metadata.json",
-		Mode: 0600,
-		Size: int64(len(metadataJSON)),
+		Name:   "metadata.json",
+		Mode:   0600,
+		Size:   int64(len(metadataJSON)),
+		Format: tar.FormatPAX,
 	}
-	if err := tw.WriteHeader(tarHeader); err != nil {
+	if err := writeHeader(tw, w, tarHeader); err != nil {
 		return fmt.Errorf("failed to write tar header: %s", err)
 	}
 
@@ -191,78 +695,178 @@ func createTar(dir string, key string, paths []string) error {
 		return fmt.Errorf("failed to add metadata.json to tar: %s", err)
 	}
 
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to close tar stream: %s", err)
+	}
+
 	return nil
 }
 
-func compressGzip(dir string, key string) error {
-	tarPath := filepath.Join(dir, key+".tar")
-	gzPath := filepath.Join(dir, key+".tar.gz")
+func uploadToS3(s3Key string, body io.Reader, metadata map[string]*string) error {
+	return uploadObject(s3Key, body, metadata, objectLockEnabled(), storageClass)
+}
 
-	log.Println("Compressing to a gzip file")
-	gzFile, gzCreateErr := os.Create(gzPath)
-	if gzCreateErr != nil {
-		return fmt.Errorf("failed to create gz file: %s", gzCreateErr)
+// setObjectOptions sets server-side encryption and tags of the flags to the upload of the object at s3Key in s3Bucket,
+// in the storage class where empty is STANDARD
+func setObjectOptions(input *s3manager.UploadInput, s3Key string, class string) {
+	if sse != "" {
+		input.ServerSideEncryption = &sse
+	}
+	if sseKMSKeyID != "" {
+		input.SSEKMSKeyId = &sseKMSKeyID
 	}
+	if class != "" {
+		input.StorageClass = &class
+	}
+	input.Tagging = aws.String(objectTagging(s3Key))
+}
 
-	defer gzFile.Close()
+// uploadObject uploads the object with the options given by flags in the storage class, where empty is STANDARD,
+// locking it with Object Lock when locked
+func uploadObject(s3Key string, body io.Reader, metadata map[string]*string, locked bool, class string) error {
+	objectMetadata := map[string]*string{
+		toolVersionMetadataKey: aws.String(Version),
+	}
+	if Commit != "" {
+		objectMetadata[toolCommitMetadataKey] = aws.String(Commit)
+	}
+	for k, v := range metadata {
+		objectMetadata[k] = v
+	}
 
-	tarFile, err := os.Open(tarPath)
-	if err != nil {
-		return fmt.Errorf("failed to re-open tar file: %s", err)
+	input := &s3manager.UploadInput{
+		Bucket:   &s3Bucket,
+		Body:     body,
+		Key:      &s3Key,
+		Metadata: objectMetadata,
 	}
+	setObjectOptions(input, s3Key, class)
+	log.Println("Uploading to S3")
+	options := []func(*s3manager.Uploader){
+		func(u *s3manager.Uploader) {
+			// validated by validateUploadOptions
+			u.PartSize, _ = parseSize(uploadPartSize)
+			u.Concurrency = uploadConcurrency
+		},
+		s3manager.WithUploaderRequestOptions(contentMD5Option),
+	}
+	if locked {
+		options = append(options, s3manager.WithUploaderRequestOptions(objectLockOption(time.Now().Add(objectLockRetention))))
+	}
+	uploader := s3manager.NewUploaderWithClient(s3Client, options...)
+	if _, err := uploader.Upload(input); err != nil {
+		if locked {
+			return markTransient(err, fmt.Errorf("failed to upload to S3 with Object Lock (the bucket must have Object Lock enabled, and locked caches can't be overwritten): %s", err))
+		}
+
+		return markTransient(err, fmt.Errorf("failed to upload to S3: %s", err))
+	}
+	log.Println("Uploaded successfully")
 
-	defer tarFile.Close()
+	return nil
+}
+
+// contentMD5Option sets Content-MD5 of each object and part uploaded, so that S3 rejects the ones corrupted on the way
+// whether or not the SDK computes it
+func contentMD5Option(r *request.Request) {
+	r.Handlers.Build.PushBack(func(r *request.Request) {
+		if r.Error != nil || r.Body == nil || r.HTTPRequest.Header.Get("Content-Md5") != "" {
+			return
+		}
 
-	gw := gzip.NewWriter(gzFile)
+		start, err := r.Body.Seek(0, io.SeekCurrent)
+		if err != nil {
+			r.Error = fmt.Errorf("failed to compute MD5 of the body: %s", err)
+			return
+		}
+		h := md5.New()
+		_, err = io.Copy(h, r.Body)
+		if _, seekErr := r.Body.Seek(start, io.SeekStart); err == nil {
+			err = seekErr
+		}
+		if err != nil {
+			r.Error = fmt.Errorf("failed to compute MD5 of the body: %s", err)
+			return
+		}
 
-	defer gw.Close()
+		r.HTTPRequest.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	})
+}
 
-	if _, err := io.Copy(gw, tarFile); err != nil {
-		return fmt.Errorf("failed to write gz: %s", err)
+func validateUploadOptions() error {
+	partSize, err := parseSize(uploadPartSize)
+	if err != nil {
+		return err
+	}
+	if partSize < s3manager.MinUploadPartSize {
+		return fmt.Errorf("upload part size must be at least 5MB: %s", uploadPartSize)
 	}
 
-	if err := gw.Flush(); err != nil {
-		return fmt.Errorf("failed to flush gzip file: %s", err)
+	if storeRetries < 0 {
+		return fmt.Errorf("store retries must not be negative: %d", storeRetries)
+	}
+	if pathConcurrency < 0 {
+		return fmt.Errorf("concurrency must not be negative: %d", pathConcurrency)
+	}
+	if uploadConcurrency < 1 {
+		return fmt.Errorf("upload concurrency must be positive: %d", uploadConcurrency)
 	}
 
-	return nil
-}
+	if err := validateObjectOptions(); err != nil {
+		return err
+	}
 
-func uploadToS3(dir string, key string) error {
-	gzPath := filepath.Join(dir, key+".tar.gz")
-	gzFile, err := os.Open(gzPath)
-	if err != nil {
-		return fmt.Errorf("failed to re-open gz: %s", err)
+	if err := validateObjectLockOptions(); err != nil {
+		return err
 	}
 
-	hash := md5.New()
-	if _, err := io.Copy(hash, gzFile); err != nil {
-		return fmt.Errorf("failed to calculate MD5 of cache: %s", err)
+	if chunked {
+		if partSize, err := parseSize(maxPartSize); err == nil && partSize > 0 {
+			return fmt.Errorf("--max-part-size can't be used with --chunked")
+		}
 	}
 
-	base64Md5 := base64.StdEncoding.EncodeToString(hash.Sum(nil))
+	if err := validateEncryptionOptions(); err != nil {
+		return err
+	}
+	if encryptionEnabled() && chunked {
+		return fmt.Errorf("encryption is not supported with --chunked")
+	}
 
-	gzFile.Seek(0, 0)
+	return nil
+}
 
-	gzFileStat, err := gzFile.Stat()
-	if err != nil {
-		return fmt.Errorf("failed to stat gz: %s", err)
+// validateObjectOptions validates the flags of addObjectFlags
+func validateObjectOptions() error {
+	switch sse {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("unsupported server-side encryption: %s", sse)
+	}
+	if sseKMSKeyID != "" && sse != s3.ServerSideEncryptionAwsKms {
+		return fmt.Errorf("--sse-kms-key-id requires --sse=%s", s3.ServerSideEncryptionAwsKms)
 	}
 
-	s3Key := key + ".tar.gz"
-	size := gzFileStat.Size()
-	input := &s3.PutObjectInput{
-		Bucket:        &s3Bucket,
-		Body:          gzFile,
-		Key:           &s3Key,
-		ContentLength: &size,
-		ContentMD5:    &base64Md5,
+	if storageClass != "" && !containsString(storageClasses, storageClass) {
+		return fmt.Errorf("unsupported storage class: %s", storageClass)
 	}
-	log.Println("Uploading to S3")
-	if _, err := s3Client.PutObject(input); err != nil {
-		return fmt.Errorf("failed to upload to S3: %s", err)
+
+	if _, err := parseTags(tags); err != nil {
+		return err
+	}
+	if len(tags) >= maxObjectTags {
+		return fmt.Errorf("too many tags: %d (at most %d, as caches have the tag %s)", len(tags), maxObjectTags-1, expiringTagKey)
 	}
-	log.Println("Uploaded successfully")
 
 	return nil
 }
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const storeRetryBaseDelay = time.Second
+const storeRetryMaxDelay = 30 * time.Second
+
+var storeRetries int
+var allowStoreFailure bool
+
+// storeRetrySleep waits for the delay before storing again, which tests replace not to wait
+var storeRetrySleep = time.Sleep
+
+// transientError is the error of an S3 request failed by throttling, server errors or the network,
+// which storing again may get over unlike invalid requests or access denied
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+// markTransient returns the error describing the failed S3 request, as transientError when the request failed transiently
+func markTransient(requestErr error, err error) error {
+	if isTransientError(requestErr) {
+		return &transientError{err}
+	}
+
+	return err
+}
+
+// isTransientError reports whether the error of an S3 request is the one the SDK retries, including the errors it wraps
+func isTransientError(err error) bool {
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return true
+	}
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() >= 500 && rerr.StatusCode() != http.StatusNotImplemented {
+		return true
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.OrigErr() != nil {
+		return isTransientError(aerr.OrigErr())
+	}
+
+	return false
+}
+
+// retryStore archives and uploads again by store after it fails transiently, which happens only after S3 requests of its parts are retried
+// by --retry-max-attempts, as the stream of the archive can't be uploaded again without archiving the files again.
+// The other errors like invalid options, access denied or too large archives would fail again, so they are returned as they are.
+func retryStore(what string, store func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := store()
+		if err == nil || attempt >= storeRetries {
+			return err
+		}
+		if _, transient := err.(*transientError); !transient {
+			return err
+		}
+
+		delay := storeRetryDelay(attempt)
+		log.Printf("failed to store %s, retrying in %s (attempt %d): %s\n", what, delay, attempt+2, err)
+		storeRetrySleep(delay)
+	}
+}
+
+// storeRetryDelay doubles every attempt up to storeRetryMaxDelay
+func storeRetryDelay(attempt int) time.Duration {
+	if attempt < 30 {
+		if d := storeRetryBaseDelay << uint(attempt); d < storeRetryMaxDelay {
+			return d
+		}
+	}
+
+	return storeRetryMaxDelay
+}
+
+// failStore exits with the error of storing, or only logs it with --allow-failure so that the build still succeeds
+func failStore(err error) {
+	if !allowStoreFailure {
+		log.Fatal(err)
+	}
+
+	log.Printf("failed to store the cache, ignored by --allow-failure: %s\n", err)
+}
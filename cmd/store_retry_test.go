@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestRetryStore(t *testing.T) {
+	defer func(original int) { storeRetries = original }(storeRetries)
+	storeRetries = 2
+	var delays []time.Duration
+	defer func(original func(time.Duration)) { storeRetrySleep = original }(storeRetrySleep)
+	storeRetrySleep = func(d time.Duration) { delays = append(delays, d) }
+
+	attempts := 0
+	err := retryStore("test", func() error {
+		if attempts++; attempts < 3 {
+			requestErr := awserr.New("RequestError", "send request failed", errors.New("connection reset by peer"))
+			return markTransient(requestErr, errors.New("failed to upload to S3"))
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Fatalf("the transient failure isn't retried: %d attempts: %v", attempts, err)
+	}
+	if len(delays) != 2 || delays[0] != time.Second || delays[1] != 2*time.Second {
+		t.Fatalf("the delays are wrong: %v", delays)
+	}
+
+	for _, requestErr := range []error{
+		awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "id"),
+		awserr.NewRequestFailure(awserr.New("EntityTooLarge", "too large", nil), 400, "id"),
+		errors.New("failed to read tmp/foo"),
+	} {
+		attempts = 0
+		err = retryStore("test", func() error {
+			attempts++
+			return markTransient(requestErr, errors.New("failed to upload to S3"))
+		})
+		if err == nil || attempts != 1 {
+			t.Fatalf("the failure is retried: %d attempts: %v", attempts, requestErr)
+		}
+	}
+
+	attempts = 0
+	err = retryStore("test", func() error {
+		attempts++
+		return &cacheTooLargeError{1 << 20}
+	})
+	if err == nil || attempts != 1 {
+		t.Fatalf("the too large archive is retried: %d attempts: %v", attempts, err)
+	}
+}
+
+func TestStoreRetryDelay(t *testing.T) {
+	for attempt, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second} {
+		if delay := storeRetryDelay(attempt); delay != expected {
+			t.Fatalf("the delay of attempt %d is wrong: %s", attempt, delay)
+		}
+	}
+	if delay := storeRetryDelay(100); delay != storeRetryMaxDelay {
+		t.Fatalf("the delay isn't capped: %s", delay)
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	for _, c := range []struct {
+		err       error
+		transient bool
+	}{
+		{awserr.New("RequestError", "send request failed", nil), true},
+		{awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate", nil), 503, "id"), true},
+		{awserr.NewRequestFailure(awserr.New("InternalError", "internal error", nil), 500, "id"), true},
+		{awserr.New("MultipartUpload", "upload multipart failed", awserr.NewRequestFailure(awserr.New("InternalError", "internal error", nil), 500, "id")), true},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "id"), false},
+		{awserr.NewRequestFailure(awserr.New("NotImplemented", "not implemented", nil), 501, "id"), false},
+		{awserr.New("ReadRequestBody", "read upload data failed", errors.New("file changed")), false},
+	} {
+		if transient := isTransientError(c.err); transient != c.transient {
+			t.Fatalf("isTransientError(%s) is %v", c.err, transient)
+		}
+	}
+}
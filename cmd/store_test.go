@@ -3,13 +3,21 @@ package cmd
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
 )
 
 func setupFixturesToCache(t *testing.T) {
@@ -129,6 +137,38 @@ func loadTarHeadersAndContents(t *testing.T, f string) map[string]*TarHeaderAndC
 	return hdrs
 }
 
+// writeTarFile writes the tar stream of paths to the file
+func writeTarFile(path string, paths []string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if err := writeTar(file, paths); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// writeArchiveFile writes the gzipped archive of paths to the file as store uploads it
+func writeArchiveFile(path string, paths []string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if _, err := writeArchive(file, paths); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
 func TestCreateTarWithRelativePaths(t *testing.T) {
 	setupFixturesToCache(t)
 
@@ -140,20 +180,28 @@ func TestCreateTarWithRelativePaths(t *testing.T) {
 	defer os.RemoveAll(dir)
 
 	paths := []string{"tmp/foo", "tmp/abc/def"}
-	if err := createTar(dir, "test", paths); err != nil {
-		t.Fatalf("failed to create a tar: %s", err)
+	if err := writeTarFile(filepath.Join(dir, "test.tar"), paths); err != nil {
+		t.Fatalf("failed to write a tar: %s", err)
 	}
 
 	hdrs := loadTarHeadersAndContents(t, filepath.Join(dir, "test.tar"))
 
 	n := len(hdrs)
-	if n != 8 {
+	if n != 9 {
 		t.Fatalf("the number of the entries is wrong: %d", n)
 	}
 
-	if hdrs["metadata.json"].Content != `{"paths":["tmp/foo","tmp/abc/def"]}` {
+	if !strings.HasPrefix(hdrs["metadata.json"].Content, `{"paths":["tmp/foo","tmp/abc/def"],"tool_version":"dev",`) {
 		t.Fatalf("the content of metadata.json is wrong: %s", hdrs["metadata.json"].Content)
 	}
+	manifest, err := readManifest(strings.NewReader(hdrs["manifest.json"].Content))
+	if err != nil {
+		t.Fatalf("failed to read manifest.json: %s", err)
+	}
+	// sha256 of "This is foo!"
+	if f := manifest.Files[manifest.names["0000/foo/hoge.txt"]]; f.Size != 12 || f.SHA256 != "db9e76928d8c4d127178d2f3612c065f69de5efe5ebac1776e4cf922255012e8" {
+		t.Fatalf("the checksum of 0000/foo/hoge.txt in manifest.json is wrong: %#v", f)
+	}
 	if hdrs["0000/foo/hoge.txt"].Content != "This is foo!" {
 		t.Fatalf("the content of 0000/foo/hoge.txt is wrong: %s", hdrs["0000/tmp/foo/hoge.txt"].Content)
 	}
@@ -183,19 +231,19 @@ func TestCreateTarWithAbsolutePaths(t *testing.T) {
 	foodir := filepath.Join(cwd, "tmp/foo")
 	defdir := filepath.Join(cwd, "tmp/abc/def")
 	paths := []string{foodir, defdir}
-	if err := createTar(dir, "test", paths); err != nil {
-		t.Fatalf("failed to create a tar: %s", err)
+	if err := writeTarFile(filepath.Join(dir, "test.tar"), paths); err != nil {
+		t.Fatalf("failed to write a tar: %s", err)
 	}
 
 	hdrs := loadTarHeadersAndContents(t, filepath.Join(dir, "test.tar"))
 
 	n := len(hdrs)
-	if n != 8 {
+	if n != 9 {
 		t.Fatalf("the number of the entries is wrong: %d", n)
 	}
 
-	expectedMetadata := fmt.Sprintf(`{"paths":["%s","%s"]}`, foodir, defdir)
-	if hdrs["metadata.json"].Content != expectedMetadata {
+	expectedMetadata := fmt.Sprintf(`{"paths":["%s","%s"],"tool_version":"dev",`, foodir, defdir)
+	if !strings.HasPrefix(hdrs["metadata.json"].Content, expectedMetadata) {
 		t.Fatalf("the content of metadata.json is wrong: %s", hdrs["metadata.json"].Content)
 	}
 	if hdrs["0000/foo/hoge.txt"].Content != "This is foo!" {
@@ -209,8 +257,127 @@ func TestCreateTarWithAbsolutePaths(t *testing.T) {
 	}
 }
 
-func TestCompressGzip(t *testing.T) {
+func TestCreateTarWithHardLinks(t *testing.T) {
+	setupFixturesToCache(t)
+
+	if err := os.Link("tmp/foo/hoge.txt", "tmp/foo/hoge-link.txt"); err != nil {
+		t.Fatalf("failed to create a hard link to cache: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	paths := []string{"tmp/foo"}
+	if err := writeTarFile(filepath.Join(dir, "test.tar"), paths); err != nil {
+		t.Fatalf("failed to write a tar: %s", err)
+	}
+
+	hdrs := loadTarHeadersAndContents(t, filepath.Join(dir, "test.tar"))
+
+	if hdrs["0000/foo/hoge-link.txt"].Content != "This is foo!" {
+		t.Fatalf("the content of 0000/foo/hoge-link.txt is wrong: %s", hdrs["0000/foo/hoge-link.txt"].Content)
+	}
+	if hdrs["0000/foo/hoge.txt"].Header.Typeflag != tar.TypeLink {
+		t.Fatalf("0000/foo/hoge.txt is not a hard link")
+	}
+	if hdrs["0000/foo/hoge.txt"].Header.Linkname != "0000/foo/hoge-link.txt" {
+		t.Fatalf("the target of the hard link 0000/foo/hoge.txt is wrong: %s", hdrs["0000/foo/hoge.txt"].Header.Linkname)
+	}
+}
+
+func createSparseFixture(t *testing.T, path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create a sparse file to cache: %s", err)
+	}
+
+	defer file.Close()
+
+	if err := file.Truncate(4 << 20); err != nil {
+		t.Fatalf("failed to extend a sparse file to cache: %s", err)
+	}
+	if _, err := file.WriteAt([]byte("This is sparse!"), 2<<20); err != nil {
+		t.Fatalf("failed to write to a sparse file to cache: %s", err)
+	}
+
+	if segments, err := sparseSegments(file, mustStat(t, path)); err != nil {
+		t.Fatalf("failed to detect holes of a sparse file: %s", err)
+	} else if segments == nil {
+		t.Skip("the filesystem doesn't support sparse files")
+	}
+}
+
+func mustStat(t *testing.T, path string) os.FileInfo {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat: %s", err)
+	}
+
+	return info
+}
+
+func TestCreateTarWithSparseFiles(t *testing.T) {
+	setupFixturesToCache(t)
+	createSparseFixture(t, "tmp/foo/sparse.img")
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	paths := []string{"tmp/foo"}
+	if err := writeTarFile(filepath.Join(dir, "test.tar"), paths); err != nil {
+		t.Fatalf("failed to write a tar: %s", err)
+	}
+
+	hdrs := loadTarHeadersAndContents(t, filepath.Join(dir, "test.tar"))
+
+	hdr := hdrs["0000/foo/sparse.img"].Header
+	if !isSparseHeader(hdr) {
+		t.Fatalf("0000/foo/sparse.img is not stored as a sparse file")
+	}
+	segments, err := parseSparseHeader(hdr)
+	if err != nil || len(segments) == 0 {
+		t.Fatalf("the data segments of 0000/foo/sparse.img are wrong: %v: %v", segments, err)
+	}
+
+	// only the data segments are stored, which archive/tar reads with the holes as zeros
+	if info := mustStat(t, filepath.Join(dir, "test.tar")); info.Size() >= 1<<20 {
+		t.Fatalf("the holes of 0000/foo/sparse.img are stored: %d bytes", info.Size())
+	}
+	expected, err := ioutil.ReadFile("tmp/foo/sparse.img")
+	if err != nil {
+		t.Fatalf("failed to read a fixture file: %s", err)
+	}
+	if hdr.Size != 4<<20 || hdrs["0000/foo/sparse.img"].Content != string(expected) {
+		t.Fatalf("the content of 0000/foo/sparse.img is wrong: %d bytes", hdr.Size)
+	}
+}
+
+const longFixtureDir = "tmp/foo/node_modules/@example/very-long-package-name/node_modules/another-very-long-package-name/lib"
+
+func setupLongAndUTF8FixturesToCache(t *testing.T) {
+	if err := os.MkdirAll(longFixtureDir, 0755); err != nil {
+		t.Fatalf("failed to create a directory contains files to cache: %s", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(longFixtureDir, "index.js"), []byte("This is long!"), 0644); err != nil {
+		t.Fatalf("failed to create a file to cache: %s", err)
+	}
+	if err := ioutil.WriteFile("tmp/foo/ぐるぐる.txt", []byte("This is UTF-8!"), 0644); err != nil {
+		t.Fatalf("failed to create a file to cache: %s", err)
+	}
+}
+
+func TestCreateTarWithLongAndUTF8Paths(t *testing.T) {
 	setupFixturesToCache(t)
+	setupLongAndUTF8FixturesToCache(t)
 
 	dir, err := ioutil.TempDir("", "test")
 	if err != nil {
@@ -219,15 +386,296 @@ func TestCompressGzip(t *testing.T) {
 
 	defer os.RemoveAll(dir)
 
+	paths := []string{"tmp/foo"}
+	if err := writeTarFile(filepath.Join(dir, "test.tar"), paths); err != nil {
+		t.Fatalf("failed to write a tar: %s", err)
+	}
+
+	hdrs := loadTarHeadersAndContents(t, filepath.Join(dir, "test.tar"))
+
+	longName := "0000/" + strings.TrimPrefix(longFixtureDir, "tmp/") + "/index.js"
+	if len(longName) <= 100 {
+		t.Fatalf("the fixture path is not long enough: %s", longName)
+	}
+	if hdr, ok := hdrs[longName]; !ok {
+		t.Fatalf("the long path is not found: %s", longName)
+	} else if hdr.Content != "This is long!" {
+		t.Fatalf("the content of %s is wrong: %s", longName, hdr.Content)
+	}
+	if hdr, ok := hdrs["0000/foo/ぐるぐる.txt"]; !ok {
+		t.Fatalf("the UTF-8 path is not found")
+	} else if hdr.Content != "This is UTF-8!" {
+		t.Fatalf("the content of 0000/foo/ぐるぐる.txt is wrong: %s", hdr.Content)
+	}
+}
+
+func TestWriteArchive(t *testing.T) {
+	setupFixturesToCache(t)
+
+	buf := new(bytes.Buffer)
+	paths := []string{"tmp/foo", "tmp/abc/def"}
+	if _, err := writeArchive(buf, paths); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	gzr, err := gzip.NewReader(buf)
+	if err != nil {
+		t.Fatalf("failed to open the archive as gzip: %s", err)
+	}
+
+	tr := tar.NewReader(gzr)
+	n := 0
+	for {
+		if _, err := tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to read the archive: %s", err)
+		}
+		n++
+	}
+
+	if n != 9 {
+		t.Fatalf("the number of the entries is wrong: %d", n)
+	}
+}
+
+func TestWriteArchiveIndex(t *testing.T) {
+	setupFixturesToCache(t)
+
+	// Make the archive large enough to consist of multiple gzip members
+	large := make([]byte, 3*indexMemberSize)
+	rand.New(rand.NewSource(1)).Read(large)
+	if err := ioutil.WriteFile("tmp/foo/large.bin", large, 0644); err != nil {
+		t.Fatalf("failed to create a file to cache: %s", err)
+	}
+
+	buf := new(bytes.Buffer)
 	paths := []string{"tmp/foo", "tmp/abc/def"}
-	if err := createTar(dir, "test", paths); err != nil {
-		t.Fatalf("failed to create a tar: %s", err)
+	index, err := writeArchive(buf, paths)
+	if err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	var entry *indexEntry
+	for i := range index.Entries {
+		if index.Entries[i].Name == "0001/def/ghe" {
+			entry = &index.Entries[i]
+		}
+	}
+	if entry == nil {
+		t.Fatalf("0001/def/ghe is not indexed")
+	}
+	if entry.Offset == 0 {
+		t.Fatalf("the archive is not split into gzip members")
+	}
+
+	gzr, err := gzip.NewReader(bytes.NewReader(buf.Bytes()[entry.Offset:]))
+	if err != nil {
+		t.Fatalf("failed to decompress from the indexed offset: %s", err)
 	}
-	if err := compressGzip(dir, "test"); err != nil {
-		t.Fatalf("failed to compress to gzip file: %s", err)
+	if _, err := io.CopyN(ioutil.Discard, gzr, entry.Skip); err != nil {
+		t.Fatalf("failed to skip to the indexed entry: %s", err)
 	}
 
-	if _, err := os.Open(filepath.Join(dir, "test.tar.gz")); err != nil {
-		t.Fatalf("failed to open the created gzip file: %s", err)
+	hdr, err := tar.NewReader(gzr).Next()
+	if err != nil {
+		t.Fatalf("failed to read the indexed entry: %s", err)
+	}
+	if hdr.Name != "0001/def/ghe" {
+		t.Fatalf("the name of the indexed entry is wrong: %s", hdr.Name)
+	}
+}
+
+func TestOverwritesCache(t *testing.T) {
+	defer func(force bool, ifNewerThan time.Duration) {
+		forceStore, storeIfNewerThan = force, ifNewerThan
+	}(forceStore, storeIfNewerThan)
+
+	now := time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC)
+	existing := &cacheEntry{Key: "foo", LastModified: now.Add(-36 * time.Hour)}
+
+	testCases := []struct {
+		force       bool
+		ifNewerThan time.Duration
+		expected    bool
+	}{
+		{false, 0, false},
+		{true, 0, true},
+		{false, 24 * time.Hour, true},
+		{false, 48 * time.Hour, false},
+	}
+
+	for _, tc := range testCases {
+		forceStore, storeIfNewerThan = tc.force, tc.ifNewerThan
+		if actual := overwritesCache(existing, now); actual != tc.expected {
+			t.Errorf("expected %v with --force=%v --if-newer-than=%s but got %v", tc.expected, tc.force, tc.ifNewerThan, actual)
+		}
+	}
+}
+
+func TestUploadToS3WithContentMD5(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(size string, concurrency int) {
+		uploadPartSize = size
+		uploadConcurrency = concurrency
+	}(uploadPartSize, uploadConcurrency)
+	uploadPartSize = "5MB"
+	uploadConcurrency = 2
+
+	// Content-MD5 is sent even when the SDK doesn't compute it
+	s3Client.Config.S3DisableContentMD5Validation = aws.Bool(true)
+
+	if err := uploadToS3("v1/small.tar.gz", strings.NewReader("small"), nil); err != nil {
+		t.Fatalf("failed to upload: %s", err)
+	}
+	requests := fake.received(http.MethodPut, "v1/small.tar.gz")
+	if len(requests) != 1 || requests[0].Header.Get("Content-Md5") != base64MD5([]byte("small")) {
+		t.Fatalf("Content-MD5 of the object isn't sent: %#v", requests)
+	}
+
+	large := bytes.Repeat([]byte("large"), 3<<20)
+	if err := uploadToS3("v1/large.tar.gz", bytes.NewReader(large), nil); err != nil {
+		t.Fatalf("failed to upload: %s", err)
+	}
+	requests = fake.received(http.MethodPut, "v1/large.tar.gz")
+	if len(requests) != 3 {
+		t.Fatalf("the object isn't uploaded in parts: %d", len(requests))
+	}
+	for _, r := range requests {
+		if r.Header.Get("Content-Md5") == "" {
+			t.Fatalf("Content-MD5 of part %s isn't sent", r.Query.Get("partNumber"))
+		}
+	}
+	if content, _ := fake.content("v1/large.tar.gz"); !bytes.Equal(content, large) {
+		t.Fatalf("the uploaded object is wrong: %d bytes", len(content))
+	}
+}
+
+func TestValidateUploadOptionsWithPassphraseAndRecipient(t *testing.T) {
+	if err := validateUploadOptions(); err != nil {
+		t.Fatalf("the default options are invalid: %s", err)
+	}
+
+	defer func(original string) { passphraseFile = original }(passphraseFile)
+	defer func(original []string) { ageRecipients = original }(ageRecipients)
+	passphraseFile = "passphrase.txt"
+	ageRecipients = []string{"age1recipient"}
+
+	err := validateUploadOptions()
+	if err == nil || !strings.Contains(err.Error(), "--passphrase-file") {
+		t.Fatalf("the passphrase is accepted with a recipient: %v", err)
+	}
+}
+
+func TestValidateUploadOptionsWithChunkedParts(t *testing.T) {
+	defer func(original bool) { chunked = original }(chunked)
+	defer func(original string) { maxPartSize = original }(maxPartSize)
+	chunked = true
+	maxPartSize = "1GB"
+
+	err := validateUploadOptions()
+	if err == nil || !strings.Contains(err.Error(), "--max-part-size") {
+		t.Fatalf("--max-part-size is accepted with --chunked: %v", err)
+	}
+
+	maxPartSize = "0"
+	if err := validateUploadOptions(); err != nil {
+		t.Fatalf("--chunked without parts is invalid: %s", err)
+	}
+}
+
+func TestUploadWithServerSideEncryption(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(s string, keyID string, size string) {
+		sse = s
+		sseKMSKeyID = keyID
+		uploadPartSize = size
+	}(sse, sseKMSKeyID, uploadPartSize)
+	sse = s3.ServerSideEncryptionAwsKms
+	sseKMSKeyID = "alias/cache"
+	uploadPartSize = "5MB"
+
+	assertEncrypted := func(what string, requests []fakeRequest) {
+		if len(requests) == 0 {
+			t.Fatalf("%s isn't requested", what)
+		}
+		for _, r := range requests {
+			if r.Header.Get("X-Amz-Server-Side-Encryption") != sse || r.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id") != sseKMSKeyID {
+				t.Errorf("%s isn't encrypted with the KMS key: %v", what, r.Header)
+			}
+		}
+	}
+	withQuery := func(requests []fakeRequest, query string) []fakeRequest {
+		var found []fakeRequest
+		for _, r := range requests {
+			if _, ok := r.Query[query]; ok {
+				found = append(found, r)
+			}
+		}
+		return found
+	}
+
+	if err := uploadToS3("v1/small.tar.gz", strings.NewReader("small"), nil); err != nil {
+		t.Fatalf("failed to upload: %s", err)
+	}
+	assertEncrypted("PutObject", fake.received(http.MethodPut, "v1/small.tar.gz"))
+
+	if err := uploadToS3("v1/large.tar.gz", bytes.NewReader(bytes.Repeat([]byte("large"), 3<<20)), nil); err != nil {
+		t.Fatalf("failed to upload: %s", err)
+	}
+	assertEncrypted("CreateMultipartUpload", withQuery(fake.received(http.MethodPost, "v1/large.tar.gz"), "uploads"))
+
+	if err := uploadStaged("v1/staged.tar.gz", strings.NewReader("staged"), nil, func() error { return nil }); err != nil {
+		t.Fatalf("failed to upload: %s", err)
+	}
+	var staging []fakeRequest
+	for _, r := range fake.requests {
+		if r.Method == http.MethodPut && strings.HasPrefix(r.Key, s3Bucket+"/v1/staged.tar.gz"+stagingKeyInfix) {
+			staging = append(staging, r)
+		}
+	}
+	assertEncrypted("PutObject of the staging object", staging)
+	assertEncrypted("CopyObject of the staging object", fake.received(http.MethodPut, "v1/staged.tar.gz"))
+
+	// staging objects too large for CopyObject are promoted by parts
+	fake.put("v1/large.tar.gz.tmp-id", []byte("large"), nil)
+	head := &s3.HeadObjectOutput{ContentLength: aws.Int64(5)}
+	if err := promoteStagedByParts("v1/large.tar.gz.tmp-id", "v1/promoted.tar.gz", head, nil); err != nil {
+		t.Fatalf("failed to promote: %s", err)
+	}
+	assertEncrypted("CreateMultipartUpload of the staging object", withQuery(fake.received(http.MethodPost, "v1/promoted.tar.gz"), "uploads"))
+}
+
+func TestStorePathsValidatesOptionsBeforeS3(t *testing.T) {
+	setupFixturesToCache(t)
+	defer clearFixturesToCache(t)
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(policy string, class string, pairs []string, lock bool) {
+		maxSizePolicy, storageClass, tags, withLock = policy, class, pairs, lock
+	}(maxSizePolicy, storageClass, tags, withLock)
+	defer func(original []string) { ageRecipients = original }(ageRecipients)
+	defer func(original string) { passphraseFile = original }(passphraseFile)
+	withLock = true
+
+	invalid := map[string]func(){
+		"max size policy": func() { maxSizePolicy = "ignore" },
+		"tags":            func() { tags = []string{"no-value"} },
+		"storage class":   func() { storageClass = "GLACIER" },
+		"encryption":      func() { passphraseFile, ageRecipients = "passphrase.txt", []string{"age1recipient"} },
+	}
+	for name, set := range invalid {
+		maxSizePolicy, storageClass, tags = maxSizePolicyFail, "", nil
+		passphraseFile, ageRecipients = "", nil
+		set()
+
+		if _, err := storePaths(prefixedKey("key"), []string{"tmp/foo"}); err == nil {
+			t.Fatalf("the invalid %s is accepted", name)
+		}
+		if len(fake.requests) > 0 {
+			t.Fatalf("S3 is requested before validating the %s: %s %s", name, fake.requests[0].Method, fake.requests[0].Key)
+		}
 	}
 }
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+	"github.com/yuya-takeyama/guruguru-cache/template"
+)
+
+var removedTags []string
+
+func init() {
+	tagCmd := &cobra.Command{
+		Use:   "tag [flags] [cache key] [key=value...]",
+		Short: "Set tags of a cache, or print them without tags",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupTemplate(); err != nil {
+				log.Fatal(err)
+			}
+
+			cacheKey, err := template.ExecuteTemplate(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+			cacheKey = prefixedKey(cacheKey)
+
+			exists, err := cacheExists(cacheKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !exists {
+				log.Fatalf("cache doesn't exist: %s", cacheKey)
+			}
+
+			pairs := args[1:]
+			if len(pairs) == 0 && len(removedTags) == 0 {
+				current, err := getCacheTags(cacheKey)
+				if err != nil {
+					log.Fatal(err)
+				}
+				for _, tag := range current {
+					fmt.Printf("%s=%s\n", aws.StringValue(tag.Key), aws.StringValue(tag.Value))
+				}
+				return
+			}
+
+			tags, err := tagCache(cacheKey, pairs, removedTags)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("%d tags are set to %s\n", len(tags), cacheKey)
+		},
+	}
+
+	tagCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of the cache")
+	tagCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(tagCmd)
+	addTemplateFlags(tagCmd)
+	tagCmd.Flags().StringArrayVarP(&removedTags, "remove", "", nil, "Key of the tag to remove (can be repeated)")
+
+	rootCmd.AddCommand(tagCmd)
+}
+
+// tagCache sets the key=value pairs to the tags of all the objects of the cache and removes the keys, returning the tags of its object.
+// Each object keeps its other tags, like the one of lifecycle apply which objects of base caches lose.
+func tagCache(cacheKey string, pairs []string, removed []string) ([]*s3.Tag, error) {
+	c, err := findCacheEntry(cacheKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var cacheTags []*s3.Tag
+	for _, object := range c.objects {
+		output, err := s3Client.GetObjectTagging(&s3.GetObjectTaggingInput{
+			Bucket: &s3Bucket,
+			Key:    object.Key,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get tags of %s: %s", aws.StringValue(object.Key), err)
+		}
+
+		tags, err := mergeTags(output.TagSet, pairs, removed)
+		if err != nil {
+			return nil, err
+		}
+
+		// tags of objects are replaced as a whole
+		if len(tags) == 0 {
+			_, err = s3Client.DeleteObjectTagging(&s3.DeleteObjectTaggingInput{
+				Bucket: &s3Bucket,
+				Key:    object.Key,
+			})
+		} else {
+			_, err = s3Client.PutObjectTagging(&s3.PutObjectTaggingInput{
+				Bucket:  &s3Bucket,
+				Key:     object.Key,
+				Tagging: &s3.Tagging{TagSet: tags},
+			})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to put tags of %s: %s", aws.StringValue(object.Key), err)
+		}
+
+		if aws.StringValue(object.Key) == objectKey(cacheKey) {
+			cacheTags = tags
+		}
+	}
+
+	return cacheTags, nil
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestTagCache(t *testing.T) {
+	_, teardown := setupFakeS3(t)
+	defer teardown()
+	defer func(original []string) { tags = original }(tags)
+
+	tags = []string{"team=web", "job=test"}
+	for _, key := range []string{"gem.tar.gz", "gem.part0001.tar.gz", "gem.part0002.tar.gz", "gem.sha256", "other.tar.gz"} {
+		if err := uploadToS3(prefixedKey(key), strings.NewReader(key), nil); err != nil {
+			t.Fatalf("failed to upload: %s", err)
+		}
+	}
+
+	cacheTags, err := tagCache(prefixedKey("gem"), []string{"branch=feature/foo", "team=api"}, []string{"job"})
+	if err != nil {
+		t.Fatalf("failed to tag the cache: %s", err)
+	}
+	if len(cacheTags) != 3 {
+		t.Fatalf("the tags of the cache are wrong: %v", cacheTags)
+	}
+
+	objectTags := func(key string) []string {
+		output, err := s3Client.GetObjectTagging(&s3.GetObjectTaggingInput{Bucket: &s3Bucket, Key: aws.String(prefixedKey(key))})
+		if err != nil {
+			t.Fatalf("failed to get tags: %s", err)
+		}
+		var pairs []string
+		for _, tag := range output.TagSet {
+			pairs = append(pairs, aws.StringValue(tag.Key)+"="+aws.StringValue(tag.Value))
+		}
+		sort.Strings(pairs)
+		return pairs
+	}
+
+	// all the objects of the cache are tagged, keeping the tag of lifecycle apply
+	expected := []string{"branch=feature/foo", expiringTagKey + "=" + expiringTagValue, "team=api"}
+	for _, key := range []string{"gem.tar.gz", "gem.part0001.tar.gz", "gem.part0002.tar.gz", "gem.sha256"} {
+		if actual := objectTags(key); !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("the tags of %s are wrong: %v", key, actual)
+		}
+	}
+	if actual := objectTags("other.tar.gz"); !reflect.DeepEqual(actual, []string{expiringTagKey + "=" + expiringTagValue, "job=test", "team=web"}) {
+		t.Fatalf("the tags of the other cache are changed: %v", actual)
+	}
+
+	if _, err := tagCache(prefixedKey("missing"), []string{"team=api"}, nil); err == nil {
+		t.Fatal("the missing cache is tagged")
+	}
+}
@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// maxObjectTags is the number of tags S3 allows for an object
+const maxObjectTags = 10
+
+// expiringTag is the tag of the objects which the rule of lifecycle apply expires.
+// Chunks don't have it, as they may be shared with newer caches.
+const (
+	expiringTagKey   = "guruguru-cache-expiring"
+	expiringTagValue = "true"
+)
+
+// objectTagging returns x-amz-tagging of the object uploaded with the tags of --tag, which are validated by validateUploadOptions
+func objectTagging(s3Key string) string {
+	pairs := tags
+	if !strings.HasPrefix(s3Key, prefixedKey(chunkStorePrefix)) {
+		pairs = append(append([]string{}, tags...), expiringTagKey+"="+expiringTagValue)
+	}
+	tagging, _ := parseTags(pairs)
+
+	return tagging
+}
+
+// parseTags converts key=value pairs into the URL-encoded form of x-amz-tagging
+func parseTags(pairs []string) (string, error) {
+	if len(pairs) > maxObjectTags {
+		return "", fmt.Errorf("too many tags: %d (at most %d)", len(pairs), maxObjectTags)
+	}
+
+	values := url.Values{}
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return "", fmt.Errorf("invalid tag: %s (must be key=value)", pair)
+		}
+		if _, ok := values[kv[0]]; ok {
+			return "", fmt.Errorf("duplicated tag: %s", kv[0])
+		}
+
+		values.Set(kv[0], kv[1])
+	}
+
+	return values.Encode(), nil
+}
+
+// encodeTags converts the tags into the URL-encoded form of x-amz-tagging
+func encodeTags(tags []*s3.Tag) string {
+	values := url.Values{}
+	for _, tag := range tags {
+		values.Set(aws.StringValue(tag.Key), aws.StringValue(tag.Value))
+	}
+
+	return values.Encode()
+}
+
+// mergeTags sets the key=value pairs to the tags and removes the keys, keeping the order of existing tags
+func mergeTags(current []*s3.Tag, pairs []string, removed []string) ([]*s3.Tag, error) {
+	// validates the pairs in the same way as --tag of store
+	if _, err := parseTags(pairs); err != nil {
+		return nil, err
+	}
+
+	var tags []*s3.Tag
+	for _, tag := range current {
+		if !containsString(removed, aws.StringValue(tag.Key)) {
+			tags = append(tags, &s3.Tag{Key: tag.Key, Value: tag.Value})
+		}
+	}
+
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		updated := false
+		for _, tag := range tags {
+			if aws.StringValue(tag.Key) == kv[0] {
+				tag.Value = aws.String(kv[1])
+				updated = true
+			}
+		}
+		if !updated {
+			tags = append(tags, &s3.Tag{Key: aws.String(kv[0]), Value: aws.String(kv[1])})
+		}
+	}
+
+	if len(tags) > maxObjectTags {
+		return nil, fmt.Errorf("too many tags: %d (at most %d)", len(tags), maxObjectTags)
+	}
+
+	return tags, nil
+}
+
+// matchTags reports whether the tags match all the queries, which are key=value or key only to match any values
+func matchTags(tags []*s3.Tag, queries []string) bool {
+	for _, query := range queries {
+		kv := strings.SplitN(query, "=", 2)
+		matched := false
+		for _, tag := range tags {
+			if aws.StringValue(tag.Key) == kv[0] && (len(kv) < 2 || aws.StringValue(tag.Value) == kv[1]) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getCacheTags returns the tags of the object of the cache
+func getCacheTags(cacheKey string) ([]*s3.Tag, error) {
+	output, err := s3Client.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket: &s3Bucket,
+		Key:    aws.String(objectKey(cacheKey)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tags of %s: %s", cacheKey, err)
+	}
+
+	return output.TagSet, nil
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestParseTags(t *testing.T) {
+	cases := map[string][]string{
+		"":                          nil,
+		"repo=guruguru-cache":       {"repo=guruguru-cache"},
+		"branch=feature%2Ffoo&job=": {"job=", "branch=feature/foo"},
+		"query=a%3Db":               {"query=a=b"},
+	}
+
+	for expected, pairs := range cases {
+		actual, err := parseTags(pairs)
+		if err != nil {
+			t.Fatalf("failed to parse tags: %v: %s", pairs, err)
+		}
+		if actual != expected {
+			t.Fatalf("the parsed tags of %v are wrong: %s", pairs, actual)
+		}
+	}
+
+	invalids := [][]string{
+		{"repo"},
+		{"=value"},
+		{"repo=a", "repo=b"},
+		{"a=1", "b=2", "c=3", "d=4", "e=5", "f=6", "g=7", "h=8", "i=9", "j=10", "k=11"},
+	}
+	for _, pairs := range invalids {
+		if _, err := parseTags(pairs); err == nil {
+			t.Fatalf("invalid tags are parsed: %v", pairs)
+		}
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	current := []*s3.Tag{
+		{Key: aws.String("branch"), Value: aws.String("master")},
+		{Key: aws.String("job"), Value: aws.String("test")},
+		{Key: aws.String("team"), Value: aws.String("web")},
+	}
+
+	tags, err := mergeTags(current, []string{"branch=feature/foo", "pr=12"}, []string{"job"})
+	if err != nil {
+		t.Fatalf("failed to merge tags: %s", err)
+	}
+
+	var pairs []string
+	for _, tag := range tags {
+		pairs = append(pairs, aws.StringValue(tag.Key)+"="+aws.StringValue(tag.Value))
+	}
+	if strings.Join(pairs, "&") != "branch=feature/foo&team=web&pr=12" {
+		t.Fatalf("merged tags are wrong: %v", pairs)
+	}
+	if aws.StringValue(current[0].Value) != "master" {
+		t.Fatal("current tags are modified")
+	}
+
+	if _, err := mergeTags(current, []string{"a=1", "b=2", "c=3", "d=4", "e=5", "f=6", "g=7", "h=8"}, nil); err == nil {
+		t.Fatal("tags more than S3 allows are merged")
+	}
+}
+
+func TestMatchTags(t *testing.T) {
+	tags := []*s3.Tag{
+		{Key: aws.String("branch"), Value: aws.String("master")},
+		{Key: aws.String("team"), Value: aws.String("web")},
+	}
+
+	cases := map[string]bool{
+		"branch=master":          true,
+		"branch":                 true,
+		"branch=master&team=web": true,
+		"branch=":                false,
+		"branch=feature":         false,
+		"branch=master&job":      false,
+	}
+	for queries, expected := range cases {
+		if actual := matchTags(tags, strings.Split(queries, "&")); actual != expected {
+			t.Fatalf("match of %s is wrong: %t", queries, actual)
+		}
+	}
+}
+
+func TestObjectTagging(t *testing.T) {
+	defer func(original []string) { tags = original }(tags)
+	tags = []string{"repo=guruguru-cache"}
+
+	if tagging := objectTagging(objectKey(prefixedKey("gem"))); tagging != "guruguru-cache-expiring=true&repo=guruguru-cache" {
+		t.Fatalf("tags of the cache are wrong: %s", tagging)
+	}
+	if tagging := objectTagging(chunkKey("0123")); tagging != "repo=guruguru-cache" {
+		t.Fatalf("chunk has the tag expired by lifecycle apply: %s", tagging)
+	}
+}
@@ -0,0 +1,268 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+)
+
+// tmpDir is the directory of temporal files, where empty means the system temp directory like $TMPDIR
+var tmpDir string
+
+var tmpSpaceFactor float64
+
+func addTmpDirFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&tmpDir, "tmp-dir", "", "", "Directory to write temporal files to (default the system temp directory)")
+}
+
+// addTmpSpaceFlags adds the flags of commands downloading caches into the temp directory
+func addTmpSpaceFlags(cmd *cobra.Command) {
+	addTmpDirFlag(cmd)
+	cmd.Flags().Float64VarP(&tmpSpaceFactor, "tmp-space-factor", "", 2, "Fail before downloading unless the temp directory has this factor times the size of the cache free (0 disables the check)")
+}
+
+// checkTmpSpace fails fast when the file system of the temp directory has less free space than the estimated size times --tmp-space-factor,
+// rather than running out of space in the middle of extracting. Free space unknown like on Windows isn't checked.
+func checkTmpSpace(dir string, estimateSize func() int64) error {
+	if tmpSpaceFactor <= 0 {
+		return nil
+	}
+	free, ok := freeSpace(dir)
+	if !ok {
+		return nil
+	}
+
+	// estimated only when it's checked, as it may read the metadata of the cache
+	size := estimateSize()
+	required := int64(float64(size) * tmpSpaceFactor)
+	if free >= uint64(required) {
+		return nil
+	}
+
+	return fmt.Errorf("not enough space in the temp directory %s: %s is free, but %s (%s of the cache times %g) is required, "+
+		"set --tmp-dir to a directory with more space or lower --tmp-space-factor", dir, formatSize(int64(free)), formatSize(required), formatSize(size), tmpSpaceFactor)
+}
+
+// compressionRatio is the ratio of the size of files to their archive assumed for caches stored by older versions without the stats
+const compressionRatio = 3
+
+// cacheSize estimates the size of the files of the cache by the stats of its paths, or by the size of its archive for caches without them
+func cacheSize(cacheKey string, item *s3.GetObjectOutput) int64 {
+	if meta, _, err := cacheMetadata(cacheKey, item.Metadata); err == nil && meta != nil {
+		if size, ok := pathStatsSize(meta); ok {
+			return size
+		}
+	}
+
+	size, err := archiveSize(cacheKey, item)
+	if err != nil {
+		log.Printf("failed to get the size of the archive: %s\n", err)
+	}
+
+	return size * compressionRatio
+}
+
+// archiveSize returns the size of the archive of the cache, which is the total of its parts or chunks for split caches
+// rather than the manifest object at the key
+func archiveSize(cacheKey string, item *s3.GetObjectOutput) (int64, error) {
+	if n := aws.StringValue(item.Metadata[partsMetadataKey]); n != "" {
+		parts, err := strconv.Atoi(n)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of parts: %s", n)
+		}
+
+		return objectsSize(partKeys(cacheKey, objectGeneration(item.Metadata), parts))
+	}
+
+	if _, ok := item.Metadata[chunksMetadataKey]; ok {
+		// the body of the item is left to be read by restore
+		manifest, err := s3Client.GetObject(&s3.GetObjectInput{
+			Bucket:  &s3Bucket,
+			Key:     aws.String(objectKey(cacheKey)),
+			IfMatch: item.ETag,
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to get manifest of chunks: %s", err)
+		}
+		keys, err := chunkKeysFromManifest(manifest.Body)
+		manifest.Body.Close()
+		if err != nil {
+			return 0, err
+		}
+
+		return objectsSize(keys)
+	}
+
+	return aws.Int64Value(item.ContentLength), nil
+}
+
+// objectsSize returns the total size of the objects, counting objects appearing more than once like shared chunks once
+func objectsSize(keys []string) (int64, error) {
+	jobs := make(chan string)
+	var mu sync.Mutex
+	var size int64
+	var firstErr error
+	counted := make(map[string]bool)
+
+	var wg sync.WaitGroup
+	for w := 0; w < chunkManifestConcurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				head, err := s3Client.HeadObject(&s3.HeadObjectInput{Bucket: &s3Bucket, Key: aws.String(key)})
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("failed to get metadata of %s: %s", key, err)
+				} else if err == nil {
+					size += aws.Int64Value(head.ContentLength)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, key := range keys {
+		if !counted[key] {
+			counted[key] = true
+			jobs <- key
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return size, firstErr
+}
+
+// pathStatsSize returns the total size of the paths, reporting false for caches stored by older versions without the stats
+func pathStatsSize(meta *metadata) (int64, bool) {
+	if len(meta.PathStats) == 0 || len(meta.PathStats) != len(meta.Paths) {
+		return 0, false
+	}
+
+	var size int64
+	for _, stats := range meta.PathStats {
+		size += stats.Size
+	}
+
+	return size, true
+}
+
+// movePath replaces the path with the extracted one. It's moved next to the path first, or copied there when the temp directory
+// is in another file system by --tmp-dir, so that the current path is replaced only after all the files are there.
+func movePath(from string, to string) error {
+	tmp, err := ioutil.TempDir(filepath.Dir(to), "."+filepath.Base(to)+".guruguru-cache-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	staged := filepath.Join(tmp, filepath.Base(to))
+	if err := os.Rename(from, staged); err != nil {
+		if !isCrossDevice(err) {
+			return err
+		}
+		if err := copyTree(from, staged); err != nil {
+			return err
+		}
+		// the copied files are removed with the temp directory anyway
+		os.RemoveAll(from)
+	}
+
+	if err := os.RemoveAll(to); err != nil {
+		return fmt.Errorf("failed to remove current path: %s: %s", to, err)
+	}
+
+	return os.Rename(staged, to)
+}
+
+// copyTree copies the files under from to the path, keeping hard links between them.
+// Modes of directories are set after their files are copied, so that read-only directories like ones of Go modules can be copied.
+func copyTree(from string, to string) error {
+	type dirMode struct {
+		path string
+		mode os.FileMode
+	}
+	var dirs []dirMode
+	links := make(map[fileID]string)
+
+	err := filepath.Walk(from, func(src string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to traverse files: %s", err)
+		}
+
+		dst := filepath.Join(to, strings.TrimPrefix(src, from))
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(dst, 0700); err != nil {
+				return fmt.Errorf("failed to create a directory: %s", err)
+			}
+			dirs = append(dirs, dirMode{dst, info.Mode().Perm()})
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(src)
+			if err != nil {
+				return fmt.Errorf("failed to read link: %s", err)
+			}
+			if err := os.Symlink(link, dst); err != nil {
+				return fmt.Errorf("failed to create a symlink: %s", err)
+			}
+		default:
+			id, hasID := hardLinkID(info)
+			if target, seen := links[id]; hasID && seen {
+				if err := os.Link(target, dst); err != nil {
+					return fmt.Errorf("failed to create a hard link: %s", err)
+				}
+				return nil
+			}
+			if err := copyFile(src, dst, info.Mode().Perm()); err != nil {
+				return err
+			}
+			if hasID {
+				links[id] = dst
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return fmt.Errorf("failed to change the mode of a directory: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func copyFile(src string, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %s", err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return fmt.Errorf("failed to create a file: %s", err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to copy file: %s", err)
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestCheckTmpSpace(t *testing.T) {
+	if _, ok := freeSpace(os.TempDir()); !ok {
+		t.Skip("free space is unknown")
+	}
+	defer func(original float64) { tmpSpaceFactor = original }(tmpSpaceFactor)
+
+	tmpSpaceFactor = 2
+	if err := checkTmpSpace(os.TempDir(), func() int64 { return 1 }); err != nil {
+		t.Fatalf("the small cache doesn't fit: %s", err)
+	}
+
+	err := checkTmpSpace(os.TempDir(), func() int64 { return math.MaxInt64 / 4 })
+	if err == nil || !strings.Contains(err.Error(), "--tmp-dir") {
+		t.Fatalf("the too large cache fits: %v", err)
+	}
+
+	tmpSpaceFactor = 0
+	err = checkTmpSpace(os.TempDir(), func() int64 {
+		t.Fatal("the size is estimated without checking")
+		return 0
+	})
+	if err != nil {
+		t.Fatalf("the check isn't disabled: %s", err)
+	}
+}
+
+func TestPathStatsSize(t *testing.T) {
+	meta := &metadata{
+		Paths:     []string{"foo", "bar"},
+		PathStats: []pathStats{{Path: "foo", Size: 10, Files: 1}, {Path: "bar", Size: 20, Files: 2}},
+	}
+	if size, ok := pathStatsSize(meta); !ok || size != 30 {
+		t.Fatalf("the size is wrong: %d, %v", size, ok)
+	}
+
+	if _, ok := pathStatsSize(&metadata{Paths: []string{"foo"}}); ok {
+		t.Fatal("the size of the cache without stats is known")
+	}
+}
+
+func TestArchiveSize(t *testing.T) {
+	fake, teardown := setupFakeS3(t)
+	defer teardown()
+
+	get := func(key string) *s3.GetObjectOutput {
+		item, err := getExactlyMatchedItem(key)
+		if err != nil {
+			t.Fatalf("failed to get the cache: %s", err)
+		}
+		item.Body.Close()
+		return item
+	}
+
+	parts := prefixedKey("parts")
+	fake.put(objectKey(parts), nil, map[string]string{partsMetadataKey: "2", generationMetadataKey: "0123456789abcdef"})
+	fake.put(partKey(parts, "0123456789abcdef", 1), []byte("12345"), nil)
+	fake.put(partKey(parts, "0123456789abcdef", 2), []byte("678"), nil)
+	if size, err := archiveSize(parts, get(parts)); err != nil || size != 8 {
+		t.Fatalf("the size of the parts is wrong: %d: %v", size, err)
+	}
+
+	// chunks shared in the cache are downloaded once
+	chunks := prefixedKey("chunks")
+	fake.put(objectKey(chunks), []byte("aaa\nbbb\naaa\n"), map[string]string{chunksMetadataKey: "3"})
+	fake.put(chunkKey("aaa"), []byte("1234"), nil)
+	fake.put(chunkKey("bbb"), []byte("56"), nil)
+	if size, err := archiveSize(chunks, get(chunks)); err != nil || size != 6 {
+		t.Fatalf("the size of the chunks is wrong: %d: %v", size, err)
+	}
+
+	plain := prefixedKey("plain")
+	fake.put(objectKey(plain), []byte("archive"), nil)
+	if size := cacheSize(plain, get(plain)); size != 7*compressionRatio {
+		t.Fatalf("the size of the cache without stats is wrong: %d", size)
+	}
+}
+
+func TestCheckSpoolSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if _, ok := freeSpace(dir); !ok {
+		t.Skip("free space is unknown")
+	}
+
+	file, err := os.Create(filepath.Join(dir, "stdin"))
+	if err != nil {
+		t.Fatalf("failed to create a file: %s", err)
+	}
+	defer file.Close()
+	if err := checkSpoolSpace(dir, file); err != nil {
+		t.Fatalf("the small stdin doesn't fit: %s", err)
+	}
+
+	// sparse files larger than the file system
+	if err := file.Truncate(1 << 43); err != nil {
+		t.Skipf("failed to create a large file: %s", err)
+	}
+	if err := checkSpoolSpace(dir, file); err == nil || !strings.Contains(err.Error(), "--tmp-dir") {
+		t.Fatalf("the too large stdin fits: %v", err)
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	setupFixturesToCache(t)
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// read-only directories like ones of Go modules
+	if err := os.Chmod("tmp/foo/bar", 0555); err != nil {
+		t.Fatalf("failed to change the mode: %s", err)
+	}
+	defer os.Chmod("tmp/foo/bar", 0755)
+
+	to := filepath.Join(dir, "foo")
+	if err := copyTree("tmp/foo", to); err != nil {
+		t.Fatalf("failed to copy: %s", err)
+	}
+	defer os.Chmod(filepath.Join(to, "bar"), 0755)
+
+	content, err := ioutil.ReadFile(filepath.Join(to, "hoge.txt"))
+	if err != nil || string(content) != "This is foo!" {
+		t.Fatalf("the file isn't copied: %s: %v", content, err)
+	}
+	if link, err := os.Readlink(filepath.Join(to, "bar/baz/link")); err != nil || link != "../../hoge.txt" {
+		t.Fatalf("the symlink isn't copied: %s: %v", link, err)
+	}
+	if runtime.GOOS != "windows" {
+		if info, err := os.Stat(filepath.Join(to, "bar")); err != nil || info.Mode().Perm() != 0555 {
+			t.Fatalf("the mode of the directory isn't copied: %v", err)
+		}
+	}
+}
+
+func TestCopyTreeWithHardLinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hard links aren't detected on Windows")
+	}
+	setupFixturesToCache(t)
+
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Link("tmp/foo/hoge.txt", "tmp/foo/bar/hard.txt"); err != nil {
+		t.Fatalf("failed to create a hard link: %s", err)
+	}
+
+	to := filepath.Join(dir, "foo")
+	if err := copyTree("tmp/foo", to); err != nil {
+		t.Fatalf("failed to copy: %s", err)
+	}
+
+	original, err := os.Stat(filepath.Join(to, "hoge.txt"))
+	if err != nil {
+		t.Fatalf("the file isn't copied: %s", err)
+	}
+	link, err := os.Stat(filepath.Join(to, "bar/hard.txt"))
+	if err != nil || !os.SameFile(original, link) {
+		t.Fatalf("the hard link isn't kept: %v", err)
+	}
+}
+
+func TestMovePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	from := filepath.Join(dir, "extracted")
+	to := filepath.Join(dir, "current")
+	for _, path := range []string{filepath.Join(from, "new.txt"), filepath.Join(to, "old.txt")} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create a directory: %s", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatalf("failed to write a file: %s", err)
+		}
+	}
+
+	if err := movePath(from, to); err != nil {
+		t.Fatalf("failed to move: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(to, "new.txt")); err != nil {
+		t.Fatalf("the path isn't moved: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(to, "old.txt")); !os.IsNotExist(err) {
+		t.Fatalf("the current path isn't replaced: %v", err)
+	}
+	// nothing is left next to the path
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("temporal files are left: %v: %v", entries, err)
+	}
+}
@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/spf13/cobra"
+	"github.com/yuya-takeyama/guruguru-cache/template"
+)
+
+// archiveEntryPattern matches entries of archives under the directories of paths like 0000/
+var archiveEntryPattern = regexp.MustCompile(`^(\d{4})(/|$)`)
+
+// cleanEntryName normalizes the name of an entry or a hard link target, where backslashes are separators as on Windows
+func cleanEntryName(name string) string {
+	return path.Clean(strings.Replace(name, `\`, "/", -1))
+}
+
+// isAbsName reports whether the cleaned name is absolute, including ones with drive letters like C:
+func isAbsName(cleaned string) bool {
+	return path.IsAbs(cleaned) || (len(cleaned) >= 2 && cleaned[1] == ':')
+}
+
+// nameEscapes reports whether the name of an entry or a hard link target is absolute or out of the archive by ..
+func nameEscapes(name string) bool {
+	cleaned := cleanEntryName(name)
+
+	return isAbsName(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../")
+}
+
+// symlinkEscapes reports whether the target of the symlink is absolute or out of the directory of its path like 0000/
+func symlinkEscapes(hdr *tar.Header) bool {
+	link := cleanEntryName(hdr.Linkname)
+	if isAbsName(link) {
+		return true
+	}
+
+	name := cleanEntryName(hdr.Name)
+	m := archiveEntryPattern.FindStringSubmatch(name)
+	if m == nil {
+		return true
+	}
+	target := path.Join(path.Dir(name), link)
+
+	return target != m[1] && !strings.HasPrefix(target, m[1]+"/")
+}
+
+// pathEscapes reports whether the path in metadata.json of an uploaded archive is out of the working directory,
+// as restore removes the paths before moving extracted ones to them
+func pathEscapes(p string) bool {
+	return p == "" || filepath.IsAbs(p) || nameEscapes(p) || cleanEntryName(p) == "."
+}
+
+func init() {
+	uploadCmd := &cobra.Command{
+		Use:   "upload [flags] [cache key] [archive]",
+		Short: "Upload an archive built by other tools as a cache with a key",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupTemplate(); err != nil {
+				log.Fatal(err)
+			}
+			if err := validateUploadOptions(); err != nil {
+				log.Fatal(err)
+			}
+
+			cacheKey, err := template.ExecuteTemplate(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+			cacheKey = prefixedKey(cacheKey)
+
+			file, err := os.Open(args[1])
+			if err != nil {
+				log.Fatalf("failed to open archive: %s", err)
+			}
+			defer file.Close()
+
+			paths, err := validateArchive(file)
+			if err != nil {
+				log.Fatalf("invalid archive: %s: %s", args[1], err)
+			}
+			log.Printf("Archive of %d paths is valid: %s\n", len(paths), strings.Join(paths, ", "))
+
+			exists, err := cacheExists(cacheKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if exists {
+				log.Printf("cache already exists: %s\n", cacheKey)
+				return
+			}
+
+			if _, err := file.Seek(0, 0); err != nil {
+				log.Fatalf("failed to read archive: %s", err)
+			}
+			if err := uploadArchive(cacheKey, file); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	uploadCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket to upload")
+	uploadCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(uploadCmd)
+	addTemplateFlags(uploadCmd)
+	uploadCmd.Flags().StringVarP(&uploadPartSize, "upload-part-size", "", "5MB", "Size of each part of multipart uploads")
+	uploadCmd.Flags().IntVarP(&uploadConcurrency, "upload-concurrency", "", s3manager.DefaultUploadConcurrency, "Number of parts uploaded concurrently")
+	uploadCmd.Flags().StringVarP(&sse, "sse", "", "", "Server-side encryption algorithm (AES256 or aws:kms)")
+	uploadCmd.Flags().StringVarP(&sseKMSKeyID, "sse-kms-key-id", "", "", "KMS key ID for server-side encryption with aws:kms")
+	uploadCmd.Flags().StringArrayVarP(&tags, "tag", "", nil, "S3 object tag of the cache as key=value (can be repeated)")
+	uploadCmd.Flags().StringVarP(&storageClass, "storage-class", "", "", "S3 storage class ("+strings.Join(storageClasses, ", ")+")")
+	uploadCmd.Flags().StringVarP(&ageIdentityFile, "age-identity-file", "", "", "age identity file to validate encrypted archives")
+	uploadCmd.Flags().StringVarP(&passphraseFile, "passphrase-file", "", "", "Validate encrypted archives with the passphrase in the file")
+
+	rootCmd.AddCommand(uploadCmd)
+}
+
+// validateArchive checks that the archive is laid out like ones of store, returning the paths in its metadata.json.
+// Entries must be under the directories of the paths like 0000/, and links and paths must not point out of them.
+func validateArchive(r io.Reader) ([]string, error) {
+	tr, err := openTarReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var meta *metadata
+	maxIndex := -1
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar entry: %s", err)
+		}
+
+		// archives created like `tar czf cache.tar.gz -C dir .` have entries of ./
+		name := strings.TrimPrefix(hdr.Name, "./")
+		if name == "" || name == "." {
+			continue
+		}
+
+		if name == "metadata.json" {
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read metadata.json: %s", err)
+			}
+
+			meta = new(metadata)
+			if err := json.Unmarshal(content, meta); err != nil {
+				return nil, fmt.Errorf("invalid metadata.json: %s", err)
+			}
+			continue
+		}
+		if name == manifestName {
+			if _, err := readManifest(tr); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if nameEscapes(name) {
+			return nil, fmt.Errorf("entry is out of the archive: %s", hdr.Name)
+		}
+		switch {
+		case hdr.Typeflag == tar.TypeLink && nameEscapes(hdr.Linkname):
+			return nil, fmt.Errorf("hard link is to a file out of the archive: %s: %s", hdr.Name, hdr.Linkname)
+		case hdr.Typeflag == tar.TypeSymlink && symlinkEscapes(hdr):
+			return nil, fmt.Errorf("symlink is to a file out of its path: %s: %s", hdr.Name, hdr.Linkname)
+		}
+
+		m := archiveEntryPattern.FindStringSubmatch(cleanEntryName(name))
+		if m == nil {
+			return nil, fmt.Errorf("entry is not under the directory of a path like 0000/: %s", hdr.Name)
+		}
+		if i, _ := strconv.Atoi(m[1]); i > maxIndex {
+			maxIndex = i
+		}
+
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", hdr.Name, err)
+		}
+	}
+
+	if meta == nil {
+		return nil, fmt.Errorf("metadata.json is missing")
+	}
+	if len(meta.Paths) < 1 {
+		return nil, fmt.Errorf("no paths are in metadata.json")
+	}
+	for _, p := range meta.Paths {
+		if pathEscapes(p) {
+			return nil, fmt.Errorf("path in metadata.json is out of the working directory: %q", p)
+		}
+	}
+	if maxIndex >= len(meta.Paths) {
+		return nil, fmt.Errorf("entries of %04d/ have no path in metadata.json", maxIndex)
+	}
+
+	return meta.Paths, nil
+}
+
+// uploadArchive uploads the archive as the cache with its checksum like store does
+func uploadArchive(cacheKey string, r io.Reader) error {
+	generation, err := newGeneration()
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.New()
+	return uploadStaged(objectKey(cacheKey), io.TeeReader(r, sum), withGeneration(nil, generation), func() error {
+		return uploadToS3(checksumKey(cacheKey), strings.NewReader(fmt.Sprintf("%x", sum.Sum(nil))), withGeneration(nil, generation))
+	})
+}
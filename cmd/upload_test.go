@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"testing"
+)
+
+func TestValidateArchive(t *testing.T) {
+	setupFixturesToCache(t)
+
+	buf := new(bytes.Buffer)
+	if _, err := writeArchive(buf, []string{"tmp/foo", "tmp/abc/def"}); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	paths, err := validateArchive(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to validate the archive: %s", err)
+	}
+	if !reflect.DeepEqual(paths, []string{"tmp/foo", "tmp/abc/def"}) {
+		t.Fatalf("paths are wrong: %v", paths)
+	}
+
+	archive := newTestArchive(t, map[string]string{"./": "", "./metadata.json": `{"paths":["tmp/foo"]}`, "./0000/foo.txt": "foo"})
+	if _, err := validateArchive(bytes.NewReader(archive)); err != nil {
+		t.Fatalf("failed to validate the archive with entries of ./: %s", err)
+	}
+
+	for name, entries := range map[string]map[string]string{
+		"without metadata.json": {"0000/foo.txt": "foo"},
+		"outside of paths":      {"metadata.json": `{"paths":["tmp/foo"]}`, "foo.txt": "foo"},
+		"with too few paths":    {"metadata.json": `{"paths":["tmp/foo"]}`, "0001/foo.txt": "foo"},
+		"with no paths":         {"metadata.json": `{"paths":[]}`},
+		"out of the archive":    {"metadata.json": `{"paths":["tmp/foo"]}`, "0000/../../etc/foo.txt": "foo"},
+		"with an absolute name": {"metadata.json": `{"paths":["tmp/foo"]}`, "/0000/foo.txt": "foo"},
+		"with an absolute path": {"metadata.json": `{"paths":["/etc"]}`, "0000/foo.txt": "foo"},
+		"with a path out of .":  {"metadata.json": `{"paths":["../foo"]}`, "0000/foo.txt": "foo"},
+		"with the path .":       {"metadata.json": `{"paths":["."]}`, "0000/foo.txt": "foo"},
+	} {
+		if _, err := validateArchive(bytes.NewReader(newTestArchive(t, entries))); err == nil {
+			t.Fatalf("archive %s is valid", name)
+		}
+	}
+}
+
+func TestValidateArchiveWithLinks(t *testing.T) {
+	for name, c := range map[string]struct {
+		typeflag byte
+		linkname string
+		valid    bool
+	}{
+		"symlink in the path":           {tar.TypeSymlink, "../bar.txt", true},
+		"symlink out of the path":       {tar.TypeSymlink, "../../../etc/passwd", false},
+		"symlink to an absolute path":   {tar.TypeSymlink, "/etc/passwd", false},
+		"hard link in the archive":      {tar.TypeLink, "0000/bar.txt", true},
+		"hard link out of the archive":  {tar.TypeLink, "../etc/passwd", false},
+		"hard link to an absolute path": {tar.TypeLink, "/etc/passwd", false},
+	} {
+		archive := newTestArchiveOf(t, []*tar.Header{
+			{Name: "metadata.json", Mode: 0644, Size: int64(len(`{"paths":["tmp/foo"]}`))},
+			{Name: "0000/foo/link", Mode: 0777, Typeflag: c.typeflag, Linkname: c.linkname},
+		}, map[string]string{"metadata.json": `{"paths":["tmp/foo"]}`})
+		if _, err := validateArchive(bytes.NewReader(archive)); (err == nil) != c.valid {
+			t.Fatalf("validation of the archive with %s is wrong: %v", name, err)
+		}
+	}
+}
+
+func TestCheckExtractedEntry(t *testing.T) {
+	symlinks := map[string]bool{"0000/foo/link": true}
+	for _, hdr := range []*tar.Header{
+		{Name: "0000/../../etc/passwd", Typeflag: tar.TypeReg},
+		{Name: "/etc/passwd", Typeflag: tar.TypeReg},
+		{Name: "0000/foo/link", Typeflag: tar.TypeReg},
+		{Name: "0000/foo/link/passwd", Typeflag: tar.TypeReg},
+		{Name: "0000/foo/hard", Typeflag: tar.TypeLink, Linkname: "0000/foo/link/passwd"},
+		{Name: "0000/foo/hard", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"},
+	} {
+		if err := checkExtractedEntry(hdr, symlinks); err == nil {
+			t.Fatalf("entry out of the directory is extracted: %s: %s", hdr.Name, hdr.Linkname)
+		}
+	}
+
+	for _, hdr := range []*tar.Header{
+		{Name: "0000/foo/bar.txt", Typeflag: tar.TypeReg},
+		{Name: "0000/foo/abs", Typeflag: tar.TypeSymlink, Linkname: "/usr/bin/ruby"},
+		{Name: "0000/foo/hard", Typeflag: tar.TypeLink, Linkname: "0000/foo/bar.txt"},
+	} {
+		if err := checkExtractedEntry(hdr, symlinks); err != nil {
+			t.Fatalf("entry is not extracted: %s", err)
+		}
+	}
+}
+
+// newTestArchiveOf writes the gzipped tar of the headers with the contents of regular files by their names
+func newTestArchiveOf(t *testing.T, hdrs []*tar.Header, contents map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for _, hdr := range hdrs {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("failed to write tar header: %s", err)
+		}
+		if _, err := tw.Write([]byte(contents[hdr.Name])); err != nil {
+			t.Fatalf("failed to write tar entry: %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("failed to close gzip: %s", err)
+	}
+
+	return buf.Bytes()
+}
+
+func newTestArchive(t *testing.T, entries map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatalf("failed to write tar header: %s", err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("failed to write tar entry: %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("failed to close gzip: %s", err)
+	}
+
+	return buf.Bytes()
+}
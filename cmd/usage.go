@@ -0,0 +1,262 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/spf13/cobra"
+)
+
+// untaggedGroup is the group of caches without the tag grouped by
+const untaggedGroup = "(untagged)"
+
+// othersGroup is the group of caches out of --top
+const othersGroup = "(others)"
+
+// chunksGroup is the group of chunks of chunked caches, which are shared by caches of any groups
+const chunksGroup = "(chunks)"
+
+var usageGroupBy string
+var usageTagKey string
+var usageTop int
+var usageFormat string
+
+// usageGroup is the storage a group of caches consumes, where Share is the ratio to the total size of caches
+type usageGroup struct {
+	Name         string    `json:"group"`
+	Caches       int       `json:"caches"`
+	Size         int64     `json:"size"`
+	Share        float64   `json:"share"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+func init() {
+	usageCmd := &cobra.Command{
+		Use:   "usage [flags] [prefix]",
+		Short: "Report which groups of caches consume the most storage",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+
+			var groupOf func(c *cacheEntry) (string, error)
+			switch usageGroupBy {
+			case "prefix":
+				if statsDepth < 1 {
+					log.Fatalf("depth of prefixes must be positive: %d", statsDepth)
+				}
+				groupOf = func(c *cacheEntry) (string, error) {
+					return keyGroup(c.Key, statsDelimiter, statsDepth), nil
+				}
+			case "tag":
+				if usageTagKey == "" {
+					log.Fatal("--group-by tag requires --tag-key")
+				}
+				groupOf = func(c *cacheEntry) (string, error) {
+					return cacheTagValue(c, usageTagKey)
+				}
+			default:
+				log.Fatalf("unsupported group: %s (must be prefix or tag)", usageGroupBy)
+			}
+			if usageTop < 0 {
+				log.Fatalf("top must not be negative: %d", usageTop)
+			}
+
+			prefix := ""
+			if len(args) > 0 {
+				prefix = args[0]
+			}
+
+			caches, err := listCaches(prefix)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			chunks, err := usageOfChunks(prefix, caches)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			groups, err := computeUsage(caches, groupOf, usageTop, chunks)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			switch usageFormat {
+			case "table":
+				err = printUsage(os.Stdout, groups)
+			case "csv":
+				err = printUsageCSV(os.Stdout, groups)
+			case "json":
+				err = printUsageJSON(os.Stdout, groups)
+			default:
+				err = fmt.Errorf("unsupported format: %s (must be table, csv or json)", usageFormat)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	usageCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of caches")
+	usageCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(usageCmd)
+	usageCmd.Flags().StringVarP(&usageGroupBy, "group-by", "", "prefix", "Group caches by prefix of their keys or tag")
+	usageCmd.Flags().StringVarP(&usageTagKey, "tag-key", "", "", "Key of the tag to group caches by with --group-by tag")
+	usageCmd.Flags().StringVarP(&statsDelimiter, "delimiter", "", "-", "Delimiter of cache keys to group them by prefixes")
+	usageCmd.Flags().IntVarP(&statsDepth, "depth", "", 1, "Number of segments separated by the delimiter in prefixes to group caches by")
+	usageCmd.Flags().IntVarP(&usageTop, "top", "", 20, "Number of the largest groups to report, the rest summed up as (others) (0 means all)")
+	usageCmd.Flags().StringVarP(&usageFormat, "format", "", "table", "Format of the report (table, csv or json)")
+
+	rootCmd.AddCommand(usageCmd)
+}
+
+// usageOfChunks returns the group of the chunks the caches under the prefix refer to, or all the chunks without the prefix
+// including ones no cache refers to yet. It's nil without chunks.
+func usageOfChunks(prefix string, caches []*cacheEntry) (*usageGroup, error) {
+	chunks, err := listCacheRefs()
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks.chunks) == 0 {
+		return nil, nil
+	}
+
+	g := &usageGroup{Name: chunksGroup, Size: chunks.totalSize()}
+	for _, object := range chunks.chunks {
+		if t := aws.TimeValue(object.LastModified); t.After(g.LastModified) {
+			g.LastModified = t
+		}
+	}
+	if prefix != "" {
+		if err := chunks.readRefs(caches, false); err != nil {
+			return nil, err
+		}
+		g.Size = chunks.size(caches)
+	}
+
+	return g, nil
+}
+
+// computeUsage sums up the caches by their groups sorted by sizes, keeping the top ones.
+// The group of chunks is reported last when it's given, as its chunks are shared by the other groups.
+func computeUsage(caches []*cacheEntry, groupOf func(c *cacheEntry) (string, error), top int, chunks *usageGroup) ([]usageGroup, error) {
+	var total int64
+	groups := make(map[string]*usageGroup)
+	for _, c := range caches {
+		name, err := groupOf(c)
+		if err != nil {
+			return nil, err
+		}
+
+		g, ok := groups[name]
+		if !ok {
+			g = &usageGroup{Name: name}
+			groups[name] = g
+		}
+		g.Caches++
+		g.Size += c.Size
+		if c.LastModified.After(g.LastModified) {
+			g.LastModified = c.LastModified
+		}
+		total += c.Size
+	}
+
+	sorted := []usageGroup{}
+	for _, g := range groups {
+		sorted = append(sorted, *g)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Size > sorted[j].Size ||
+			(sorted[i].Size == sorted[j].Size && sorted[i].Name < sorted[j].Name)
+	})
+
+	if top > 0 && len(sorted) > top {
+		others := usageGroup{Name: othersGroup}
+		for _, g := range sorted[top:] {
+			others.Caches += g.Caches
+			others.Size += g.Size
+			if g.LastModified.After(others.LastModified) {
+				others.LastModified = g.LastModified
+			}
+		}
+		sorted = append(sorted[:top], others)
+	}
+
+	if chunks != nil {
+		sorted = append(sorted, *chunks)
+		total += chunks.Size
+	}
+
+	for i := range sorted {
+		if total > 0 {
+			sorted[i].Share = float64(sorted[i].Size) / float64(total)
+		}
+	}
+
+	return sorted, nil
+}
+
+// cacheTagValue returns the value of the tag of the cache, or (untagged) without the tag
+func cacheTagValue(c *cacheEntry, key string) (string, error) {
+	tags, err := getCacheTags(prefixedKey(c.Key))
+	if err != nil {
+		return "", err
+	}
+
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value), nil
+		}
+	}
+
+	return untaggedGroup, nil
+}
+
+func printUsage(w io.Writer, groups []usageGroup) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "GROUP\tCACHES\tSIZE\tSHARE\tLAST MODIFIED")
+	for _, g := range groups {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%.1f%%\t%s\n", g.Name, g.Caches, formatSize(g.Size), g.Share*100, g.LastModified.Format(time.RFC3339))
+	}
+
+	return tw.Flush()
+}
+
+// printUsageCSV prints sizes in bytes to be processed by other tools
+func printUsageCSV(w io.Writer, groups []usageGroup) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"group", "caches", "size", "share", "last_modified"})
+	for _, g := range groups {
+		cw.Write([]string{
+			g.Name,
+			strconv.Itoa(g.Caches),
+			strconv.FormatInt(g.Size, 10),
+			strconv.FormatFloat(g.Share, 'f', 4, 64),
+			g.LastModified.Format(time.RFC3339),
+		})
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+func printUsageJSON(w io.Writer, groups []usageGroup) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(groups); err != nil {
+		return fmt.Errorf("failed to encode usage as JSON: %s", err)
+	}
+
+	return nil
+}
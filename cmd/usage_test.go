@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestComputeUsage(t *testing.T) {
+	now := time.Date(2019, 3, 15, 0, 0, 0, 0, time.UTC)
+	caches := []*cacheEntry{
+		{Key: "gem-v1-a", Size: 300, LastModified: now.Add(-time.Hour)},
+		{Key: "gem-v1-b", Size: 100, LastModified: now},
+		{Key: "node-v1-a", Size: 400, LastModified: now},
+		{Key: "go-v1-a", Size: 150, LastModified: now},
+		{Key: "docker-a", Size: 50, LastModified: now.Add(-time.Hour)},
+	}
+	groupOf := func(c *cacheEntry) (string, error) {
+		return keyGroup(c.Key, "-", 1), nil
+	}
+
+	groups, err := computeUsage(caches, groupOf, 2, nil)
+	if err != nil {
+		t.Fatalf("failed to compute usage: %s", err)
+	}
+
+	expected := []usageGroup{
+		{Name: "gem-", Caches: 2, Size: 400, Share: 0.4, LastModified: now},
+		{Name: "node-", Caches: 1, Size: 400, Share: 0.4, LastModified: now},
+		{Name: othersGroup, Caches: 2, Size: 200, Share: 0.2, LastModified: now},
+	}
+	if len(groups) != len(expected) {
+		t.Fatalf("the number of groups is wrong: %+v", groups)
+	}
+	for i, g := range groups {
+		if g != expected[i] {
+			t.Fatalf("group %d is wrong: %+v", i, g)
+		}
+	}
+
+	if all, _ := computeUsage(caches, groupOf, 0, nil); len(all) != 4 {
+		t.Fatalf("all groups aren't reported: %+v", all)
+	}
+	if none, _ := computeUsage(nil, groupOf, 20, nil); none == nil || len(none) != 0 {
+		t.Fatalf("groups of no caches are wrong: %+v", none)
+	}
+
+	chunks := &usageGroup{Name: chunksGroup, Size: 1000, LastModified: now}
+	withChunks, err := computeUsage(caches, groupOf, 2, chunks)
+	if err != nil {
+		t.Fatalf("failed to compute usage: %s", err)
+	}
+	if len(withChunks) != 4 || withChunks[3].Name != chunksGroup || withChunks[3].Share != 0.5 || withChunks[0].Share != 0.2 {
+		t.Fatalf("the chunks aren't reported last: %+v", withChunks)
+	}
+}
+
+func TestPrintUsageCSV(t *testing.T) {
+	groups := []usageGroup{
+		{Name: "gem-", Caches: 2, Size: 1536, Share: 0.75, LastModified: time.Date(2019, 3, 15, 0, 0, 0, 0, time.UTC)},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := printUsageCSV(buf, groups); err != nil {
+		t.Fatalf("failed to print usage: %s", err)
+	}
+
+	expected := "group,caches,size,share,last_modified\ngem-,2,1536,0.7500,2019-03-15T00:00:00Z\n"
+	if buf.String() != expected {
+		t.Fatalf("CSV of usage is wrong: %s", buf.String())
+	}
+}
@@ -0,0 +1,243 @@
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+	"github.com/yuya-takeyama/guruguru-cache/template"
+)
+
+// checksumKey is the key of the SHA-256 checksum of the archive stream before being split into parts or chunks
+func checksumKey(cacheKey string) string {
+	return cacheKey + ".sha256"
+}
+
+func init() {
+	verifyCmd := &cobra.Command{
+		Use:   "verify [flags] [cache key]",
+		Short: "Download a cache and verify its checksum and archive",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupTemplate(); err != nil {
+				log.Fatal(err)
+			}
+
+			cacheKey, err := template.ExecuteTemplate(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if err := verifyCache(prefixedKey(cacheKey)); err != nil {
+				log.Fatal(err)
+			}
+
+			log.Printf("cache is valid: %s\n", cacheKey)
+		},
+	}
+
+	verifyCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket of the cache")
+	verifyCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(verifyCmd)
+	addTemplateFlags(verifyCmd)
+	verifyCmd.Flags().StringVarP(&ageIdentityFile, "age-identity-file", "", "", "age identity file to decrypt encrypted caches")
+	verifyCmd.Flags().StringVarP(&passphraseFile, "passphrase-file", "", "", "Decrypt encrypted caches with the passphrase in the file")
+	addTmpDirFlag(verifyCmd)
+
+	rootCmd.AddCommand(verifyCmd)
+}
+
+// verifyCache verifies the cache, or each of its per-path archives
+func verifyCache(cacheKey string) error {
+	item, err := getExactlyMatchedItem(cacheKey)
+	if err != nil {
+		return fmt.Errorf("failed to get cache: %s: %s", cacheKey, err)
+	}
+
+	if !isPathArchivesManifest(item) {
+		return verifyArchive(cacheKey, item)
+	}
+
+	meta, err := readPathArchivesManifest(item.Body)
+	item.Body.Close()
+	if err != nil {
+		return fmt.Errorf("storage: %s", err)
+	}
+
+	for i, path := range meta.Paths {
+		log.Printf("verifying the archive of %s\n", path)
+
+		key := pathArchiveKey(cacheKey, objectGeneration(item.Metadata), i)
+		item, err := getExactlyMatchedItem(key)
+		if err != nil {
+			return fmt.Errorf("storage: failed to get the archive of %s: %s", path, err)
+		}
+		if err := verifyArchive(key, item); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyArchive downloads the archive while checking its checksum, then reads all of its entries.
+// Errors are prefixed with "storage" for objects broken or missing in S3 and "archive" for ones failing to extract.
+func verifyArchive(cacheKey string, item *s3.GetObjectOutput) error {
+	file, err := ioutil.TempFile(tmpDir, "guruguru-cache-verify-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporal file: %s", err)
+	}
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	body, err := newArchiveReader(item, objectKey(cacheKey))
+	if err != nil {
+		return fmt.Errorf("storage: %s", err)
+	}
+
+	defer body.Close()
+
+	// the checksum of a chunked cache is of the stream before chunks are compressed
+	var stream io.Reader = body
+	if _, ok := item.Metadata[chunksMetadataKey]; ok {
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			return fmt.Errorf("storage: failed to decompress chunks: %s", err)
+		}
+		stream = gr
+	}
+
+	sum := sha256.New()
+	size, err := io.Copy(file, io.TeeReader(stream, sum))
+	if err != nil {
+		return fmt.Errorf("storage: failed to download archive: %s", err)
+	}
+
+	expected, err := storedChecksum(cacheKey, objectGeneration(item.Metadata))
+	if err != nil {
+		return err
+	}
+	actual := fmt.Sprintf("%x", sum.Sum(nil))
+	switch {
+	case expected == "":
+		log.Printf("storage: no checksum is stored, downloaded %s\n", formatSize(size))
+	case expected != actual:
+		return fmt.Errorf("storage: checksum mismatch: expected %s, but got %s", expected, actual)
+	default:
+		log.Printf("storage: checksum matches, downloaded %s\n", formatSize(size))
+	}
+
+	if _, err := file.Seek(0, 0); err != nil {
+		return fmt.Errorf("failed to seek temporal file: %s", err)
+	}
+
+	entries, err := readArchiveEntries(file)
+	if err != nil {
+		return fmt.Errorf("archive: %s", err)
+	}
+	log.Printf("archive: read %d entries\n", entries)
+
+	return nil
+}
+
+// storedChecksum returns the checksum stored with the generation of the cache, or empty for caches stored without it
+// and while the checksum of another generation is uploaded
+func storedChecksum(cacheKey string, generation string) (string, error) {
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: &s3Bucket,
+		Key:    aws.String(checksumKey(cacheKey)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("storage: failed to get checksum: %s", err)
+	}
+
+	defer output.Body.Close()
+
+	if objectGeneration(output.Metadata) != generation {
+		return "", nil
+	}
+
+	content, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return "", fmt.Errorf("storage: failed to read checksum: %s", err)
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// readArchiveEntries reads all the entries of the archive and returns the number of them.
+// The files are compared with manifest.json, which caches stored by older versions don't have.
+func readArchiveEntries(r io.Reader) (int, error) {
+	tr, err := openTarReader(r)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	hasMetadata := false
+	files := make(map[string]manifestFile)
+	var manifest *fileManifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, fmt.Errorf("failed to read tar entry after %d entries: %s", n, err)
+		}
+
+		switch {
+		case isManifestEntry(hdr):
+			if manifest, err = readManifest(tr); err != nil {
+				return n, err
+			}
+		case hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA:
+			sum, size, err := entrySum(tr, hdr)
+			if err != nil {
+				return n, fmt.Errorf("failed to read %s: %s", hdr.Name, err)
+			}
+			files[hdr.Name] = manifestFile{Name: hdr.Name, Size: size, Mode: hdr.Mode, SHA256: sum}
+		case hdr.Typeflag == tar.TypeLink:
+			if target, ok := files[hdr.Linkname]; ok {
+				target.Name, target.Mode = hdr.Name, hdr.Mode
+				files[hdr.Name] = target
+			}
+		}
+
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return n, fmt.Errorf("failed to read %s: %s", hdr.Name, err)
+		}
+		if hdr.Name == "metadata.json" {
+			hasMetadata = true
+		}
+		n++
+	}
+
+	if !hasMetadata {
+		return n, fmt.Errorf("metadata.json is missing")
+	}
+	if manifest != nil {
+		if corrupted := corruptedFiles(manifest, files, true); len(corrupted) > 0 {
+			return n, corruptedFilesError(corrupted)
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadArchiveEntries(t *testing.T) {
+	setupFixturesToCache(t)
+
+	buf := new(bytes.Buffer)
+	index, err := writeArchive(buf, []string{"tmp/foo", "tmp/abc/def"})
+	if err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	n, err := readArchiveEntries(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read the archive: %s", err)
+	}
+	if n != len(index.Entries) {
+		t.Fatalf("the number of the entries is wrong: %d", n)
+	}
+
+	truncated := buf.Bytes()[:buf.Len()/2]
+	if _, err := readArchiveEntries(bytes.NewReader(truncated)); err == nil {
+		t.Fatal("truncated archive is read without errors")
+	}
+}
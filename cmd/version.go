@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	versionCmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print the version of guruguru-cache",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Print(versionInfo())
+		},
+	}
+
+	rootCmd.AddCommand(versionCmd)
+}
+
+// versionInfo returns the version, the commit and the build date of guruguru-cache
+func versionInfo() string {
+	return fmt.Sprintf("guruguru-cache %s\ncommit: %s\nbuilt:  %s\ngo:     %s %s/%s\n",
+		Version, orUnknown(Commit), orUnknown(BuildDate), runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+
+	return s
+}
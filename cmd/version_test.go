@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVersionInfo(t *testing.T) {
+	defer func() { Version, Commit, BuildDate = "dev", "", "" }()
+
+	Version, Commit, BuildDate = "v0.5.0", "0a1b2c3", "2019-01-02T03:04:05Z"
+	info := versionInfo()
+	if !strings.HasPrefix(info, "guruguru-cache v0.5.0\ncommit: 0a1b2c3\nbuilt:  2019-01-02T03:04:05Z\ngo:     ") {
+		t.Fatalf("version info is wrong: %s", info)
+	}
+
+	Version, Commit, BuildDate = "dev", "", ""
+	info = versionInfo()
+	if !strings.HasPrefix(info, "guruguru-cache dev\ncommit: unknown\nbuilt:  unknown\n") {
+		t.Fatalf("version info without build metadata is wrong: %s", info)
+	}
+}
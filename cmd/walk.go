@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var dereference bool
+
+// walkArchivedFiles walks the files under root which are stored, skipping ones excluded by --exclude and .cacheignore
+func walkArchivedFiles(root string, fn filepath.WalkFunc) error {
+	ignore, err := loadCacheIgnore(root)
+	if err != nil {
+		return err
+	}
+
+	return walkFiles(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fn(path, info, err)
+		}
+		if isExcluded(root, path) || ignore.ignored(path, info.IsDir()) {
+			return skipEntry(info)
+		}
+
+		return fn(path, info, nil)
+	})
+}
+
+// walkFiles walks the files under root like filepath.Walk, following symlinks like tar -h with --dereference.
+// Dangling symlinks are walked as they are, and symlinks to their ancestor directories are skipped.
+func walkFiles(root string, fn filepath.WalkFunc) error {
+	if !dereference {
+		return filepath.Walk(root, fn)
+	}
+
+	info, err := statFollowingLink(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+
+	err = walkDereferenced(root, info, nil, fn)
+	if err == filepath.SkipDir {
+		return nil
+	}
+
+	return err
+}
+
+func walkDereferenced(path string, info os.FileInfo, ancestors []string, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fn(path, info, err)
+	}
+	for _, ancestor := range ancestors {
+		if ancestor == realPath {
+			log.Printf("skipping symlink to the ancestor directory: %s\n", path)
+			return nil
+		}
+	}
+
+	if err := fn(path, info, nil); err != nil {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return fn(path, info, err)
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return fn(path, info, err)
+	}
+	sort.Strings(names)
+
+	ancestors = append(ancestors, realPath)
+	for _, name := range names {
+		child := filepath.Join(path, name)
+		childInfo, err := statFollowingLink(child)
+		if err != nil {
+			if err := fn(child, nil, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+
+		if err := walkDereferenced(child, childInfo, ancestors, fn); err != nil {
+			if err == filepath.SkipDir {
+				// like filepath.Walk, the rest of the directory is skipped
+				return nil
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// statFollowingLink returns the info of the file the symlink points to, or the symlink itself when it's dangling
+func statFollowingLink(path string) (os.FileInfo, error) {
+	if info, err := os.Stat(path); err == nil {
+		return info, nil
+	}
+
+	return os.Lstat(path)
+}
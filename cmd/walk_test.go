@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestWriteArchiveDereferenced(t *testing.T) {
+	setupFixturesToCache(t)
+	defer func(original bool) { dereference = original }(dereference)
+	dereference = true
+
+	for link, target := range map[string]string{
+		"tmp/abc/foo":          "../foo",
+		"tmp/foo/bar/ancestor": "..",
+		"tmp/abc/dangling":     "missing",
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatalf("failed to create a symlink: %s", err)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := writeArchive(buf, []string{"tmp/abc"}); err != nil {
+		t.Fatalf("failed to write an archive: %s", err)
+	}
+
+	digests, _, err := readArchiveDigests(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read the archive: %s", err)
+	}
+
+	testCases := []struct {
+		path     string
+		typeflag byte
+	}{
+		{"tmp/abc/foo", tar.TypeDir},
+		{"tmp/abc/foo/hoge.txt", tar.TypeReg},
+		{"tmp/abc/foo/bar/baz/link", tar.TypeReg},
+		{"tmp/abc/dangling", tar.TypeSymlink},
+	}
+	for _, tc := range testCases {
+		if d, ok := digests[tc.path]; !ok || d.typeflag != tc.typeflag {
+			t.Errorf("%s is not archived as %c: %v", tc.path, tc.typeflag, d)
+		}
+	}
+	if d := digests["tmp/abc/foo/bar/baz/link"]; d.sum != digests["tmp/abc/foo/hoge.txt"].sum {
+		t.Errorf("the file the symlink points to is not archived")
+	}
+	if _, ok := digests["tmp/abc/foo/bar/ancestor"]; ok {
+		t.Errorf("the symlink to the ancestor directory is followed")
+	}
+}
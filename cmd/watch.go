@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yuya-takeyama/guruguru-cache/template"
+)
+
+var watchInterval time.Duration
+
+func init() {
+	watchCmd := &cobra.Command{
+		Use:   "watch [flags] [cache key] [paths...]",
+		Short: "Store cache files periodically while they change",
+		Long: `Store cache files periodically while they change.
+
+The cache key template is rendered again on every --interval, and the paths are
+stored when their files have changed since the last store and no cache exists
+with the key. Keys must change with the contents, like ones with checksum or epoch,
+as existing caches are never overwritten.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := setupS3Client(); err != nil {
+				log.Fatal(err)
+			}
+			if err := setupTemplate(); err != nil {
+				log.Fatal(err)
+			}
+			if watchInterval <= 0 {
+				log.Fatalf("interval must be positive: %s", watchInterval)
+			}
+
+			keyTemplate, args, err := keyTemplateArgs(args)
+			if err != nil {
+				log.Fatal(err)
+			}
+			paths, err := resolvePaths(args)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+			ticker := time.NewTicker(watchInterval)
+			defer ticker.Stop()
+
+			var stored string
+			for {
+				// errors are retried on the next tick, as watch runs for long
+				if fingerprint, err := watchStore(keyTemplate, paths, stored); err != nil {
+					log.Println(err)
+				} else {
+					stored = fingerprint
+				}
+
+				select {
+				case <-ticker.C:
+				case <-signals:
+					log.Println("stopped watching")
+					return
+				}
+			}
+		},
+	}
+
+	watchCmd.Flags().StringVarP(&s3Bucket, "s3-bucket", "", "", "S3 bucket to upload")
+	watchCmd.MarkFlagRequired("s3-bucket")
+	addS3Flags(watchCmd)
+	addTemplateFlags(watchCmd)
+	addKeyFlags(watchCmd)
+	addStoreFlags(watchCmd)
+	watchCmd.Flags().DurationVarP(&watchInterval, "interval", "", 10*time.Minute, "Interval to check the paths like 10m")
+
+	rootCmd.AddCommand(watchCmd)
+}
+
+// watchStore stores the paths when their fingerprint differs from the last stored one, returning the fingerprint stored up to now
+func watchStore(keyTemplate string, paths []string, stored string) (string, error) {
+	fingerprint, err := pathsFingerprint(paths)
+	if err != nil {
+		return stored, err
+	}
+	if fingerprint == stored {
+		log.Println("no files are changed since the last store")
+		return stored, nil
+	}
+
+	cacheKey, err := template.ExecuteTemplate(keyTemplate)
+	if err != nil {
+		return stored, err
+	}
+	cacheKey = prefixedKey(cacheKey)
+	storedKeyTemplate = keyTemplate
+
+	if err := storePathsWithAliases(cacheKey, paths); err != nil {
+		return stored, err
+	}
+
+	// the files are in the cache of the key anyway, even if it's stored by others
+	return fingerprint, nil
+}
+
+// pathsFingerprint returns the hash of the names, modes, sizes and modification times of the files under the paths.
+// It's much cheaper than checksums of the contents to compute every interval.
+func pathsFingerprint(paths []string) (string, error) {
+	h := sha256.New()
+	for _, root := range paths {
+		if !pathExists(root) {
+			fmt.Fprintf(h, "%s\x00missing\n", root)
+			continue
+		}
+
+		// changes of excluded files don't need storing the cache
+		err := walkArchivedFiles(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return fmt.Errorf("failed to traverse files: %s", err)
+			}
+
+			var link string
+			if info.Mode()&os.ModeSymlink != 0 {
+				if link, err = os.Readlink(path); err != nil {
+					return fmt.Errorf("failed to read symlink: %s", err)
+				}
+			}
+			fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d\x00%s\n", path, info.Mode(), info.Size(), info.ModTime().UnixNano(), link)
+
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
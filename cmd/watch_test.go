@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPathsFingerprint(t *testing.T) {
+	setupFixturesToCache(t)
+	paths := []string{"tmp/foo", "tmp/missing"}
+
+	before, err := pathsFingerprint(paths)
+	if err != nil {
+		t.Fatalf("failed to compute fingerprint: %s", err)
+	}
+	if again, _ := pathsFingerprint(paths); again != before {
+		t.Fatalf("fingerprint of the same files differs: %s != %s", again, before)
+	}
+
+	if err := ioutil.WriteFile("tmp/foo/hoge.txt", []byte("This is changed foo!"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	changed, _ := pathsFingerprint(paths)
+	if changed == before {
+		t.Fatal("fingerprint isn't changed by the content")
+	}
+
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes("tmp/foo/hoge.txt", modTime, modTime); err != nil {
+		t.Fatalf("failed to change mtime: %s", err)
+	}
+	if touched, _ := pathsFingerprint(paths); touched == changed {
+		t.Fatal("fingerprint isn't changed by the modification time")
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !nogopsutil
+// +build !nogopsutil
+
+package template
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/shirou/gopsutil/cpu"
+)
+
+func arch() (string, error) {
+	info, err := cpu.Info()
+	if err != nil {
+		return "", fmt.Errorf("failed to get CPU info: %s", err)
+	}
+	if len(info) < 1 {
+		return "", fmt.Errorf("zero CPU info retrieved")
+	}
+
+	return fmt.Sprintf("%s-%s-%s", runtime.GOOS, runtime.GOARCH, info[0].Model), nil
+}
@@ -0,0 +1,10 @@
+//go:build nogopsutil
+// +build nogopsutil
+
+package template
+
+import "fmt"
+
+func arch() (string, error) {
+	return "", fmt.Errorf("arch is not available in the build without gopsutil, use platform instead")
+}
@@ -2,71 +2,112 @@ package template
 
 import (
 	"bytes"
-	"crypto/md5"
 	"fmt"
-	"io"
 	"os"
-	"runtime"
 	"strconv"
 	"strings"
 	"text/template"
 	"time"
-
-	"github.com/shirou/gopsutil/cpu"
 )
 
 var funcMap = template.FuncMap{
-	"checksum": func(path string) (string, error) {
-		file, err := os.Open(path)
-		if err != nil {
-			fmt.Println("open error")
-			return "", fmt.Errorf("failed to open file: %s", err)
-		}
-
-		hash := md5.New()
-		if _, err := io.Copy(hash, file); err != nil {
-			return "", fmt.Errorf("failed to calculate checksum: %s", err)
-		}
-
-		return fmt.Sprintf("%x", hash.Sum(nil)), nil
-	},
+	"checksum":     checksum,
+	"sha256":       sha256Checksum,
+	"hash":         hashWith,
+	"cmdChecksum":  cmdChecksum,
+	"depsChecksum": depsChecksum,
+	"combine":      combine,
+	"mtime":        mtime,
 	"epoch": func() string {
 		return strconv.Itoa(int(time.Now().Unix()))
 	},
-	"arch": func() (string, error) {
-		info, err := cpu.Info()
-		if err != nil {
-			return "", fmt.Errorf("failed to get CPU info: %s", err)
-		}
-		if len(info) < 1 {
-			return "", fmt.Errorf("zero CPU info retrieved")
+	"arch":         arch,
+	"platform":     platform,
+	"gitBranch":    gitBranch,
+	"gitSha":       gitSha,
+	"gitShortSha":  gitShortSha,
+	"gitDescribe":  gitDescribe,
+	"gitLatestTag": gitLatestTag,
+	"envOr":        envOr,
+	"hostname":     hostname,
+	"runnerId":     runnerID,
+	"date":         date,
+	"epochDay":     epochDay,
+	"epochWeek":    epochWeek,
+	"slug":         slug,
+	"trunc":        trunc,
+	"replace":      replace,
+	"lower":        strings.ToLower,
+	"upper":        strings.ToUpper,
+	"cacheToolVersion": func() string {
+		return ToolVersion
+	},
+}
+
+// ToolVersion is the version of guruguru-cache exposed as cacheToolVersion
+var ToolVersion = "dev"
+
+func init() {
+	// own functions take precedence over ones of sprig like date
+	for name, f := range sprigFuncMap() {
+		if _, ok := funcMap[name]; !ok {
+			funcMap[name] = f
 		}
+	}
+}
 
-		return fmt.Sprintf("%s-%s-%s", runtime.GOOS, runtime.GOARCH, info[0].Model), nil
-	},
+// leftDelim and rightDelim are the delimiters of actions, where empty ones mean "{{" and "}}"
+var leftDelim, rightDelim string
+
+// SetDelims sets the delimiters of actions given like "[[ ]]"
+func SetDelims(delims string) error {
+	fields := strings.Fields(delims)
+	if len(fields) != 2 {
+		return fmt.Errorf("delimiters must be a pair separated by a space like \"[[ ]]\": %q", delims)
+	}
+	leftDelim, rightDelim = fields[0], fields[1]
+
+	return nil
 }
 
 type templateData struct {
+	ciInfo
 	Environment map[string]string
+	Values      map[string]interface{}
+}
+
+// ValidateTemplate parses the template of a cache key without executing it
+func ValidateTemplate(s string) error {
+	if _, err := template.New("cache key").Delims(leftDelim, rightDelim).Funcs(funcMap).Parse(s); err != nil {
+		return fmt.Errorf("invalid cache key: %s", err)
+	}
+
+	return nil
 }
 
 // ExecuteTemplate executes template of a cache key
 func ExecuteTemplate(s string) (string, error) {
-	tmpl, err := template.New("cache key").Funcs(funcMap).Parse(s)
+	return executeTemplate(s, funcMap)
+}
+
+func executeTemplate(s string, funcs template.FuncMap) (string, error) {
+	tmpl, err := template.New("cache key").Delims(leftDelim, rightDelim).Funcs(funcs).Parse(s)
 	if err != nil {
 		return "", fmt.Errorf("invalid cache key: %s", err)
 	}
 
 	buf := new(bytes.Buffer)
 	templateData := templateData{
+		ciInfo:      detectCI(),
 		Environment: environ(),
+		Values:      values,
 	}
 	err = tmpl.Execute(buf, templateData)
 	if err != nil {
 		return "", fmt.Errorf("invalid cache key: %s", err)
 	}
 
-	return buf.String(), nil
+	return normalizeKey(buf.String())
 }
 
 func environ() map[string]string {
@@ -74,7 +115,9 @@ func environ() map[string]string {
 
 	for _, env := range os.Environ() {
 		keyValue := strings.SplitN(env, "=", 2)
-		envMap[keyValue[0]] = keyValue[1]
+		if envAllowed(keyValue[0]) {
+			envMap[keyValue[0]] = keyValue[1]
+		}
 	}
 
 	return envMap
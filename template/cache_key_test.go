@@ -0,0 +1,39 @@
+package template
+
+import (
+	"testing"
+)
+
+func TestExecuteTemplateWithDelims(t *testing.T) {
+	defer func() { leftDelim, rightDelim = "", "" }()
+
+	if err := SetDelims("[[ ]]"); err != nil {
+		t.Fatalf("failed to set delimiters: %s", err)
+	}
+
+	actual, err := ExecuteTemplate(`deps-[[ "v1" | upper ]]-{{ .Values.helm }}`)
+	if err != nil {
+		t.Fatalf("failed to execute template: %s", err)
+	}
+	if actual != "deps-V1---.Values.helm--" {
+		t.Fatalf("template with delimiters is wrong: %s", actual)
+	}
+
+	for _, delims := range []string{"", "[[", "[[ ]] ))"} {
+		if err := SetDelims(delims); err == nil {
+			t.Fatalf("invalid delimiters are accepted: %q", delims)
+		}
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	if err := ValidateTemplate(`gem-v1-{{ cmdChecksum "exit 1" }}`); err != nil {
+		t.Fatalf("valid template is rejected: %s", err)
+	}
+
+	for _, s := range []string{`{{ checksum "go.sum" `, `{{ unknownFunction }}`} {
+		if err := ValidateTemplate(s); err == nil {
+			t.Fatalf("invalid template is accepted: %s", s)
+		}
+	}
+}
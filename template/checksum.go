@@ -0,0 +1,273 @@
+package template
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// checksum returns the MD5 checksum of the files matching the paths or glob patterns
+func checksum(patterns ...string) (string, error) {
+	return hashFiles(md5.New, patterns)
+}
+
+func sha256Checksum(patterns ...string) (string, error) {
+	return hashFiles(sha256.New, patterns)
+}
+
+// cmdChecksum returns the MD5 checksum of the stdout of the command run by the shell.
+// It's disabled while environment variables are restricted, as commands can read any of them.
+func cmdChecksum(command string) (string, error) {
+	if envRestricted() {
+		return "", fmt.Errorf("cmdChecksum is disabled while environment variables are restricted: %s", command)
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	// stderr isn't included in errors, as it may have secrets
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run command: %s: %s", command, err)
+	}
+
+	return fmt.Sprintf("%x", md5.Sum(out)), nil
+}
+
+// combinedLength is the number of hex characters of the digest returned by combine
+const combinedLength = 16
+
+// combine hashes the values into a short digest, so that keys composed of many checksums stay short
+func combine(values ...interface{}) (string, error) {
+	if len(values) < 1 {
+		return "", fmt.Errorf("combine requires at least one value")
+	}
+
+	h := sha256.New()
+	for _, value := range values {
+		// values are separated by NUL so that "ab" "c" and "a" "bc" differ
+		fmt.Fprintf(h, "%v\x00", value)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil))[:combinedLength], nil
+}
+
+// hashWith returns the checksum of the files with the algorithm like "sha512"
+func hashWith(algorithm string, patterns ...string) (string, error) {
+	newHash, ok := hashAlgorithms[strings.ToLower(algorithm)]
+	if !ok {
+		return "", fmt.Errorf("unsupported hash algorithm: %s", algorithm)
+	}
+
+	return hashFiles(newHash, patterns)
+}
+
+// hashFiles hashes a single file as it is, and multiple files over their relative paths and checksums in sorted order
+func hashFiles(newHash func() hash.Hash, patterns []string) (string, error) {
+	if len(patterns) < 1 {
+		return "", fmt.Errorf("checksum requires at least one path")
+	}
+
+	paths, err := expandPaths(patterns)
+	if err != nil {
+		return "", err
+	}
+
+	if len(paths) == 1 {
+		return fileChecksum(newHash, paths[0])
+	}
+
+	// paths are hashed relative to the working directory, so that checksums don't depend on where the repository is checked out
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to get working directory: %s", err)
+	}
+	names := make(map[string]string)
+	var sorted []string
+	for _, path := range paths {
+		name := relativePath(wd, path)
+		if _, seen := names[name]; !seen {
+			names[name] = path
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+
+	h := newHash()
+	for _, name := range sorted {
+		sum, err := fileChecksum(newHash, names[name])
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(h, "%s  %s\n", sum, filepath.ToSlash(name))
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// relativePath returns the absolute path relative to the working directory,
+// keeping the ones which can't be like paths on other drives of Windows
+func relativePath(wd string, path string) string {
+	if !filepath.IsAbs(path) {
+		return path
+	}
+	if rel, err := filepath.Rel(wd, path); err == nil {
+		return rel
+	}
+
+	return path
+}
+
+func fileChecksum(newHash func() hash.Hash, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %s", err)
+	}
+
+	defer file.Close()
+
+	h := newHash()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("failed to calculate checksum: %s", err)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// expandPaths expands glob patterns into the sorted list of files
+func expandPaths(patterns []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, pattern := range patterns {
+		matches := []string{pattern}
+		if hasMeta(pattern) {
+			var err error
+			if matches, err = glob(pattern); err != nil {
+				return nil, err
+			}
+			if len(matches) < 1 {
+				return nil, fmt.Errorf("no files match: %s", pattern)
+			}
+		}
+
+		for _, path := range matches {
+			path = filepath.Clean(path)
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+func hasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// glob returns the regular files matching the pattern, where "**" matches any number of directories
+func glob(pattern string) ([]string, error) {
+	patternSegments := strings.Split(filepath.ToSlash(pattern), "/")
+
+	root := "."
+	rootSegments := 0
+	for i, segment := range patternSegments[:len(patternSegments)-1] {
+		if hasMeta(segment) {
+			break
+		}
+		rootSegments = i + 1
+	}
+	if rootSegments > 0 {
+		root = strings.Join(patternSegments[:rootSegments], "/")
+		if root == "" {
+			root = "/"
+		}
+	}
+
+	var matches []string
+	err := filepath.Walk(filepath.FromSlash(root), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == filepath.FromSlash(root) {
+				return filepath.SkipDir
+			}
+			return fmt.Errorf("failed to traverse files: %s", err)
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(filepath.FromSlash(root), path)
+		if err != nil {
+			return err
+		}
+
+		ok, err := matchSegments(patternSegments[rootSegments:], strings.Split(filepath.ToSlash(rel), "/"))
+		if err != nil {
+			return fmt.Errorf("invalid pattern: %s: %s", pattern, err)
+		}
+		if ok {
+			matches = append(matches, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return matches, nil
+}
+
+func matchSegments(pattern []string, path []string) (bool, error) {
+	if len(pattern) == 0 {
+		return len(path) == 0, nil
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if ok, err := matchSegments(pattern[1:], path[i:]); ok || err != nil {
+				return ok, err
+			}
+		}
+
+		return false, nil
+	}
+
+	if len(path) == 0 {
+		return false, nil
+	}
+
+	ok, err := filepath.Match(pattern[0], path[0])
+	if !ok || err != nil {
+		return false, err
+	}
+
+	return matchSegments(pattern[1:], path[1:])
+}
@@ -0,0 +1,219 @@
+package template
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func setupChecksumFixtures() string {
+	dir, err := ioutil.TempDir("", "guruguru-cache-test-")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+
+	files := map[string]string{
+		"go.sum":                           "go.sum\n",
+		"package-lock.json":                "root\n",
+		"web/package-lock.json":            "web\n",
+		"web/app/package-lock.json":        "app\n",
+		"web/app/package.json":             "{}\n",
+		".git/package-lock.json":           "ignored\n",
+		"node_modules/x/package-lock.json": "x\n",
+	}
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			log.Fatalf("failed to create a directory: %s", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			log.Fatalf("failed to write a file: %s", err)
+		}
+	}
+
+	return dir
+}
+
+func TestChecksum(t *testing.T) {
+	dir := setupChecksumFixtures()
+	defer os.RemoveAll(dir)
+
+	single, err := checksum(filepath.Join(dir, "go.sum"))
+	if err != nil {
+		t.Fatalf("failed to calculate checksum: %s", err)
+	}
+	// a single file is hashed as it is to keep existing keys
+	if single != "5f9bf469624a0c65f51cc2ebe480ada8" {
+		t.Fatalf("checksum of a single file is wrong: %s", single)
+	}
+
+	multiple, err := checksum(filepath.Join(dir, "go.sum"), filepath.Join(dir, "**/package-lock.json"))
+	if err != nil {
+		t.Fatalf("failed to calculate checksum: %s", err)
+	}
+	reordered, err := checksum(filepath.Join(dir, "**/package-lock.json"), filepath.Join(dir, "go.sum"), filepath.Join(dir, "go.sum"))
+	if err != nil {
+		t.Fatalf("failed to calculate checksum: %s", err)
+	}
+	if multiple != reordered {
+		t.Fatalf("checksum depends on the order of paths: %s != %s", multiple, reordered)
+	}
+	if multiple == single {
+		t.Fatal("checksum of multiple files is the same as a single file")
+	}
+
+	if _, err := checksum(filepath.Join(dir, "**/yarn.lock")); err == nil {
+		t.Fatal("checksum is calculated without matching files")
+	}
+	if _, err := checksum(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("checksum is calculated for a missing file")
+	}
+}
+
+func TestChecksumOfRelativePaths(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get working directory: %s", err)
+	}
+	defer os.Chdir(wd)
+
+	// the same files checked out to other directories have the same checksum
+	var sums []string
+	for i := 0; i < 2; i++ {
+		dir := setupChecksumFixtures()
+		defer os.RemoveAll(dir)
+		if err := os.Chdir(dir); err != nil {
+			t.Fatalf("failed to change directory: %s", err)
+		}
+
+		absolute, err := checksum(filepath.Join(dir, "go.sum"), filepath.Join(dir, "**/package-lock.json"))
+		if err != nil {
+			t.Fatalf("failed to calculate checksum: %s", err)
+		}
+		relative, err := checksum("go.sum", "**/package-lock.json", filepath.Join(dir, "go.sum"))
+		if err != nil {
+			t.Fatalf("failed to calculate checksum: %s", err)
+		}
+		if absolute != relative {
+			t.Fatalf("checksum of absolute paths differs from relative ones: %s != %s", absolute, relative)
+		}
+		sums = append(sums, absolute)
+	}
+	if sums[0] != sums[1] {
+		t.Fatalf("checksum depends on the directory: %s != %s", sums[0], sums[1])
+	}
+}
+
+func TestExpandPaths(t *testing.T) {
+	dir := setupChecksumFixtures()
+	defer os.RemoveAll(dir)
+
+	cases := map[string][]string{
+		"go.sum":               {"go.sum"},
+		"*.json":               {"package-lock.json"},
+		"web/*/package*.json":  {"web/app/package-lock.json", "web/app/package.json"},
+		"**/package-lock.json": {"node_modules/x/package-lock.json", "package-lock.json", "web/app/package-lock.json", "web/package-lock.json"},
+		"web/**/package.json":  {"web/app/package.json"},
+	}
+
+	for pattern, expected := range cases {
+		actual, err := expandPaths([]string{filepath.Join(dir, pattern)})
+		if err != nil {
+			t.Fatalf("failed to expand paths: %s: %s", pattern, err)
+		}
+
+		for i, path := range expected {
+			expected[i] = filepath.Join(dir, path)
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			t.Fatalf("expanded paths of %s are wrong: %v", pattern, actual)
+		}
+	}
+}
+
+func TestHashWith(t *testing.T) {
+	dir := setupChecksumFixtures()
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "go.sum")
+	cases := map[string]string{
+		"md5":    "5f9bf469624a0c65f51cc2ebe480ada8",
+		"SHA256": "4dd83416c611c474b1ce4eae1e4987436706746a51aab81d60530d765735b994",
+	}
+
+	for algorithm, expected := range cases {
+		actual, err := hashWith(algorithm, path)
+		if err != nil {
+			t.Fatalf("failed to calculate checksum with %s: %s", algorithm, err)
+		}
+		if actual != expected {
+			t.Fatalf("checksum with %s is wrong: %s", algorithm, actual)
+		}
+	}
+
+	if sum, _ := sha256Checksum(path); sum != cases["SHA256"] {
+		t.Fatalf("sha256 checksum is wrong: %s", sum)
+	}
+
+	if _, err := hashWith("crc32", path); err == nil {
+		t.Fatal("checksum is calculated with an unsupported algorithm")
+	}
+}
+
+func TestCmdChecksum(t *testing.T) {
+	actual, err := cmdChecksum("echo go.sum")
+	if err != nil {
+		t.Fatalf("failed to calculate checksum of command: %s", err)
+	}
+	// md5 of "go.sum\n"
+	if runtime.GOOS != "windows" && actual != "5f9bf469624a0c65f51cc2ebe480ada8" {
+		t.Fatalf("checksum of command is wrong: %s", actual)
+	}
+
+	if _, err := cmdChecksum("exit 1"); err == nil {
+		t.Fatal("checksum of a failed command is returned")
+	}
+}
+
+func TestDepsChecksum(t *testing.T) {
+	dir := setupChecksumFixtures()
+	defer os.RemoveAll(dir)
+
+	actual, err := depsChecksum(dir)
+	if err != nil {
+		t.Fatalf("failed to calculate checksum of lockfiles: %s", err)
+	}
+	// node_modules and .git are ignored
+	expected, _ := checksum(filepath.Join(dir, "go.sum"), filepath.Join(dir, "package-lock.json"), filepath.Join(dir, "web/**/package-lock.json"))
+	if actual != expected {
+		t.Fatalf("checksum of lockfiles is wrong: %s != %s", actual, expected)
+	}
+
+	if _, err := depsChecksum(filepath.Join(dir, "web/app/package.json")); err == nil {
+		t.Fatal("checksum is calculated without lockfiles")
+	}
+}
+
+func TestCombine(t *testing.T) {
+	actual, err := combine("ab", "c")
+	if err != nil {
+		t.Fatalf("failed to combine values: %s", err)
+	}
+	if len(actual) != combinedLength {
+		t.Fatalf("combined digest is not short: %s", actual)
+	}
+	if other, _ := combine("a", "bc"); other == actual {
+		t.Fatal("combined digests of different values collide")
+	}
+	if again, _ := combine("ab", "c"); again != actual {
+		t.Fatalf("combined digest is not stable: %s != %s", again, actual)
+	}
+
+	if _, err := combine(); err == nil {
+		t.Fatal("digest is combined without values")
+	}
+}
@@ -0,0 +1,109 @@
+package template
+
+import (
+	"strings"
+)
+
+// ciService maps the environment variables of a CI service to the normalized template variables
+type ciService struct {
+	name        string
+	detectEnv   string
+	branchEnvs  []string
+	revisionEnv string
+	buildNumEnv string
+	jobNameEnv  string
+}
+
+var ciServices = []ciService{
+	{
+		name:        "github-actions",
+		detectEnv:   "GITHUB_ACTIONS",
+		branchEnvs:  []string{"GITHUB_HEAD_REF", "GITHUB_REF_NAME"},
+		revisionEnv: "GITHUB_SHA",
+		buildNumEnv: "GITHUB_RUN_NUMBER",
+		jobNameEnv:  "GITHUB_JOB",
+	},
+	{
+		name:        "circleci",
+		detectEnv:   "CIRCLECI",
+		branchEnvs:  []string{"CIRCLE_BRANCH"},
+		revisionEnv: "CIRCLE_SHA1",
+		buildNumEnv: "CIRCLE_BUILD_NUM",
+		jobNameEnv:  "CIRCLE_JOB",
+	},
+	{
+		name:        "gitlab",
+		detectEnv:   "GITLAB_CI",
+		branchEnvs:  []string{"CI_COMMIT_REF_NAME"},
+		revisionEnv: "CI_COMMIT_SHA",
+		buildNumEnv: "CI_PIPELINE_IID",
+		jobNameEnv:  "CI_JOB_NAME",
+	},
+	{
+		name:        "buildkite",
+		detectEnv:   "BUILDKITE",
+		branchEnvs:  []string{"BUILDKITE_BRANCH"},
+		revisionEnv: "BUILDKITE_COMMIT",
+		buildNumEnv: "BUILDKITE_BUILD_NUMBER",
+		jobNameEnv:  "BUILDKITE_LABEL",
+	},
+}
+
+// ciInfo is the normalized information of the CI build exposed to templates
+type ciInfo struct {
+	CI       string
+	Branch   string
+	Revision string
+	BuildNum string
+	JobName  string
+}
+
+// detectCI reads the build information of the detected CI service,
+// falling back to the git repository for the branch and the revision
+func detectCI() ciInfo {
+	var info ciInfo
+	for _, service := range ciServices {
+		if v := getenv(service.detectEnv); v == "" || strings.EqualFold(v, "false") {
+			continue
+		}
+
+		info = ciInfo{
+			CI:       service.name,
+			Branch:   firstEnv(service.branchEnvs),
+			Revision: getenv(service.revisionEnv),
+			BuildNum: getenv(service.buildNumEnv),
+			JobName:  getenv(service.jobNameEnv),
+		}
+		break
+	}
+
+	if info.Branch == "" {
+		info.Branch, _ = gitBranch()
+	}
+	if info.Revision == "" {
+		info.Revision, _ = gitSha()
+	}
+
+	return info
+}
+
+// CIBuild is the information of the CI build recorded in the metadata of caches
+type CIBuild struct {
+	Service  string
+	Branch   string
+	Revision string
+	BuildNum string
+	JobName  string
+}
+
+// DetectCIBuild returns the build of the detected CI service, which has only the branch and the revision out of CI
+func DetectCIBuild() CIBuild {
+	info := detectCI()
+	return CIBuild{
+		Service:  info.CI,
+		Branch:   info.Branch,
+		Revision: info.Revision,
+		BuildNum: info.BuildNum,
+		JobName:  info.JobName,
+	}
+}
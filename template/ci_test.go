@@ -0,0 +1,56 @@
+package template
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDetectCI(t *testing.T) {
+	for _, service := range ciServices {
+		if v, ok := os.LookupEnv(service.detectEnv); ok {
+			os.Unsetenv(service.detectEnv)
+			defer os.Setenv(service.detectEnv, v)
+		}
+	}
+
+	envs := map[string]string{
+		"GITLAB_CI":          "true",
+		"CI_COMMIT_REF_NAME": "feature/foo",
+		"CI_COMMIT_SHA":      "0123456789abcdef0123456789abcdef01234567",
+		"CI_PIPELINE_IID":    "42",
+		"CI_JOB_NAME":        "test",
+	}
+	for name, v := range envs {
+		os.Setenv(name, v)
+		defer os.Unsetenv(name)
+	}
+
+	actual, err := ExecuteTemplate("{{ .CI }}-{{ .Branch | slug }}-{{ .Revision | trunc 7 }}-{{ .BuildNum }}-{{ .JobName }}")
+	if err != nil {
+		t.Fatalf("failed to execute template: %s", err)
+	}
+	if actual != "gitlab-feature-foo-0123456-42-test" {
+		t.Fatalf("CI variables are wrong: %s", actual)
+	}
+}
+
+func TestDetectCIWithAllowedEnvs(t *testing.T) {
+	for _, service := range ciServices {
+		if v, ok := os.LookupEnv(service.detectEnv); ok {
+			os.Unsetenv(service.detectEnv)
+			defer os.Setenv(service.detectEnv, v)
+		}
+	}
+	os.Setenv("GITLAB_CI", "true")
+	os.Setenv("CI_JOB_NAME", "secret")
+	defer os.Unsetenv("GITLAB_CI")
+	defer os.Unsetenv("CI_JOB_NAME")
+	defer func() { allowedEnvs = nil }()
+
+	if err := SetAllowedEnvs([]string{"GITLAB_CI"}); err != nil {
+		t.Fatalf("failed to set allowed environment variables: %s", err)
+	}
+	if info := detectCI(); info.CI != "gitlab" || info.JobName != "" {
+		t.Fatalf("environment variable not allowed is exposed: %#v", info)
+	}
+}
@@ -0,0 +1,59 @@
+//go:build amd64
+// +build amd64
+
+package template
+
+// implemented in cpu_family_amd64.s
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+func xgetbv() (eax, edx uint32)
+
+// cpuFamily returns the microarchitecture level of the x86-64 CPU which binaries can be compiled for
+func cpuFamily() string {
+	return x86Level(readX86Features())
+}
+
+// readX86Features reads the features with CPUID, where AVX also needs the OS to save the YMM registers
+func readX86Features() x86Features {
+	var f x86Features
+
+	maxID, _, _, _ := cpuid(0, 0)
+	if maxID < 1 {
+		return f
+	}
+
+	_, _, ecx1, _ := cpuid(1, 0)
+	f.sse3 = isSet(ecx1, 0)
+	f.ssse3 = isSet(ecx1, 9)
+	f.fma = isSet(ecx1, 12)
+	f.cx16 = isSet(ecx1, 13)
+	f.sse41 = isSet(ecx1, 19)
+	f.sse42 = isSet(ecx1, 20)
+	f.movbe = isSet(ecx1, 22)
+	f.popcnt = isSet(ecx1, 23)
+	f.osxsave = isSet(ecx1, 27)
+	f.f16c = isSet(ecx1, 29)
+	if f.osxsave {
+		xcr0, _ := xgetbv()
+		f.osxsave = isSet(xcr0, 1) && isSet(xcr0, 2)
+	}
+	f.avx = isSet(ecx1, 28) && f.osxsave
+
+	if maxID >= 7 {
+		_, ebx7, _, _ := cpuid(7, 0)
+		f.bmi1 = isSet(ebx7, 3)
+		f.avx2 = isSet(ebx7, 5) && f.osxsave
+		f.bmi2 = isSet(ebx7, 8)
+	}
+
+	if maxExtID, _, _, _ := cpuid(0x80000000, 0); maxExtID >= 0x80000001 {
+		_, _, ecxExt, _ := cpuid(0x80000001, 0)
+		f.lahfSahf = isSet(ecxExt, 0)
+		f.lzcnt = isSet(ecxExt, 5)
+	}
+
+	return f
+}
+
+func isSet(value uint32, bit uint) bool {
+	return value&(1<<bit) != 0
+}
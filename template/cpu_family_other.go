@@ -0,0 +1,9 @@
+//go:build !amd64
+// +build !amd64
+
+package template
+
+// cpuFamily returns no level on CPUs other than x86-64
+func cpuFamily() string {
+	return ""
+}
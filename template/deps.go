@@ -0,0 +1,79 @@
+package template
+
+import (
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockfiles are the names of lockfiles of package managers detected by depsChecksum
+var lockfiles = map[string]bool{
+	"go.sum":            true,
+	"package-lock.json": true,
+	"yarn.lock":         true,
+	"Gemfile.lock":      true,
+	"poetry.lock":       true,
+	"Cargo.lock":        true,
+}
+
+// ignoredDepsDirs are directories of installed dependencies which may contain their own lockfiles
+var ignoredDepsDirs = map[string]bool{
+	".git":         true,
+	"node_modules": true,
+	"vendor":       true,
+}
+
+// depsChecksum returns the MD5 checksum of the lockfiles found under the directories, or the current directory
+func depsChecksum(dirs ...string) (string, error) {
+	paths, err := depsLockfiles(dirs)
+	if err != nil {
+		return "", err
+	}
+
+	return hashFiles(md5.New, paths)
+}
+
+// depsLockfiles returns the lockfiles found under the directories, or the current directory
+func depsLockfiles(dirs []string) ([]string, error) {
+	if len(dirs) < 1 {
+		dirs = []string{"."}
+	}
+
+	var paths []string
+	for _, dir := range dirs {
+		found, err := findLockfiles(dir)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, found...)
+	}
+
+	if len(paths) < 1 {
+		return nil, fmt.Errorf("no lockfiles are found in: %v", dirs)
+	}
+
+	return paths, nil
+}
+
+func findLockfiles(dir string) ([]string, error) {
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to traverse files: %s", err)
+		}
+		if info.IsDir() && path != dir && ignoredDepsDirs[info.Name()] {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && lockfiles[info.Name()] {
+			paths = append(paths, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return paths, nil
+}
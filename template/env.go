@@ -0,0 +1,90 @@
+package template
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// allowedEnvs are the patterns of environment variables exposed to templates, where nil exposes all of them
+var allowedEnvs []string
+
+// SetAllowedEnvs restricts environment variables exposed to templates to the ones matching the patterns like "NODE_*"
+func SetAllowedEnvs(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern of environment variables: %s: %s", pattern, err)
+		}
+	}
+	allowedEnvs = append([]string{}, patterns...)
+
+	return nil
+}
+
+// envRestricted reports whether environment variables are restricted by SetAllowedEnvs
+func envRestricted() bool {
+	return allowedEnvs != nil
+}
+
+func envAllowed(name string) bool {
+	if allowedEnvs == nil {
+		return true
+	}
+
+	for _, pattern := range allowedEnvs {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runnerEnvs are environment variables of CI services identifying the runner
+var runnerEnvs = []string{
+	"RUNNER_NAME",
+	"CI_RUNNER_ID",
+	"BUILDKITE_AGENT_NAME",
+	"NODE_NAME",
+}
+
+// getenv returns the environment variable, or empty when it's not allowed
+func getenv(name string) string {
+	if !envAllowed(name) {
+		return ""
+	}
+
+	return os.Getenv(name)
+}
+
+// envOr returns the environment variable, or the default value when it's unset, empty or not allowed
+func envOr(name string, defaultValue string) string {
+	if v := getenv(name); v != "" {
+		return v
+	}
+
+	return defaultValue
+}
+
+// hostname returns the hostname, which is allowed like the environment variable HOSTNAME
+func hostname() (string, error) {
+	if !envAllowed("HOSTNAME") {
+		return "", fmt.Errorf("hostname is not allowed by the patterns of environment variables")
+	}
+
+	name, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to get hostname: %s", err)
+	}
+
+	return name, nil
+}
+
+// runnerID returns the runner given by CI like RUNNER_NAME, or the hostname outside of CI
+func runnerID() (string, error) {
+	if id := firstEnv(runnerEnvs); id != "" {
+		return id, nil
+	}
+
+	return hostname()
+}
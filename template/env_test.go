@@ -0,0 +1,87 @@
+package template
+
+import (
+	"os"
+	"testing"
+)
+
+func TestEnvOr(t *testing.T) {
+	os.Setenv("GURUGURU_CACHE_TEST_SET", "v2")
+	os.Setenv("GURUGURU_CACHE_TEST_EMPTY", "")
+	os.Unsetenv("GURUGURU_CACHE_TEST_UNSET")
+	defer os.Unsetenv("GURUGURU_CACHE_TEST_SET")
+	defer os.Unsetenv("GURUGURU_CACHE_TEST_EMPTY")
+
+	cases := map[string]string{
+		"GURUGURU_CACHE_TEST_SET":   "v2",
+		"GURUGURU_CACHE_TEST_EMPTY": "v1",
+		"GURUGURU_CACHE_TEST_UNSET": "v1",
+	}
+
+	for name, expected := range cases {
+		if actual := envOr(name, "v1"); actual != expected {
+			t.Fatalf("envOr of %s is wrong: %s", name, actual)
+		}
+	}
+}
+
+func TestAllowedEnvs(t *testing.T) {
+	os.Setenv("GURUGURU_CACHE_TEST_NODE_VERSION", "10")
+	os.Setenv("GURUGURU_CACHE_TEST_SECRET", "secret")
+	defer os.Unsetenv("GURUGURU_CACHE_TEST_NODE_VERSION")
+	defer os.Unsetenv("GURUGURU_CACHE_TEST_SECRET")
+	defer func() { allowedEnvs = nil }()
+
+	if env := environ(); env["GURUGURU_CACHE_TEST_SECRET"] != "secret" {
+		t.Fatal("environment variables are restricted without patterns")
+	}
+
+	if err := SetAllowedEnvs([]string{"GURUGURU_CACHE_TEST_NODE_*"}); err != nil {
+		t.Fatalf("failed to set allowed environment variables: %s", err)
+	}
+
+	env := environ()
+	if env["GURUGURU_CACHE_TEST_NODE_VERSION"] != "10" {
+		t.Fatal("allowed environment variable is not exposed")
+	}
+	if _, ok := env["GURUGURU_CACHE_TEST_SECRET"]; ok {
+		t.Fatal("environment variable not allowed is exposed")
+	}
+	if v := envOr("GURUGURU_CACHE_TEST_SECRET", "none"); v != "none" {
+		t.Fatalf("envOr exposes environment variable not allowed: %s", v)
+	}
+	if v := firstEnv([]string{"GURUGURU_CACHE_TEST_SECRET", "GURUGURU_CACHE_TEST_NODE_VERSION"}); v != "10" {
+		t.Fatalf("firstEnv exposes environment variable not allowed: %s", v)
+	}
+	if name, err := hostname(); err == nil {
+		t.Fatalf("hostname not allowed is exposed: %s", name)
+	}
+	if _, err := cmdChecksum("echo $GURUGURU_CACHE_TEST_SECRET"); err == nil {
+		t.Fatal("cmdChecksum is enabled while environment variables are restricted")
+	}
+
+	if err := SetAllowedEnvs([]string{"NODE_["}); err == nil {
+		t.Fatal("invalid pattern is accepted")
+	}
+}
+
+func TestRunnerID(t *testing.T) {
+	for _, name := range runnerEnvs {
+		if v, ok := os.LookupEnv(name); ok {
+			os.Unsetenv(name)
+			defer os.Setenv(name, v)
+		}
+	}
+
+	name, _ := os.Hostname()
+	if id, err := runnerID(); err != nil || id != name {
+		t.Fatalf("runner ID outside of CI is wrong: %s: %v", id, err)
+	}
+
+	os.Setenv("CI_RUNNER_ID", "42")
+	defer os.Unsetenv("CI_RUNNER_ID")
+
+	if id, err := runnerID(); err != nil || id != "42" {
+		t.Fatalf("runner ID of CI is wrong: %s: %v", id, err)
+	}
+}
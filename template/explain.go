@@ -0,0 +1,94 @@
+package template
+
+import (
+	"fmt"
+	"reflect"
+	"text/template"
+)
+
+// Call is a call of a function in a cache key template
+type Call struct {
+	Func   string
+	Args   []string
+	Result string
+	// Files are the files read by the function like checksum
+	Files []string
+}
+
+// fileInputs return the files read by the functions from their arguments
+var fileInputs = map[string]func(args []string) ([]string, error){
+	"checksum": expandPaths,
+	"sha256":   expandPaths,
+	"mtime":    expandPaths,
+	"hash": func(args []string) ([]string, error) {
+		if len(args) < 1 {
+			return nil, nil
+		}
+		return expandPaths(args[1:])
+	},
+	"depsChecksum": depsLockfiles,
+}
+
+// ExplainTemplate executes the template of a cache key like ExecuteTemplate, also returning the calls of functions in order
+func ExplainTemplate(s string) (string, []Call, error) {
+	var calls []Call
+	funcs := make(template.FuncMap, len(funcMap))
+	for name, f := range funcMap {
+		funcs[name] = tracedFunc(name, f, &calls)
+	}
+
+	key, err := executeTemplate(s, funcs)
+
+	return key, calls, err
+}
+
+// tracedFunc wraps the function to record its calls
+func tracedFunc(name string, f interface{}, calls *[]Call) interface{} {
+	fv := reflect.ValueOf(f)
+	ft := fv.Type()
+
+	return reflect.MakeFunc(ft, func(args []reflect.Value) []reflect.Value {
+		var out []reflect.Value
+		var rawArgs []interface{}
+		if ft.IsVariadic() {
+			out = fv.CallSlice(args)
+			for _, arg := range args[:len(args)-1] {
+				rawArgs = append(rawArgs, arg.Interface())
+			}
+			variadic := args[len(args)-1]
+			for i := 0; i < variadic.Len(); i++ {
+				rawArgs = append(rawArgs, variadic.Index(i).Interface())
+			}
+		} else {
+			out = fv.Call(args)
+			for _, arg := range args {
+				rawArgs = append(rawArgs, arg.Interface())
+			}
+		}
+
+		call := Call{Func: name}
+		var stringArgs []string
+		for _, arg := range rawArgs {
+			call.Args = append(call.Args, formatArg(arg))
+			stringArgs = append(stringArgs, fmt.Sprint(arg))
+		}
+		if len(out) > 0 {
+			call.Result = fmt.Sprint(out[0].Interface())
+		}
+		if inputs, ok := fileInputs[name]; ok {
+			// failures of the function itself are reported by the execution
+			call.Files, _ = inputs(stringArgs)
+		}
+		*calls = append(*calls, call)
+
+		return out
+	}).Interface()
+}
+
+func formatArg(arg interface{}) string {
+	if s, ok := arg.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+
+	return fmt.Sprint(arg)
+}
@@ -0,0 +1,35 @@
+package template
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExplainTemplate(t *testing.T) {
+	dir := setupChecksumFixtures()
+	defer os.RemoveAll(dir)
+
+	goSum := filepath.Join(dir, "go.sum")
+	key, calls, err := ExplainTemplate(`deps-{{ checksum "` + filepath.ToSlash(goSum) + `" }}-{{ trunc 3 "abcdef" }}`)
+	if err != nil {
+		t.Fatalf("failed to explain template: %s", err)
+	}
+
+	sum, err := checksum(goSum)
+	if err != nil {
+		t.Fatalf("failed to calculate checksum: %s", err)
+	}
+	if key != "deps-"+sum+"-abc" {
+		t.Fatalf("key is wrong: %s", key)
+	}
+
+	expected := []Call{
+		{Func: "checksum", Args: []string{`"` + filepath.ToSlash(goSum) + `"`}, Result: sum, Files: []string{goSum}},
+		{Func: "trunc", Args: []string{"3", `"abcdef"`}, Result: "abc"},
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("calls are wrong: %#v", calls)
+	}
+}
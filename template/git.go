@@ -0,0 +1,226 @@
+package template
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// branchEnvs are environment variables of CI services holding the branch name
+var branchEnvs = []string{
+	"GITHUB_HEAD_REF",
+	"GITHUB_REF_NAME",
+	"CIRCLE_BRANCH",
+	"CI_COMMIT_REF_NAME",
+	"BUILDKITE_BRANCH",
+	"TRAVIS_BRANCH",
+	"BRANCH_NAME",
+	"GIT_BRANCH",
+}
+
+// shaEnvs are environment variables of CI services holding the commit SHA
+var shaEnvs = []string{
+	"GITHUB_SHA",
+	"CIRCLE_SHA1",
+	"CI_COMMIT_SHA",
+	"BUILDKITE_COMMIT",
+	"TRAVIS_COMMIT",
+	"GIT_COMMIT",
+}
+
+// gitBranch returns the current branch of the repository, or the one given by CI when HEAD is detached
+func gitBranch() (string, error) {
+	head, err := readGitHead()
+	if err == nil && strings.HasPrefix(head, "ref: refs/heads/") {
+		return strings.TrimPrefix(head, "ref: refs/heads/"), nil
+	}
+
+	if branch := firstEnv(branchEnvs); branch != "" {
+		return branch, nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("HEAD is detached and no branch is given by CI")
+}
+
+// gitSha returns the commit SHA of HEAD, or the one given by CI outside of a repository
+func gitSha() (string, error) {
+	dir, err := findGitDir(".")
+	if err != nil {
+		if sha := firstEnv(shaEnvs); sha != "" {
+			return sha, nil
+		}
+
+		return "", err
+	}
+
+	return resolveGitHead(dir)
+}
+
+func gitShortSha() (string, error) {
+	sha, err := gitSha()
+	if err != nil {
+		return "", err
+	}
+
+	if len(sha) > 7 {
+		sha = sha[:7]
+	}
+
+	return sha, nil
+}
+
+// gitDescribe returns the nearest tag with the number of commits since it like v1.2.0-3-g0123456
+func gitDescribe() (string, error) {
+	return runGit("describe", "--tags")
+}
+
+// gitLatestTag returns the nearest tag reachable from HEAD
+func gitLatestTag() (string, error) {
+	return runGit("describe", "--tags", "--abbrev=0")
+}
+
+// runGit runs git because finding tags requires traversing the history
+func runGit(args ...string) (string, error) {
+	stderr := new(bytes.Buffer)
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run git %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// firstEnv returns the first environment variable set and allowed
+func firstEnv(names []string) string {
+	for _, name := range names {
+		if v := getenv(name); v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+func readGitHead() (string, error) {
+	dir, err := findGitDir(".")
+	if err != nil {
+		return "", err
+	}
+
+	return readGitHeadOf(dir)
+}
+
+func readGitHeadOf(dir string) (string, error) {
+	head, err := ioutil.ReadFile(filepath.Join(dir, "HEAD"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read HEAD: %s", err)
+	}
+
+	return strings.TrimSpace(string(head)), nil
+}
+
+// findGitDir finds the git directory of the repository containing dir,
+// following the "gitdir:" file of worktrees and submodules
+func findGitDir(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		path := filepath.Join(dir, ".git")
+		info, err := os.Stat(path)
+		if err == nil {
+			if info.IsDir() {
+				return path, nil
+			}
+
+			return readGitDirFile(path)
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("not a git repository")
+		}
+		dir = parent
+	}
+}
+
+func readGitDirFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read .git file: %s", err)
+	}
+
+	line := strings.TrimSpace(string(content))
+	if !strings.HasPrefix(line, "gitdir: ") {
+		return "", fmt.Errorf("invalid .git file: %s", path)
+	}
+
+	gitDir := strings.TrimPrefix(line, "gitdir: ")
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(filepath.Dir(path), gitDir)
+	}
+
+	return gitDir, nil
+}
+
+// resolveGitHead resolves HEAD of the git directory into the commit SHA
+func resolveGitHead(dir string) (string, error) {
+	head, err := readGitHeadOf(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.HasPrefix(head, "ref: ") {
+		return head, nil
+	}
+	ref := strings.TrimPrefix(head, "ref: ")
+
+	// refs of worktrees are shared in the common directory
+	commonDir := dir
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "commondir")); err == nil {
+		commonDir = strings.TrimSpace(string(content))
+		if !filepath.IsAbs(commonDir) {
+			commonDir = filepath.Join(dir, commonDir)
+		}
+	}
+
+	if sha, err := ioutil.ReadFile(filepath.Join(commonDir, filepath.FromSlash(ref))); err == nil {
+		return strings.TrimSpace(string(sha)), nil
+	}
+
+	return readPackedRef(commonDir, ref)
+}
+
+// readPackedRef looks up the ref in packed-refs of the git directory
+func readPackedRef(dir string, ref string) (string, error) {
+	file, err := os.Open(filepath.Join(dir, "packed-refs"))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve ref: %s", ref)
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[1] == ref {
+			return fields[0], nil
+		}
+	}
+
+	return "", fmt.Errorf("failed to resolve ref: %s", ref)
+}
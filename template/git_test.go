@@ -0,0 +1,185 @@
+package template
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// setupGitRepository creates a fake repository with HEAD and chdirs into its subdirectory
+func setupGitRepository(head string) (string, func()) {
+	dir, err := ioutil.TempDir("", "guruguru-cache-test-")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, ".git"), 0755); err != nil {
+		log.Fatalf("failed to create a directory: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".git", "HEAD"), []byte(head+"\n"), 0644); err != nil {
+		log.Fatalf("failed to write HEAD: %s", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		log.Fatalf("failed to create a directory: %s", err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("failed to get working directory: %s", err)
+	}
+	if err := os.Chdir(filepath.Join(dir, "sub")); err != nil {
+		log.Fatalf("failed to change directory: %s", err)
+	}
+
+	return dir, func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+func clearBranchEnvs() func() {
+	saved := make(map[string]string)
+	for _, name := range branchEnvs {
+		if v, ok := os.LookupEnv(name); ok {
+			saved[name] = v
+		}
+		os.Unsetenv(name)
+	}
+
+	return func() {
+		for name, v := range saved {
+			os.Setenv(name, v)
+		}
+	}
+}
+
+func TestGitBranch(t *testing.T) {
+	defer clearBranchEnvs()()
+
+	_, cleanup := setupGitRepository("ref: refs/heads/feature/foo")
+	branch, err := gitBranch()
+	cleanup()
+	if err != nil {
+		t.Fatalf("failed to get branch: %s", err)
+	}
+	if branch != "feature/foo" {
+		t.Fatalf("branch is wrong: %s", branch)
+	}
+
+	_, cleanup = setupGitRepository("0123456789abcdef0123456789abcdef01234567")
+	defer cleanup()
+
+	if _, err := gitBranch(); err == nil {
+		t.Fatal("branch is returned for detached HEAD")
+	}
+
+	os.Setenv("CIRCLE_BRANCH", "master")
+	defer os.Unsetenv("CIRCLE_BRANCH")
+
+	branch, err = gitBranch()
+	if err != nil {
+		t.Fatalf("failed to get branch from CI: %s", err)
+	}
+	if branch != "master" {
+		t.Fatalf("branch from CI is wrong: %s", branch)
+	}
+}
+
+func TestGitSha(t *testing.T) {
+	sha := "0123456789abcdef0123456789abcdef01234567"
+
+	dir, cleanup := setupGitRepository("ref: refs/heads/master")
+	defer cleanup()
+
+	if err := os.MkdirAll(filepath.Join(dir, ".git", "refs", "heads"), 0755); err != nil {
+		log.Fatalf("failed to create a directory: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".git", "refs", "heads", "master"), []byte(sha+"\n"), 0644); err != nil {
+		log.Fatalf("failed to write ref: %s", err)
+	}
+
+	actual, err := gitSha()
+	if err != nil {
+		t.Fatalf("failed to get SHA: %s", err)
+	}
+	if actual != sha {
+		t.Fatalf("SHA is wrong: %s", actual)
+	}
+
+	short, err := gitShortSha()
+	if err != nil {
+		t.Fatalf("failed to get short SHA: %s", err)
+	}
+	if short != "0123456" {
+		t.Fatalf("short SHA is wrong: %s", short)
+	}
+
+	packed := "fedcba9876543210fedcba9876543210fedcba98"
+	if err := os.Remove(filepath.Join(dir, ".git", "refs", "heads", "master")); err != nil {
+		log.Fatalf("failed to remove ref: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".git", "packed-refs"), []byte("# pack-refs with: peeled fully-peeled sorted\n"+packed+" refs/heads/master\n"), 0644); err != nil {
+		log.Fatalf("failed to write packed-refs: %s", err)
+	}
+
+	actual, err = gitSha()
+	if err != nil {
+		t.Fatalf("failed to get SHA from packed-refs: %s", err)
+	}
+	if actual != packed {
+		t.Fatalf("SHA from packed-refs is wrong: %s", actual)
+	}
+}
+
+func TestGitDescribe(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "guruguru-cache-test-")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("failed to get working directory: %s", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatalf("failed to change directory: %s", err)
+	}
+	defer os.Chdir(wd)
+
+	commands := [][]string{
+		{"init", "-q"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "first"},
+		{"tag", "v1.0.0"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "second"},
+	}
+	for _, args := range commands {
+		if _, err := runGit(args...); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	tag, err := gitLatestTag()
+	if err != nil {
+		t.Fatalf("failed to get latest tag: %s", err)
+	}
+	if tag != "v1.0.0" {
+		t.Fatalf("latest tag is wrong: %s", tag)
+	}
+
+	description, err := gitDescribe()
+	if err != nil {
+		t.Fatalf("failed to describe: %s", err)
+	}
+	short, _ := gitShortSha()
+	if description != "v1.0.0-1-g"+short {
+		t.Fatalf("description is wrong: %s", description)
+	}
+}
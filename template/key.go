@@ -0,0 +1,60 @@
+package template
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxKeyLength leaves room in the 1024 bytes of S3 keys for the prefix and suffixes like ".part0001.tar.gz"
+const maxKeyLength = 960
+
+// HashLongKeys makes too long keys shortened with their hash instead of an error
+var HashLongKeys bool
+
+var whitespaces = regexp.MustCompile(`\s+`)
+
+// unsafeCharacters are control characters and ones which AWS recommends to avoid in keys
+var unsafeCharacters = regexp.MustCompile("[\\x00-\\x1f\\x7f\\\\{}^%`\\[\\]\"<>~#|]+")
+
+var repeatedSlashes = regexp.MustCompile(`/{2,}`)
+
+// normalizeKey makes the rendered key safe for S3, replacing whitespaces and unsafe characters with "-"
+func normalizeKey(key string) (string, error) {
+	key = strings.TrimSpace(key)
+	key = whitespaces.ReplaceAllString(key, "-")
+	key = unsafeCharacters.ReplaceAllString(key, "-")
+	key = repeatedSlashes.ReplaceAllString(key, "/")
+	key = strings.TrimLeft(key, "/")
+
+	if key == "" {
+		return "", fmt.Errorf("cache key is empty")
+	}
+	if !utf8.ValidString(key) {
+		return "", fmt.Errorf("cache key is not valid UTF-8: %q", key)
+	}
+
+	if len(key) > maxKeyLength {
+		if !HashLongKeys {
+			return "", fmt.Errorf("cache key is too long: %d bytes (at most %d)", len(key), maxKeyLength)
+		}
+
+		key = shortenKey(key)
+	}
+
+	return key, nil
+}
+
+// shortenKey keeps the head of the key followed by the hash of the whole key
+func shortenKey(key string) string {
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+
+	head := key[:maxKeyLength-len(sum)-1]
+	for !utf8.ValidString(head) {
+		head = head[:len(head)-1]
+	}
+
+	return head + "-" + sum
+}
@@ -0,0 +1,56 @@
+package template
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNormalizeKey(t *testing.T) {
+	cases := map[string]string{
+		"gem-v1-linux-amd64":      "gem-v1-linux-amd64",
+		"  gem-v1-\n":             "gem-v1-",
+		"deps node 10\t{x}":       "deps-node-10--x-",
+		"/org//repo/deps-v1":      "org/repo/deps-v1",
+		"deps-\"quoted\"|#~%^key": "deps--quoted-key",
+	}
+
+	for key, expected := range cases {
+		actual, err := normalizeKey(key)
+		if err != nil {
+			t.Fatalf("failed to normalize key: %q: %s", key, err)
+		}
+		if actual != expected {
+			t.Fatalf("normalized key of %q is wrong: %s", key, actual)
+		}
+	}
+
+	for _, key := range []string{"", " \n ", "/"} {
+		if _, err := normalizeKey(key); err == nil {
+			t.Fatalf("empty key is accepted: %q", key)
+		}
+	}
+}
+
+func TestNormalizeLongKey(t *testing.T) {
+	defer func() { HashLongKeys = false }()
+
+	key := strings.Repeat("日", maxKeyLength)
+	if _, err := normalizeKey(key); err == nil {
+		t.Fatal("too long key is accepted")
+	}
+
+	HashLongKeys = true
+	shortened, err := normalizeKey(key)
+	if err != nil {
+		t.Fatalf("failed to shorten key: %s", err)
+	}
+	if len(shortened) > maxKeyLength || !utf8.ValidString(shortened) {
+		t.Fatalf("shortened key is invalid: %d bytes", len(shortened))
+	}
+
+	other, _ := normalizeKey(key + "x")
+	if other == shortened {
+		t.Fatal("shortened keys of different keys collide")
+	}
+}
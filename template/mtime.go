@@ -0,0 +1,33 @@
+package template
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// mtime returns the latest modification time of the files matching the paths or glob patterns as a UNIX timestamp
+func mtime(patterns ...string) (string, error) {
+	if len(patterns) < 1 {
+		return "", fmt.Errorf("mtime requires at least one path")
+	}
+
+	paths, err := expandPaths(patterns)
+	if err != nil {
+		return "", err
+	}
+
+	var latest int64
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to stat file: %s", err)
+		}
+
+		if t := info.ModTime().Unix(); t > latest {
+			latest = t
+		}
+	}
+
+	return strconv.FormatInt(latest, 10), nil
+}
@@ -0,0 +1,43 @@
+package template
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMtime(t *testing.T) {
+	dir := setupChecksumFixtures()
+	defer os.RemoveAll(dir)
+
+	old := time.Unix(1500000000, 0)
+	latest := time.Unix(1600000000, 0)
+	if err := os.Chtimes(filepath.Join(dir, "go.sum"), old, old); err != nil {
+		log.Fatalf("failed to change times: %s", err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, "package-lock.json"), latest, latest); err != nil {
+		log.Fatalf("failed to change times: %s", err)
+	}
+
+	actual, err := mtime(filepath.Join(dir, "go.sum"))
+	if err != nil {
+		t.Fatalf("failed to get mtime: %s", err)
+	}
+	if actual != "1500000000" {
+		t.Fatalf("mtime is wrong: %s", actual)
+	}
+
+	actual, err = mtime(filepath.Join(dir, "go.sum"), filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatalf("failed to get mtime: %s", err)
+	}
+	if actual != "1600000000" {
+		t.Fatalf("latest mtime is wrong: %s", actual)
+	}
+
+	if _, err := mtime(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("mtime of a missing file is returned")
+	}
+}
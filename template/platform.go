@@ -0,0 +1,43 @@
+package template
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// platform returns GOOS-GOARCH, which is stable across machines of the same instance type.
+// With "family", the x86-64 microarchitecture level like v3 is appended on amd64.
+func platform(options ...string) (string, error) {
+	p := fmt.Sprintf("%s-%s", runtime.GOOS, runtime.GOARCH)
+
+	for _, option := range options {
+		switch option {
+		case "family":
+			if family := cpuFamily(); family != "" {
+				p += "-" + family
+			}
+		default:
+			return "", fmt.Errorf("unknown option of platform: %s", option)
+		}
+	}
+
+	return p, nil
+}
+
+// x86Features is the CPU features which x86-64 microarchitecture levels require
+type x86Features struct {
+	cx16, lahfSahf, popcnt, sse3, sse41, sse42, ssse3       bool
+	avx, avx2, bmi1, bmi2, f16c, fma, lzcnt, movbe, osxsave bool
+}
+
+// x86Level returns the microarchitecture level like v3 defined by the x86-64 psABI, which GOAMD64 compiles binaries for
+func x86Level(f x86Features) string {
+	if !(f.cx16 && f.lahfSahf && f.popcnt && f.sse3 && f.sse41 && f.sse42 && f.ssse3) {
+		return "v1"
+	}
+	if !(f.avx && f.avx2 && f.bmi1 && f.bmi2 && f.f16c && f.fma && f.lzcnt && f.movbe && f.osxsave) {
+		return "v2"
+	}
+
+	return "v3"
+}
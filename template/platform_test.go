@@ -0,0 +1,56 @@
+package template
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestPlatform(t *testing.T) {
+	p, err := platform()
+	if err != nil {
+		t.Fatalf("failed to get platform: %s", err)
+	}
+	if p != runtime.GOOS+"-"+runtime.GOARCH {
+		t.Fatalf("platform is wrong: %s", p)
+	}
+
+	withFamily, err := platform("family")
+	if err != nil {
+		t.Fatalf("failed to get platform with CPU family: %s", err)
+	}
+	if !strings.HasPrefix(withFamily, p) {
+		t.Fatalf("platform with CPU family is wrong: %s", withFamily)
+	}
+
+	if _, err := platform("model"); err == nil {
+		t.Fatal("platform accepts an unknown option")
+	}
+}
+
+func TestX86Level(t *testing.T) {
+	v2 := x86Features{cx16: true, lahfSahf: true, popcnt: true, sse3: true, sse41: true, sse42: true, ssse3: true}
+	v3 := v2
+	v3.avx, v3.avx2, v3.bmi1, v3.bmi2, v3.f16c, v3.fma, v3.lzcnt, v3.movbe, v3.osxsave = true, true, true, true, true, true, true, true, true
+
+	noLZCNT := v3
+	noLZCNT.lzcnt = false
+	noMOVBE := v3
+	noMOVBE.movbe = false
+	noF16C := v3
+	noF16C.f16c = false
+	noCX16 := v2
+	noCX16.cx16 = false
+
+	for expected, features := range map[string][]x86Features{
+		"v1": {{}, noCX16},
+		"v2": {v2, noLZCNT, noMOVBE, noF16C},
+		"v3": {v3},
+	} {
+		for _, f := range features {
+			if level := x86Level(f); level != expected {
+				t.Fatalf("the level of %+v is wrong: %s", f, level)
+			}
+		}
+	}
+}
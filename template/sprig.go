@@ -0,0 +1,46 @@
+package template
+
+import (
+	"text/template"
+
+	"github.com/Masterminds/sprig"
+)
+
+// sprigFunctions are the functions of sprig available in cache keys.
+// Functions depending on the environment, the network, the current time or randomness are excluded
+// so that keys stay reproducible and can't leak secrets.
+var sprigFunctions = []string{
+	// strings
+	"abbrev", "abbrevboth", "trim", "trimAll", "trimPrefix", "trimSuffix", "title", "untitle",
+	"repeat", "substr", "nospace", "initials", "wrap", "wrapWith", "contains", "hasPrefix", "hasSuffix",
+	"quote", "squote", "cat", "snakecase", "camelcase", "kebabcase", "swapcase", "plural",
+	"split", "splitList", "splitn", "join", "sortAlpha", "toString", "toStrings",
+	// regular expressions
+	"regexMatch", "regexFind", "regexFindAll", "regexReplaceAll", "regexReplaceAllLiteral", "regexSplit",
+	// numbers
+	"atoi", "int", "int64", "float64", "add", "add1", "sub", "mul", "div", "mod", "max", "min",
+	"biggest", "ceil", "floor", "round", "toDecimal", "until", "untilStep",
+	// defaults
+	"default", "empty", "coalesce", "compact", "ternary", "toJson",
+	// lists and dicts
+	"list", "first", "last", "rest", "initial", "append", "prepend", "concat", "reverse", "uniq",
+	"without", "has", "slice", "dict", "set", "unset", "hasKey", "pluck", "keys", "values",
+	"pick", "omit", "merge",
+	// encodings and hashes
+	"b64enc", "b64dec", "b32enc", "b32dec", "sha1sum", "sha256sum", "adler32sum",
+	// versions and paths
+	"semver", "semverCompare", "base", "dir", "clean", "ext", "isAbs",
+}
+
+func sprigFuncMap() template.FuncMap {
+	all := sprig.TxtFuncMap()
+
+	funcs := make(template.FuncMap)
+	for _, name := range sprigFunctions {
+		if f, ok := all[name]; ok {
+			funcs[name] = f
+		}
+	}
+
+	return funcs
+}
@@ -0,0 +1,32 @@
+package template
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/Masterminds/sprig"
+)
+
+func TestSprigFuncMap(t *testing.T) {
+	all := sprig.TxtFuncMap()
+	for _, name := range sprigFunctions {
+		if _, ok := all[name]; !ok {
+			t.Fatalf("sprig doesn't have the function: %s", name)
+		}
+	}
+
+	funcs := sprigFuncMap()
+	for _, name := range []string{"env", "expandenv", "getHostByName", "now", "randAlphaNum", "uuidv4"} {
+		if _, ok := funcs[name]; ok {
+			t.Fatalf("unsafe function of sprig is available: %s", name)
+		}
+	}
+
+	actual, err := ExecuteTemplate(`{{ list "go" "1.12" | join "-" }}-{{ "node_modules" | camelcase }}-{{ default "v1" "" }}-{{ date "2006" | trunc 2 }}`)
+	if err != nil {
+		t.Fatalf("failed to execute template: %s", err)
+	}
+	if !regexp.MustCompile(`^go-1\.12-NodeModules-v1-\d\d$`).MatchString(actual) {
+		t.Fatalf("result of sprig functions is wrong: %s", actual)
+	}
+}
@@ -0,0 +1,32 @@
+package template
+
+import (
+	"regexp"
+	"strings"
+)
+
+var unsafeKeyCharacters = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// slug lower-cases the string and replaces characters unsafe for S3 keys like "/" with "-"
+func slug(s string) string {
+	return strings.Trim(unsafeKeyCharacters.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// trunc keeps the first n characters of the string, or the last -n characters when n is negative
+func trunc(n int, s string) string {
+	runes := []rune(s)
+	if n < 0 {
+		if -n < len(runes) {
+			return string(runes[len(runes)+n:])
+		}
+	} else if n < len(runes) {
+		return string(runes[:n])
+	}
+
+	return s
+}
+
+// replace is strings.Replace in the argument order for pipelines like {{ .Environment.FOO | replace "/" "-" }}
+func replace(old string, new string, s string) string {
+	return strings.Replace(s, old, new, -1)
+}
@@ -0,0 +1,49 @@
+package template
+
+import "testing"
+
+func TestSlug(t *testing.T) {
+	cases := map[string]string{
+		"master":                "master",
+		"feature/Foo-Bar":       "feature-foo-bar",
+		"renovate/go.sum_v1.2":  "renovate-go.sum_v1.2",
+		"  fix: #123 (urgent)!": "fix-123-urgent",
+		"日本語/branch":            "branch",
+	}
+
+	for s, expected := range cases {
+		if actual := slug(s); actual != expected {
+			t.Fatalf("slug of %q is wrong: %s", s, actual)
+		}
+	}
+}
+
+func TestTrunc(t *testing.T) {
+	cases := []struct {
+		n        int
+		s        string
+		expected string
+	}{
+		{8, "0123456789abcdef", "01234567"},
+		{-4, "0123456789abcdef", "cdef"},
+		{20, "short", "short"},
+		{-20, "short", "short"},
+		{2, "日本語", "日本"},
+	}
+
+	for _, c := range cases {
+		if actual := trunc(c.n, c.s); actual != c.expected {
+			t.Fatalf("trunc %d of %q is wrong: %s", c.n, c.s, actual)
+		}
+	}
+}
+
+func TestStringPipelines(t *testing.T) {
+	actual, err := ExecuteTemplate(`{{ "Feature/Foo-0123456789" | replace "/" "_" | lower | trunc 11 }}-{{ "linux" | upper }}`)
+	if err != nil {
+		t.Fatalf("failed to execute template: %s", err)
+	}
+	if actual != "feature_foo-LINUX" {
+		t.Fatalf("result of pipelines is wrong: %s", actual)
+	}
+}
@@ -0,0 +1,86 @@
+package template
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// now is replaced in tests
+var now = time.Now
+
+// epochDay returns the UNIX timestamp truncated to the start of the day in UTC
+func epochDay() string {
+	return strconv.FormatInt(now().UTC().Truncate(24*time.Hour).Unix(), 10)
+}
+
+// epochWeek returns the UNIX timestamp truncated to the start of the week, Monday in UTC
+func epochWeek() string {
+	// durations are truncated since January 1, year 1, which is Monday
+	return strconv.FormatInt(now().UTC().Truncate(7*24*time.Hour).Unix(), 10)
+}
+
+// date formats the current time in UTC with a Go layout like "2006-01" or a strftime format like "%Y-%m"
+func date(layout string) (string, error) {
+	t := now().UTC()
+	if !strings.Contains(layout, "%") {
+		return t.Format(layout), nil
+	}
+
+	return strftime(t, layout)
+}
+
+func strftime(t time.Time, format string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+
+		i++
+		if i >= len(format) {
+			return "", fmt.Errorf("invalid date format: %s", format)
+		}
+
+		switch format[i] {
+		case 'Y':
+			fmt.Fprintf(&b, "%04d", t.Year())
+		case 'y':
+			fmt.Fprintf(&b, "%02d", t.Year()%100)
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 'u':
+			wd := int(t.Weekday())
+			if wd == 0 {
+				wd = 7
+			}
+			fmt.Fprintf(&b, "%d", wd)
+		case 'G':
+			year, _ := t.ISOWeek()
+			fmt.Fprintf(&b, "%04d", year)
+		case 'V':
+			_, week := t.ISOWeek()
+			fmt.Fprintf(&b, "%02d", week)
+		case 's':
+			fmt.Fprintf(&b, "%d", t.Unix())
+		case '%':
+			b.WriteByte('%')
+		default:
+			return "", fmt.Errorf("unsupported directive of date format: %%%c", format[i])
+		}
+	}
+
+	return b.String(), nil
+}
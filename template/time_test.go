@@ -0,0 +1,55 @@
+package template
+
+import (
+	"testing"
+	"time"
+)
+
+func fixNow(t time.Time) func() {
+	now = func() time.Time { return t }
+	return func() { now = time.Now }
+}
+
+func TestDate(t *testing.T) {
+	defer fixNow(time.Date(2021, 1, 3, 4, 5, 6, 0, time.FixedZone("JST", 9*60*60)))()
+
+	cases := map[string]string{
+		"2006-01":       "2021-01",
+		"2006-01-02T15": "2021-01-02T19",
+		"%Y-%m":         "2021-01",
+		"%y%m%d-%H%M%S": "210102-190506",
+		"%j":            "002",
+		"%G-W%V-%u":     "2020-W53-6",
+		"100%%":         "100%",
+		"weekly-%G-%V":  "weekly-2020-53",
+	}
+
+	for layout, expected := range cases {
+		actual, err := date(layout)
+		if err != nil {
+			t.Fatalf("failed to format date: %s: %s", layout, err)
+		}
+		if actual != expected {
+			t.Fatalf("date of %q is wrong: %s", layout, actual)
+		}
+	}
+
+	for _, layout := range []string{"%", "%Q"} {
+		if _, err := date(layout); err == nil {
+			t.Fatalf("invalid date format is accepted: %q", layout)
+		}
+	}
+}
+
+func TestEpochDayAndWeek(t *testing.T) {
+	// Wednesday
+	defer fixNow(time.Date(2021, 1, 6, 23, 59, 59, 0, time.UTC))()
+
+	if day := epochDay(); day != "1609891200" {
+		t.Fatalf("epochDay is wrong: %s", day)
+	}
+	// Monday, January 4
+	if week := epochWeek(); week != "1609718400" {
+		t.Fatalf("epochWeek is wrong: %s", week)
+	}
+}
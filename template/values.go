@@ -0,0 +1,64 @@
+package template
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// values are exposed to templates as .Values
+var values map[string]interface{}
+
+// LoadValues loads the JSON or YAML file exposed to templates as .Values
+func LoadValues(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read values file: %s", err)
+	}
+
+	var v interface{}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(content, &v)
+	} else {
+		err = yaml.Unmarshal(content, &v)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse values file: %s: %s", path, err)
+	}
+
+	m, ok := normalizeValue(v).(map[string]interface{})
+	if !ok && v != nil {
+		return fmt.Errorf("values file must be a mapping: %s", path)
+	}
+	values = m
+
+	return nil
+}
+
+// normalizeValue converts maps decoded from YAML into map[string]interface{} like ones from JSON
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = normalizeValue(value)
+		}
+		return m
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = normalizeValue(value)
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = normalizeValue(value)
+		}
+		return v
+	default:
+		return v
+	}
+}
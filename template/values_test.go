@@ -0,0 +1,50 @@
+package template
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guruguru-cache-test-")
+	if err != nil {
+		log.Fatalf("failed to create temporal directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { values = nil }()
+
+	files := map[string]string{
+		"values.yaml": "toolchain:\n  go: \"1.12\"\n  node: 10\nservices: [db, cache]\n",
+		"values.json": `{"toolchain": {"go": "1.12", "node": 10}, "services": ["db", "cache"]}`,
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			log.Fatalf("failed to write values file: %s", err)
+		}
+
+		if err := LoadValues(path); err != nil {
+			t.Fatalf("failed to load values: %s: %s", name, err)
+		}
+
+		actual, err := ExecuteTemplate(`go{{ .Values.toolchain.go }}-node{{ .Values.toolchain.node }}-{{ join "-" .Values.services }}-{{ hasKey .Values.toolchain "go" }}`)
+		if err != nil {
+			t.Fatalf("failed to execute template with values: %s: %s", name, err)
+		}
+		if actual != "go1.12-node10-db-cache-true" {
+			t.Fatalf("result with values of %s is wrong: %s", name, actual)
+		}
+	}
+
+	path := filepath.Join(dir, "list.yaml")
+	if err := ioutil.WriteFile(path, []byte("- a\n- b\n"), 0644); err != nil {
+		log.Fatalf("failed to write values file: %s", err)
+	}
+	if err := LoadValues(path); err == nil {
+		t.Fatal("values file of a list is loaded")
+	}
+}